@@ -0,0 +1,139 @@
+// Package clientinfo describes the client of a request: its address, the
+// browser, operating system and device named by its user agent, and where the
+// address is located according to a local MaxMind GeoIP2 or GeoLite2
+// database.
+package clientinfo
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mileusna/useragent"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Client is what is known about the client of a request. Fields that could
+// not be determined are empty.
+type Client struct {
+	IPAddress   string
+	UserAgent   string
+	Browser     string
+	OS          string
+	Device      string
+	Country     string
+	CountryCode string
+	City        string
+}
+
+// Resolver describes clients. The zero value works without GeoIP and takes
+// the address from the connection.
+type Resolver struct {
+	// GeoIP locates addresses when set. City and country databases are
+	// both supported.
+	GeoIP *geoip2.Reader
+
+	// TrustProxyHeaders takes the address from X-Forwarded-For or
+	// X-Real-IP. Only enable it behind a proxy that sets them, or clients
+	// can claim any address.
+	TrustProxyHeaders bool
+}
+
+// NewResolver opens the GeoIP database at geoIPDatabase, unless it is empty.
+func NewResolver(geoIPDatabase string, trustProxyHeaders bool) (*Resolver, error) {
+	resolver := &Resolver{TrustProxyHeaders: trustProxyHeaders}
+
+	if geoIPDatabase != "" {
+		reader, err := geoip2.Open(geoIPDatabase)
+		if err != nil {
+			return nil, err
+		}
+		resolver.GeoIP = reader
+	}
+
+	return resolver, nil
+}
+
+func (resolver *Resolver) Close() error {
+	if resolver.GeoIP == nil {
+		return nil
+	}
+
+	return resolver.GeoIP.Close()
+}
+
+func (resolver *Resolver) Describe(r *http.Request) Client {
+	client := Client{
+		IPAddress: resolver.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+
+	if client.UserAgent != "" {
+		ua := useragent.Parse(client.UserAgent)
+
+		client.Browser = strings.TrimSpace(ua.Name + " " + ua.Version)
+		client.OS = strings.TrimSpace(ua.OS + " " + ua.OSVersion)
+
+		switch {
+		case ua.Device != "":
+			client.Device = ua.Device
+		case ua.Bot:
+			client.Device = "Bot"
+		case ua.Tablet:
+			client.Device = "Tablet"
+		case ua.Mobile:
+			client.Device = "Mobile"
+		case ua.Desktop:
+			client.Device = "Desktop"
+		}
+	}
+
+	resolver.locate(&client)
+
+	return client
+}
+
+func (resolver *Resolver) clientIP(r *http.Request) string {
+	if resolver.TrustProxyHeaders {
+		// The first address is the client's, the proxies append theirs.
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			if ip := net.ParseIP(strings.TrimSpace(strings.Split(forwarded, ",")[0])); ip != nil {
+				return ip.String()
+			}
+		}
+
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+func (resolver *Resolver) locate(client *Client) {
+	ip := net.ParseIP(client.IPAddress)
+	if resolver.GeoIP == nil || ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return
+	}
+
+	if city, err := resolver.GeoIP.City(ip); err == nil {
+		client.City = city.City.Names["en"]
+		client.Country = city.Country.Names["en"]
+		client.CountryCode = city.Country.IsoCode
+		return
+	}
+
+	if country, err := resolver.GeoIP.Country(ip); err == nil {
+		client.Country = country.Country.Names["en"]
+		client.CountryCode = country.Country.IsoCode
+	}
+}
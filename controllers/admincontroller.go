@@ -0,0 +1,490 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/ingestion"
+	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/vectorstore"
+)
+
+const (
+	defaultUsersPageSize = 20
+	maxUsersPageSize     = 100
+)
+
+// knownRoles are the roles an administrator can grant.
+var knownRoles = map[string]bool{RoleUser: true, RoleAdmin: true}
+
+// AdminController serves the user management API. Every route is registered
+// for administrators only.
+type AdminController struct {
+	DBManager      *db.DBManager
+	AuthController *AuthController
+	UserController *UserController
+	VectorStore    vectorstore.VectorStore
+	IngestionQueue *ingestion.Queue
+}
+
+// ListUsers pages through the users, optionally filtered by a part of their
+// email address given as ?q=.
+func (adminController *AdminController) ListUsers(w http.ResponseWriter, r *http.Request) {
+	adminController.setJSONHeaders(w)
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if pageSize < 1 {
+		pageSize = defaultUsersPageSize
+	}
+	if pageSize > maxUsersPageSize {
+		pageSize = maxUsersPageSize
+	}
+
+	pattern := "%" + escapeLike(r.URL.Query().Get("q")) + "%"
+
+	var total int
+
+	err := adminController.DBManager.DB.Get(&total, "SELECT COUNT(*) FROM user WHERE email LIKE $1 ESCAPE '\\'", pattern)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	users := make([]models.UserAccount, 0)
+
+	queryStr := "SELECT id, email, roles, confirmed, locked, totp_enabled, last_login, date_created FROM user WHERE email LIKE $1 ESCAPE '\\' ORDER BY id LIMIT $2 OFFSET $3"
+
+	err = adminController.DBManager.DB.Select(&users, queryStr, pattern, pageSize, (page-1)*pageSize)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{
+		"users":     users,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	}})
+}
+
+// GetUser returns a user with their collections and usage counts.
+func (adminController *AdminController) GetUser(w http.ResponseWriter, r *http.Request) {
+	adminController.setJSONHeaders(w)
+
+	user, err := adminController.getUser(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	vectorCollections := make([]models.VectorCollection, 0)
+
+	err = adminController.DBManager.DB.Select(&vectorCollections, "SELECT * FROM vector_collections WHERE user_id=$1 ORDER BY date_created DESC", user.ID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	usage := models.UserUsage{}
+
+	queryUsageStr := `SELECT
+		(SELECT COUNT(*) FROM vector_collections WHERE user_id=$1) AS collections,
+		(SELECT COUNT(*) FROM documents WHERE user_id=$1) AS documents,
+		(SELECT COUNT(*) FROM chat_sessions WHERE user_id=$1) AS chat_sessions,
+		(SELECT COUNT(*) FROM session_messages WHERE user_id=$1 AND message_role='human') AS messages_sent`
+
+	err = adminController.DBManager.DB.Get(&usage, queryUsageStr, user.ID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{
+		"user":        user,
+		"collections": vectorCollections,
+		"usage":       usage,
+	}})
+}
+
+// UpdateUserRoles replaces the roles of a user with the "roles" list of the
+// body. Every user keeps the USER role.
+func (adminController *AdminController) UpdateUserRoles(w http.ResponseWriter, r *http.Request) {
+	adminController.setJSONHeaders(w)
+
+	user, err := adminController.getUser(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var body struct {
+		Roles []string `json:"roles"`
+	}
+
+	if err := json.Unmarshal(b, &body); err != nil || body.Roles == nil {
+		w.WriteHeader(http.StatusBadRequest)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": "roles is required and must be a list"})
+		return
+	}
+
+	roles := []string{RoleUser}
+	for _, role := range body.Roles {
+		role = strings.ToUpper(strings.TrimSpace(role))
+
+		if !knownRoles[role] {
+			w.WriteHeader(http.StatusBadRequest)
+
+			_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": "Unknown role " + role})
+			return
+		}
+
+		if role != RoleUser && !containsString(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	if adminController.isSelf(r, user.ID) && !containsString(roles, RoleAdmin) {
+		adminController.writeSelfError(w)
+		return
+	}
+
+	_, err = adminController.DBManager.DB.Exec("UPDATE user SET roles=$1, date_modified=datetime('now') WHERE id=$2", strings.Join(roles, ":"), user.ID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{"roles": roles}})
+}
+
+// LockUser blocks a user from signing in and revokes their tokens.
+func (adminController *AdminController) LockUser(w http.ResponseWriter, r *http.Request) {
+	adminController.setLocked(w, r, true)
+}
+
+func (adminController *AdminController) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	adminController.setLocked(w, r, false)
+}
+
+func (adminController *AdminController) setLocked(w http.ResponseWriter, r *http.Request, locked bool) {
+	adminController.setJSONHeaders(w)
+
+	user, err := adminController.getUser(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if locked && adminController.isSelf(r, user.ID) {
+		adminController.writeSelfError(w)
+		return
+	}
+
+	_, err = adminController.DBManager.DB.Exec("UPDATE user SET locked=$1, date_modified=datetime('now') WHERE id=$2", locked, user.ID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if locked {
+		if err := adminController.AuthController.RevokeUserTokens(user.ID); err != nil {
+			writeAuthError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "success", "error_code": "-1"})
+}
+
+// ForcePasswordReset invalidates the password of a user, mails them a link to
+// set a new one and signs them out everywhere.
+func (adminController *AdminController) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	adminController.setJSONHeaders(w)
+
+	account, err := adminController.getUser(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	user := models.User{Id: account.ID, Email: account.Email}
+
+	if err := adminController.UserController.ResetPassword(&user); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if err := adminController.AuthController.RevokeUserTokens(user.Id); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "success", "error_code": "-1"})
+}
+
+// ResetTwoFactor turns two-factor authentication off for a user who lost
+// their authenticator and their recovery codes.
+func (adminController *AdminController) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	adminController.setJSONHeaders(w)
+
+	user, err := adminController.getUser(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if err := resetTwoFactor(adminController.DBManager, user.ID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "success", "error_code": "-1"})
+}
+
+// ResendConfirmation mails the registration link again to an unconfirmed
+// user.
+func (adminController *AdminController) ResendConfirmation(w http.ResponseWriter, r *http.Request) {
+	adminController.setJSONHeaders(w)
+
+	user := models.User{}
+
+	err := adminController.DBManager.DB.Get(&user, "SELECT * FROM user WHERE id=$1", r.PathValue("userID"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAuthError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if user.Confirmed {
+		w.WriteHeader(http.StatusConflict)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "14", "message": "The user is already confirmed"})
+		return
+	}
+
+	adminController.UserController.sendConfirmationMail(user.Email, user.ConfirmationToken)
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "success", "error_code": "-1"})
+}
+
+// DeleteUser permanently removes a user with their personal vector
+// collections, documents, uploaded files, chat sessions, memberships, API
+// keys and tokens. Collections of organizations stay with the organization.
+func (adminController *AdminController) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	adminController.setJSONHeaders(w)
+
+	user, err := adminController.getUser(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if adminController.isSelf(r, user.ID) {
+		adminController.writeSelfError(w)
+		return
+	}
+
+	// Sign the user out first so nothing new is created while deleting.
+	if err := adminController.AuthController.RevokeUserTokens(user.ID); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	queries := []string{
+		"DELETE FROM session_messages WHERE user_id=$1 OR session_id IN (SELECT session_id FROM chat_sessions WHERE user_id=$1)",
+		"DELETE FROM chat_session_collections WHERE session_id IN (SELECT session_id FROM chat_sessions WHERE user_id=$1)",
+		"DELETE FROM chat_sessions WHERE user_id=$1",
+		"DELETE FROM collection_grants WHERE user_id=$1",
+		"DELETE FROM organization_members WHERE user_id=$1",
+		"DELETE FROM api_keys WHERE user_id=$1",
+		"DELETE FROM user_recovery_codes WHERE user_id=$1",
+		"DELETE FROM login_challenges WHERE user_id=$1",
+		"DELETE FROM password_resets WHERE user_id=$1",
+		"DELETE FROM tokens WHERE user_id=$1",
+		"DELETE FROM sessions WHERE user_id=$1",
+		"DELETE FROM user WHERE id=$1",
+	}
+
+	err = deleteCollections(r.Context(), adminController.DBManager, adminController.VectorStore, adminController.IngestionQueue, "SELECT id FROM vector_collections WHERE user_id=$1 AND organization_id=0", user.ID, queries...)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": "Successfully deleted"})
+}
+
+func (adminController *AdminController) getUser(r *http.Request) (*models.UserAccount, error) {
+	userID, err := strconv.ParseInt(r.PathValue("userID"), 10, 64)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	user := models.UserAccount{}
+
+	err = adminController.DBManager.DB.Get(&user, "SELECT id, email, roles, confirmed, locked, totp_enabled, last_login, date_created FROM user WHERE id=$1", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetSettings returns the deployment wide settings.
+func (adminController *AdminController) GetSettings(w http.ResponseWriter, r *http.Request) {
+	adminController.setJSONHeaders(w)
+
+	requireAdminTwoFactor, err := adminController.settingEnabled(SettingRequireAdminTwoFactor)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{SettingRequireAdminTwoFactor: requireAdminTwoFactor}})
+}
+
+// UpdateSettings changes the settings present in the body. Requiring
+// two-factor authentication for administrators takes effect on their next
+// request: until they enable it, they keep only the USER role.
+func (adminController *AdminController) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	adminController.setJSONHeaders(w)
+
+	principal, err := currentPrincipal(r, w)
+	if err != nil {
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var body struct {
+		RequireAdminTwoFactor *bool `json:"require_admin_2fa"`
+	}
+
+	if err := json.Unmarshal(b, &body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if body.RequireAdminTwoFactor != nil {
+		if *body.RequireAdminTwoFactor {
+			var totpEnabled bool
+
+			err = adminController.DBManager.DB.Get(&totpEnabled, "SELECT totp_enabled FROM user WHERE id=$1", principal.UserID)
+			if err != nil {
+				writeAuthError(w, err)
+				return
+			}
+
+			// Otherwise the administrator would lock themselves out of
+			// this very setting.
+			if !totpEnabled {
+				w.WriteHeader(http.StatusConflict)
+				_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "17", "message": "Enable two-factor authentication for your own account first"})
+				return
+			}
+		}
+
+		_, err = adminController.DBManager.DB.Exec("INSERT INTO settings(name, value, date_modified) VALUES($1, $2, datetime('now')) ON CONFLICT(name) DO UPDATE SET value=excluded.value, date_modified=excluded.date_modified", SettingRequireAdminTwoFactor, strconv.FormatBool(*body.RequireAdminTwoFactor))
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+	}
+
+	adminController.GetSettings(w, r)
+}
+
+func (adminController *AdminController) settingEnabled(name string) (bool, error) {
+	var value string
+
+	err := adminController.DBManager.DB.Get(&value, "SELECT value FROM settings WHERE name=$1", name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	return value == "true", err
+}
+
+// isSelf reports whether the administrator is acting on their own account,
+// which is refused for actions that would lock them out.
+func (adminController *AdminController) isSelf(r *http.Request, userID int64) bool {
+	principal, ok := PrincipalFromContext(r.Context())
+
+	return ok && principal.UserID == userID
+}
+
+func (adminController *AdminController) writeSelfError(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusConflict)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "13", "message": "Administrators cannot lock, demote or delete their own account"})
+}
+
+func (adminController *AdminController) setJSONHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// escapeLike escapes the LIKE wildcards in s for use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
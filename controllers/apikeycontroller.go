@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/models"
+)
+
+// APIKeyPrefix starts every API key, which tells them apart from JWTs in the
+// Authorization header.
+const APIKeyPrefix = "rck_"
+
+const maxAPIKeyLifetimeDays = 3650
+
+// APIKeyController lets users manage API keys for their services. The
+// routes only accept JWTs, so a key cannot be used to create further keys.
+type APIKeyController struct {
+	DBManager      *db.DBManager
+	AuthController *AuthController
+}
+
+// CreateAPIKey creates a key named "name" limited to "scopes", and optionally
+// to the collection "collection_hash" and to "expires_in_days". The key is
+// only returned by this call.
+func (apiKeyController *APIKeyController) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	apiKeyController.setJSONHeaders(w)
+
+	principal, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		writeAuthError(w, ErrUnauthorized)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var body struct {
+		Name           string   `json:"name"`
+		Scopes         []string `json:"scopes"`
+		CollectionHash string   `json:"collection_hash"`
+		ExpiresInDays  int      `json:"expires_in_days"`
+	}
+
+	if err := json.Unmarshal(b, &body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" || len(body.Scopes) == 0 {
+		apiKeyController.writeValidationError(w, "name and scopes are required")
+		return
+	}
+
+	for _, scope := range body.Scopes {
+		if !containsString(knownScopes, scope) {
+			apiKeyController.writeValidationError(w, fmt.Sprintf("Unknown scope %s, expected one of %s", scope, strings.Join(knownScopes, ", ")))
+			return
+		}
+	}
+
+	if body.ExpiresInDays < 0 || body.ExpiresInDays > maxAPIKeyLifetimeDays {
+		apiKeyController.writeValidationError(w, fmt.Sprintf("expires_in_days must be between 1 and %d, or 0 for a key that does not expire", maxAPIKeyLifetimeDays))
+		return
+	}
+
+	var collectionID int64
+	if body.CollectionHash != "" {
+		vectorCollection, err := apiKeyController.AuthController.FindCollection(principal, body.CollectionHash, CollectionViewer)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		collectionID = vectorCollection.ID
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	var expiresAt interface{}
+	if body.ExpiresInDays > 0 {
+		expiresAt = fmt.Sprintf("+%d days", body.ExpiresInDays)
+	}
+
+	queryStr := `INSERT INTO api_keys(user_id, name, key_prefix, key_hash, scopes, collection_id, expires_at, date_created, date_modified)
+		VALUES($1, $2, $3, $4, $5, $6, CASE WHEN $7 IS NULL THEN NULL ELSE datetime('now', $7) END, datetime('now'), datetime('now'))`
+
+	result, err := apiKeyController.DBManager.DB.Exec(queryStr, principal.UserID, body.Name, key[:len(APIKeyPrefix)+8], hashToken(key), strings.Join(body.Scopes, " "), collectionID, expiresAt)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	apiKeyID, err := result.LastInsertId()
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	apiKey := models.APIKey{}
+
+	err = apiKeyController.DBManager.DB.Get(&apiKey, "SELECT * FROM api_keys WHERE id=$1", apiKeyID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{"api_key": apiKey, "key": key}})
+}
+
+func (apiKeyController *APIKeyController) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	apiKeyController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	apiKeys := make([]models.APIKey, 0)
+
+	err = apiKeyController.DBManager.DB.Select(&apiKeys, "SELECT * FROM api_keys WHERE user_id=$1 ORDER BY date_created DESC", userID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": apiKeys})
+}
+
+// RevokeAPIKey disables a key for good. Revoked keys stay listed so that
+// their last use can still be looked up.
+func (apiKeyController *APIKeyController) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	apiKeyController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	result, err := apiKeyController.DBManager.DB.Exec("UPDATE api_keys SET revoked=1, date_modified=datetime('now') WHERE id=$1 AND user_id=$2", r.PathValue("apiKeyID"), userID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		writeAuthError(w, ErrNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": "Successfully revoked"})
+}
+
+// authenticateAPIKey resolves the owner of a valid, unexpired and unrevoked
+// key. API keys never carry the ADMIN role.
+func (aController *AuthController) authenticateAPIKey(key string) (*Principal, error) {
+	var apiKey struct {
+		models.APIKey
+		Email   string `db:"email"`
+		Locked  bool   `db:"locked"`
+		Expired bool   `db:"expired"`
+	}
+
+	queryStr := `SELECT api_keys.*, user.email, user.locked, COALESCE(api_keys.expires_at <= datetime('now'), 0) AS expired
+		FROM api_keys JOIN user ON user.id=api_keys.user_id WHERE api_keys.key_hash=$1`
+
+	err := aController.DBManager.DB.Get(&apiKey, queryStr, hashToken(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if apiKey.Revoked || apiKey.Expired || apiKey.Locked {
+		return nil, ErrUnauthorized
+	}
+
+	// Only record the last use once a minute to spare the database a write
+	// on every request.
+	_, err = aController.DBManager.DB.Exec("UPDATE api_keys SET last_used_at=datetime('now') WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < datetime('now', '-1 minute'))", apiKey.ID)
+	if err != nil {
+		log.Printf("%s", err.Error())
+	}
+
+	return &Principal{
+		UserID:       apiKey.UserID,
+		Email:        apiKey.Email,
+		Roles:        []string{RoleUser},
+		APIKeyID:     apiKey.ID,
+		Scopes:       strings.Fields(apiKey.Scopes),
+		CollectionID: apiKey.CollectionID,
+	}, nil
+}
+
+// generateAPIKey returns a new key carrying 256 random bits.
+func generateAPIKey() (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	return APIKeyPrefix + token, nil
+}
+
+// randomToken returns 32 random bytes, base64url encoded.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken hashes an API key, login challenge or recovery code for storage
+// and lookup. They are random, so a fast hash is enough, unlike for
+// passwords.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (apiKeyController *APIKeyController) writeValidationError(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": message})
+}
+
+func (apiKeyController *APIKeyController) setJSONHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 
 	"net/http"
 
@@ -13,23 +14,34 @@ import (
 	"strings"
 	"time"
 
-	"crypto/sha1"
-
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt"
 	"github.com/twinj/uuid"
 
+	"github.com/zarkopopovski/rag-chat/clientinfo"
 	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/jwtkeys"
 	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/passwords"
 )
 
 type AuthController struct {
 	DBManager     *db.DBManager
-	AccessSecret  string
-	RefreshSecret string
+	AccessKeys    *jwtkeys.KeySet
+	RefreshKeys   *jwtkeys.KeySet
 	AdminUser     string
 	AdminPassword string
+
+	// Clients describes where logins come from for the session list.
+	Clients *clientinfo.Resolver
+
+	// LoginAlerts mails users about logins from a new country or device.
+	LoginAlerts bool
 }
 
+// dummyPasswordHash is verified against when the user does not exist, so
+// response times do not reveal which email addresses are registered.
+var dummyPasswordHash, _ = passwords.Hash("dummy password")
+
 type Exception struct {
 	Message string `json:"message"`
 }
@@ -49,25 +61,45 @@ func (aController *AuthController) CheckUserCredentials(w http.ResponseWriter, r
 	email := postMap["email"].(string)
 	password := postMap["password"].(string)
 
-	sha1Hash := sha1.New()
-	sha1Hash.Write([]byte(password))
-	sha1HashString := sha1Hash.Sum(nil)
+	query := "SELECT id, email, password, confirmed, locked, last_login, totp_enabled FROM user WHERE email=$1"
 
-	passwordEnc := fmt.Sprintf("%x", sha1HashString)
+	newUser := new(models.User)
 
-	query := "SELECT id, email, confirmed, last_login FROM user WHERE email=$1 AND password=$2"
+	err = aController.DBManager.DB.QueryRowx(query, email).StructScan(newUser)
 
-	newUser := new(models.User)
+	if err != nil {
+		// Spend the same time on unknown users as on wrong passwords.
+		_, _, _ = passwords.Verify(password, dummyPasswordHash)
 
-	err = aController.DBManager.DB.QueryRowx(query, email, passwordEnc).StructScan(newUser)
+		w.WriteHeader(http.StatusNotFound)
 
+		json.NewEncoder(w).Encode(map[string]string{"error": "The user is not found"})
+		return
+	}
+
+	match, needsRehash, err := passwords.Verify(password, newUser.Password)
 	if err != nil {
+		log.Printf("%s", err.Error())
+	}
+
+	if !match {
 		w.WriteHeader(http.StatusNotFound)
 
 		json.NewEncoder(w).Encode(map[string]string{"error": "The user is not found"})
 		return
 	}
 
+	if needsRehash {
+		// Upgrade legacy SHA-1 and outdated hashes now that the password is known.
+		passwordEnc, err := passwords.Hash(password)
+		if err == nil {
+			_, err = aController.DBManager.DB.Exec("UPDATE user SET password=$1, date_modified=datetime('now') WHERE id=$2", passwordEnc, newUser.Id)
+		}
+		if err != nil {
+			log.Printf("%s", err.Error())
+		}
+	}
+
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
@@ -77,30 +109,28 @@ func (aController *AuthController) CheckUserCredentials(w http.ResponseWriter, r
 		return
 	}
 
-	ts, err := aController.CreateToken(strconv.Itoa(int(newUser.Id)))
-	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		json.NewEncoder(w).Encode(Exception{Message: err.Error()})
+	if newUser.Locked {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "The account is locked, please contact an administrator."})
 		return
 	}
 
-	err = aController.CreateAuth(newUser.Id, ts)
-	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		json.NewEncoder(w).Encode(Exception{Message: err.Error()})
+	if newUser.TOTPEnabled {
+		challengeToken, err := aController.StartLoginChallenge(newUser.Id)
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(Exception{Message: err.Error()})
+			return
+		}
+
+		writeLoginChallenge(w, challengeToken)
 		return
 	}
 
-	newUser.Tokens = ts
-
-	_, err = aController.DBManager.DB.Exec("UPDATE user SET last_login=datetime('now') WHERE id=$1", newUser.Id)
-
+	err = aController.SignIn(r, newUser)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusNotFound)
-		if err := json.NewEncoder(w).Encode(err); err != nil {
-			panic(err)
-		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Exception{Message: err.Error()})
 		return
 	}
 
@@ -113,14 +143,34 @@ func (aController *AuthController) CheckUserCredentials(w http.ResponseWriter, r
 
 }
 
+// SignIn starts a session for a user who has been authenticated by r and
+// issues its token pair.
+func (aController *AuthController) SignIn(r *http.Request, user *models.User) error {
+	ts, err := aController.CreateToken(strconv.Itoa(int(user.Id)))
+	if err != nil {
+		return err
+	}
+
+	ts.SessionID, err = aController.startSession(r, user, ts.RtExpires)
+	if err != nil {
+		return err
+	}
+
+	err = aController.CreateAuth(user.Id, ts)
+	if err != nil {
+		return err
+	}
+
+	user.Tokens = ts
+
+	_, err = aController.DBManager.DB.Exec("UPDATE user SET last_login=datetime('now') WHERE id=$1", user.Id)
+
+	return err
+}
+
 func (aController *AuthController) VerifyToken(r *http.Request) (*jwt.Token, error) {
 	tokenString := aController.ExtractToken(r)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(aController.AccessSecret), nil
-	})
+	token, err := aController.AccessKeys.Parse(tokenString)
 	if err != nil {
 		return nil, err
 	}
@@ -180,17 +230,14 @@ func (aController *AuthController) TokenValid(r *http.Request) error {
 }
 
 func (aController *AuthController) Refresh(w http.ResponseWriter, r *http.Request) {
-	refreshToken := r.URL.Query().Get("refreshToken")
+	refreshToken := r.PathValue("refreshToken")
+	if refreshToken == "" {
+		refreshToken = r.URL.Query().Get("refreshToken")
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	token, err := jwt.Parse(refreshToken, func(token *jwt.Token) (interface{}, error) {
-		//Make sure that the token method conform to "SigningMethodHMAC"
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(aController.RefreshSecret), nil
-	})
+	token, err := aController.RefreshKeys.Parse(refreshToken)
 	//if there is an error, the token must have expired
 	if err != nil {
 		fmt.Println("the error: ", err)
@@ -219,6 +266,10 @@ func (aController *AuthController) Refresh(w http.ResponseWriter, r *http.Reques
 			json.NewEncoder(w).Encode(Exception{Message: "Error occurred"})
 			return
 		}
+		// The new pair continues the session of the old one.
+		var sessionID int64
+		_ = aController.DBManager.DB.Get(&sessionID, "SELECT session_id FROM tokens WHERE uuid=$1 AND type='REFRESH_UUID'", refreshUuid)
+
 		//Delete the previous Refresh Token
 		deleted, delErr := aController.DeleteAuth(refreshUuid)
 		if delErr != nil || deleted == 0 { //if any goes wrong
@@ -235,6 +286,14 @@ func (aController *AuthController) Refresh(w http.ResponseWriter, r *http.Reques
 			json.NewEncoder(w).Encode(Exception{Message: err.Error()})
 			return
 		}
+		ts.SessionID = sessionID
+
+		err = aController.renewSession(sessionID, ts.RtExpires)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(Exception{Message: err.Error()})
+			return
+		}
 		//save the tokens metadata to redis
 		saveErr := aController.CreateAuth(userId, ts)
 		if saveErr != nil {
@@ -268,8 +327,7 @@ func (aController *AuthController) CreateToken(userID string) (*models.TokenDeta
 	atClaims["access_uuid"] = td.AccessUuid
 	atClaims["user_id"] = userID
 	atClaims["exp"] = td.AtExpires
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-	td.AccessToken, err = at.SignedString([]byte(aController.AccessSecret))
+	td.AccessToken, err = aController.AccessKeys.Sign(atClaims)
 	if err != nil {
 		return nil, err
 	}
@@ -278,8 +336,7 @@ func (aController *AuthController) CreateToken(userID string) (*models.TokenDeta
 	rtClaims["refresh_uuid"] = td.RefreshUuid
 	rtClaims["user_id"] = userID
 	rtClaims["exp"] = td.RtExpires
-	rt := jwt.NewWithClaims(jwt.SigningMethodHS256, rtClaims)
-	td.RefreshToken, err = rt.SignedString([]byte(aController.RefreshSecret))
+	td.RefreshToken, err = aController.RefreshKeys.Sign(rtClaims)
 	if err != nil {
 		return nil, err
 	}
@@ -300,13 +357,13 @@ func (aController *AuthController) CreateAuth(userid int64, td *models.TokenDeta
 	rt := time.Unix(td.RtExpires, 0)
 	now := time.Now()
 
-	query := "INSERT INTO tokens(type, uuid, user_id, date_created) VALUES($1, $2, $3, $4);"
+	query := "INSERT INTO tokens(type, uuid, user_id, date_created, session_id) VALUES($1, $2, $3, $4, $5);"
 
-	_, err := aController.DBManager.DB.Exec(query, "ACCESS_UUID", td.AccessUuid, strconv.Itoa(int(userid)), at.Sub(now))
+	_, err := aController.DBManager.DB.Exec(query, "ACCESS_UUID", td.AccessUuid, strconv.Itoa(int(userid)), at.Sub(now), td.SessionID)
 	if err != nil {
 		return err
 	}
-	_, err = aController.DBManager.DB.Exec(query, "REFRESH_UUID", td.RefreshUuid, strconv.Itoa(int(userid)), rt.Sub(now))
+	_, err = aController.DBManager.DB.Exec(query, "REFRESH_UUID", td.RefreshUuid, strconv.Itoa(int(userid)), rt.Sub(now), td.SessionID)
 	if err != nil {
 		return err
 	}
@@ -335,22 +392,38 @@ func (aController *AuthController) DeleteTokens(authD *models.AccessDetails) err
 func (aController *AuthController) DeleteAuth(givenUuid string) (int64, error) {
 	query := "DELETE FROM tokens WHERE uuid=$1 AND type=$2;"
 
-	_, err := aController.DBManager.DB.Exec(query, givenUuid, "REFRESH_UUID")
+	result, err := aController.DBManager.DB.Exec(query, givenUuid, "REFRESH_UUID")
 	if err != nil {
 		return 0, err
 	}
 
-	return -1, nil
+	return result.RowsAffected()
 }
 
-func (aController *AuthController) Logout(w http.ResponseWriter, r *http.Request) {
-	metadata, err := aController.ExtractTokenMetadata(r)
+// RevokeUserTokens signs the user out everywhere by forgetting all of their
+// access and refresh tokens.
+func (aController *AuthController) RevokeUserTokens(userID int64) error {
+	_, err := aController.DBManager.DB.Exec("DELETE FROM tokens WHERE user_id=$1", userID)
 	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		json.NewEncoder(w).Encode(Exception{Message: err.Error()})
+		return err
+	}
+
+	_, err = aController.DBManager.DB.Exec("UPDATE sessions SET ended_at=datetime('now') WHERE user_id=$1 AND ended_at IS NULL", userID)
+
+	return err
+}
+
+func (aController *AuthController) Logout(w http.ResponseWriter, r *http.Request) {
+	principal, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		writeAuthError(w, ErrUnauthorized)
 		return
 	}
-	err = aController.DeleteTokens(metadata)
+
+	err := aController.DeleteTokens(&models.AccessDetails{AccessUuid: principal.AccessUUID, UserId: principal.UserID})
+	if err == nil {
+		err = aController.EndSession(principal.UserID, principal.SessionID)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		json.NewEncoder(w).Encode(Exception{Message: err.Error()})
@@ -364,3 +437,13 @@ func (aController *AuthController) Logout(w http.ResponseWriter, r *http.Request
 		panic(err)
 	}
 }
+
+// JWKS publishes the public keys that verify access tokens, so other services
+// can check them without sharing a secret. It is empty for HS256.
+func (aController *AuthController) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(aController.AccessKeys.JWKS())
+}
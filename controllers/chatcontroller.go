@@ -3,65 +3,82 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
 	"strings"
+	"time"
 
-	"github.com/tmc/langchaingo/embeddings"
 	"github.com/tmc/langchaingo/llms"
-	"github.com/tmc/langchaingo/llms/openai"
-	"github.com/tmc/langchaingo/vectorstores"
-	"github.com/tmc/langchaingo/vectorstores/qdrant"
+	"github.com/tmc/langchaingo/schema"
 	"github.com/twinj/uuid"
 	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/history"
 	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/providers"
+	"github.com/zarkopopovski/rag-chat/retrieval"
+	"github.com/zarkopopovski/rag-chat/vectorstore"
+)
+
+const (
+	// hybridCandidateFactor times top_k chunks, and at least
+	// minHybridCandidates, are taken from each ranking before fusing them.
+	hybridCandidateFactor = 4
+	minHybridCandidates   = 20
+
+	// sessionFusionK is the rank constant of the fusion of the rankings of
+	// the collections of a session.
+	sessionFusionK = 60
 )
 
 type ChatController struct {
 	DBManager      *db.DBManager
 	AuthController *AuthController
-	OpenAIOptions  []openai.Option
+	Providers      *providers.Registry
+	VectorStore    vectorstore.VectorStore
+	Keywords       *retrieval.KeywordIndex
+	Rerankers      *retrieval.Rerankers
 }
 
 func (chatController *ChatController) StartChatSession(w http.ResponseWriter, r *http.Request) {
 	chatController.setJSONHeaders(w)
 
-	userID, err := chatController.authenticateRequest(r, w)
+	principal, err := currentPrincipal(r, w)
 	if err != nil {
 		return
 	}
+	userID := principal.UserID
 
 	postMap, err := chatController.parseRequestBody(r, w)
 	if err != nil {
 		return
 	}
 
-	collectionHash := postMap["collection_hash"].(string)
-
-	queryStr := "SELECT * FROM vector_collections WHERE collection_hash=$2"
-
-	vectorCollection := models.VectorCollection{}
-
-	err = chatController.DBManager.DB.Get(&vectorCollection, queryStr, collectionHash)
-
+	collectionHashes, err := sessionCollectionHashes(postMap)
 	if err != nil {
-		log.Println(err.Error())
-
-		w.WriteHeader(http.StatusNotFound)
-
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": err.Error()})
 		return
 	}
-	collectionID := vectorCollection.ID
 
-	sessionID := uuid.NewV4().String()
+	// The first collection is the primary one: its prompt template starts
+	// the session and its settings drive the turns.
+	vectorCollections := make([]*models.VectorCollection, 0, len(collectionHashes))
+	for _, collectionHash := range collectionHashes {
+		vectorCollection, err := chatController.AuthController.FindCollection(principal, collectionHash, CollectionViewer)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		vectorCollections = append(vectorCollections, vectorCollection)
+	}
+	collectionID := vectorCollections[0].ID
 
-	querySessionStr := "INSERT INTO chat_sessions(user_id, collection_id, session_id, date_created, date_modified) VALUES($1, $2, $3, datetime('now'), datetime('now'))"
+	sessionID := uuid.NewV4().String()
 
-	_, err = chatController.DBManager.DB.Exec(querySessionStr, userID, collectionID, sessionID)
+	err = chatController.createChatSession(userID, sessionID, vectorCollections)
 
 	if err != nil {
 		log.Printf("%s", err.Error())
@@ -104,61 +121,89 @@ func (chatController *ChatController) StartChatSession(w http.ResponseWriter, r
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF8")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Successfully created"}); err != nil {
+	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Successfully created", "session_id": sessionID, "primary_collection_hash": vectorCollections[0].CollectionHash}); err != nil {
 		log.Printf("%s", err)
 	}
 }
 
-func (chatController *ChatController) ListChatSessions(w http.ResponseWriter, r *http.Request) {
-	chatController.setJSONHeaders(w)
+// maxSessionCollections limits how many collections a session searches.
+const maxSessionCollections = 10
 
-	userID, err := chatController.authenticateRequest(r, w)
-	if err != nil {
-		return
+// sessionCollectionHashes reads the collections of a new session from either
+// "collection_hashes", a list, or "collection_hash".
+func sessionCollectionHashes(postMap map[string]interface{}) ([]string, error) {
+	list, ok := postMap["collection_hashes"].([]interface{})
+	if !ok {
+		if _, present := postMap["collection_hashes"]; present {
+			return nil, errors.New("collection_hashes must be a list of collection hashes")
+		}
+
+		collectionHash, _ := postMap["collection_hash"].(string)
+		return []string{collectionHash}, nil
 	}
 
-	queryStr := "SELECT * FROM chat_sessions WHERE user_id=$1 ORDER BY date_created DESC"
+	if len(list) == 0 || len(list) > maxSessionCollections {
+		return nil, fmt.Errorf("collection_hashes must hold between 1 and %d collections", maxSessionCollections)
+	}
 
-	chatSessions := make([]models.ChatSession, 0)
+	collectionHashes := make([]string, 0, len(list))
+	seen := make(map[string]bool, len(list))
+
+	for _, item := range list {
+		collectionHash, ok := item.(string)
+		if !ok || collectionHash == "" {
+			return nil, errors.New("collection_hashes must be a list of collection hashes")
+		}
+
+		if !seen[collectionHash] {
+			seen[collectionHash] = true
+			collectionHashes = append(collectionHashes, collectionHash)
+		}
+	}
 
-	err = chatController.DBManager.DB.Select(&chatSessions, queryStr, userID)
+	return collectionHashes, nil
+}
 
+// createChatSession stores a session on vectorCollections, the first of which
+// becomes chat_sessions.collection_id.
+func (chatController *ChatController) createChatSession(userID int64, sessionID string, vectorCollections []*models.VectorCollection) error {
+	tx, err := chatController.DBManager.DB.Beginx()
 	if err != nil {
-		log.Println(err.Error())
+		return err
+	}
+	defer tx.Rollback()
 
-		w.WriteHeader(http.StatusNotFound)
+	querySessionStr := "INSERT INTO chat_sessions(user_id, collection_id, session_id, date_created, date_modified) VALUES($1, $2, $3, datetime('now'), datetime('now'))"
 
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
-		return
+	_, err = tx.Exec(querySessionStr, userID, vectorCollections[0].ID, sessionID)
+	if err != nil {
+		return err
 	}
 
-	w.WriteHeader(http.StatusOK)
+	for position, vectorCollection := range vectorCollections {
+		_, err = tx.Exec("INSERT INTO chat_session_collections(session_id, collection_id, position) VALUES($1, $2, $3)", sessionID, vectorCollection.ID, position)
+		if err != nil {
+			return err
+		}
+	}
 
-	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": chatSessions})
+	return tx.Commit()
 }
 
-func (chatController *ChatController) SendMessageToChatSession(w http.ResponseWriter, r *http.Request) {
+func (chatController *ChatController) ListChatSessions(w http.ResponseWriter, r *http.Request) {
 	chatController.setJSONHeaders(w)
 
-	userID, err := chatController.authenticateRequest(r, w)
-	if err != nil {
-		return
-	}
-
-	postMap, err := chatController.parseRequestBody(r, w)
+	principal, err := currentPrincipal(r, w)
 	if err != nil {
 		return
 	}
 
-	chatSessionID := postMap["session_id"].(string)
-	userMessage := postMap["user_message"].(string)
-	question := strings.ToLower(userMessage)
-
-	queryStr := "SELECT * FROM chat_sessions WHERE user_id=$1 AND session_id=$2"
+	// API keys limited to a collection only see the sessions on it.
+	queryStr := "SELECT * FROM chat_sessions WHERE user_id=$1 AND ($2=0 OR collection_id=$2) ORDER BY date_created DESC"
 
-	chatSession := models.ChatSession{}
+	chatSessions := make([]models.ChatSession, 0)
 
-	err = chatController.DBManager.DB.Get(&chatSession, queryStr, userID, chatSessionID)
+	err = chatController.DBManager.DB.Select(&chatSessions, queryStr, principal.UserID, principal.CollectionID)
 
 	if err != nil {
 		log.Println(err.Error())
@@ -169,151 +214,179 @@ func (chatController *ChatController) SendMessageToChatSession(w http.ResponseWr
 		return
 	}
 
-	vectorCollection := models.VectorCollection{}
+	err = chatController.loadSessionCollectionHashes(principal.UserID, chatSessions)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	w.WriteHeader(http.StatusOK)
 
-	queryCollectionStr := "SELECT * FROM vector_collections WHERE id=$1"
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": chatSessions})
+}
 
-	err = chatController.DBManager.DB.Get(&vectorCollection, queryCollectionStr, chatSession.CollectionID)
+// loadSessionCollectionHashes fills in the collections of chatSessions, all
+// sessions of userID.
+func (chatController *ChatController) loadSessionCollectionHashes(userID int64, chatSessions []models.ChatSession) error {
+	links := make([]struct {
+		SessionID      string `db:"session_id"`
+		CollectionID   int64  `db:"collection_id"`
+		CollectionHash string `db:"collection_hash"`
+	}, 0)
+
+	queryStr := `SELECT chat_session_collections.session_id, chat_session_collections.collection_id, vector_collections.collection_hash FROM chat_session_collections
+		JOIN chat_sessions ON chat_sessions.session_id=chat_session_collections.session_id
+		JOIN vector_collections ON vector_collections.id=chat_session_collections.collection_id
+		WHERE chat_sessions.user_id=$1 ORDER BY chat_session_collections.position`
+
+	err := chatController.DBManager.DB.Select(&links, queryStr, userID)
+
+	bySession := make(map[string][]string, len(chatSessions))
+	hashes := make(map[int64]string, len(links))
+	for _, link := range links {
+		bySession[link.SessionID] = append(bySession[link.SessionID], link.CollectionHash)
+		hashes[link.CollectionID] = link.CollectionHash
+	}
 
-	if err != nil {
-		log.Println(err.Error())
+	for i := range chatSessions {
+		chatSessions[i].PrimaryCollectionHash = hashes[chatSessions[i].CollectionID]
+		chatSessions[i].CollectionHashes = bySession[chatSessions[i].SessionID]
+		if chatSessions[i].CollectionHashes == nil {
+			chatSessions[i].CollectionHashes = []string{}
+		}
+	}
 
-		w.WriteHeader(http.StatusNotFound)
+	return err
+}
 
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "4", "message": "Not Found"})
+func (chatController *ChatController) SendMessageToChatSession(w http.ResponseWriter, r *http.Request) {
+	turn, err := chatController.prepareChatTurn(w, r)
+	if err != nil {
 		return
 	}
 
-	querySessionStr := "INSERT INTO session_messages(user_id, session_id, message, message_role, date_created, date_modified) VALUES($1, $2, $3, $4, datetime('now'), datetime('now'))"
-
-	_, err = chatController.DBManager.DB.Exec(querySessionStr, userID, chatSession.SessionID, userMessage, "human")
+	ctx := context.Background()
 
+	output, err := turn.llm.GenerateContent(ctx, turn.content,
+		llms.WithMaxTokens(turn.vectorCollection.Settings.MaxAnswerTokens),
+		llms.WithTemperature(turn.vectorCollection.Settings.Temperature),
+	)
 	if err != nil {
 		log.Printf("%s", err.Error())
 
-		w.WriteHeader(http.StatusInternalServerError)
-		if err := json.NewEncoder(w).Encode(map[string]string{"error": "Something got wrong..."}); err != nil {
-			log.Printf("%s", err)
-		}
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "7", "message": "LLM Error"})
 		return
 	}
 
-	queryChatMessagesStr := "SELECT * FROM session_messages WHERE user_id=$1 AND session_id=$2 AND message_role ORDER BY date_created ASC"
-
-	sessionMessages := make([]models.SessionMessage, 0)
+	aiResponse := output.Choices[0].Content
 
-	err = chatController.DBManager.DB.Select(&sessionMessages, queryChatMessagesStr, userID, chatSessionID)
+	_, err = chatController.saveSessionMessage(turn.userID, turn.chatSession.SessionID, aiResponse, "ai", turn.sources)
 
 	if err != nil {
-		log.Println(err.Error())
-	}
-
-	var chatMessageData string = ""
-	content := make([]llms.MessageContent, 0)
+		log.Printf("%s", err.Error())
 
-	if len(sessionMessages) > 0 {
-		for _, message := range sessionMessages {
-			if message.MessageRole == "system" {
-				content = append(content, llms.TextParts(llms.ChatMessageTypeSystem, message.Message))
-			} else if message.MessageRole == "human" {
-				content = append(content, llms.TextParts(llms.ChatMessageTypeHuman, message.Message))
-			} else if message.MessageRole == "ai" {
-				content = append(content, llms.TextParts(llms.ChatMessageTypeAI, message.Message))
-			}
+		w.WriteHeader(http.StatusInternalServerError)
+		if err := json.NewEncoder(w).Encode(map[string]string{"error": "Something got wrong..."}); err != nil {
+			log.Printf("%s", err)
 		}
+		return
 	}
 
-	qdrantURL := os.Getenv("QDRANT_URL")
-
-	urlAPI, err := url.Parse(qdrantURL)
+	w.WriteHeader(http.StatusOK)
 
-	if err != nil {
-		log.Fatal(err)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"message": "Successfully created", "data": aiResponse, "sources": turn.sources}); err != nil {
+		log.Printf("%s", err)
 	}
+	w.(http.Flusher).Flush()
+}
 
-	llm, err := openai.New(chatController.OpenAIOptions...)
+// StreamMessageToChatSession works like SendMessageToChatSession but streams the
+// answer as Server-Sent Events: a "token" event per generated chunk and a final
+// "done" event carrying the ID of the stored ai message. Whatever was generated
+// is stored even when the client goes away before the answer is complete.
+func (chatController *ChatController) StreamMessageToChatSession(w http.ResponseWriter, r *http.Request) {
+	turn, err := chatController.prepareChatTurn(w, r)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
 
-	e, err := embeddings.NewEmbedder(llm)
-	if err != nil {
-		log.Fatal(err)
-	}
+	responseController := http.NewResponseController(w)
 
-	store, err := qdrant.New(
-		qdrant.WithURL(*urlAPI),
-		qdrant.WithCollectionName(vectorCollection.CollectionHash),
-		qdrant.WithEmbedder(e),
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// Long answers easily outlive the server wide write timeout.
+	_ = responseController.SetWriteDeadline(time.Time{})
 
-	ctx := context.Background()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_ = responseController.Flush()
 
-	docs, err := store.SimilaritySearch(ctx,
-		question, 2,
-		vectorstores.WithScoreThreshold(0))
-	if err != nil {
-		log.Fatal(err)
-	}
+	ctx := r.Context()
 
-	stringContext := ""
-	for i := range len(docs) {
-		stringContext += docs[i].PageContent
-	}
+	var aiResponse strings.Builder
 
-	chatMessageData += "Context: " + stringContext
-	content = append(content, llms.TextParts(llms.ChatMessageTypeHuman, chatMessageData))
+	_, err = turn.llm.GenerateContent(ctx, turn.content,
+		llms.WithMaxTokens(turn.vectorCollection.Settings.MaxAnswerTokens),
+		llms.WithTemperature(turn.vectorCollection.Settings.Temperature),
+		llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			aiResponse.Write(chunk)
 
-	output, err := llm.GenerateContent(ctx, content,
-		llms.WithMaxTokens(512),
-		llms.WithTemperature(0),
+			if err := writeSSEEvent(w, "token", map[string]string{"content": string(chunk)}); err != nil {
+				return err
+			}
+			return responseController.Flush()
+		}),
 	)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("%s", err.Error())
 	}
 
-	queryAIResponseStr := "INSERT INTO session_messages(user_id, session_id, message, message_role, date_created, date_modified) VALUES($1, $2, $3, $4, datetime('now'), datetime('now'))"
+	var messageID int64 = -1
 
-	aiResponse := output.Choices[0].Content
-
-	_, err = chatController.DBManager.DB.Exec(queryAIResponseStr, userID, chatSession.SessionID, aiResponse, "ai")
+	if aiResponse.Len() > 0 {
+		var saveErr error
 
-	if err != nil {
-		log.Printf("%s", err.Error())
+		messageID, saveErr = chatController.saveSessionMessage(turn.userID, turn.chatSession.SessionID, aiResponse.String(), "ai", turn.sources)
+		if saveErr != nil {
+			log.Printf("%s", saveErr.Error())
 
-		w.WriteHeader(http.StatusInternalServerError)
-		if err := json.NewEncoder(w).Encode(map[string]string{"error": "Something got wrong..."}); err != nil {
-			log.Printf("%s", err)
+			if err == nil {
+				err = saveErr
+			}
 		}
-		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	if ctx.Err() != nil {
+		return
+	}
 
-	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Successfully created", "data": aiResponse}); err != nil {
-		log.Printf("%s", err)
+	if err != nil {
+		_ = writeSSEEvent(w, "error", map[string]string{"status": "error", "error_code": "7", "message": "Something got wrong..."})
+		_ = responseController.Flush()
+		return
 	}
-	w.(http.Flusher).Flush()
+
+	_ = writeSSEEvent(w, "done", map[string]interface{}{"status": "success", "error_code": "-1", "message_id": messageID, "sources": turn.sources})
+	_ = responseController.Flush()
 }
 
 func (chatController *ChatController) GetChatSessionMessages(w http.ResponseWriter, r *http.Request) {
 	chatController.setJSONHeaders(w)
 
-	userID, err := chatController.authenticateRequest(r, w)
+	principal, err := currentPrincipal(r, w)
 	if err != nil {
 		return
 	}
+	userID := principal.UserID
 
 	chatSessionID := r.PathValue("chatSessionID")
 
-	queryChatSessionStr := "SELECT * FROM chat_sessions WHERE user_id=$1 AND session_id=$2"
+	queryChatSessionStr := "SELECT * FROM chat_sessions WHERE user_id=$1 AND session_id=$2 AND ($3=0 OR collection_id=$3)"
 
 	chatSession := models.ChatSession{}
 
-	err = chatController.DBManager.DB.Get(&chatSession, queryChatSessionStr, userID, chatSessionID)
+	err = chatController.DBManager.DB.Get(&chatSession, queryChatSessionStr, userID, chatSessionID, principal.CollectionID)
 
 	if err != nil {
 		log.Println(err.Error())
@@ -324,7 +397,7 @@ func (chatController *ChatController) GetChatSessionMessages(w http.ResponseWrit
 		return
 	}
 
-	queryStr := "SELECT * FROM session_messages WHERE user_id=$1 AND session_id=$2 AND message_role <> 'system' ORDER BY date_created ASC"
+	queryStr := "SELECT * FROM session_messages WHERE user_id=$1 AND session_id=$2 AND message_role NOT IN ('system', 'summary') ORDER BY date_created ASC"
 
 	sessionMessages := make([]models.SessionMessage, 0)
 
@@ -347,18 +420,19 @@ func (chatController *ChatController) GetChatSessionMessages(w http.ResponseWrit
 func (chatController *ChatController) DeleteChatSession(w http.ResponseWriter, r *http.Request) {
 	chatController.setJSONHeaders(w)
 
-	userID, err := chatController.authenticateRequest(r, w)
+	principal, err := currentPrincipal(r, w)
 	if err != nil {
 		return
 	}
+	userID := principal.UserID
 
 	chatSessionID := r.PathValue("chatSessionID")
 
-	queryChatSessionStr := "SELECT * FROM chat_sessions WHERE user_id=$1 AND session_id=$2"
+	queryChatSessionStr := "SELECT * FROM chat_sessions WHERE user_id=$1 AND session_id=$2 AND ($3=0 OR collection_id=$3)"
 
 	chatSession := models.ChatSession{}
 
-	err = chatController.DBManager.DB.Get(&chatSession, queryChatSessionStr, userID, chatSessionID)
+	err = chatController.DBManager.DB.Get(&chatSession, queryChatSessionStr, userID, chatSessionID, principal.CollectionID)
 
 	if err != nil {
 		log.Println(err.Error())
@@ -375,6 +449,11 @@ func (chatController *ChatController) DeleteChatSession(w http.ResponseWriter, r
 		log.Printf("%s", err)
 	}
 
+	_, err = chatController.DBManager.DB.Exec("DELETE FROM chat_session_collections WHERE session_id=$1", chatSession.SessionID)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+
 	queryStr := "DELETE FROM chat_sessions WHERE session_id=$1 AND user_id=$2"
 
 	_, err = chatController.DBManager.DB.Exec(queryStr, chatSessionID, userID)
@@ -395,25 +474,554 @@ func (chatController *ChatController) DeleteChatSession(w http.ResponseWriter, r
 	}
 }
 
-func (chatController *ChatController) setJSONHeaders(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+const (
+	// contextPrefix introduces the retrieved chunks in the last message of
+	// a turn, summaryPrefix the summary of the earlier conversation.
+	contextPrefix = "Context: "
+	summaryPrefix = "Summary of the earlier conversation: "
+)
+
+// conversation is the history of a chat session before the current turn.
+type conversation struct {
+	// system is the prompt template the session started with.
+	system string
+
+	// summary is the latest summary message, if any, and turns are the
+	// human and ai messages, oldest first. unsummarized are the turns the
+	// summary does not cover.
+	summary      models.SessionMessage
+	turns        []models.SessionMessage
+	unsummarized []models.SessionMessage
+}
+
+func newConversation(sessionMessages []models.SessionMessage) conversation {
+	c := conversation{turns: make([]models.SessionMessage, 0, len(sessionMessages))}
+
+	systems := make([]string, 0, 1)
+
+	for _, message := range sessionMessages {
+		switch message.MessageRole {
+		case "system":
+			systems = append(systems, message.Message)
+		case "summary":
+			c.summary = message
+		case "human", "ai":
+			c.turns = append(c.turns, message)
+		}
+	}
+
+	c.system = strings.Join(systems, "\n\n")
+
+	for i, message := range c.turns {
+		if message.ID > c.summary.SummarizedThrough {
+			c.unsummarized = c.turns[i:]
+			break
+		}
+	}
+
+	return c
 }
 
-func (chatController *ChatController) authenticateRequest(r *http.Request, w http.ResponseWriter) (int64, error) {
-	metaData, err := chatController.AuthController.ExtractTokenMetadata(r)
+// fitConversation fits the turn into the context window of the model. When
+// unsummarized turns had to be dropped, or more than SummarizeAfter of them
+// piled up, all but the latest few are first folded into a new summary, which
+// is stored as a summary message of the session. A failing summary leaves the
+// oldest turns dropped.
+func (chatController *ChatController) fitConversation(ctx context.Context, llm llms.Model, budget history.Budget, settings models.CollectionSettings, userID int64, sessionID string, c *conversation, userMessage string, docs []schema.Document) (history.Fitted, error) {
+	turn := history.Turn{
+		System:        c.system,
+		Summary:       c.summary.Message,
+		History:       c.unsummarized,
+		Question:      userMessage,
+		Chunks:        docs,
+		ContextPrefix: contextPrefix,
+	}
+
+	fitted, err := budget.Fit(turn)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return -1, err
+		return history.Fitted{}, err
+	}
+
+	pending := len(c.unsummarized)
+	if settings.SummarizeAfter == 0 || pending <= history.RecentMessages || (fitted.Dropped == 0 && pending <= settings.SummarizeAfter) {
+		return fitted, nil
+	}
+
+	folded := c.unsummarized[:pending-history.RecentMessages]
+
+	summary, err := history.Summarize(ctx, llm, settings.ContextWindow, c.summary.Message, folded)
+	if err != nil {
+		log.Printf("Summarizing session %s failed, dropping its oldest turns: %v", sessionID, err)
+		return fitted, nil
+	}
+
+	summarizedThrough := folded[len(folded)-1].ID
+
+	queryStr := "INSERT INTO session_messages(user_id, session_id, message, message_role, summarized_through, date_created, date_modified) VALUES($1, $2, $3, 'summary', $4, datetime('now'), datetime('now'))"
+
+	_, err = chatController.DBManager.DB.Exec(queryStr, userID, sessionID, summary, summarizedThrough)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+
+	c.summary = models.SessionMessage{Message: summary, MessageRole: "summary", SummarizedThrough: summarizedThrough}
+	c.unsummarized = c.unsummarized[len(folded):]
+
+	turn.Summary = summary
+	turn.History = c.unsummarized
+
+	return budget.Fit(turn)
+}
+
+type chatTurn struct {
+	userID           int64
+	chatSession      models.ChatSession
+	vectorCollection models.VectorCollection
+	content          []llms.MessageContent
+	sources          models.Sources
+	llm              llms.Model
+}
+
+// prepareChatTurn authenticates the request, stores the human message and builds
+// the LLM input from the session history and the retrieved context, as much of
+// them as the context window of the model allows. On failure the error
+// response is already written.
+func (chatController *ChatController) prepareChatTurn(w http.ResponseWriter, r *http.Request) (*chatTurn, error) {
+	chatController.setJSONHeaders(w)
+
+	principal, err := currentPrincipal(r, w)
+	if err != nil {
+		return nil, err
+	}
+	userID := principal.UserID
+
+	postMap, err := chatController.parseRequestBody(r, w)
+	if err != nil {
+		return nil, err
+	}
+
+	chatSessionID, _ := postMap["session_id"].(string)
+	userMessage, _ := postMap["user_message"].(string)
+	if chatSessionID == "" || userMessage == "" {
+		http.Error(w, "session_id and user_message are required", http.StatusBadRequest)
+		return nil, errors.New("missing parameters")
+	}
+	question := strings.ToLower(userMessage)
+
+	queryStr := "SELECT * FROM chat_sessions WHERE user_id=$1 AND session_id=$2"
+
+	chatSession := models.ChatSession{}
+
+	err = chatController.DBManager.DB.Get(&chatSession, queryStr, userID, chatSessionID)
+
+	if err != nil {
+		log.Println(err.Error())
+
+		w.WriteHeader(http.StatusNotFound)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
+		return nil, err
+	}
+
+	vectorCollections, err := chatController.sessionCollections(principal, chatSession)
+	if err != nil {
+		return nil, chatController.writeSystemError(w, err)
+	}
+
+	if len(vectorCollections) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "4", "message": "Not Found"})
+		return nil, errors.New("no collections left in the session")
+	}
+
+	// The primary collection decides the chat model, settings and budget.
+	vectorCollection := vectorCollections[0]
+
+	queryChatMessagesStr := "SELECT * FROM session_messages WHERE user_id=$1 AND session_id=$2 ORDER BY date_created ASC, id ASC"
+
+	sessionMessages := make([]models.SessionMessage, 0)
+
+	err = chatController.DBManager.DB.Select(&sessionMessages, queryChatMessagesStr, userID, chatSessionID)
+
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	conversation := newConversation(sessionMessages)
+
+	settings := vectorCollection.Settings
+	budget := history.Budget{ContextWindow: settings.ContextWindow, AnswerTokens: settings.MaxAnswerTokens}
+
+	// Refuse a message that cannot fit before it becomes part of the session.
+	if _, err := budget.Fit(history.Turn{System: conversation.system, Question: userMessage, ContextPrefix: contextPrefix}); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": "The message is too long for the model of this collection"})
+		return nil, err
+	}
+
+	messageID, err := chatController.saveSessionMessage(userID, chatSession.SessionID, userMessage, "human", nil)
+
+	if err != nil {
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		if err := json.NewEncoder(w).Encode(map[string]string{"error": "Something got wrong..."}); err != nil {
+			log.Printf("%s", err)
+		}
+		return nil, err
+	}
+
+	llm, err := chatController.Providers.ChatModel(vectorCollection.Settings.ChatProvider, vectorCollection.Settings.ChatModel)
+	if err != nil {
+		return nil, chatController.writeSystemError(w, err)
+	}
+
+	if settings.QueryRewriting {
+		question = chatController.condenseQuestion(r.Context(), llm, conversation.turns, messageID, userMessage, question)
+	}
+
+	chunks, err := chatController.retrieveAll(r.Context(), vectorCollections, question)
+	if errors.Is(err, errEmbeddingMismatch) {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "10", "message": "The embedding model does not match the collection, please re-embed the collection"})
+		return nil, err
+	}
+	if err != nil {
+		return nil, chatController.writeSystemError(w, err)
+	}
+
+	docs := make([]schema.Document, len(chunks))
+	for i := range chunks {
+		docs[i] = chunks[i].doc
+	}
+
+	fitted, err := chatController.fitConversation(r.Context(), llm, budget, settings, userID, chatSession.SessionID, &conversation, userMessage, docs)
+	if err != nil {
+		return nil, chatController.writeSystemError(w, err)
+	}
+
+	content := make([]llms.MessageContent, 0, len(fitted.History)+4)
+
+	if conversation.system != "" {
+		content = append(content, llms.TextParts(llms.ChatMessageTypeSystem, conversation.system))
+	}
+	if fitted.Summary {
+		content = append(content, llms.TextParts(llms.ChatMessageTypeSystem, summaryPrefix+conversation.summary.Message))
+	}
+	for _, message := range fitted.History {
+		if message.MessageRole == "ai" {
+			content = append(content, llms.TextParts(llms.ChatMessageTypeAI, message.Message))
+		} else {
+			content = append(content, llms.TextParts(llms.ChatMessageTypeHuman, message.Message))
+		}
+	}
+	content = append(content, llms.TextParts(llms.ChatMessageTypeHuman, userMessage))
+
+	stringContext := ""
+	sources := make(models.Sources, 0, len(fitted.Chunks))
+	for i := range len(fitted.Chunks) {
+		stringContext += fitted.Chunks[i].PageContent
+
+		source := sourceFromDocument(fitted.Chunks[i])
+		source.CollectionHash = chunks[i].collection.CollectionHash
+		source.CollectionName = chunks[i].collection.Name
+		source.RerankScore = chunks[i].rerankScore
+		sources = append(sources, source)
+	}
+
+	content = append(content, llms.TextParts(llms.ChatMessageTypeHuman, contextPrefix+stringContext))
+
+	return &chatTurn{
+		userID:           userID,
+		chatSession:      chatSession,
+		vectorCollection: vectorCollection,
+		content:          content,
+		sources:          sources,
+		llm:              llm,
+	}, nil
+}
+
+// condenseQuestion rewrites the human message messageID into a standalone
+// question when the session has earlier turns, and stores the rewrite along
+// with the message. It returns the lower case query to retrieve with, which
+// stays question when there is nothing to rewrite or the rewrite fails.
+func (chatController *ChatController) condenseQuestion(ctx context.Context, llm llms.Model, turns []models.SessionMessage, messageID int64, userMessage string, question string) string {
+	if len(turns) == 0 {
+		return question
+	}
+
+	rewritten, err := retrieval.CondenseQuestion(ctx, llm, turns, userMessage)
+	if err != nil {
+		log.Printf("rewriting the question failed, retrieving with the message as written: %v", err)
+		return question
+	}
+
+	_, err = chatController.DBManager.DB.Exec("UPDATE session_messages SET rewritten_query=$1, date_modified=datetime('now') WHERE id=$2", rewritten, messageID)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+
+	return strings.ToLower(rewritten)
+}
+
+// sessionCollections returns the collections a session still searches, in
+// the order it was started with. Collections deleted since or no longer
+// shared with the caller are left out, since sessions outlive grants; the
+// first one left is the primary collection of the turn.
+func (chatController *ChatController) sessionCollections(principal *Principal, chatSession models.ChatSession) ([]models.VectorCollection, error) {
+	vectorCollections := make([]models.VectorCollection, 0)
+
+	queryStr := `SELECT vector_collections.* FROM chat_session_collections JOIN vector_collections ON vector_collections.id=chat_session_collections.collection_id
+		WHERE chat_session_collections.session_id=$1 ORDER BY chat_session_collections.position`
+
+	err := chatController.DBManager.DB.Select(&vectorCollections, queryStr, chatSession.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	shared := vectorCollections[:0]
+	for _, vectorCollection := range vectorCollections {
+		level, err := chatController.AuthController.CollectionLevel(principal, vectorCollection.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if checkCollectionLevel(level, CollectionViewer) == nil {
+			shared = append(shared, vectorCollection)
+		}
+	}
+
+	return shared, nil
+}
+
+// errEmbeddingMismatch is returned when a collection was embedded with
+// another dimension than its embedding model produces now.
+var errEmbeddingMismatch = errors.New("embedding dimension mismatch")
+
+// retrievedChunk is a chunk retrieved from one of the collections of a
+// session, with its rerank score if the collection reranks.
+type retrievedChunk struct {
+	doc         schema.Document
+	rerankScore *float64
+	collection  models.VectorCollection
+}
+
+// retrieveAll retrieves the chunks answering question from every collection
+// of a session, each with its own settings. The scores of different
+// collections are of different kinds, so their rankings are merged with
+// reciprocal rank fusion, and the largest top_k among the collections is
+// kept. Merged chunks carry their fusion score.
+func (chatController *ChatController) retrieveAll(ctx context.Context, vectorCollections []models.VectorCollection, question string) ([]retrievedChunk, error) {
+	// Collections embedded with the same model share the question's vector.
+	vectors := make(map[string][]float32, len(vectorCollections))
+
+	chunks := make(map[string]retrievedChunk)
+	rankings := make([]retrieval.Ranking, 0, len(vectorCollections))
+	limit := 0
+
+	for _, vectorCollection := range vectorCollections {
+		embedding := vectorCollection.EmbeddingProvider + "\x00" + vectorCollection.EmbeddingModel
+
+		questionVector, ok := vectors[embedding]
+		if !ok {
+			e, err := chatController.Providers.Embedder(vectorCollection.EmbeddingProvider, vectorCollection.EmbeddingModel)
+			if err != nil {
+				return nil, err
+			}
+
+			questionVector, err = e.EmbedQuery(ctx, question)
+			if err != nil {
+				return nil, err
+			}
+
+			vectors[embedding] = questionVector
+		}
+
+		if len(questionVector) != vectorCollection.EmbeddingDimension {
+			log.Printf("query dimension %d does not match collection %s dimension %d", len(questionVector), vectorCollection.CollectionHash, vectorCollection.EmbeddingDimension)
+			return nil, errEmbeddingMismatch
+		}
+
+		docs, rerankScores, err := chatController.retrieve(ctx, vectorCollection, question, questionVector)
+		if err != nil {
+			return nil, err
+		}
+
+		ranked := make([]retrievedChunk, len(docs))
+		for i := range docs {
+			ranked[i] = retrievedChunk{doc: docs[i], collection: vectorCollection}
+			if rerankScores != nil {
+				ranked[i].rerankScore = &rerankScores[i]
+			}
+		}
+
+		if len(vectorCollections) == 1 {
+			return ranked, nil
+		}
+
+		for _, chunk := range ranked {
+			chunks[retrieval.ChunkKey(chunk.doc)] = chunk
+		}
+
+		rankings = append(rankings, retrieval.Ranking{Documents: docs, Weight: 1})
+		limit = max(limit, vectorCollection.Settings.TopK)
+	}
+
+	fused := retrieval.Fuse(sessionFusionK, limit, rankings...)
+
+	merged := make([]retrievedChunk, len(fused))
+	for i, doc := range fused {
+		merged[i] = chunks[retrieval.ChunkKey(doc)]
+		merged[i].doc = doc
+	}
+
+	return merged, nil
+}
+
+// retrieve finds the chunks of a collection that answer question. When the
+// collection reranks, more candidates are retrieved and the reranker picks the
+// best of them; its scores are returned too, nil otherwise. A failing reranker
+// leaves the first stage order in place.
+func (chatController *ChatController) retrieve(ctx context.Context, vectorCollection models.VectorCollection, question string, questionVector []float32) ([]schema.Document, []float64, error) {
+	settings := vectorCollection.Settings
+
+	reranker, err := chatController.Rerankers.Reranker(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if reranker == nil {
+		docs, err := chatController.search(ctx, vectorCollection, question, questionVector, settings.TopK)
+		return docs, nil, err
+	}
+
+	docs, err := chatController.search(ctx, vectorCollection, question, questionVector, max(settings.RerankCandidates, settings.TopK))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reranked, scores, err := retrieval.Rerank(ctx, reranker, question, docs, settings.TopK)
+	if err != nil {
+		log.Printf("Reranking chunks of collection %s failed: %v", vectorCollection.CollectionHash, err)
+
+		return docs[:min(len(docs), settings.TopK)], nil, nil
+	}
+
+	return reranked, scores, nil
+}
+
+// search returns the limit best chunks of a collection for question. Unless
+// the collection turned keyword search off, the vector and keyword rankings
+// are fused with the weights of its settings.
+func (chatController *ChatController) search(ctx context.Context, vectorCollection models.VectorCollection, question string, questionVector []float32, limit int) ([]schema.Document, error) {
+	settings := vectorCollection.Settings
+
+	if settings.KeywordWeight == 0 {
+		return chatController.VectorStore.SimilaritySearch(ctx, vectorCollection.StoreName, questionVector, limit,
+			vectorstore.WithScoreThreshold(settings.ScoreThreshold))
+	}
+
+	// Chunks just outside the top of one ranking may still win the fusion.
+	candidates := max(limit*hybridCandidateFactor, minHybridCandidates)
+
+	rankings := make([]retrieval.Ranking, 0, 2)
+
+	// Chunks that passed score_threshold in the vector search.
+	similar := make(map[string]bool)
+
+	if settings.VectorWeight > 0 {
+		docs, err := chatController.VectorStore.SimilaritySearch(ctx, vectorCollection.StoreName, questionVector, candidates,
+			vectorstore.WithScoreThreshold(settings.ScoreThreshold))
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			similar[retrieval.ChunkKey(doc)] = true
+		}
+		rankings = append(rankings, retrieval.Ranking{Documents: docs, Weight: settings.VectorWeight})
+	}
+
+	docs, err := chatController.Keywords.Search(ctx, vectorCollection.ID, question, candidates)
+	if err != nil {
+		return nil, err
 	}
-	userID, err := chatController.AuthController.FetchAuth(metaData)
+
+	if settings.MinKeywordMatch > 0 {
+		matching := make([]schema.Document, 0, len(docs))
+		for _, doc := range docs {
+			if similar[retrieval.ChunkKey(doc)] || retrieval.Coverage(question, doc.PageContent) >= settings.MinKeywordMatch {
+				matching = append(matching, doc)
+			}
+		}
+		docs = matching
+	}
+	rankings = append(rankings, retrieval.Ranking{Documents: docs, Weight: settings.KeywordWeight})
+
+	return retrieval.Fuse(settings.RRFK, limit, rankings...), nil
+}
+
+func (chatController *ChatController) saveSessionMessage(userID int64, sessionID string, message string, messageRole string, sources models.Sources) (int64, error) {
+	queryStr := "INSERT INTO session_messages(user_id, session_id, message, message_role, sources, date_created, date_modified) VALUES($1, $2, $3, $4, $5, datetime('now'), datetime('now'))"
+
+	result, err := chatController.DBManager.DB.Exec(queryStr, userID, sessionID, message, messageRole, sources)
 	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "1", "message": "Forbidden access"})
 		return -1, err
 	}
-	return userID, nil
+
+	return result.LastInsertId()
+}
+
+func (chatController *ChatController) writeSystemError(w http.ResponseWriter, err error) error {
+	log.Printf("%s", err.Error())
+
+	w.WriteHeader(http.StatusInternalServerError)
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+
+	return err
+}
+
+const sourceSnippetLength = 240
+
+// sourceFromDocument turns a retrieved chunk and the payload stored with it at
+// indexing time into a citation.
+func sourceFromDocument(doc schema.Document) models.Source {
+	source := models.Source{
+		Snippet: doc.PageContent,
+		Score:   doc.Score,
+	}
+
+	if snippet := []rune(doc.PageContent); len(snippet) > sourceSnippetLength {
+		source.Snippet = string(snippet[:sourceSnippetLength]) + "..."
+	}
+
+	if documentID, ok := doc.Metadata["document_id"].(float64); ok {
+		source.DocumentID = int64(documentID)
+	}
+	if fileName, ok := doc.Metadata["file_name"].(string); ok {
+		source.FileName = fileName
+	}
+	if page, ok := doc.Metadata["page"].(float64); ok {
+		source.Page = int(page)
+	}
+
+	return source
+}
+
+func writeSSEEvent(w io.Writer, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+func (chatController *ChatController) setJSONHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 }
 
 func (chatController *ChatController) parseRequestBody(r *http.Request, w http.ResponseWriter) (map[string]interface{}, error) {
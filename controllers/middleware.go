@@ -0,0 +1,452 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zarkopopovski/rag-chat/models"
+)
+
+const (
+	RoleUser  = "USER"
+	RoleAdmin = "ADMIN"
+)
+
+// CollectionAccess is the level of access a user has, or a route needs, on a
+// collection. The values match the levels of the collection_access view.
+type CollectionAccess int
+
+const (
+	// CollectionViewer may chat with a collection and read its settings,
+	// prompt template and documents.
+	CollectionViewer CollectionAccess = iota + 1
+	// CollectionEditor may additionally upload and re-index documents.
+	CollectionEditor
+	// CollectionOwner may additionally change, share or delete it and its
+	// documents and prompt templates.
+	CollectionOwner
+)
+
+var collectionPermissions = map[CollectionAccess]string{
+	CollectionViewer: "viewer",
+	CollectionEditor: "editor",
+	CollectionOwner:  "owner",
+}
+
+func (access CollectionAccess) String() string {
+	return collectionPermissions[access]
+}
+
+// ParseCollectionAccess returns the access named by permission, which is
+// "viewer", "editor" or "owner".
+func ParseCollectionAccess(permission string) (CollectionAccess, bool) {
+	for access, name := range collectionPermissions {
+		if name == permission {
+			return access, true
+		}
+	}
+
+	return 0, false
+}
+
+const (
+	OrganizationOwner  = "owner"
+	OrganizationMember = "member"
+)
+
+// collectionLevelsSQL selects the highest access level user $1 has on each
+// collection they can reach.
+const collectionLevelsSQL = "SELECT collection_id, MAX(level) AS level FROM collection_access WHERE user_id=$1 GROUP BY collection_id"
+
+// collectionPermissionSQL names the level selected by collectionLevelsSQL,
+// joined as access.
+const collectionPermissionSQL = "CASE access.level WHEN 3 THEN 'owner' WHEN 2 THEN 'editor' ELSE 'viewer' END AS permission"
+
+// Scopes an API key can be given. Routes declare the scope they need with
+// RequireScope, and API keys are refused on routes that declare none.
+const (
+	ScopeCollectionsRead  = "collections:read"
+	ScopeCollectionsWrite = "collections:write"
+	ScopeDocumentsUpload  = "documents:upload"
+	ScopeChatRead         = "chat:read"
+	ScopeChatWrite        = "chat:write"
+)
+
+var knownScopes = []string{ScopeCollectionsRead, ScopeCollectionsWrite, ScopeDocumentsUpload, ScopeChatRead, ScopeChatWrite}
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+
+	// ErrTwoFactorRequired refuses administrators who have not enabled
+	// two-factor authentication while it is required for them.
+	ErrTwoFactorRequired = fmt.Errorf("%w: two-factor authentication required", ErrForbidden)
+)
+
+type principalContextKey struct{}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID     int64
+	Email      string
+	Roles      []string
+	AccessUUID string
+
+	// SessionID is the login session the access token belongs to, 0 for
+	// API keys and tokens issued before sessions were recorded.
+	SessionID int64
+
+	// APIKeyID is set when the caller authenticated with an API key, which
+	// is limited to Scopes and, unless CollectionID is 0, to one collection.
+	APIKeyID     int64
+	Scopes       []string
+	CollectionID int64
+
+	// twoFactorMissing is set when the ADMIN role was withheld because the
+	// user has not enabled the two-factor authentication required for it.
+	twoFactorMissing bool
+	scopeChecked     bool
+}
+
+// HasScope reports whether the principal may act within scope. Users signed
+// in with a JWT hold every scope.
+func (p *Principal) HasScope(scope string) bool {
+	if p.APIKeyID == 0 {
+		return true
+	}
+
+	return containsString(p.Scopes, scope)
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseRoles splits the roles column, stored as e.g. "USER:ADMIN".
+func ParseRoles(roles string) []string {
+	parsed := make([]string, 0)
+
+	for _, role := range strings.Split(roles, ":") {
+		if role = strings.TrimSpace(role); role != "" {
+			parsed = append(parsed, strings.ToUpper(role))
+		}
+	}
+
+	return parsed
+}
+
+// PrincipalFromContext returns the caller resolved by Authorize.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(*Principal)
+
+	return principal, ok
+}
+
+// Check decides whether principal may perform request r. It returns
+// ErrForbidden or ErrNotFound to deny the request.
+type Check func(r *http.Request, principal *Principal) error
+
+// Authorize wraps next so that it only runs for callers with a valid access
+// token or API key that pass every check. The caller is resolved once and
+// stored in the request context.
+func (aController *AuthController) Authorize(next http.HandlerFunc, checks ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := aController.authenticate(r)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+
+		for _, check := range checks {
+			if err := check(r, principal); err != nil {
+				writeAuthError(w, err)
+				return
+			}
+		}
+
+		if principal.APIKeyID != 0 && !principal.scopeChecked {
+			writeAuthError(w, ErrForbidden)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal)))
+	}
+}
+
+func (aController *AuthController) authenticate(r *http.Request) (*Principal, error) {
+	if token := aController.ExtractToken(r); strings.HasPrefix(token, APIKeyPrefix) {
+		return aController.authenticateAPIKey(token)
+	}
+
+	metaData, err := aController.ExtractTokenMetadata(r)
+	if err != nil || metaData == nil {
+		return nil, ErrUnauthorized
+	}
+
+	userID, err := aController.FetchAuth(metaData)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	var user struct {
+		Email              string `db:"email"`
+		Roles              string `db:"roles"`
+		Locked             bool   `db:"locked"`
+		TOTPEnabled        bool   `db:"totp_enabled"`
+		TwoFactorForAdmins bool   `db:"two_factor_for_admins"`
+		SessionID          int64  `db:"session_id"`
+	}
+
+	queryStr := "SELECT email, roles, locked, totp_enabled, COALESCE((SELECT value='true' FROM settings WHERE name=$1), 0) AS two_factor_for_admins, COALESCE((SELECT session_id FROM tokens WHERE uuid=$2 AND type='ACCESS_UUID'), 0) AS session_id FROM user WHERE id=$3"
+
+	err = aController.DBManager.DB.Get(&user, queryStr, SettingRequireAdminTwoFactor, metaData.AccessUuid, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Locked {
+		return nil, ErrUnauthorized
+	}
+
+	principal := &Principal{
+		UserID:     userID,
+		Email:      user.Email,
+		Roles:      ParseRoles(user.Roles),
+		AccessUUID: metaData.AccessUuid,
+		SessionID:  user.SessionID,
+	}
+
+	aController.touchSession(user.SessionID)
+
+	if user.TwoFactorForAdmins && !user.TOTPEnabled && principal.HasRole(RoleAdmin) {
+		roles := make([]string, 0, len(principal.Roles))
+		for _, role := range principal.Roles {
+			if role != RoleAdmin {
+				roles = append(roles, role)
+			}
+		}
+		principal.Roles = roles
+		principal.twoFactorMissing = true
+	}
+
+	return principal, nil
+}
+
+// RequireRole admits only callers holding role.
+func RequireRole(role string) Check {
+	return func(r *http.Request, principal *Principal) error {
+		if !principal.HasRole(role) {
+			if role == RoleAdmin && principal.twoFactorMissing {
+				return ErrTwoFactorRequired
+			}
+			return ErrForbidden
+		}
+
+		return nil
+	}
+}
+
+// RequireScope admits users signed in with a JWT and API keys holding scope.
+func RequireScope(scope string) Check {
+	return func(r *http.Request, principal *Principal) error {
+		if !principal.HasScope(scope) {
+			return ErrForbidden
+		}
+
+		principal.scopeChecked = true
+
+		return nil
+	}
+}
+
+// RequireCollection admits callers with at least access to the collection
+// named by the {collectionHash} path value, to the collection of the document
+// named by {documentID} or to the collection of the prompt template named by
+// {promptTemplateID}. Collections the caller cannot read are reported as not
+// found so that their existence is not revealed.
+func (aController *AuthController) RequireCollection(access CollectionAccess) Check {
+	return func(r *http.Request, principal *Principal) error {
+		var collectionID int64
+		var err error
+
+		if collectionHash := r.PathValue("collectionHash"); collectionHash != "" {
+			err = aController.DBManager.DB.Get(&collectionID, "SELECT id FROM vector_collections WHERE collection_hash=$1", collectionHash)
+		} else if documentID := r.PathValue("documentID"); documentID != "" {
+			err = aController.DBManager.DB.Get(&collectionID, "SELECT collection_id FROM documents WHERE id=$1", documentID)
+		} else if promptTemplateID := r.PathValue("promptTemplateID"); promptTemplateID != "" {
+			err = aController.DBManager.DB.Get(&collectionID, "SELECT collection_id FROM prompt_templates WHERE id=$1", promptTemplateID)
+		} else {
+			return ErrNotFound
+		}
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		level, err := aController.CollectionLevel(principal, collectionID)
+		if err != nil {
+			return err
+		}
+
+		return checkCollectionLevel(level, access)
+	}
+}
+
+// CollectionLevel returns the highest access principal has on the collection,
+// or 0 if they cannot reach it at all.
+func (aController *AuthController) CollectionLevel(principal *Principal, collectionID int64) (CollectionAccess, error) {
+	if !principal.CanUseCollection(collectionID) {
+		return 0, nil
+	}
+
+	var level CollectionAccess
+
+	err := aController.DBManager.DB.Get(&level, "SELECT COALESCE(MAX(level), 0) FROM collection_access WHERE collection_id=$1 AND user_id=$2", collectionID, principal.UserID)
+
+	return level, err
+}
+
+// CanUseCollection reports whether an API key restricted to one collection
+// allows collectionID. Other principals may use any collection they can reach.
+func (p *Principal) CanUseCollection(collectionID int64) bool {
+	return p.CollectionID == 0 || p.CollectionID == collectionID
+}
+
+// FindCollection loads the collection named by collectionHash if principal
+// has at least access to it, with Permission set to their access.
+func (aController *AuthController) FindCollection(principal *Principal, collectionHash string, access CollectionAccess) (*models.VectorCollection, error) {
+	queryStr := "SELECT vector_collections.*, " + collectionPermissionSQL + " FROM vector_collections JOIN (" + collectionLevelsSQL + ") access ON access.collection_id=vector_collections.id WHERE vector_collections.collection_hash=$2"
+
+	vectorCollection := models.VectorCollection{}
+
+	err := aController.DBManager.DB.Get(&vectorCollection, queryStr, principal.UserID, collectionHash)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !principal.CanUseCollection(vectorCollection.ID)) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	level, _ := ParseCollectionAccess(vectorCollection.Permission)
+	if err := checkCollectionLevel(level, access); err != nil {
+		return nil, err
+	}
+
+	return &vectorCollection, nil
+}
+
+// checkCollectionLevel hides collections the caller cannot see at all and
+// forbids those they can see but need more access to.
+func checkCollectionLevel(level CollectionAccess, access CollectionAccess) error {
+	if level < CollectionViewer {
+		return ErrNotFound
+	}
+
+	if level < access {
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+// RequireOrganization admits members of the organization named by the
+// {organizationID} path value. With OrganizationOwner only its owners are
+// admitted. Organizations the caller does not belong to are reported as not
+// found.
+func (aController *AuthController) RequireOrganization(role string) Check {
+	return func(r *http.Request, principal *Principal) error {
+		organizationID, err := strconv.ParseInt(r.PathValue("organizationID"), 10, 64)
+		if err != nil {
+			return ErrNotFound
+		}
+
+		memberRole, err := aController.OrganizationRole(principal.UserID, organizationID)
+		if err != nil {
+			return err
+		}
+
+		if role == OrganizationOwner && memberRole != OrganizationOwner {
+			return ErrForbidden
+		}
+
+		return nil
+	}
+}
+
+// OrganizationRole returns the role of userID in the organization, or
+// ErrNotFound if they are not a member.
+func (aController *AuthController) OrganizationRole(userID int64, organizationID int64) (string, error) {
+	var role string
+
+	err := aController.DBManager.DB.Get(&role, "SELECT role FROM organization_members WHERE organization_id=$1 AND user_id=$2", organizationID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+
+	return role, err
+}
+
+// currentUserID returns the ID of the caller resolved by Authorize. Handlers
+// registered without Authorize get a 401.
+func currentUserID(r *http.Request, w http.ResponseWriter) (int64, error) {
+	principal, err := currentPrincipal(r, w)
+	if err != nil {
+		return -1, err
+	}
+
+	return principal.UserID, nil
+}
+
+func currentPrincipal(r *http.Request, w http.ResponseWriter) (*Principal, error) {
+	principal, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		writeAuthError(w, ErrUnauthorized)
+		return nil, ErrUnauthorized
+	}
+
+	return principal, nil
+}
+
+func writeAuthError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "1", "message": "Unauthorized"})
+	case errors.Is(err, ErrTwoFactorRequired):
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "17", "message": "Two-factor authentication must be enabled for this account"})
+	case errors.Is(err, ErrForbidden):
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "1", "message": "Forbidden access"})
+	case errors.Is(err, ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
+	default:
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+	}
+}
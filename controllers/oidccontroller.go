@@ -0,0 +1,347 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/oidc"
+	"github.com/zarkopopovski/rag-chat/passwords"
+)
+
+const (
+	// oidcLoginStateLifetime bounds how long a user may spend at the
+	// provider's login page, as an SQLite datetime modifier.
+	oidcLoginStateLifetime = "-10 minutes"
+
+	// oidcStateCookie ties a login to the browser that started it, so that
+	// nobody can complete their own login in somebody else's browser.
+	oidcStateCookie       = "rag_chat_oidc_state"
+	oidcStateCookiePath   = "/api/v1/oidc/"
+	oidcStateCookieMaxAge = 10 * 60
+)
+
+var errOIDCIdentityConflict = errors.New("the account is linked to another single sign-on identity")
+
+// OIDCController signs users in through an OpenID provider and then issues
+// the same token pair as CheckUserCredentials.
+type OIDCController struct {
+	DBManager      *db.DBManager
+	AuthController *AuthController
+	Provider       *oidc.Provider
+
+	// IssuerURL is stored with the subject of linked users.
+	IssuerURL string
+
+	// GroupsClaim names the ID token claim listing the user's groups. When
+	// AdminGroups is set, the roles of SSO users follow their groups on
+	// every login; otherwise roles are managed in rag-chat only.
+	GroupsClaim string
+	AdminGroups []string
+
+	// PostLoginRedirectURL, when set, receives the tokens in the URL fragment
+	// after a successful login instead of a JSON response.
+	PostLoginRedirectURL string
+}
+
+// Login starts the authorization code flow and redirects to the provider. The
+// state, nonce and PKCE verifier stay on the server until the callback, and
+// the state is also set as a cookie the callback has to present.
+func (oidcController *OIDCController) Login(w http.ResponseWriter, r *http.Request) {
+	state, err := randomToken()
+	if err != nil {
+		oidcController.writeError(w, http.StatusInternalServerError, "6", err)
+		return
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		oidcController.writeError(w, http.StatusInternalServerError, "6", err)
+		return
+	}
+
+	verifier := oidc.NewVerifier()
+
+	authURL, err := oidcController.Provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		oidcController.writeError(w, http.StatusBadGateway, "6", err)
+		return
+	}
+
+	_, err = oidcController.DBManager.DB.Exec("DELETE FROM oidc_login_states WHERE date_created < datetime('now', $1)", oidcLoginStateLifetime)
+	if err != nil {
+		log.Printf("%s", err.Error())
+	}
+
+	_, err = oidcController.DBManager.DB.Exec("INSERT INTO oidc_login_states(state, nonce, code_verifier, date_created) VALUES($1, $2, $3, datetime('now'))", state, nonce, verifier)
+	if err != nil {
+		oidcController.writeError(w, http.StatusInternalServerError, "6", err)
+		return
+	}
+
+	http.SetCookie(w, oidcController.stateCookie(r, state, oidcStateCookieMaxAge))
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// stateCookie sets the state cookie of a login to value for maxAge seconds,
+// or removes it when maxAge is negative. It is only Secure when the callback
+// is served over HTTPS, so that plain HTTP development setups keep working.
+func (oidcController *OIDCController) stateCookie(r *http.Request, value string, maxAge int) *http.Cookie {
+	secure := r.TLS != nil
+	if redirectURL, err := url.Parse(oidcController.Provider.RedirectURL()); err == nil && redirectURL.Scheme == "https" {
+		secure = true
+	}
+
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     oidcStateCookiePath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Callback completes the login: it redeems the code, verifies the ID token,
+// finds, links or provisions the user and issues the token pair.
+func (oidcController *OIDCController) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if providerError := query.Get("error"); providerError != "" {
+		message := providerError
+		if description := query.Get("error_description"); description != "" {
+			message += ": " + description
+		}
+		oidcController.writeError(w, http.StatusUnauthorized, "1", errors.New(message))
+		return
+	}
+
+	// The state has to come back to the browser it was issued to.
+	stateCookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(query.Get("state"))) != 1 {
+		oidcController.writeError(w, http.StatusUnauthorized, "1", errors.New("The login was not started in this browser, please sign in again"))
+		return
+	}
+
+	http.SetCookie(w, oidcController.stateCookie(r, "", -1))
+
+	loginState := struct {
+		Nonce        string `db:"nonce"`
+		CodeVerifier string `db:"code_verifier"`
+	}{}
+
+	// A state is used once, and only while it is fresh. Deleting it in the
+	// same statement keeps concurrent callbacks from both redeeming it.
+	err = oidcController.DBManager.DB.Get(&loginState, "DELETE FROM oidc_login_states WHERE state=$1 AND date_created >= datetime('now', $2) RETURNING nonce, code_verifier", query.Get("state"), oidcLoginStateLifetime)
+	if errors.Is(err, sql.ErrNoRows) {
+		oidcController.writeError(w, http.StatusUnauthorized, "1", errors.New("The login request is unknown or has expired, please sign in again"))
+		return
+	}
+	if err != nil {
+		oidcController.writeError(w, http.StatusInternalServerError, "6", err)
+		return
+	}
+
+	rawIDToken, err := oidcController.Provider.Exchange(r.Context(), query.Get("code"), loginState.CodeVerifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %s", err.Error())
+		oidcController.writeError(w, http.StatusUnauthorized, "1", errors.New("The authorization code could not be redeemed"))
+		return
+	}
+
+	idToken, err := oidcController.Provider.VerifyIDToken(r.Context(), rawIDToken, loginState.Nonce)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		oidcController.writeError(w, http.StatusUnauthorized, "1", oidc.ErrInvalidIDToken)
+		return
+	}
+
+	user, err := oidcController.resolveUser(idToken)
+	if errors.Is(err, ErrForbidden) {
+		oidcController.writeError(w, http.StatusForbidden, "1", errors.New("The identity provider has not verified the email address"))
+		return
+	}
+	if errors.Is(err, errOIDCIdentityConflict) {
+		oidcController.writeError(w, http.StatusConflict, "16", err)
+		return
+	}
+	if err != nil {
+		oidcController.writeError(w, http.StatusInternalServerError, "6", err)
+		return
+	}
+
+	if user.Locked {
+		oidcController.writeError(w, http.StatusForbidden, "1", errors.New("The account is locked, please contact an administrator."))
+		return
+	}
+
+	// The provider's own second factor is out of rag-chat's sight, so users
+	// who enabled one here are asked for it too.
+	if user.TOTPEnabled {
+		challengeToken, err := oidcController.AuthController.StartLoginChallenge(user.Id)
+		if err != nil {
+			oidcController.writeError(w, http.StatusInternalServerError, "6", err)
+			return
+		}
+
+		if oidcController.PostLoginRedirectURL != "" {
+			fragment := url.Values{}
+			fragment.Set("challenge_token", challengeToken)
+
+			http.Redirect(w, r, oidcController.PostLoginRedirectURL+"#"+fragment.Encode(), http.StatusFound)
+			return
+		}
+
+		oidcController.setJSONHeaders(w)
+		writeLoginChallenge(w, challengeToken)
+		return
+	}
+
+	err = oidcController.AuthController.SignIn(r, user)
+	if err != nil {
+		oidcController.writeError(w, http.StatusInternalServerError, "6", err)
+		return
+	}
+
+	if oidcController.PostLoginRedirectURL != "" {
+		fragment := url.Values{}
+		fragment.Set("access_token", user.Tokens.AccessToken)
+		fragment.Set("refresh_token", user.Tokens.RefreshToken)
+		fragment.Set("expires_at", strconv.FormatInt(user.Tokens.AtExpires, 10))
+
+		http.Redirect(w, r, oidcController.PostLoginRedirectURL+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	oidcController.setJSONHeaders(w)
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": user})
+}
+
+// resolveUser returns the user linked to the token's subject. Otherwise the
+// user with the same, verified, email address is linked, or a new confirmed
+// user without a usable password is created.
+func (oidcController *OIDCController) resolveUser(idToken *oidc.IDToken) (*models.User, error) {
+	const userQuery = "SELECT id, email, password, confirmed, locked, last_login, roles, oidc_issuer, oidc_subject, totp_enabled FROM user WHERE "
+
+	user := new(models.User)
+
+	err := oidcController.DBManager.DB.Get(user, userQuery+"oidc_issuer=$1 AND oidc_subject=$2", oidcController.IssuerURL, idToken.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		if idToken.Email == "" || !idToken.EmailVerified {
+			return nil, ErrForbidden
+		}
+
+		err = oidcController.DBManager.DB.Get(user, userQuery+"email=$1", idToken.Email)
+		switch {
+		case err == nil && user.OIDCSubject != "":
+			return nil, errOIDCIdentityConflict
+		case err == nil:
+			// The provider vouches for the address, which confirms it too.
+			_, err = oidcController.DBManager.DB.Exec("UPDATE user SET oidc_issuer=$1, oidc_subject=$2, confirmed=true, date_modified=datetime('now') WHERE id=$3", oidcController.IssuerURL, idToken.Subject, user.Id)
+			user.Confirmed = true
+		case errors.Is(err, sql.ErrNoRows):
+			user, err = oidcController.provisionUser(idToken)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(oidcController.AdminGroups) > 0 {
+		roles := oidcController.mapRoles(idToken)
+		if roles != user.Roles {
+			_, err = oidcController.DBManager.DB.Exec("UPDATE user SET roles=$1, date_modified=datetime('now') WHERE id=$2", roles, user.Id)
+			if err != nil {
+				return nil, err
+			}
+			user.Roles = roles
+		}
+	}
+
+	return user, nil
+}
+
+func (oidcController *OIDCController) provisionUser(idToken *oidc.IDToken) (*models.User, error) {
+	// SSO users sign in at the provider; a random password keeps the
+	// password login closed until they reset it.
+	password, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	passwordEnc, err := passwords.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	confirmationToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	roles := RoleUser
+	if len(oidcController.AdminGroups) > 0 {
+		roles = oidcController.mapRoles(idToken)
+	}
+
+	queryStr := `INSERT INTO user(email, password, confirmed, last_login, date_created, date_modified, confirmation_token, roles, oidc_issuer, oidc_subject)
+		VALUES($1, $2, true, datetime('now'), datetime('now'), datetime('now'), $3, $4, $5, $6)`
+
+	result, err := oidcController.DBManager.DB.Exec(queryStr, idToken.Email, passwordEnc, confirmationToken, roles, oidcController.IssuerURL, idToken.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.User{
+		Id:          userID,
+		Email:       idToken.Email,
+		Confirmed:   true,
+		Roles:       roles,
+		OIDCIssuer:  oidcController.IssuerURL,
+		OIDCSubject: idToken.Subject,
+	}, nil
+}
+
+// mapRoles grants ADMIN to members of one of the AdminGroups.
+func (oidcController *OIDCController) mapRoles(idToken *oidc.IDToken) string {
+	for _, group := range idToken.Strings(oidcController.GroupsClaim) {
+		if containsString(oidcController.AdminGroups, group) {
+			return RoleUser + ":" + RoleAdmin
+		}
+	}
+
+	return RoleUser
+}
+
+func (oidcController *OIDCController) writeError(w http.ResponseWriter, status int, errorCode string, err error) {
+	if status == http.StatusInternalServerError || status == http.StatusBadGateway {
+		log.Printf("%s", err.Error())
+	}
+
+	oidcController.setJSONHeaders(w)
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": errorCode, "message": err.Error()})
+}
+
+func (oidcController *OIDCController) setJSONHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+}
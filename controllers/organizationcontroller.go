@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/models"
+)
+
+// OrganizationController manages organizations and their members. Members
+// can view every collection of their organization and owners own them.
+type OrganizationController struct {
+	DBManager      *db.DBManager
+	AuthController *AuthController
+}
+
+// CreateOrganization creates an organization with the caller as its owner.
+func (orgController *OrganizationController) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	orgController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	postMap, err := orgController.parseRequestBody(r, w)
+	if err != nil {
+		return
+	}
+
+	name, _ := postMap["name"].(string)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": "Name is required and must be a string"})
+		return
+	}
+
+	tx, err := orgController.DBManager.DB.Beginx()
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO organizations(name, date_created, date_modified) VALUES($1, datetime('now'), datetime('now'))", name)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	organizationID, err := result.LastInsertId()
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO organization_members(organization_id, user_id, role, date_created, date_modified) VALUES($1, $2, $3, datetime('now'), datetime('now'))", organizationID, userID, OrganizationOwner)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{"id": organizationID, "name": name, "role": OrganizationOwner}})
+}
+
+// ListOrganizations lists the organizations of the caller with their role.
+func (orgController *OrganizationController) ListOrganizations(w http.ResponseWriter, r *http.Request) {
+	orgController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	queryStr := "SELECT organizations.*, organization_members.role FROM organizations JOIN organization_members ON organization_members.organization_id=organizations.id WHERE organization_members.user_id=$1 ORDER BY organizations.name"
+
+	organizations := make([]models.Organization, 0)
+
+	err = orgController.DBManager.DB.Select(&organizations, queryStr, userID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": organizations})
+}
+
+func (orgController *OrganizationController) ListMembers(w http.ResponseWriter, r *http.Request) {
+	orgController.setJSONHeaders(w)
+
+	queryStr := "SELECT organization_members.user_id, user.email, organization_members.role, organization_members.date_created FROM organization_members JOIN user ON user.id=organization_members.user_id WHERE organization_members.organization_id=$1 ORDER BY user.email"
+
+	members := make([]models.OrganizationMember, 0)
+
+	err := orgController.DBManager.DB.Select(&members, queryStr, r.PathValue("organizationID"))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": members})
+}
+
+// SetMember adds the user whose "email" is posted to the organization, or
+// changes their role, which is "owner" or "member".
+func (orgController *OrganizationController) SetMember(w http.ResponseWriter, r *http.Request) {
+	orgController.setJSONHeaders(w)
+
+	organizationID, _ := strconv.ParseInt(r.PathValue("organizationID"), 10, 64)
+
+	postMap, err := orgController.parseRequestBody(r, w)
+	if err != nil {
+		return
+	}
+
+	email, _ := postMap["email"].(string)
+	role, _ := postMap["role"].(string)
+	if role == "" {
+		role = OrganizationMember
+	}
+
+	if email == "" || (role != OrganizationMember && role != OrganizationOwner) {
+		w.WriteHeader(http.StatusBadRequest)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": "email and a role of owner or member are required"})
+		return
+	}
+
+	var memberID int64
+
+	err = orgController.DBManager.DB.Get(&memberID, "SELECT id FROM user WHERE email=$1", email)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAuthError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if role != OrganizationOwner {
+		if lastOwner, err := orgController.isLastOwner(organizationID, memberID); err != nil || lastOwner {
+			orgController.writeLastOwnerError(w, err)
+			return
+		}
+	}
+
+	queryStr := `INSERT INTO organization_members(organization_id, user_id, role, date_created, date_modified) VALUES($1, $2, $3, datetime('now'), datetime('now'))
+		ON CONFLICT(organization_id, user_id) DO UPDATE SET role=excluded.role, date_modified=excluded.date_modified`
+
+	_, err = orgController.DBManager.DB.Exec(queryStr, organizationID, memberID, role)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{"user_id": memberID, "role": role}})
+}
+
+// RemoveMember removes the member named by {userID}. Owners can remove anyone
+// and members can only leave themselves.
+func (orgController *OrganizationController) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	orgController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	organizationID, _ := strconv.ParseInt(r.PathValue("organizationID"), 10, 64)
+
+	memberID, err := strconv.ParseInt(r.PathValue("userID"), 10, 64)
+	if err != nil {
+		writeAuthError(w, ErrNotFound)
+		return
+	}
+
+	if memberID != userID {
+		role, err := orgController.AuthController.OrganizationRole(userID, organizationID)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+
+		if role != OrganizationOwner {
+			writeAuthError(w, ErrForbidden)
+			return
+		}
+	}
+
+	if lastOwner, err := orgController.isLastOwner(organizationID, memberID); err != nil || lastOwner {
+		orgController.writeLastOwnerError(w, err)
+		return
+	}
+
+	result, err := orgController.DBManager.DB.Exec("DELETE FROM organization_members WHERE organization_id=$1 AND user_id=$2", organizationID, memberID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		writeAuthError(w, ErrNotFound)
+		return
+	}
+
+	// Grants on the organization's collections end with the membership.
+	_, err = orgController.DBManager.DB.Exec("DELETE FROM collection_grants WHERE user_id=$1 AND collection_id IN (SELECT id FROM vector_collections WHERE organization_id=$2)", memberID, organizationID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": "Successfully deleted"})
+}
+
+// isLastOwner reports whether userID is the only owner of the organization,
+// who therefore may neither leave nor be demoted.
+func (orgController *OrganizationController) isLastOwner(organizationID int64, userID int64) (bool, error) {
+	var owners []int64
+
+	err := orgController.DBManager.DB.Select(&owners, "SELECT user_id FROM organization_members WHERE organization_id=$1 AND role=$2", organizationID, OrganizationOwner)
+	if err != nil {
+		return false, err
+	}
+
+	return len(owners) == 1 && owners[0] == userID, nil
+}
+
+func (orgController *OrganizationController) writeLastOwnerError(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusConflict)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "15", "message": "An organization must keep at least one owner"})
+}
+
+func (orgController *OrganizationController) setJSONHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+}
+
+func (orgController *OrganizationController) parseRequestBody(r *http.Request, w http.ResponseWriter) (map[string]interface{}, error) {
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	var postMap map[string]interface{}
+	if err := json.Unmarshal(body, &postMap); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return nil, err
+	}
+	return postMap, nil
+}
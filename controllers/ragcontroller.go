@@ -3,28 +3,26 @@ package controllers
 import (
 	"context"
 	"crypto/sha1"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/gen2brain/go-fitz"
 	"github.com/twinj/uuid"
 	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/ingestion"
+	"github.com/zarkopopovski/rag-chat/loaders"
 	"github.com/zarkopopovski/rag-chat/models"
-
-	"github.com/tmc/langchaingo/embeddings"
-	"github.com/tmc/langchaingo/llms/openai"
-	"github.com/tmc/langchaingo/schema"
-	"github.com/tmc/langchaingo/textsplitter"
-	"github.com/tmc/langchaingo/vectorstores/qdrant"
+	"github.com/zarkopopovski/rag-chat/providers"
+	"github.com/zarkopopovski/rag-chat/retrieval"
+	"github.com/zarkopopovski/rag-chat/vectorstore"
 )
 
 const MAX_UPLOAD_SIZE = 1024 * 1024 * 50 // 50MB
@@ -32,16 +30,27 @@ const MAX_UPLOAD_SIZE = 1024 * 1024 * 50 // 50MB
 type RagController struct {
 	DBManager      *db.DBManager
 	AuthController *AuthController
-	OpenAIOptions  []openai.Option
+	Providers      *providers.Registry
+	VectorStore    vectorstore.VectorStore
+	IngestionQueue *ingestion.Queue
+	Loaders        *loaders.Registry
+	Rerankers      *retrieval.Rerankers
 }
 
 func (ragController *RagController) CreateVectorCollection(w http.ResponseWriter, r *http.Request) {
 	ragController.setJSONHeaders(w)
 
-	userID, err := ragController.authenticateRequest(r, w)
+	principal, err := currentPrincipal(r, w)
 	if err != nil {
 		return
 	}
+	userID := principal.UserID
+
+	// A key limited to one collection cannot create others.
+	if principal.CollectionID != 0 {
+		writeAuthError(w, ErrForbidden)
+		return
+	}
 
 	postMap, err := ragController.parseRequestBody(r, w)
 	if err != nil {
@@ -54,35 +63,61 @@ func (ragController *RagController) CreateVectorCollection(w http.ResponseWriter
 		return
 	}
 
-	collectionHash := uuid.NewV4().String()
-
-	qdrantURL := os.Getenv("QDRANT_URL")
+	// Collections created in an organization can be viewed by all of its
+	// members.
+	var organizationID int64
+	if id, ok := postMap["organization_id"].(float64); ok && id > 0 {
+		organizationID = int64(id)
 
-	ctx := context.Background()
+		if _, err := ragController.AuthController.OrganizationRole(userID, organizationID); err != nil {
+			writeAuthError(w, err)
+			return
+		}
+	}
 
-	urlAPI, err := url.Parse(qdrantURL)
+	embeddingProvider, _ := postMap["embedding_provider"].(string)
+	embeddingModel, _ := postMap["embedding_model"].(string)
 
+	embeddingProvider, embeddingModel, err = ragController.Providers.ResolveEmbedding(embeddingProvider, embeddingModel)
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	collectionConfig := map[string]interface{}{
-		"vectors": map[string]interface{}{
-			"size":     1536,
-			"distance": "Cosine",
-		},
-	}
+	collectionHash := uuid.NewV4().String()
+
+	dimension, err := ragController.Providers.Dimension(r.Context(), embeddingProvider, embeddingModel)
+	if err != nil {
+		log.Printf("%s", err.Error())
 
-	urlCollection := urlAPI.JoinPath("collections", collectionHash)
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "10", "message": "Unable to reach the embedding model"})
+		return
+	}
 
-	_, _, err = qdrant.DoRequest(ctx, *urlCollection, "", http.MethodPut, collectionConfig)
+	err = ragController.VectorStore.CreateCollection(r.Context(), collectionHash, dimension)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+		return
 	}
 
-	queryStr := "INSERT INTO vector_collections(user_id, name, collection_hash, date_created, date_modified) VALUES($1, $2, $3, datetime('now'), datetime('now'))"
+	queryStr := "INSERT INTO vector_collections(user_id, organization_id, name, collection_hash, store_name, embedding_provider, embedding_model, embedding_dimension, date_created, date_modified) VALUES($1, $2, $3, $4, $4, $5, $6, $7, datetime('now'), datetime('now'))"
 
-	_, err = ragController.DBManager.DB.Exec(queryStr, userID, name, collectionHash)
+	result, err := ragController.DBManager.DB.Exec(queryStr, userID, organizationID, name, collectionHash, embeddingProvider, embeddingModel, dimension)
+
+	// The creator owns an organization collection only while they stay in
+	// the organization, so their ownership is a grant.
+	if err == nil && organizationID != 0 {
+		var collectionID int64
+
+		collectionID, err = result.LastInsertId()
+		if err == nil {
+			_, err = ragController.DBManager.DB.Exec("INSERT INTO collection_grants(collection_id, user_id, permission, granted_by, date_created, date_modified) VALUES($1, $2, $3, $2, datetime('now'), datetime('now'))", collectionID, userID, CollectionOwner.String())
+		}
+	}
 
 	if err != nil {
 		log.Printf("%s", err.Error())
@@ -105,16 +140,16 @@ func (ragController *RagController) CreateVectorCollection(w http.ResponseWriter
 func (ragController *RagController) ListVectorCollections(w http.ResponseWriter, r *http.Request) {
 	ragController.setJSONHeaders(w)
 
-	userID, err := ragController.authenticateRequest(r, w)
+	principal, err := currentPrincipal(r, w)
 	if err != nil {
 		return
 	}
 
-	queryStr := "SELECT * FROM vector_collections WHERE user_id=$1 ORDER BY date_created DESC"
+	queryStr := "SELECT vector_collections.*, " + collectionPermissionSQL + " FROM vector_collections JOIN (" + collectionLevelsSQL + ") access ON access.collection_id=vector_collections.id WHERE ($2=0 OR vector_collections.id=$2) ORDER BY vector_collections.date_created DESC"
 
 	vectorCollections := make([]models.VectorCollection, 0)
 
-	err = ragController.DBManager.DB.Select(&vectorCollections, queryStr, userID)
+	err = ragController.DBManager.DB.Select(&vectorCollections, queryStr, principal.UserID, principal.CollectionID)
 
 	if err != nil {
 		log.Println(err.Error())
@@ -130,39 +165,73 @@ func (ragController *RagController) ListVectorCollections(w http.ResponseWriter,
 	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": vectorCollections})
 }
 
-func (ragController *RagController) DeleteVectorCollection(w http.ResponseWriter, r *http.Request) {
+func (ragController *RagController) GetVectorCollectionSettings(w http.ResponseWriter, r *http.Request) {
 	ragController.setJSONHeaders(w)
 
-	userID, err := ragController.authenticateRequest(r, w)
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, r.PathValue("collectionHash"), CollectionViewer)
 	if err != nil {
+		writeAuthError(w, err)
 		return
 	}
 
-	collectionHash := r.PathValue("collectionHash")
+	w.WriteHeader(http.StatusOK)
 
-	qdrantURL := os.Getenv("QDRANT_URL")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": vectorCollection.Settings})
+}
 
-	ctx := context.Background()
+// UpdateVectorCollectionSettings merges the posted fields into the current
+// settings. Chunking changes only apply to documents indexed afterwards, so
+// existing documents have to be re-indexed to pick them up.
+func (ragController *RagController) UpdateVectorCollectionSettings(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
 
-	urlAPI, err := url.Parse(qdrantURL)
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, r.PathValue("collectionHash"), CollectionOwner)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
 
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	urlCollection := urlAPI.JoinPath("collections", collectionHash)
+	settings := vectorCollection.Settings
+	if err := json.Unmarshal(body, &settings); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
 
-	_, _, err = qdrant.DoRequest(ctx, *urlCollection, "", http.MethodDelete, nil)
-	if err != nil {
-		log.Fatal(err)
+	if err := settings.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": err.Error()})
+		return
+	}
+
+	if _, err := ragController.Providers.ChatModel(settings.ChatProvider, settings.ChatModel); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": err.Error()})
+		return
+	}
+
+	if _, err := ragController.Rerankers.Reranker(settings); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": err.Error()})
+		return
 	}
 
-	queryStr := "DELETE FROM vector_collections WHERE collection_hash=$1 AND user_id=$2"
+	queryUpdateStr := "UPDATE vector_collections SET settings=$1, date_modified=datetime('now') WHERE id=$2"
 
-	_, err = ragController.DBManager.DB.Exec(queryStr, collectionHash, userID)
+	_, err = ragController.DBManager.DB.Exec(queryUpdateStr, settings, vectorCollection.ID)
 
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json; charset=UTF8")
+		log.Printf("%s", err.Error())
+
 		w.WriteHeader(http.StatusInternalServerError)
 		if err := json.NewEncoder(w).Encode(map[string]string{"error": "Something got wrong..."}); err != nil {
 			log.Printf("%s", err)
@@ -170,6 +239,32 @@ func (ragController *RagController) DeleteVectorCollection(w http.ResponseWriter
 		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": settings})
+}
+
+// DeleteVectorCollection removes a collection with everything stored for it.
+func (ragController *RagController) DeleteVectorCollection(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
+
+	collectionHash := r.PathValue("collectionHash")
+
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, collectionHash, CollectionOwner)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	err = deleteCollections(r.Context(), ragController.DBManager, ragController.VectorStore, ragController.IngestionQueue, "SELECT id FROM vector_collections WHERE id=$1", vectorCollection.ID)
+	if err != nil {
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=UTF8")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Successfully deleted"}); err != nil {
@@ -177,10 +272,310 @@ func (ragController *RagController) DeleteVectorCollection(w http.ResponseWriter
 	}
 }
 
+// deleteCollections removes the collections collectionsQuery selects, given
+// id as $1, with everything stored for them: their vectors, also those of
+// unfinished re-embeds, keyword index, documents and uploaded files, jobs,
+// prompt templates, grants and the chat sessions searching nothing else.
+// The rows go in one transaction, along with queries, which run with id as
+// $1 once the collections are gone.
+func deleteCollections(ctx context.Context, dbManager *db.DBManager, vectorStore vectorstore.VectorStore, queue *ingestion.Queue, collectionsQuery string, id int64, queries ...string) error {
+	storeNames := make([]string, 0)
+
+	queryStoresStr := `SELECT store_name FROM vector_collections WHERE id IN (` + collectionsQuery + `)
+		UNION SELECT target_store_name FROM reembed_jobs WHERE collection_id IN (` + collectionsQuery + `) AND status IN ($2, $3)`
+
+	err := dbManager.DB.Select(&storeNames, queryStoresStr, id, ingestion.StatusPending, ingestion.StatusRunning)
+	if err != nil {
+		return err
+	}
+
+	for _, storeName := range storeNames {
+		err := vectorStore.DeleteCollection(ctx, storeName)
+		if err != nil && !errors.Is(err, vectorstore.ErrCollectionNotFound) {
+			return err
+		}
+	}
+
+	collectionIDs := make([]int64, 0)
+
+	err = dbManager.DB.Select(&collectionIDs, collectionsQuery, id)
+	if err != nil {
+		return err
+	}
+
+	for _, collectionID := range collectionIDs {
+		if err := queue.Keywords.DeleteCollection(ctx, collectionID); err != nil {
+			return err
+		}
+	}
+
+	fileNames := make([]string, 0)
+
+	err = dbManager.DB.Select(&fileNames, "SELECT file_name FROM documents WHERE collection_id IN ("+collectionsQuery+")", id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbManager.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Sessions keep searching the collections they have left, the first of
+	// them becoming their primary collection; sessions left with none go.
+	orphanedSessions := "SELECT session_id FROM chat_session_collections WHERE collection_id IN (" + collectionsQuery + ") AND session_id NOT IN (SELECT session_id FROM chat_session_collections WHERE collection_id NOT IN (" + collectionsQuery + "))"
+
+	collectionQueries := []string{
+		"DELETE FROM session_messages WHERE session_id IN (" + orphanedSessions + ")",
+		"DELETE FROM chat_sessions WHERE session_id IN (" + orphanedSessions + ")",
+		"DELETE FROM chat_session_collections WHERE collection_id IN (" + collectionsQuery + ")",
+		"UPDATE chat_sessions SET collection_id=(SELECT collection_id FROM chat_session_collections WHERE chat_session_collections.session_id=chat_sessions.session_id ORDER BY position LIMIT 1), date_modified=datetime('now') WHERE collection_id IN (" + collectionsQuery + ")",
+		"DELETE FROM prompt_templates WHERE collection_id IN (" + collectionsQuery + ")",
+		"DELETE FROM ingestion_jobs WHERE collection_id IN (" + collectionsQuery + ")",
+		"DELETE FROM reembed_jobs WHERE collection_id IN (" + collectionsQuery + ")",
+		"DELETE FROM documents WHERE collection_id IN (" + collectionsQuery + ")",
+		"DELETE FROM collection_grants WHERE collection_id IN (" + collectionsQuery + ")",
+		"DELETE FROM vector_collections WHERE id IN (" + collectionsQuery + ")",
+	}
+
+	for _, query := range append(collectionQueries, queries...) {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, fileName := range fileNames {
+		err := os.Remove(queue.UploadFolder + fileName)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete uploaded file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// ReembedVectorCollection starts copying a collection into a new store
+// collection embedded with another model, swapping it in once complete.
+func (ragController *RagController) ReembedVectorCollection(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, r.PathValue("collectionHash"), CollectionOwner)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	postMap, err := ragController.parseRequestBody(r, w)
+	if err != nil {
+		return
+	}
+
+	provider, _ := postMap["embedding_provider"].(string)
+	model, ok := postMap["embedding_model"].(string)
+	if !ok || model == "" {
+		http.Error(w, "embedding_model is required and must be a string", http.StatusBadRequest)
+		return
+	}
+
+	provider, model, err = ragController.Providers.ResolveEmbedding(provider, model)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	active, err := ragController.IngestionQueue.HasActiveReembed(vectorCollection.ID)
+	if err != nil {
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+		return
+	}
+
+	if active {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "7", "message": "The collection is already being re-embedded"})
+		return
+	}
+
+	dimension, err := ragController.Providers.Dimension(r.Context(), provider, model)
+	if err != nil {
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "10", "message": "Unable to use the embedding model " + model})
+		return
+	}
+
+	jobID, err := ragController.IngestionQueue.EnqueueReembed(userID, vectorCollection.ID, provider, model, dimension)
+	if err != nil {
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{"job_id": jobID, "embedding_provider": provider, "embedding_model": model, "embedding_dimension": dimension}})
+}
+
+func (ragController *RagController) GetReembedStatus(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
+
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, r.PathValue("collectionHash"), CollectionViewer)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	job, err := ragController.IngestionQueue.LatestReembedJob(vectorCollection.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "4", "message": "Not Found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": job})
+}
+
+// ListCollectionGrants lists the users a collection is shared with.
+func (ragController *RagController) ListCollectionGrants(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
+
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, r.PathValue("collectionHash"), CollectionOwner)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	queryStr := "SELECT collection_grants.user_id, user.email, collection_grants.permission, collection_grants.granted_by, collection_grants.date_created FROM collection_grants JOIN user ON user.id=collection_grants.user_id WHERE collection_grants.collection_id=$1 ORDER BY user.email"
+
+	grants := make([]models.CollectionGrant, 0)
+
+	err = ragController.DBManager.DB.Select(&grants, queryStr, vectorCollection.ID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": grants})
+}
+
+// GrantCollectionAccess shares a collection with the user whose "email" is
+// posted, as "viewer", "editor" or "owner". An existing grant is replaced.
+func (ragController *RagController) GrantCollectionAccess(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, r.PathValue("collectionHash"), CollectionOwner)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	postMap, err := ragController.parseRequestBody(r, w)
+	if err != nil {
+		return
+	}
+
+	email, _ := postMap["email"].(string)
+	permission, _ := postMap["permission"].(string)
+
+	access, ok := ParseCollectionAccess(permission)
+	if email == "" || !ok {
+		w.WriteHeader(http.StatusBadRequest)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": "email and a permission of viewer, editor or owner are required"})
+		return
+	}
+
+	var granteeID int64
+
+	err = ragController.DBManager.DB.Get(&granteeID, "SELECT id FROM user WHERE email=$1", email)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAuthError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	queryStr := `INSERT INTO collection_grants(collection_id, user_id, permission, granted_by, date_created, date_modified) VALUES($1, $2, $3, $4, datetime('now'), datetime('now'))
+		ON CONFLICT(collection_id, user_id) DO UPDATE SET permission=excluded.permission, granted_by=excluded.granted_by, date_modified=excluded.date_modified`
+
+	_, err = ragController.DBManager.DB.Exec(queryStr, vectorCollection.ID, granteeID, access.String(), userID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{"user_id": granteeID, "permission": access.String()}})
+}
+
+// RevokeCollectionAccess removes the grant of the user named by {userID}.
+// Access through an organization is not affected.
+func (ragController *RagController) RevokeCollectionAccess(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
+
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, r.PathValue("collectionHash"), CollectionOwner)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	result, err := ragController.DBManager.DB.Exec("DELETE FROM collection_grants WHERE collection_id=$1 AND user_id=$2", vectorCollection.ID, r.PathValue("userID"))
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		writeAuthError(w, ErrNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": "Successfully deleted"})
+}
+
 func (ragController *RagController) UploadPDFDocument(w http.ResponseWriter, r *http.Request) {
+	ragController.uploadDocument(w, r, true)
+}
+
+// UploadDocument accepts every format known to the loader registry.
+func (ragController *RagController) UploadDocument(w http.ResponseWriter, r *http.Request) {
+	ragController.uploadDocument(w, r, false)
+}
+
+func (ragController *RagController) uploadDocument(w http.ResponseWriter, r *http.Request, pdfOnly bool) {
 	ragController.setJSONHeaders(w)
 
-	userID, err := ragController.authenticateRequest(r, w)
+	userID, err := currentUserID(r, w)
 	if err != nil {
 		return
 	}
@@ -193,7 +588,7 @@ func (ragController *RagController) UploadPDFDocument(w http.ResponseWriter, r *
 		return
 	}
 
-	file, _, err := r.FormFile("file")
+	file, header, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, "Unable to retrieve the file from the request", http.StatusBadRequest)
 		return
@@ -201,18 +596,23 @@ func (ragController *RagController) UploadPDFDocument(w http.ResponseWriter, r *
 	defer file.Close()
 
 	fileHeader := make([]byte, 512)
-	_, err = file.Read(fileHeader)
+	n, err := file.Read(fileHeader)
 	if err != nil {
 		http.Error(w, "Unable to read file header", http.StatusInternalServerError)
 		return
 	}
 
-	fileType := http.DetectContentType(fileHeader)
-	if fileType != "application/pdf" {
+	fileType := http.DetectContentType(fileHeader[:n])
+	if pdfOnly && fileType != "application/pdf" {
 		http.Error(w, "The uploaded file is not a valid PDF", http.StatusBadRequest)
 		return
 	}
 
+	if _, ok := ragController.Loaders.Lookup(header.Filename, fileType); !ok {
+		http.Error(w, "The uploaded file type is not supported", http.StatusBadRequest)
+		return
+	}
+
 	// Reset file pointer to the beginning
 	_, err = file.Seek(0, io.SeekStart)
 	if err != nil {
@@ -224,7 +624,7 @@ func (ragController *RagController) UploadPDFDocument(w http.ResponseWriter, r *
 
 	fileName := ""
 
-	file, header, err := r.FormFile("file")
+	file, header, err = r.FormFile("file")
 	if err != nil {
 		isFileUploadedError = true
 	}
@@ -236,18 +636,9 @@ func (ragController *RagController) UploadPDFDocument(w http.ResponseWriter, r *
 
 	collectionHash := r.FormValue("collectionHash")
 
-	queryStr := "SELECT * FROM vector_collections WHERE user_id=$1 AND collection_hash=$2"
-
-	vectorCollection := models.VectorCollection{}
-
-	err = ragController.DBManager.DB.Get(&vectorCollection, queryStr, userID, collectionHash)
-
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, collectionHash, CollectionEditor)
 	if err != nil {
-		log.Println(err.Error())
-
-		w.WriteHeader(http.StatusNotFound)
-
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
+		writeAuthError(w, err)
 		return
 	}
 	collectionId := vectorCollection.ID
@@ -267,7 +658,7 @@ func (ragController *RagController) UploadPDFDocument(w http.ResponseWriter, r *
 
 		fileName = fileNameHASH + "$" + fileName
 
-		out, err := os.Create(os.Getenv("UPLOAD_FOLDER") + fileName)
+		out, err := os.Create(ragController.IngestionQueue.UploadFolder + fileName)
 
 		if err != nil {
 			fmt.Fprintf(w, "Unable to create a file for writting. Check your write access privilege")
@@ -279,135 +670,216 @@ func (ragController *RagController) UploadPDFDocument(w http.ResponseWriter, r *
 		_, err = io.Copy(out, file)
 
 		if err != nil {
-			fmt.Fprintln(w, err)
+			http.Error(w, "Unable to store the uploaded file", http.StatusInternalServerError)
+			return
 		}
 	}
 
-	queryDocumentStr := "INSERT INTO documents(user_id, collection_id, file_name, is_indexed, date_created, date_modified) VALUES($1, $2, $3, false, datetime('now'), datetime('now'))"
+	queryDocumentStr := "INSERT INTO documents(user_id, collection_id, file_name, content_type, is_indexed, date_created, date_modified) VALUES($1, $2, $3, $4, false, datetime('now'), datetime('now'))"
 
-	_, err = ragController.DBManager.DB.Exec(queryDocumentStr, userID, collectionId, fileName)
+	result, err := ragController.DBManager.DB.Exec(queryDocumentStr, userID, collectionId, fileName, fileType)
 
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	go func() {
-		doc, err := fitz.New(os.Getenv("UPLOAD_FOLDER") + fileName)
-		if err != nil {
-			log.Printf("Failed to open PDF file: %v", err)
-			return
-		}
+	documentID, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
-		defer doc.Close()
+	jobID, err := ragController.IngestionQueue.Enqueue(userID, documentID, collectionId)
 
-		reqCharacterSplitter := textsplitter.NewRecursiveCharacter()
-		reqCharacterSplitter.ChunkSize = 1000
-		reqCharacterSplitter.ChunkOverlap = 200
-		reqCharacterSplitter.LenFunc = func(s string) int { return len(s) }
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
-		pagesList := make([]schema.Document, 0)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
 
-		for idx := range doc.NumPage() {
-			text, _ := doc.Text(idx)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]int64{"document_id": documentID, "job_id": jobID}})
+}
 
-			text = strings.ReplaceAll(text, "\n", " ")
-			text = strings.ToLower(text)
+func (ragController *RagController) ListPDFDocuments(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
 
-			newDoc := schema.Document{PageContent: text}
-			pagesList = append(pagesList, newDoc)
-		}
+	principal, err := currentPrincipal(r, w)
+	if err != nil {
+		return
+	}
 
-		chunksDocList, _ := textsplitter.SplitDocuments(reqCharacterSplitter, pagesList)
+	queryStr := "SELECT documents.* FROM documents JOIN (" + collectionLevelsSQL + ") access ON access.collection_id=documents.collection_id WHERE ($2=0 OR documents.collection_id=$2) ORDER BY documents.date_created DESC"
 
-		qdrantURL := os.Getenv("QDRANT_URL")
+	documents := make([]models.Document, 0)
 
-		ctx := context.Background()
+	err = ragController.DBManager.DB.Select(&documents, queryStr, principal.UserID, principal.CollectionID)
 
-		urlAPI, err := url.Parse(qdrantURL)
+	if err != nil {
+		log.Println(err.Error())
 
-		if err != nil {
-			log.Fatal(err)
-		}
+		w.WriteHeader(http.StatusNotFound)
 
-		llm, err := openai.New(ragController.OpenAIOptions...)
-		if err != nil {
-			log.Fatal(err)
-		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
+		return
+	}
 
-		e, err := embeddings.NewEmbedder(llm)
-		if err != nil {
-			log.Fatal(err)
-		}
+	w.WriteHeader(http.StatusOK)
 
-		store, err := qdrant.New(
-			qdrant.WithURL(*urlAPI),
-			qdrant.WithCollectionName(collectionHash),
-			qdrant.WithEmbedder(e),
-		)
-		if err != nil {
-			log.Fatal(err)
-		}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": documents})
+}
 
-		_, err = store.AddDocuments(ctx, chunksDocList)
-		if err != nil {
-			log.Fatal(err)
-		}
+func (ragController *RagController) GetDocumentIngestionStatus(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
 
-		queryDocumentStr := "UPDATE documents SET is_indexed=true, date_modified=datetime('now') WHERE user_id=$1 AND collection_id=$2 AND file_name=$3;"
+	documentID, err := strconv.ParseInt(r.PathValue("documentID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid document ID", http.StatusBadRequest)
+		return
+	}
 
-		_, err = ragController.DBManager.DB.Exec(queryDocumentStr, userID, collectionId, fileName)
+	job, err := ragController.IngestionQueue.LatestJobForDocument(documentID)
 
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
+	if err != nil {
+		log.Println(err.Error())
 
-		uploadedFilePath := os.Getenv("UPLOAD_FOLDER") + fileName
-		err = os.Remove(uploadedFilePath)
-		if err != nil {
-			log.Printf("Failed to delete uploaded file: %v", err)
-		}
-	}()
+		w.WriteHeader(http.StatusNotFound)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
-	_ = json.NewEncoder(w).Encode(map[string]string{"status": "success", "error_code": "-1"})
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": job})
 }
 
-func (ragController *RagController) ListPDFDocuments(w http.ResponseWriter, r *http.Request) {
+// DeleteDocument removes a document together with its stored file and vectors.
+func (ragController *RagController) DeleteDocument(w http.ResponseWriter, r *http.Request) {
 	ragController.setJSONHeaders(w)
 
-	userID, err := ragController.authenticateRequest(r, w)
+	document, vectorCollection, err := ragController.getDocumentWithCollection(r.PathValue("documentID"))
 	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
 		return
 	}
 
-	queryStr := "SELECT * FROM documents WHERE user_id=$1 ORDER BY date_created DESC"
+	// A re-embed may already have copied the document into its new store,
+	// which would bring it back once swapped in.
+	active, err := ragController.IngestionQueue.HasActiveReembed(vectorCollection.ID)
+	if err != nil {
+		log.Printf("%s", err.Error())
 
-	documents := make([]models.Document, 0)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+		return
+	}
 
-	err = ragController.DBManager.DB.Select(&documents, queryStr, userID)
+	if active {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "7", "message": "The collection is being re-embedded, please delete the document once it is done"})
+		return
+	}
 
+	err = ragController.VectorStore.DeleteByDocument(r.Context(), vectorCollection.StoreName, document.ID)
+	if err == nil || errors.Is(err, vectorstore.ErrCollectionNotFound) {
+		err = ragController.IngestionQueue.Keywords.DeleteDocument(r.Context(), vectorCollection.ID, document.ID)
+	}
 	if err != nil {
-		log.Println(err.Error())
+		log.Printf("%s", err.Error())
 
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+		return
+	}
+
+	_, err = ragController.DBManager.DB.Exec("DELETE FROM documents WHERE id=$1", document.ID)
+	if err != nil {
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		if err := json.NewEncoder(w).Encode(map[string]string{"error": "Something got wrong..."}); err != nil {
+			log.Printf("%s", err)
+		}
+		return
+	}
+
+	if err := ragController.IngestionQueue.DeleteJobsForDocument(document.ID); err != nil {
+		log.Printf("%s", err)
+	}
+
+	err = os.Remove(ragController.IngestionQueue.UploadFolder + document.FileName)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to delete uploaded file: %v", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Successfully deleted"}); err != nil {
+		log.Printf("%s", err)
+	}
+}
+
+// ReindexDocument queues a fresh ingestion of an already uploaded document. The
+// old vectors keep serving chat requests until the new ones replace them.
+func (ragController *RagController) ReindexDocument(w http.ResponseWriter, r *http.Request) {
+	ragController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	document, vectorCollection, err := ragController.getDocumentWithCollection(r.PathValue("documentID"))
+	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 
 		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
 		return
 	}
 
+	active, err := ragController.IngestionQueue.HasActiveJob(document.ID)
+	if err != nil {
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+		return
+	}
+
+	if active {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "7", "message": "The document is already being indexed"})
+		return
+	}
+
+	if _, err := os.Stat(ragController.IngestionQueue.UploadFolder + document.FileName); err != nil {
+		w.WriteHeader(http.StatusGone)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "8", "message": "The original file is no longer available, please upload it again"})
+		return
+	}
+
+	jobID, err := ragController.IngestionQueue.Enqueue(userID, document.ID, vectorCollection.ID)
+	if err != nil {
+		log.Printf("%s", err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "6", "message": "System Error"})
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 
-	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": documents})
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]int64{"document_id": document.ID, "job_id": jobID}})
 }
 
 func (ragController *RagController) SetupPromptTemplateForCollection(w http.ResponseWriter, r *http.Request) {
 	ragController.setJSONHeaders(w)
 
-	userID, err := ragController.authenticateRequest(r, w)
+	userID, err := currentUserID(r, w)
 	if err != nil {
 		return
 	}
@@ -420,18 +892,9 @@ func (ragController *RagController) SetupPromptTemplateForCollection(w http.Resp
 	template := postMap["template"].(string)
 	collectionHash := postMap["collection_hash"].(string)
 
-	queryCollectionStr := "SELECT * FROM vector_collections WHERE user_id=$1 AND collection_hash=$2"
-
-	vectorCollection := models.VectorCollection{}
-
-	err = ragController.DBManager.DB.Get(&vectorCollection, queryCollectionStr, userID, collectionHash)
-
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, collectionHash, CollectionOwner)
 	if err != nil {
-		log.Println(err.Error())
-
-		w.WriteHeader(http.StatusNotFound)
-
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
+		writeAuthError(w, err)
 		return
 	}
 	collectionId := vectorCollection.ID
@@ -461,33 +924,19 @@ func (ragController *RagController) SetupPromptTemplateForCollection(w http.Resp
 func (ragController *RagController) GetPromptTemplateForCollection(w http.ResponseWriter, r *http.Request) {
 	ragController.setJSONHeaders(w)
 
-	userID, err := ragController.authenticateRequest(r, w)
-	if err != nil {
-		return
-	}
-
 	collectionHash := r.PathValue("collectionHash")
 
-	queryCollectionStr := "SELECT * FROM vector_collections WHERE user_id=$1 AND collection_hash=$2"
-
-	vectorCollection := models.VectorCollection{}
-
-	err = ragController.DBManager.DB.Get(&vectorCollection, queryCollectionStr, userID, collectionHash)
-
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, collectionHash, CollectionViewer)
 	if err != nil {
-		log.Println(err.Error())
-
-		w.WriteHeader(http.StatusNotFound)
-
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
+		writeAuthError(w, err)
 		return
 	}
 
-	queryStr := "SELECT * FROM prompt_templates WHERE user_id=$1 AND collection_id=$2"
+	queryStr := "SELECT * FROM prompt_templates WHERE collection_id=$1"
 
 	promptTemplate := models.PromptTemplate{}
 
-	err = ragController.DBManager.DB.Get(&promptTemplate, queryStr, userID, vectorCollection.ID)
+	err = ragController.DBManager.DB.Get(&promptTemplate, queryStr, vectorCollection.ID)
 
 	if err != nil {
 		log.Println(err.Error())
@@ -506,11 +955,6 @@ func (ragController *RagController) GetPromptTemplateForCollection(w http.Respon
 func (ragController *RagController) UpdatePromptTemplateForCollection(w http.ResponseWriter, r *http.Request) {
 	ragController.setJSONHeaders(w)
 
-	userID, err := ragController.authenticateRequest(r, w)
-	if err != nil {
-		return
-	}
-
 	postMap, err := ragController.parseRequestBody(r, w)
 	if err != nil {
 		return
@@ -519,25 +963,16 @@ func (ragController *RagController) UpdatePromptTemplateForCollection(w http.Res
 	template := postMap["template"].(string)
 	collectionHash := postMap["collection_hash"].(string)
 
-	queryStr := "SELECT * FROM vector_collections WHERE user_id=$1 AND collection_hash=$2"
-
-	vectorCollection := models.VectorCollection{}
-
-	err = ragController.DBManager.DB.Get(&vectorCollection, queryStr, userID, collectionHash)
-
+	vectorCollection, err := ragController.GetVectorCollectionByHash(r, collectionHash, CollectionOwner)
 	if err != nil {
-		log.Println(err.Error())
-
-		w.WriteHeader(http.StatusNotFound)
-
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "3", "message": "Not Found"})
+		writeAuthError(w, err)
 		return
 	}
 	collectionId := vectorCollection.ID
 
-	queryUpdatePromptStr := "UPDATE prompt_templates SET template=$1, date_modified=NOW() WHERE user_id=$2 AND collection_id=$3;"
+	queryUpdatePromptStr := "UPDATE prompt_templates SET template=$1, date_modified=datetime('now') WHERE collection_id=$2;"
 
-	_, err = ragController.DBManager.DB.Exec(queryUpdatePromptStr, template, userID, collectionId)
+	_, err = ragController.DBManager.DB.Exec(queryUpdatePromptStr, template, collectionId)
 
 	if err != nil {
 		log.Printf("%s", err.Error())
@@ -560,16 +995,11 @@ func (ragController *RagController) UpdatePromptTemplateForCollection(w http.Res
 func (ragController *RagController) DeletePromptTemplateForCollection(w http.ResponseWriter, r *http.Request) {
 	ragController.setJSONHeaders(w)
 
-	userID, err := ragController.authenticateRequest(r, w)
-	if err != nil {
-		return
-	}
-
 	promptTemplateID := r.PathValue("promptTemplateID")
 
-	queryStr := "DELETE FROM prompt_templates WHERE id=$1 AND user_id=$2"
+	queryStr := "DELETE FROM prompt_templates WHERE id=$1"
 
-	_, err = ragController.DBManager.DB.Exec(queryStr, promptTemplateID, userID)
+	_, err := ragController.DBManager.DB.Exec(queryStr, promptTemplateID)
 
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json; charset=UTF8")
@@ -587,20 +1017,44 @@ func (ragController *RagController) DeletePromptTemplateForCollection(w http.Res
 	}
 }
 
-func (ragController *RagController) GetVectorCollectionByHash(userID int64, collectionHash string) (interface{}, error) {
-	queryStr := "SELECT * FROM vector_collections WHERE user_id=$1 AND collection_hash=$2"
+// GetVectorCollectionByHash loads a collection the caller of r has at least
+// access to. It returns ErrNotFound or ErrForbidden otherwise.
+func (ragController *RagController) GetVectorCollectionByHash(r *http.Request, collectionHash string, access CollectionAccess) (*models.VectorCollection, error) {
+	principal, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		return nil, ErrUnauthorized
+	}
 
-	vectorCollection := models.VectorCollection{}
+	return ragController.AuthController.FindCollection(principal, collectionHash, access)
+}
 
-	err := ragController.DBManager.DB.Get(&vectorCollection, queryStr, userID, collectionHash)
+// getDocumentWithCollection loads a document and its collection. Access is
+// checked by RequireCollection on the route.
+func (ragController *RagController) getDocumentWithCollection(documentIDParam string) (*models.Document, *models.VectorCollection, error) {
+	documentID, err := strconv.ParseInt(documentIDParam, 10, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	document := models.Document{}
 
+	err = ragController.DBManager.DB.Get(&document, "SELECT * FROM documents WHERE id=$1", documentID)
 	if err != nil {
 		log.Println(err.Error())
 
-		return nil, err
+		return nil, nil, err
 	}
 
-	return vectorCollection, nil
+	vectorCollection := models.VectorCollection{}
+
+	err = ragController.DBManager.DB.Get(&vectorCollection, "SELECT * FROM vector_collections WHERE id=$1", document.CollectionID)
+	if err != nil {
+		log.Println(err.Error())
+
+		return nil, nil, err
+	}
+
+	return &document, &vectorCollection, nil
 }
 
 func (ragController *RagController) setJSONHeaders(w http.ResponseWriter) {
@@ -609,21 +1063,6 @@ func (ragController *RagController) setJSONHeaders(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 }
 
-func (ragController *RagController) authenticateRequest(r *http.Request, w http.ResponseWriter) (int64, error) {
-	metaData, err := ragController.AuthController.ExtractTokenMetadata(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return -1, err
-	}
-	userID, err := ragController.AuthController.FetchAuth(metaData)
-	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "1", "message": "Forbidden access"})
-		return -1, err
-	}
-	return userID, nil
-}
-
 func (ragController *RagController) parseRequestBody(r *http.Request, w http.ResponseWriter) (map[string]interface{}, error) {
 	body, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/zarkopopovski/rag-chat/clientinfo"
+	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/models"
+)
+
+// activeSessionSQL limits a query on sessions to the ones that can still be
+// refreshed.
+const activeSessionSQL = "ended_at IS NULL AND expires_at > datetime('now')"
+
+// SessionController lets users see where they are signed in and sign out
+// other devices. The routes only accept JWTs.
+type SessionController struct {
+	DBManager      *db.DBManager
+	AuthController *AuthController
+}
+
+// ListSessions returns the caller's active sessions, most recently used
+// first. The session of the calling token is marked as current.
+func (sessionController *SessionController) ListSessions(w http.ResponseWriter, r *http.Request) {
+	sessionController.setJSONHeaders(w)
+
+	principal, err := currentPrincipal(r, w)
+	if err != nil {
+		return
+	}
+
+	sessions := make([]models.Session, 0)
+
+	queryStr := `SELECT id, ip_address, user_agent, browser, os, device, country, country_code, city, expires_at, last_seen_at, date_created, id=$1 AS current
+		FROM sessions WHERE user_id=$2 AND ` + activeSessionSQL + ` ORDER BY last_seen_at DESC, id DESC`
+
+	err = sessionController.DBManager.DB.Select(&sessions, queryStr, principal.SessionID, principal.UserID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": sessions})
+}
+
+// RevokeSession signs the caller out of the session named by {sessionID}.
+func (sessionController *SessionController) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionController.setJSONHeaders(w)
+
+	principal, err := currentPrincipal(r, w)
+	if err != nil {
+		return
+	}
+
+	var sessionID int64
+
+	err = sessionController.DBManager.DB.Get(&sessionID, "SELECT id FROM sessions WHERE id=$1 AND user_id=$2 AND "+activeSessionSQL, r.PathValue("sessionID"), principal.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAuthError(w, ErrNotFound)
+		return
+	}
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	err = sessionController.AuthController.EndSession(principal.UserID, sessionID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": "Successfully revoked"})
+}
+
+// RevokeOtherSessions signs the caller out everywhere except in the session
+// of the calling token.
+func (sessionController *SessionController) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	sessionController.setJSONHeaders(w)
+
+	principal, err := currentPrincipal(r, w)
+	if err != nil {
+		return
+	}
+
+	tx, err := sessionController.DBManager.DB.Beginx()
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE sessions SET ended_at=datetime('now') WHERE user_id=$1 AND id<>$2 AND ended_at IS NULL", principal.UserID, principal.SessionID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM tokens WHERE user_id=$1 AND session_id<>$2", principal.UserID, principal.SessionID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	revoked, _ := result.RowsAffected()
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]int64{"revoked": revoked}})
+}
+
+func (sessionController *SessionController) setJSONHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+}
+
+// startSession records a login from r that can be refreshed until
+// expiresAt, a Unix time, and alerts the user when LoginAlerts is set and it
+// comes from a new country or device.
+func (aController *AuthController) startSession(r *http.Request, user *models.User, expiresAt int64) (int64, error) {
+	clients := aController.Clients
+	if clients == nil {
+		clients = &clientinfo.Resolver{}
+	}
+
+	client := clients.Describe(r)
+
+	var history struct {
+		Sessions    int `db:"sessions"`
+		SameCountry int `db:"same_country"`
+		SameDevice  int `db:"same_device"`
+	}
+
+	if aController.LoginAlerts {
+		// SQLite numbers the parameters in the order they appear, so the
+		// user's sessions are picked before they are compared.
+		queryStr := `WITH history AS (SELECT country_code, browser, os, device FROM sessions WHERE user_id=$1)
+			SELECT COUNT(*) AS sessions, COALESCE(SUM(country_code=$2), 0) AS same_country, COALESCE(SUM(browser=$3 AND os=$4 AND device=$5), 0) AS same_device
+			FROM history`
+
+		err := aController.DBManager.DB.Get(&history, queryStr, user.Id, client.CountryCode, client.Browser, client.OS, client.Device)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	queryStr := `INSERT INTO sessions(user_id, ip_address, user_agent, browser, os, device, country, country_code, city, expires_at, last_seen_at, date_created)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, datetime($10, 'unixepoch'), datetime('now'), datetime('now'))`
+
+	result, err := aController.DBManager.DB.Exec(queryStr, user.Id, client.IPAddress, client.UserAgent, client.Browser, client.OS, client.Device, client.Country, client.CountryCode, client.City, expiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	sessionID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	newCountry := client.CountryCode != "" && history.SameCountry == 0
+	newDevice := history.SameDevice == 0
+
+	if aController.LoginAlerts && history.Sessions > 0 && (newCountry || newDevice) {
+		sendLoginAlert(user.Email, client)
+	}
+
+	return sessionID, nil
+}
+
+// renewSession extends a session to the expiry of its refreshed tokens.
+func (aController *AuthController) renewSession(sessionID int64, expiresAt int64) error {
+	if sessionID == 0 {
+		return nil
+	}
+
+	_, err := aController.DBManager.DB.Exec("UPDATE sessions SET expires_at=datetime($1, 'unixepoch'), last_seen_at=datetime('now') WHERE id=$2", expiresAt, sessionID)
+
+	return err
+}
+
+// touchSession notes that a session is in use. It writes at most once a
+// minute per session so that every request does not cost a write.
+func (aController *AuthController) touchSession(sessionID int64) {
+	if sessionID == 0 {
+		return
+	}
+
+	_, err := aController.DBManager.DB.Exec("UPDATE sessions SET last_seen_at=datetime('now') WHERE id=$1 AND last_seen_at < datetime('now', '-1 minute')", sessionID)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+}
+
+// EndSession signs a user out of one session by deleting its tokens.
+func (aController *AuthController) EndSession(userID int64, sessionID int64) error {
+	if sessionID == 0 {
+		return nil
+	}
+
+	tx, err := aController.DBManager.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE sessions SET ended_at=datetime('now') WHERE id=$1 AND user_id=$2 AND ended_at IS NULL", sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM tokens WHERE session_id=$1 AND user_id=$2", sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func sendLoginAlert(to string, client clientinfo.Client) {
+	location := strings.Trim(client.City+", "+client.Country, ", ")
+	if location == "" {
+		location = "an unknown location"
+	}
+
+	device := strings.TrimSpace(client.Browser + " on " + client.OS)
+	if client.Browser == "" && client.OS == "" {
+		device = "an unknown device"
+	}
+
+	sendSystemMail(to, `
+		<p>Your account was just signed in to from a new location or device:</p>
+		<p>`+html.EscapeString(device)+` (`+html.EscapeString(client.Device)+`), `+html.EscapeString(location)+`, IP address `+html.EscapeString(client.IPAddress)+`</p>
+		<p>If this was not you, please change your password and sign out of your other sessions.</p>
+	`)
+}
@@ -0,0 +1,562 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/totp"
+)
+
+const (
+	// loginChallengeLifetime is how long the second login step may take, as
+	// an SQLite datetime modifier and in seconds.
+	loginChallengeLifetime        = "-5 minutes"
+	loginChallengeLifetimeSeconds = 300
+
+	// maxLoginChallengeAttempts bounds the codes tried per challenge, so a
+	// stolen password alone cannot be used to guess the code.
+	maxLoginChallengeAttempts = 5
+
+	recoveryCodeCount = 10
+)
+
+// DefaultTOTPIssuer names rag-chat in authenticator apps unless TOTP_ISSUER
+// is set.
+const DefaultTOTPIssuer = "Rag Chat"
+
+// SettingRequireAdminTwoFactor names the setting that withholds the ADMIN
+// role from administrators without two-factor authentication.
+const SettingRequireAdminTwoFactor = "require_admin_2fa"
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorController manages TOTP two-factor authentication and completes
+// logins that need a second step.
+type TwoFactorController struct {
+	DBManager      *db.DBManager
+	AuthController *AuthController
+
+	// Issuer names rag-chat in authenticator apps.
+	Issuer string
+}
+
+// GetTwoFactorStatus tells whether two-factor authentication is enabled for
+// the caller, how many recovery codes are left and whether it is required.
+func (twoFactorController *TwoFactorController) GetTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	twoFactorController.setJSONHeaders(w)
+
+	principal, err := currentPrincipal(r, w)
+	if err != nil {
+		return
+	}
+
+	user, err := twoFactorController.getUser(principal.UserID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	var recoveryCodesLeft int
+
+	err = twoFactorController.DBManager.DB.Get(&recoveryCodesLeft, "SELECT COUNT(*) FROM user_recovery_codes WHERE user_id=$1 AND used=0", user.Id)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{
+		"enabled":             user.TOTPEnabled,
+		"recovery_codes_left": recoveryCodesLeft,
+		"required":            principal.twoFactorMissing,
+	}})
+}
+
+// EnrollTwoFactor generates a new TOTP secret for the caller. It only takes
+// effect once ConfirmTwoFactor receives a code generated with it.
+func (twoFactorController *TwoFactorController) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	twoFactorController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	user, err := twoFactorController.getUser(userID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if user.TOTPEnabled {
+		twoFactorController.writeEnabledError(w, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	_, err = twoFactorController.DBManager.DB.Exec("UPDATE user SET totp_secret=$1, totp_last_step=0, date_modified=datetime('now') WHERE id=$2", secret, user.Id)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	// The otpauth URI is the payload of the QR code shown to the user.
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(twoFactorController.Issuer, user.Email, secret),
+	}})
+}
+
+// ConfirmTwoFactor enables two-factor authentication once "code" proves the
+// authenticator app holds the enrolled secret, and returns the recovery
+// codes. They are only shown this once.
+func (twoFactorController *TwoFactorController) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	twoFactorController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	body, ok := twoFactorController.parseCodeBody(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := twoFactorController.getUser(userID)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if user.TOTPEnabled {
+		twoFactorController.writeEnabledError(w, "Two-factor authentication is already enabled")
+		return
+	}
+
+	if user.TOTPSecret == "" {
+		twoFactorController.writeEnabledError(w, "Start the enrolment first")
+		return
+	}
+
+	step, valid := totp.Validate(user.TOTPSecret, body.Code, time.Now())
+	if !valid {
+		twoFactorController.writeValidationError(w, "The code is not valid")
+		return
+	}
+
+	tx, err := twoFactorController.DBManager.DB.Beginx()
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE user SET totp_enabled=1, totp_last_step=$1, date_modified=datetime('now') WHERE id=$2", step, user.Id)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	recoveryCodes, err := replaceRecoveryCodes(tx, user.Id)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{"recovery_codes": recoveryCodes}})
+}
+
+// DisableTwoFactor turns two-factor authentication off after a valid "code"
+// or "recovery_code".
+func (twoFactorController *TwoFactorController) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	twoFactorController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	body, ok := twoFactorController.parseCodeBody(w, r)
+	if !ok {
+		return
+	}
+
+	user, ok := twoFactorController.verifyEnabledUser(w, userID, body.Code, body.RecoveryCode)
+	if !ok {
+		return
+	}
+
+	if err := resetTwoFactor(twoFactorController.DBManager, user.Id); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "success", "error_code": "-1"})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after a valid "code".
+func (twoFactorController *TwoFactorController) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	twoFactorController.setJSONHeaders(w)
+
+	userID, err := currentUserID(r, w)
+	if err != nil {
+		return
+	}
+
+	body, ok := twoFactorController.parseCodeBody(w, r)
+	if !ok {
+		return
+	}
+
+	user, ok := twoFactorController.verifyEnabledUser(w, userID, body.Code, "")
+	if !ok {
+		return
+	}
+
+	tx, err := twoFactorController.DBManager.DB.Beginx()
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	recoveryCodes, err := replaceRecoveryCodes(tx, user.Id)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "error_code": "-1", "data": map[string]interface{}{"recovery_codes": recoveryCodes}})
+}
+
+// CompleteLogin is the second login step. It exchanges the "challenge_token"
+// returned by the first step and a valid "code" or "recovery_code" for the
+// token pair.
+func (twoFactorController *TwoFactorController) CompleteLogin(w http.ResponseWriter, r *http.Request) {
+	twoFactorController.setJSONHeaders(w)
+
+	body, ok := twoFactorController.parseCodeBody(w, r)
+	if !ok {
+		return
+	}
+
+	challengeHash := hashToken(body.ChallengeToken)
+
+	// Count the attempt before checking the code, so that parallel
+	// requests cannot exceed the limit.
+	result, err := twoFactorController.DBManager.DB.Exec("UPDATE login_challenges SET attempts=attempts+1 WHERE token_hash=$1 AND attempts < $2 AND date_created >= datetime('now', $3)", challengeHash, maxLoginChallengeAttempts, loginChallengeLifetime)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "1", "message": "The login has expired, please sign in again"})
+		return
+	}
+
+	var userID int64
+
+	err = twoFactorController.DBManager.DB.Get(&userID, "SELECT user_id FROM login_challenges WHERE token_hash=$1", challengeHash)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	user, err := twoFactorController.getUser(userID)
+	if errors.Is(err, ErrNotFound) {
+		writeAuthError(w, ErrUnauthorized)
+		return
+	}
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if user.Locked {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "1", "message": "The account is locked, please contact an administrator."})
+		return
+	}
+
+	valid, err := verifySecondFactor(twoFactorController.DBManager, user, body.Code, body.RecoveryCode)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "1", "message": "The code is not valid"})
+		return
+	}
+
+	_, err = twoFactorController.DBManager.DB.Exec("DELETE FROM login_challenges WHERE token_hash=$1", challengeHash)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	err = twoFactorController.AuthController.SignIn(r, user)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": user})
+}
+
+// StartLoginChallenge returns the token of a second login step for a user
+// whose password, or single sign-on, has been verified.
+func (aController *AuthController) StartLoginChallenge(userID int64) (string, error) {
+	_, err := aController.DBManager.DB.Exec("DELETE FROM login_challenges WHERE date_created < datetime('now', $1)", loginChallengeLifetime)
+	if err != nil {
+		return "", err
+	}
+
+	challengeToken, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = aController.DBManager.DB.Exec("INSERT INTO login_challenges(token_hash, user_id, attempts, date_created) VALUES($1, $2, 0, datetime('now'))", hashToken(challengeToken), userID)
+	if err != nil {
+		return "", err
+	}
+
+	return challengeToken, nil
+}
+
+// writeLoginChallenge answers the first login step of a user with two-factor
+// authentication. The tokens follow from CompleteLogin.
+func writeLoginChallenge(w http.ResponseWriter, challengeToken string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+		"two_factor_required": true,
+		"challenge_token":     challengeToken,
+		"expires_in":          loginChallengeLifetimeSeconds,
+	}})
+}
+
+// verifySecondFactor accepts a TOTP code of a step newer than the last one
+// used, or consumes an unused recovery code.
+func verifySecondFactor(dbManager *db.DBManager, user *models.User, code string, recoveryCode string) (bool, error) {
+	if !user.TOTPEnabled {
+		return false, nil
+	}
+
+	if code != "" {
+		step, valid := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !valid {
+			return false, nil
+		}
+
+		result, err := dbManager.DB.Exec("UPDATE user SET totp_last_step=$1 WHERE id=$2 AND totp_last_step < $1", step, user.Id)
+		if err != nil {
+			return false, err
+		}
+
+		affected, err := result.RowsAffected()
+
+		return affected == 1, err
+	}
+
+	if recoveryCode != "" {
+		result, err := dbManager.DB.Exec("UPDATE user_recovery_codes SET used=1 WHERE user_id=$1 AND code_hash=$2 AND used=0", user.Id, hashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return false, err
+		}
+
+		affected, err := result.RowsAffected()
+
+		return affected == 1, err
+	}
+
+	return false, nil
+}
+
+// replaceRecoveryCodes stores new recovery codes for a user, invalidating the
+// previous ones, and returns them.
+func replaceRecoveryCodes(tx *sqlx.Tx, userID int64) ([]string, error) {
+	_, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id=$1", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		code = code[:5] + "-" + code[5:]
+
+		_, err = tx.Exec("INSERT INTO user_recovery_codes(user_id, code_hash, used, date_created) VALUES($1, $2, 0, datetime('now'))", userID, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+
+		recoveryCodes = append(recoveryCodes, code)
+	}
+
+	return recoveryCodes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// resetTwoFactor turns two-factor authentication off and drops the secret
+// and the recovery codes.
+func resetTwoFactor(dbManager *db.DBManager, userID int64) error {
+	tx, err := dbManager.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE user SET totp_secret='', totp_enabled=0, totp_last_step=0, date_modified=datetime('now') WHERE id=$1", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM user_recovery_codes WHERE user_id=$1", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM login_challenges WHERE user_id=$1", userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// verifyEnabledUser loads a user with two-factor authentication enabled and
+// checks their code, writing the error response when that fails.
+func (twoFactorController *TwoFactorController) verifyEnabledUser(w http.ResponseWriter, userID int64, code string, recoveryCode string) (*models.User, bool) {
+	user, err := twoFactorController.getUser(userID)
+	if err != nil {
+		writeAuthError(w, err)
+		return nil, false
+	}
+
+	if !user.TOTPEnabled {
+		twoFactorController.writeEnabledError(w, "Two-factor authentication is not enabled")
+		return nil, false
+	}
+
+	valid, err := verifySecondFactor(twoFactorController.DBManager, user, code, recoveryCode)
+	if err != nil {
+		writeAuthError(w, err)
+		return nil, false
+	}
+
+	if !valid {
+		twoFactorController.writeValidationError(w, "The code is not valid")
+		return nil, false
+	}
+
+	return user, true
+}
+
+type twoFactorCodeBody struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+func (twoFactorController *TwoFactorController) parseCodeBody(w http.ResponseWriter, r *http.Request) (*twoFactorCodeBody, bool) {
+	b, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	body := new(twoFactorCodeBody)
+
+	if err := json.Unmarshal(b, body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return body, true
+}
+
+func (twoFactorController *TwoFactorController) getUser(userID int64) (*models.User, error) {
+	user := new(models.User)
+
+	err := twoFactorController.DBManager.DB.Get(user, "SELECT * FROM user WHERE id=$1", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (twoFactorController *TwoFactorController) writeEnabledError(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusConflict)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "18", "message": message})
+}
+
+func (twoFactorController *TwoFactorController) writeValidationError(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "9", "message": message})
+}
+
+func (twoFactorController *TwoFactorController) setJSONHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+}
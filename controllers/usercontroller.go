@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -13,8 +15,6 @@ import (
 	"encoding/json"
 	"time"
 
-	"math/rand"
-
 	"crypto/tls"
 
 	"gopkg.in/gomail.v2"
@@ -24,11 +24,17 @@ import (
 	// "github.com/google/uuid"
 	"github.com/zarkopopovski/rag-chat/db"
 	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/passwords"
 )
 
+// passwordResetLifetime is how long a reset link stays valid, as an SQLite
+// datetime modifier.
+const passwordResetLifetime = "+1 hour"
+
 type UserController struct {
 	DBManager      *db.DBManager
 	AuthController *AuthController
+	PasswordPolicy passwords.Policy
 }
 
 func (uController *UserController) Index(w http.ResponseWriter, r *http.Request) {
@@ -52,27 +58,24 @@ func (uController *UserController) RegisterNewUser(w http.ResponseWriter, r *htt
 	emailAddress := postMap["email"].(string)
 	password := postMap["password"].(string)
 
-	roles := "USER"
-	//r.ParseForm()
-	if r.PostForm.Has("roles") {
-		roles = "USER:ADMIN"
+	if err := uController.PasswordPolicy.Check(password); err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusBadRequest)
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "11", "message": err.Error()})
+		return
 	}
 
-	mailContact := os.Getenv("MAIL_CONTACT")
+	// Roles are only ever granted by an administrator.
+	roles := RoleUser
 
-	mailPort := os.Getenv("SMTP_PORT")
-	mailServer := os.Getenv("MAIL_SERVER")
-	mailUsername := os.Getenv("MAIL_USERNAME")
-	mailPassword := os.Getenv("MAIL_PASSWORD")
-	hostname := os.Getenv("HOSTNAME")
+	passwordEnc, err := passwords.Hash(password)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
 	sha1Hash := sha1.New()
-	sha1Hash.Write([]byte(password))
-	sha1HashString := sha1Hash.Sum(nil)
-
-	passwordEnc := fmt.Sprintf("%x", sha1HashString)
-
-	sha1Hash = sha1.New()
 	sha1Hash.Write([]byte(time.Now().String() + password + emailAddress))
 	cfgToken := sha1Hash.Sum(nil)
 
@@ -99,28 +102,7 @@ func (uController *UserController) RegisterNewUser(w http.ResponseWriter, r *htt
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
 	if err == nil {
-		go func() {
-			m := gomail.NewMessage()
-
-			m.SetHeader("From", mailContact)
-			m.SetHeader("To", emailAddress)
-			m.SetHeader("Subject", "Popup Message Ads: System notification")
-
-			m.SetBody("text/html", `
-				<p>Thank you for your registration.</p>
-				<p>Please confirm your registration on the following link:</p>
-				<p><a href="`+hostname+`"/confirm-registartion/`+confirmationToken+`>`+hostname+`/confirm-registartion/`+confirmationToken+`<a/></p>
-			`)
-
-			port, _ := strconv.Atoi(mailPort)
-
-			d := gomail.NewDialer(mailServer, port, mailUsername, mailPassword)
-			d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
-			if err := d.DialAndSend(m); err != nil {
-				log.Println(err.Error())
-			}
-		}()
+		uController.sendConfirmationMail(emailAddress, confirmationToken)
 
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
@@ -141,15 +123,18 @@ func (uController *UserController) RegisterNewUser(w http.ResponseWriter, r *htt
 
 func (uController *UserController) RegisterAdminUser(emailAddress string, password string) error {
 
-	roles := "USER:ADMIN"
+	roles := RoleUser + ":" + RoleAdmin
 
-	sha1Hash := sha1.New()
-	sha1Hash.Write([]byte(password))
-	sha1HashString := sha1Hash.Sum(nil)
+	if err := uController.PasswordPolicy.Check(password); err != nil {
+		log.Printf("The admin password does not satisfy the password policy: %s", err.Error())
+	}
 
-	passwordEnc := fmt.Sprintf("%x", sha1HashString)
+	passwordEnc, err := passwords.Hash(password)
+	if err != nil {
+		return err
+	}
 
-	sha1Hash = sha1.New()
+	sha1Hash := sha1.New()
 	sha1Hash.Write([]byte(time.Now().String() + password + emailAddress))
 	cfgToken := sha1Hash.Sum(nil)
 
@@ -159,7 +144,7 @@ func (uController *UserController) RegisterAdminUser(emailAddress string, passwo
 
 	existingUser := new(models.User)
 
-	err := uController.DBManager.DB.Get(existingUser, queryTest, emailAddress)
+	err = uController.DBManager.DB.Get(existingUser, queryTest, emailAddress)
 
 	if err == nil {
 		return nil
@@ -179,13 +164,6 @@ func (uController *UserController) RegisterAdminUser(emailAddress string, passwo
 func (uController *UserController) ConfirmRegistration(w http.ResponseWriter, r *http.Request) {
 	confirmationKey := r.PathValue("confirmationKey")
 
-	mailContact := os.Getenv("MAIL_CONTACT")
-
-	mailPort := os.Getenv("SMTP_PORT")
-	mailServer := os.Getenv("MAIL_SERVER")
-	mailUsername := os.Getenv("MAIL_USERNAME")
-	mailPassword := os.Getenv("MAIL_PASSWORD")
-
 	user := models.User{}
 
 	err := uController.DBManager.DB.Get(&user, "SELECT * FROM user WHERE confirmation_token=$1;", confirmationKey)
@@ -224,30 +202,51 @@ func (uController *UserController) ConfirmRegistration(w http.ResponseWriter, r
 		log.Printf("%s", err)
 	}
 
-	go func() {
-		m := gomail.NewMessage()
+	sendSystemMail(user.Email, `
+		<p>Thank you for your registration confirmation.</p>
+		<p>You can now use your account.</p>
+	`)
+}
 
-		m.SetHeader("From", mailContact)
-		m.SetHeader("To", user.Email)
-		m.SetHeader("Subject", "Popup Message Ads: System notification")
+// RequestPasswordReset mails a single-use link for setting a new password to
+// the owner of "email". The response is the same whether or not the address
+// belongs to an account, so it cannot be used to find out.
+func (uController *UserController) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
-		m.SetBody("text/html", `
-			<p>Thank you for your registration confirmation.</p>
-			<p>You can now use your account.</p>
-		`)
+	var body struct {
+		Email string `json:"email"`
+	}
 
-		port, _ := strconv.Atoi(mailPort)
+	if err := json.Unmarshal(b, &body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
 
-		d := gomail.NewDialer(mailServer, port, mailUsername, mailPassword)
-		d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	user := models.User{}
 
-		if err := d.DialAndSend(m); err != nil {
-			log.Println(err.Error())
-		}
-	}()
+	err = uController.DBManager.DB.Get(&user, "SELECT * FROM user WHERE email=$1;", body.Email)
+	if err == nil {
+		err = uController.SendPasswordResetLink(&user)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("%s", err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF8")
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "success", "error_code": "-1", "message": "If the address belongs to an account, a link to reset the password has been sent to it."})
 }
 
-func (uController *UserController) SendTempPassPerMail(w http.ResponseWriter, r *http.Request) {
+// ConfirmPasswordReset sets the new "password" of the user a reset "token"
+// was sent to, and signs them out everywhere.
+func (uController *UserController) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
 	b, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
@@ -255,71 +254,181 @@ func (uController *UserController) SendTempPassPerMail(w http.ResponseWriter, r
 		return
 	}
 
-	var postMap map[string]interface{}
-
-	json.Unmarshal([]byte(b), &postMap)
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
 
-	emailAddress := postMap["email"].(string)
+	if err := json.Unmarshal(b, &body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
 
-	mailContact := os.Getenv("MAIL_CONTACT")
+	w.Header().Set("Content-Type", "application/json; charset=UTF8")
 
-	mailPort := os.Getenv("SMTP_PORT")
-	mailServer := os.Getenv("MAIL_SERVER")
-	mailUsername := os.Getenv("MAIL_USERNAME")
-	mailPassword := os.Getenv("MAIL_PASSWORD")
+	if err := uController.PasswordPolicy.Check(body.Password); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 
-	user := models.User{}
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "11", "message": err.Error()})
+		return
+	}
 
-	err = uController.DBManager.DB.Get(&user, "SELECT * FROM user WHERE email=$1;", emailAddress)
+	passwordEnc, err := passwords.Hash(body.Password)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
 
+	tx, err := uController.DBManager.DB.Beginx()
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json; charset=UTF8")
-		w.WriteHeader(http.StatusNotFound)
-		if err := json.NewEncoder(w).Encode(map[string]string{"error": "Not existing confirmation token"}); err != nil {
-			log.Printf("%s", err)
-		}
+		writeAuthError(w, err)
 		return
 	}
+	defer tx.Rollback()
+
+	tokenHash := hashToken(body.Token)
 
-	rand.Seed(time.Now().UnixNano())
+	// Spend the token before anything else, so that it works only once.
+	result, err := tx.Exec("UPDATE password_resets SET used=1 WHERE token_hash=$1 AND used=0 AND expires_at > datetime('now')", tokenHash)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
 
-	password := uController.generatePassword(8, true, true)
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		w.WriteHeader(http.StatusBadRequest)
 
-	sha1Hash := sha1.New()
-	sha1Hash.Write([]byte(password))
-	sha1HashString := sha1Hash.Sum(nil)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "19", "message": "The reset link is invalid or has expired"})
+		return
+	}
 
-	passwordEnc := fmt.Sprintf("%x", sha1HashString)
+	var userID int64
 
-	query := "UPDATE user SET password=$1 WHERE id=$2;"
+	err = tx.Get(&userID, "SELECT user_id FROM password_resets WHERE token_hash=$1", tokenHash)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
 
-	_, err = uController.DBManager.DB.Exec(query, passwordEnc, user.Id)
+	// Following the link proves the address, which confirms it too.
+	_, err = tx.Exec("UPDATE user SET password=$1, confirmed=true, date_modified=datetime('now') WHERE id=$2", passwordEnc, userID)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json; charset=UTF8")
-		w.WriteHeader(http.StatusInternalServerError)
-		if err := json.NewEncoder(w).Encode(map[string]string{"error": "Something got wrong..."}); err != nil {
-			log.Printf("%s", err)
+		writeAuthError(w, err)
+		return
+	}
+
+	// Whoever knew the old password is signed out.
+	for _, query := range []string{
+		"DELETE FROM tokens WHERE user_id=$1",
+		"DELETE FROM login_challenges WHERE user_id=$1",
+		"UPDATE sessions SET ended_at=datetime('now') WHERE user_id=$1 AND ended_at IS NULL",
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			writeAuthError(w, err)
+			return
 		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeAuthError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=UTF8")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(map[string]string{"error": "Successfully confirmed"}); err != nil {
-		log.Printf("%s", err)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "success", "error_code": "-1"})
+}
+
+// ResetPassword replaces the password of user with an unusable random one and
+// mails them a link to set a new one.
+func (uController *UserController) ResetPassword(user *models.User) error {
+	password, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	passwordEnc, err := passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = uController.DBManager.DB.Exec("UPDATE user SET password=$1, date_modified=datetime('now') WHERE id=$2", passwordEnc, user.Id)
+	if err != nil {
+		return err
+	}
+
+	return uController.SendPasswordResetLink(user)
+}
+
+// SendPasswordResetLink mails user a link to set a new password, replacing
+// any link sent before. Only a hash of the link's token is stored.
+func (uController *UserController) SendPasswordResetLink(user *models.User) error {
+	resetToken, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	tx, err := uController.DBManager.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM password_resets WHERE user_id=$1", user.Id)
+	if err != nil {
+		return err
 	}
 
+	_, err = tx.Exec("INSERT INTO password_resets(user_id, token_hash, expires_at, used, date_created) VALUES($1, $2, datetime('now', $3), 0, datetime('now'))", user.Id, hashToken(resetToken), passwordResetLifetime)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	link := os.Getenv("HOSTNAME") + "/reset-password/" + resetToken
+
+	sendSystemMail(user.Email, `
+		<p>A new password was requested for your account.</p>
+		<p>Please set it on the following link within an hour:</p>
+		<p><a href="`+link+`">`+link+`</a></p>
+		<p>If you did not ask for it, you can ignore this mail.</p>
+	`)
+
+	return nil
+}
+
+// sendConfirmationMail sends the link that confirms a registration.
+func (uController *UserController) sendConfirmationMail(emailAddress string, confirmationToken string) {
+	hostname := os.Getenv("HOSTNAME")
+
+	sendSystemMail(emailAddress, `
+		<p>Thank you for your registration.</p>
+		<p>Please confirm your registration on the following link:</p>
+		<p><a href="`+hostname+`"/confirm-registartion/`+confirmationToken+`>`+hostname+`/confirm-registartion/`+confirmationToken+`<a/></p>
+	`)
+}
+
+// sendSystemMail sends a notification in the background using the SMTP
+// settings from the environment.
+func sendSystemMail(to string, body string) {
+	mailContact := os.Getenv("MAIL_CONTACT")
+
+	mailPort := os.Getenv("SMTP_PORT")
+	mailServer := os.Getenv("MAIL_SERVER")
+	mailUsername := os.Getenv("MAIL_USERNAME")
+	mailPassword := os.Getenv("MAIL_PASSWORD")
+
 	go func() {
 		m := gomail.NewMessage()
 
 		m.SetHeader("From", mailContact)
-		m.SetHeader("To", user.Email)
+		m.SetHeader("To", to)
 		m.SetHeader("Subject", "Popup Message Ads: System notification")
 
-		m.SetBody("text/html", `
-			<p>Your temporary password is:`+password+`</p>
-			<p>Please change it!!!</p>
-		`)
+		m.SetBody("text/html", body)
 
 		port, _ := strconv.Atoi(mailPort)
 
@@ -333,19 +442,8 @@ func (uController *UserController) SendTempPassPerMail(w http.ResponseWriter, r
 }
 
 func (uController *UserController) ChangePassword(w http.ResponseWriter, r *http.Request) {
-	metaData, err := uController.AuthController.ExtractTokenMetadata(r)
+	userID, err := currentUserID(r, w)
 	if err != nil {
-		fmt.Println(err.Error())
-
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	userID, err := uController.AuthController.FetchAuth(metaData)
-	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-
-		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "1", "message": "Forbidden access"})
 		return
 	}
 
@@ -362,11 +460,19 @@ func (uController *UserController) ChangePassword(w http.ResponseWriter, r *http
 
 	password := postMap["password"].(string)
 
-	sha1Hash := sha1.New()
-	sha1Hash.Write([]byte(password))
-	sha1HashString := sha1Hash.Sum(nil)
+	if err := uController.PasswordPolicy.Check(password); err != nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF8")
+		w.WriteHeader(http.StatusBadRequest)
 
-	passwordEnc := fmt.Sprintf("%x", sha1HashString)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "error", "error_code": "11", "message": err.Error()})
+		return
+	}
+
+	passwordEnc, err := passwords.Hash(password)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
 	query := "UPDATE user SET password=? WHERE id=?;"
 
@@ -391,23 +497,3 @@ func (uController *UserController) ChangePassword(w http.ResponseWriter, r *http
 func (uController *UserController) UpdateUserDetails(w http.ResponseWriter, r *http.Request) {
 	//USER
 }
-
-func (uController *UserController) generatePassword(length int, includeNumber bool, includeSpecial bool) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	var password []byte
-	var charSource string
-
-	if includeNumber {
-		charSource += "0123456789"
-	}
-	if includeSpecial {
-		charSource += "!@#$%^&*()_+=-"
-	}
-	charSource += charset
-
-	for i := 0; i < length; i++ {
-		randNum := rand.Intn(len(charSource))
-		password = append(password, charSource[randNum])
-	}
-	return string(password)
-}
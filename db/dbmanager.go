@@ -14,8 +14,14 @@ type DBManager struct {
 	DB *sqlx.DB
 }
 
-func NewDBConnection(databaseURL string) *DBManager {
-	dbx, err := sqlx.Open("sqlite3", "ragchatbase.db")
+// NewDBConnection opens the SQLite database file at databasePath, falling back
+// to ragchatbase.db, and applies the pending migrations.
+func NewDBConnection(databasePath string) *DBManager {
+	if databasePath == "" {
+		databasePath = "ragchatbase.db"
+	}
+
+	dbx, err := sqlx.Open("sqlite3", databasePath+"?_busy_timeout=5000")
 
 	if err != nil {
 		panic(err)
@@ -29,6 +35,10 @@ func NewDBConnection(databaseURL string) *DBManager {
 	m, err := migrate.NewWithDatabaseInstance(
 		"file://./migrations",
 		"ql", driver)
+	if err != nil {
+		panic(err)
+	}
+
 	m.Up()
 
 	return &DBManager{
@@ -0,0 +1,105 @@
+// Package history fits the conversation of a chat session into the context
+// window of its model. A Budget decides how many of the retrieved chunks and
+// of the earlier turns are sent along with a question, and Summarize folds
+// turns that no longer fit into a rolling summary.
+package history
+
+import (
+	"errors"
+
+	"github.com/tmc/langchaingo/schema"
+
+	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/tokenizer"
+)
+
+// messageOverhead is what chat formats add to every message for its role
+// and delimiters, rounded up.
+const messageOverhead = 4
+
+// ErrTooLong is returned when the system prompt, the question and the answer
+// alone do not fit the context window.
+var ErrTooLong = errors.New("the message does not fit the context window of the model")
+
+// Count returns the tokens a message of text takes up in a conversation.
+func Count(text string) int {
+	return tokenizer.Count(text) + messageOverhead
+}
+
+// Budget splits the context window of a model between the parts of a chat
+// turn. The system prompt, the question and the answer are set aside first.
+// Retrieved chunks may take up to half of the rest, in order of relevance,
+// and the summary and the latest turns fill what is left.
+type Budget struct {
+	ContextWindow int
+	AnswerTokens  int
+}
+
+// Turn is what a chat turn could send to the model.
+type Turn struct {
+	System   string
+	Summary  string
+	History  []models.SessionMessage
+	Question string
+	Chunks   []schema.Document
+
+	// ContextPrefix introduces the chunks in the message that carries them.
+	ContextPrefix string
+}
+
+// Fitted is the part of a Turn that fits the budget.
+type Fitted struct {
+	Summary bool
+	History []models.SessionMessage
+	Chunks  []schema.Document
+
+	// Dropped counts the messages of History that did not fit, the oldest
+	// ones.
+	Dropped int
+}
+
+// Fit keeps the best chunks and the latest messages of turn that fit the
+// budget.
+func (budget Budget) Fit(turn Turn) (Fitted, error) {
+	available := budget.ContextWindow - budget.AnswerTokens - Count(turn.System) - Count(turn.Question) - Count(turn.ContextPrefix)
+	if available < 0 {
+		return Fitted{}, ErrTooLong
+	}
+
+	fitted := Fitted{Chunks: make([]schema.Document, 0, len(turn.Chunks))}
+
+	chunkBudget := available / 2
+	for _, chunk := range turn.Chunks {
+		tokens := tokenizer.Count(chunk.PageContent)
+		if tokens > chunkBudget {
+			break
+		}
+
+		chunkBudget -= tokens
+		available -= tokens
+		fitted.Chunks = append(fitted.Chunks, chunk)
+	}
+
+	if turn.Summary != "" {
+		if tokens := Count(turn.Summary); tokens <= available {
+			available -= tokens
+			fitted.Summary = true
+		}
+	}
+
+	kept := len(turn.History)
+	for kept > 0 {
+		tokens := Count(turn.History[kept-1].Message)
+		if tokens > available {
+			break
+		}
+
+		available -= tokens
+		kept--
+	}
+
+	fitted.History = turn.History[kept:]
+	fitted.Dropped = kept
+
+	return fitted, nil
+}
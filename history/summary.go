@@ -0,0 +1,88 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+
+	"github.com/zarkopopovski/rag-chat/models"
+)
+
+const (
+	// SummaryTokens is the longest summary the model is asked to write.
+	SummaryTokens = 512
+
+	// RecentMessages is how many of the latest messages stay verbatim when
+	// the ones before them are summarized.
+	RecentMessages = 4
+
+	// charsPerToken underestimates the characters of a token, to cut a
+	// message that does not fit a summarizing call on its own.
+	charsPerToken = 3
+)
+
+const summaryInstructions = "Summarize the conversation between a user and an assistant below for the assistant, so it can continue the conversation without it. " +
+	"Keep the questions asked, the facts, names, numbers and codes that came up and anything the user asked to remember. " +
+	"Reply with the summary only, in at most a few paragraphs.\n"
+
+// Summarize folds messages, oldest first, into summary, the summary of the
+// conversation before them, and returns the new summary. The messages are
+// summarized in as many calls as the context window requires.
+func Summarize(ctx context.Context, llm llms.Model, contextWindow int, summary string, messages []models.SessionMessage) (string, error) {
+	for len(messages) > 0 {
+		var prompt strings.Builder
+
+		prompt.WriteString(summaryInstructions)
+		if summary != "" {
+			prompt.WriteString("\nSummary of the conversation so far:\n" + summary + "\n")
+		}
+		prompt.WriteString("\nConversation:\n")
+
+		available := contextWindow - SummaryTokens - Count(prompt.String())
+		taken := 0
+
+		for _, message := range messages {
+			line := speaker(message) + ": " + message.Message + "\n"
+
+			tokens := Count(line) - messageOverhead
+			if tokens > available {
+				if taken > 0 {
+					break
+				}
+
+				// A message that does not fit alone is cut to what does.
+				cut := []rune(line)
+				line = string(cut[:min(len(cut), max(available, 0)*charsPerToken)]) + "\n"
+				tokens = available
+			}
+
+			prompt.WriteString(line)
+			available -= tokens
+			taken++
+		}
+
+		answer, err := llms.GenerateFromSinglePrompt(ctx, llm, prompt.String(), llms.WithTemperature(0), llms.WithMaxTokens(SummaryTokens))
+		if err != nil {
+			return "", err
+		}
+
+		summary = strings.TrimSpace(answer)
+		if summary == "" {
+			return "", errors.New("the model did not summarize the conversation")
+		}
+
+		messages = messages[taken:]
+	}
+
+	return summary, nil
+}
+
+func speaker(message models.SessionMessage) string {
+	if message.MessageRole == "ai" {
+		return "Assistant"
+	}
+
+	return "User"
+}
@@ -0,0 +1,163 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/tmc/langchaingo/textsplitter"
+
+	"github.com/zarkopopovski/rag-chat/models"
+)
+
+const embeddingBatchSize = 32
+
+func (q *Queue) process(ctx context.Context, job *models.IngestionJob) error {
+	document := models.Document{}
+
+	err := q.DBManager.DB.Get(&document, "SELECT * FROM documents WHERE id=$1", job.DocumentID)
+	if err != nil {
+		return permanent(fmt.Errorf("loading document: %w", err))
+	}
+
+	vectorCollection := models.VectorCollection{}
+
+	err = q.DBManager.DB.Get(&vectorCollection, "SELECT * FROM vector_collections WHERE id=$1", document.CollectionID)
+	if err != nil {
+		return permanent(fmt.Errorf("loading collection: %w", err))
+	}
+
+	if err := q.setStage(job.ID, StageParsing, 0); err != nil {
+		return err
+	}
+
+	filePath := q.UploadFolder + document.FileName
+
+	fileName := OriginalFileName(document.FileName)
+
+	loader, ok := q.Loaders.Lookup(fileName, document.ContentType)
+	if !ok {
+		return permanent(fmt.Errorf("no loader for %s (%s)", fileName, document.ContentType))
+	}
+
+	pagesList, err := loader.Load(filePath)
+	if err != nil {
+		return permanent(err)
+	}
+
+	for i := range pagesList {
+		if pagesList[i].Metadata == nil {
+			pagesList[i].Metadata = map[string]any{}
+		}
+		pagesList[i].Metadata["document_id"] = document.ID
+		pagesList[i].Metadata["file_name"] = fileName
+	}
+
+	if err := q.setStage(job.ID, StageChunking, 10); err != nil {
+		return err
+	}
+
+	splitter, err := newTextSplitter(vectorCollection.Settings)
+	if err != nil {
+		return permanent(err)
+	}
+
+	chunksDocList, err := textsplitter.SplitDocuments(splitter, pagesList)
+	if err != nil {
+		return fmt.Errorf("splitting document: %w", err)
+	}
+
+	// Splitting runs on the raw text so paragraph and heading breaks can guide it.
+	for i := range chunksDocList {
+		text := strings.ReplaceAll(chunksDocList[i].PageContent, "\n", " ")
+		chunksDocList[i].PageContent = strings.ToLower(text)
+	}
+
+	if err := q.setStage(job.ID, StageEmbedding, 20); err != nil {
+		return err
+	}
+
+	e, err := q.Providers.Embedder(vectorCollection.EmbeddingProvider, vectorCollection.EmbeddingModel)
+	if err != nil {
+		return permanent(err)
+	}
+
+	vectors := make([][]float32, 0, len(chunksDocList))
+
+	for start := 0; start < len(chunksDocList); start += embeddingBatchSize {
+		end := min(start+embeddingBatchSize, len(chunksDocList))
+
+		texts := make([]string, 0, end-start)
+		for _, chunk := range chunksDocList[start:end] {
+			texts = append(texts, chunk.PageContent)
+		}
+
+		batchVectors, err := e.EmbedDocuments(ctx, texts)
+		if err != nil {
+			return fmt.Errorf("embedding chunks: %w", err)
+		}
+
+		if len(batchVectors) > 0 && len(batchVectors[0]) != vectorCollection.EmbeddingDimension {
+			return permanent(fmt.Errorf("embedding dimension %d does not match collection dimension %d", len(batchVectors[0]), vectorCollection.EmbeddingDimension))
+		}
+		vectors = append(vectors, batchVectors...)
+
+		if err := q.setStage(job.ID, StageEmbedding, 20+60*end/len(chunksDocList)); err != nil {
+			return err
+		}
+	}
+
+	if err := q.setStage(job.ID, StageUpserting, 80); err != nil {
+		return err
+	}
+
+	// Drop whatever an earlier, interrupted attempt already stored.
+	err = q.VectorStore.DeleteByDocument(ctx, vectorCollection.StoreName, document.ID)
+	if err != nil {
+		return fmt.Errorf("removing previous vectors: %w", err)
+	}
+
+	_, err = q.VectorStore.AddDocuments(ctx, vectorCollection.StoreName, chunksDocList, vectors)
+	if err != nil {
+		return fmt.Errorf("storing vectors: %w", err)
+	}
+
+	err = q.Keywords.Replace(ctx, vectorCollection.ID, document.ID, chunksDocList)
+	if err != nil {
+		return fmt.Errorf("storing keywords: %w", err)
+	}
+
+	queryDocumentStr := "UPDATE documents SET is_indexed=true, date_modified=datetime('now') WHERE id=$1;"
+
+	result, err := q.DBManager.DB.Exec(queryDocumentStr, document.ID)
+	if err != nil {
+		return err
+	}
+
+	// The document was deleted while we were working on it.
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		if err := q.VectorStore.DeleteByDocument(ctx, vectorCollection.StoreName, document.ID); err != nil {
+			log.Printf("Failed to remove vectors of deleted document %d: %v", document.ID, err)
+		}
+		if err := q.Keywords.DeleteDocument(ctx, vectorCollection.ID, document.ID); err != nil {
+			log.Printf("Failed to remove keywords of deleted document %d: %v", document.ID, err)
+		}
+		return permanent(fmt.Errorf("document %d was deleted during ingestion", document.ID))
+	}
+
+	queryJobStr := "UPDATE ingestion_jobs SET status=$1, stage=$2, progress=100, last_error='', date_modified=datetime('now') WHERE id=$3"
+
+	_, err = q.DBManager.DB.Exec(queryJobStr, StatusCompleted, StageDone, job.ID)
+
+	return err
+}
+
+// OriginalFileName strips the random prefix uploads are stored under.
+func OriginalFileName(storedFileName string) string {
+	if _, name, found := strings.Cut(storedFileName, "$"); found {
+		return name
+	}
+
+	return storedFileName
+}
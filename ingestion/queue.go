@@ -0,0 +1,295 @@
+package ingestion
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/loaders"
+	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/providers"
+	"github.com/zarkopopovski/rag-chat/retrieval"
+	"github.com/zarkopopovski/rag-chat/vectorstore"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+const (
+	StageQueued    = "queued"
+	StageParsing   = "parsing"
+	StageChunking  = "chunking"
+	StageEmbedding = "embedding"
+	StageUpserting = "upserting"
+	StageDone      = "done"
+)
+
+const (
+	defaultWorkers     = 2
+	defaultMaxAttempts = 5
+	pollInterval       = 5 * time.Second
+	baseBackoff        = 10 * time.Second
+	maxBackoff         = 10 * time.Minute
+)
+
+// Queue runs document ingestion in a pool of workers. Jobs live in the
+// ingestion_jobs table, so pending work survives restarts.
+type Queue struct {
+	DBManager    *db.DBManager
+	VectorStore  vectorstore.VectorStore
+	Providers    *providers.Registry
+	UploadFolder string
+	Loaders      *loaders.Registry
+	Keywords     *retrieval.KeywordIndex
+	Workers      int
+	MaxAttempts  int
+
+	// Backoff is how long a failed job waits before its first retry. The
+	// wait doubles with every further attempt, up to ten minutes.
+	Backoff time.Duration
+
+	wake        chan struct{}
+	reembedWake chan struct{}
+	claimMu     sync.Mutex
+	wg          sync.WaitGroup
+}
+
+func NewQueue(dbManager *db.DBManager, vectorStore vectorstore.VectorStore, providerRegistry *providers.Registry, uploadFolder string) *Queue {
+	return &Queue{
+		DBManager:    dbManager,
+		VectorStore:  vectorStore,
+		Providers:    providerRegistry,
+		UploadFolder: uploadFolder,
+		Loaders:      loaders.DefaultRegistry(),
+		Keywords:     retrieval.NewKeywordIndex(dbManager),
+		Workers:      defaultWorkers,
+		MaxAttempts:  defaultMaxAttempts,
+		Backoff:      baseBackoff,
+		wake:         make(chan struct{}, 1),
+		reembedWake:  make(chan struct{}, 1),
+	}
+}
+
+// Start requeues jobs interrupted by a previous shutdown and launches the
+// workers. They stop when ctx is cancelled; Wait blocks until they have.
+func (q *Queue) Start(ctx context.Context) error {
+	queryStr := "UPDATE ingestion_jobs SET status=$1, date_modified=datetime('now') WHERE status=$2"
+
+	_, err := q.DBManager.DB.Exec(queryStr, StatusPending, StatusRunning)
+	if err != nil {
+		return err
+	}
+
+	queryReembedStr := "UPDATE reembed_jobs SET status=$1, date_modified=datetime('now') WHERE status=$2"
+
+	_, err = q.DBManager.DB.Exec(queryReembedStr, StatusPending, StatusRunning)
+	if err != nil {
+		return err
+	}
+
+	workers := q.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	for range workers {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+
+	q.wg.Add(1)
+	go q.reembedWork(ctx)
+
+	return nil
+}
+
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+// Enqueue schedules the indexing of a document and returns the job ID.
+func (q *Queue) Enqueue(userID int64, documentID int64, collectionID int64) (int64, error) {
+	maxAttempts := q.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	queryStr := "INSERT INTO ingestion_jobs(user_id, document_id, collection_id, status, stage, max_attempts, next_attempt_at, date_created, date_modified) VALUES($1, $2, $3, $4, $5, $6, datetime('now'), datetime('now'), datetime('now'))"
+
+	result, err := q.DBManager.DB.Exec(queryStr, userID, documentID, collectionID, StatusPending, StageQueued, maxAttempts)
+	if err != nil {
+		return -1, err
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return result.LastInsertId()
+}
+
+// LatestJobForDocument returns the most recent job of a document.
+func (q *Queue) LatestJobForDocument(documentID int64) (*models.IngestionJob, error) {
+	queryStr := "SELECT * FROM ingestion_jobs WHERE document_id=$1 ORDER BY id DESC LIMIT 1"
+
+	job := models.IngestionJob{}
+
+	err := q.DBManager.DB.Get(&job, queryStr, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// HasActiveJob reports whether the document is waiting for or being indexed.
+func (q *Queue) HasActiveJob(documentID int64) (bool, error) {
+	var count int
+
+	queryStr := "SELECT COUNT(*) FROM ingestion_jobs WHERE document_id=$1 AND status IN ($2, $3)"
+
+	err := q.DBManager.DB.Get(&count, queryStr, documentID, StatusPending, StatusRunning)
+
+	return count > 0, err
+}
+
+// DeleteJobsForDocument forgets the ingestion history of a removed document.
+func (q *Queue) DeleteJobsForDocument(documentID int64) error {
+	_, err := q.DBManager.DB.Exec("DELETE FROM ingestion_jobs WHERE document_id=$1", documentID)
+
+	return err
+}
+
+func (q *Queue) work(ctx context.Context) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			job, err := q.claim()
+			if errors.Is(err, sql.ErrNoRows) {
+				break
+			}
+			if err != nil {
+				log.Printf("Failed to claim ingestion job: %v", err)
+				break
+			}
+
+			q.run(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) claim() (*models.IngestionJob, error) {
+	q.claimMu.Lock()
+	defer q.claimMu.Unlock()
+
+	queryStr := `UPDATE ingestion_jobs SET status=$1, attempts=attempts+1, date_modified=datetime('now')
+		WHERE id=(SELECT id FROM ingestion_jobs WHERE status=$2 AND next_attempt_at<=datetime('now')
+			AND NOT EXISTS (SELECT 1 FROM reembed_jobs WHERE reembed_jobs.collection_id=ingestion_jobs.collection_id AND reembed_jobs.status=$1)
+			ORDER BY id LIMIT 1)
+		RETURNING *`
+
+	job := models.IngestionJob{}
+
+	err := q.DBManager.DB.QueryRowx(queryStr, StatusRunning, StatusPending).StructScan(&job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (q *Queue) run(ctx context.Context, job *models.IngestionJob) {
+	jobErr := q.process(ctx, job)
+	if jobErr == nil {
+		return
+	}
+
+	// Shutting down: leave the job running so Start picks it up again.
+	if ctx.Err() != nil {
+		return
+	}
+
+	log.Printf("Ingestion job %d for document %d failed (attempt %d/%d): %v", job.ID, job.DocumentID, job.Attempts, job.MaxAttempts, jobErr)
+
+	var permanent *permanentError
+	if errors.As(jobErr, &permanent) || job.Attempts >= job.MaxAttempts {
+		queryStr := "UPDATE ingestion_jobs SET status=$1, last_error=$2, date_modified=datetime('now') WHERE id=$3"
+
+		if _, err := q.DBManager.DB.Exec(queryStr, StatusFailed, jobErr.Error(), job.ID); err != nil {
+			log.Printf("Failed to update ingestion job %d: %v", job.ID, err)
+		}
+		return
+	}
+
+	delay := backoff(q.Backoff, job.Attempts)
+
+	queryStr := "UPDATE ingestion_jobs SET status=$1, last_error=$2, next_attempt_at=datetime('now', $3), date_modified=datetime('now') WHERE id=$4"
+
+	_, err := q.DBManager.DB.Exec(queryStr, StatusPending, jobErr.Error(), fmt.Sprintf("+%d seconds", int(delay.Seconds())), job.ID)
+	if err != nil {
+		log.Printf("Failed to update ingestion job %d: %v", job.ID, err)
+	}
+}
+
+func (q *Queue) setStage(jobID int64, stage string, progress int) error {
+	queryStr := "UPDATE ingestion_jobs SET stage=$1, progress=$2, date_modified=datetime('now') WHERE id=$3"
+
+	_, err := q.DBManager.DB.Exec(queryStr, stage, progress, jobID)
+
+	return err
+}
+
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	if delay <= 0 {
+		delay = baseBackoff
+	}
+
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxBackoff)
+}
+
+// permanentError marks failures that retrying cannot fix, like an unreadable file.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
@@ -0,0 +1,226 @@
+package ingestion
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tmc/langchaingo/schema"
+	"github.com/twinj/uuid"
+
+	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/vectorstore"
+)
+
+const reembedBatchSize = 64
+
+// EnqueueReembed schedules copying every chunk of a collection into a new store
+// collection embedded with the given provider and model. The collection keeps answering from its
+// current vectors until the copy is complete and swapped in.
+func (q *Queue) EnqueueReembed(userID int64, collectionID int64, provider string, model string, dimension int) (int64, error) {
+	queryStr := "INSERT INTO reembed_jobs(user_id, collection_id, status, target_provider, target_model, target_dimension, target_store_name, date_created, date_modified) VALUES($1, $2, $3, $4, $5, $6, $7, datetime('now'), datetime('now'))"
+
+	result, err := q.DBManager.DB.Exec(queryStr, userID, collectionID, StatusPending, provider, model, dimension, uuid.NewV4().String())
+	if err != nil {
+		return -1, err
+	}
+
+	select {
+	case q.reembedWake <- struct{}{}:
+	default:
+	}
+
+	return result.LastInsertId()
+}
+
+func (q *Queue) HasActiveReembed(collectionID int64) (bool, error) {
+	var count int
+
+	queryStr := "SELECT COUNT(*) FROM reembed_jobs WHERE collection_id=$1 AND status IN ($2, $3)"
+
+	err := q.DBManager.DB.Get(&count, queryStr, collectionID, StatusPending, StatusRunning)
+
+	return count > 0, err
+}
+
+func (q *Queue) LatestReembedJob(collectionID int64) (*models.ReembedJob, error) {
+	queryStr := "SELECT * FROM reembed_jobs WHERE collection_id=$1 ORDER BY id DESC LIMIT 1"
+
+	job := models.ReembedJob{}
+
+	err := q.DBManager.DB.Get(&job, queryStr, collectionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// reembedWork handles one re-embedding at a time; they are rare and each one
+// already keeps the embedding API busy.
+func (q *Queue) reembedWork(ctx context.Context) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			job, err := q.claimReembed()
+			if errors.Is(err, sql.ErrNoRows) {
+				break
+			}
+			if err != nil {
+				log.Printf("Failed to claim re-embed job: %v", err)
+				break
+			}
+
+			q.runReembed(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.reembedWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimReembed waits until no document of the collection is being indexed, so
+// the copy cannot miss chunks written to the old store collection.
+func (q *Queue) claimReembed() (*models.ReembedJob, error) {
+	q.claimMu.Lock()
+	defer q.claimMu.Unlock()
+
+	queryStr := `UPDATE reembed_jobs SET status=$1, date_modified=datetime('now')
+		WHERE id=(SELECT id FROM reembed_jobs WHERE status=$2
+			AND NOT EXISTS (SELECT 1 FROM ingestion_jobs WHERE ingestion_jobs.collection_id=reembed_jobs.collection_id AND ingestion_jobs.status=$1)
+			ORDER BY id LIMIT 1)
+		RETURNING *`
+
+	job := models.ReembedJob{}
+
+	err := q.DBManager.DB.QueryRowx(queryStr, StatusRunning, StatusPending).StructScan(&job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (q *Queue) runReembed(ctx context.Context, job *models.ReembedJob) {
+	jobErr := q.reembed(ctx, job)
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	status := StatusCompleted
+	lastError := ""
+
+	if jobErr != nil {
+		log.Printf("Re-embed job %d for collection %d failed: %v", job.ID, job.CollectionID, jobErr)
+
+		status = StatusFailed
+		lastError = jobErr.Error()
+
+		err := q.VectorStore.DeleteCollection(context.Background(), job.TargetStoreName)
+		if err != nil && !errors.Is(err, vectorstore.ErrCollectionNotFound) {
+			log.Printf("Failed to remove store collection %s: %v", job.TargetStoreName, err)
+		}
+	}
+
+	queryStr := "UPDATE reembed_jobs SET status=$1, last_error=$2, date_modified=datetime('now') WHERE id=$3"
+
+	if _, err := q.DBManager.DB.Exec(queryStr, status, lastError, job.ID); err != nil {
+		log.Printf("Failed to update re-embed job %d: %v", job.ID, err)
+	}
+}
+
+func (q *Queue) reembed(ctx context.Context, job *models.ReembedJob) error {
+	vectorCollection := models.VectorCollection{}
+
+	err := q.DBManager.DB.Get(&vectorCollection, "SELECT * FROM vector_collections WHERE id=$1", job.CollectionID)
+	if err != nil {
+		return fmt.Errorf("loading collection: %w", err)
+	}
+
+	// A previous run swapped the collections but stopped before recording it.
+	if vectorCollection.StoreName == job.TargetStoreName {
+		return nil
+	}
+
+	e, err := q.Providers.Embedder(job.TargetProvider, job.TargetModel)
+	if err != nil {
+		return err
+	}
+
+	// Start over if an interrupted run left a partial copy behind.
+	err = q.VectorStore.DeleteCollection(ctx, job.TargetStoreName)
+	if err != nil && !errors.Is(err, vectorstore.ErrCollectionNotFound) {
+		return err
+	}
+
+	if err := q.VectorStore.CreateCollection(ctx, job.TargetStoreName, job.TargetDimension); err != nil {
+		return err
+	}
+
+	processed := 0
+
+	err = q.VectorStore.Scroll(ctx, vectorCollection.StoreName, reembedBatchSize, func(docs []schema.Document) error {
+		texts := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			texts = append(texts, doc.PageContent)
+		}
+
+		vectors, err := e.EmbedDocuments(ctx, texts)
+		if err != nil {
+			return fmt.Errorf("embedding chunks: %w", err)
+		}
+
+		if len(vectors) > 0 && len(vectors[0]) != job.TargetDimension {
+			return fmt.Errorf("embedding dimension %d does not match target dimension %d", len(vectors[0]), job.TargetDimension)
+		}
+
+		if _, err := q.VectorStore.AddDocuments(ctx, job.TargetStoreName, docs, vectors); err != nil {
+			return err
+		}
+
+		processed += len(docs)
+
+		_, err = q.DBManager.DB.Exec("UPDATE reembed_jobs SET processed_points=$1, date_modified=datetime('now') WHERE id=$2", processed, job.ID)
+
+		return err
+	})
+	// A missing store collection fails the job rather than swapping in an
+	// empty copy.
+	if err != nil {
+		return fmt.Errorf("copying chunks: %w", err)
+	}
+
+	queryStr := "UPDATE vector_collections SET store_name=$1, embedding_provider=$2, embedding_model=$3, embedding_dimension=$4, date_modified=datetime('now') WHERE id=$5 AND store_name=$6"
+
+	result, err := q.DBManager.DB.Exec(queryStr, job.TargetStoreName, job.TargetProvider, job.TargetModel, job.TargetDimension, vectorCollection.ID, vectorCollection.StoreName)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.New("collection changed while re-embedding")
+	}
+
+	err = q.VectorStore.DeleteCollection(ctx, vectorCollection.StoreName)
+	if err != nil && !errors.Is(err, vectorstore.ErrCollectionNotFound) {
+		log.Printf("Failed to remove previous store collection %s: %v", vectorCollection.StoreName, err)
+	}
+
+	return nil
+}
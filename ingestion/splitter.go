@@ -0,0 +1,39 @@
+package ingestion
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/tmc/langchaingo/textsplitter"
+
+	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/tokenizer"
+)
+
+func newTextSplitter(settings models.CollectionSettings) (textsplitter.TextSplitter, error) {
+	lenFunc := utf8.RuneCountInString
+	if settings.LengthFunction == models.LengthTokens {
+		lenFunc = tokenizer.Count
+	}
+
+	options := []textsplitter.Option{
+		textsplitter.WithChunkSize(settings.ChunkSize),
+		textsplitter.WithChunkOverlap(settings.ChunkOverlap),
+		textsplitter.WithLenFunc(lenFunc),
+	}
+
+	switch settings.SplitterType {
+	case models.SplitterRecursiveCharacter:
+		return textsplitter.NewRecursiveCharacter(options...), nil
+	case models.SplitterMarkdown:
+		return textsplitter.NewMarkdownTextSplitter(append(options, textsplitter.WithHeadingHierarchy(true))...), nil
+	case models.SplitterToken:
+		return textsplitter.NewTokenSplitter(
+			textsplitter.WithChunkSize(settings.ChunkSize),
+			textsplitter.WithChunkOverlap(settings.ChunkOverlap),
+			textsplitter.WithEncodingName(tokenizer.Encoding),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown splitter type %q", settings.SplitterType)
+	}
+}
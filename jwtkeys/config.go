@@ -0,0 +1,61 @@
+package jwtkeys
+
+import "fmt"
+
+// Config describes a key set as configured for the deployment. The previous
+// secrets and key files keep tokens signed before a rotation valid, even when
+// the rotation also changed the algorithm.
+type Config struct {
+	Algorithm        string
+	Secret           string
+	PreviousSecrets  []string
+	PrivateKeyFile   string
+	PreviousKeyFiles []string
+}
+
+func (c Config) KeySet() (*KeySet, error) {
+	var current *Key
+	var err error
+
+	switch c.Algorithm {
+	case "", HS256:
+		if c.Secret == "" {
+			return nil, fmt.Errorf("%w: a secret is required for %s", ErrNoSigningKey, HS256)
+		}
+		current, err = NewHMACKey(c.Secret)
+	case RS256, EdDSA:
+		if c.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("%w: a private key file is required for %s", ErrNoSigningKey, c.Algorithm)
+		}
+		current, err = LoadPrivateKeyFile(c.PrivateKeyFile)
+		if err == nil && current.Method.Alg() != c.Algorithm {
+			err = fmt.Errorf("%s holds a %s key, not %s", c.PrivateKeyFile, current.Method.Alg(), c.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", c.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	previous := make([]*Key, 0, len(c.PreviousSecrets)+len(c.PreviousKeyFiles))
+
+	for _, secret := range c.PreviousSecrets {
+		key, err := NewHMACKey(secret)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey = nil
+		previous = append(previous, key)
+	}
+
+	for _, path := range c.PreviousKeyFiles {
+		key, err := LoadPublicKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, key)
+	}
+
+	return NewKeySet(current, previous...)
+}
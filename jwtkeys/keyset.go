@@ -0,0 +1,188 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// MinSecretLength is the shortest HMAC secret accepted, in bytes.
+const MinSecretLength = 32
+
+var (
+	ErrUnknownKey     = errors.New("unknown signing key")
+	ErrNoSigningKey   = errors.New("no signing key configured")
+	ErrSecretTooShort = fmt.Errorf("HMAC secrets must be at least %d bytes long", MinSecretLength)
+)
+
+// Key is one JWT key. Keys without a private half only verify tokens, which is
+// how retired keys stay valid until the tokens they signed expire.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+func (k *Key) CanSign() bool {
+	return k.signKey != nil
+}
+
+// NewHMACKey builds an HS256 key from a shared secret. Its ID is derived from
+// a hash of the secret so that it is stable across restarts.
+func NewHMACKey(secret string) (*Key, error) {
+	if len(secret) < MinSecretLength {
+		return nil, ErrSecretTooShort
+	}
+
+	sum := sha256.Sum256([]byte("rag-chat kid:" + secret))
+
+	return &Key{
+		ID:        hex.EncodeToString(sum[:8]),
+		Method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}, nil
+}
+
+// NewPrivateKey builds an RS256 or EdDSA signing key. Its ID is the RFC 7638
+// thumbprint of the public key.
+func NewPrivateKey(privateKey interface{}) (*Key, error) {
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		key, err := NewPublicKey(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey = k
+
+		return key, nil
+	case ed25519.PrivateKey:
+		key, err := NewPublicKey(k.Public())
+		if err != nil {
+			return nil, err
+		}
+		key.signKey = k
+
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+}
+
+// NewPublicKey builds a verification-only RS256 or EdDSA key.
+func NewPublicKey(publicKey interface{}) (*Key, error) {
+	jwk, err := publicJWK(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: jwk.thumbprint(), verifyKey: publicKey}
+
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	}
+
+	return key, nil
+}
+
+// KeySet signs tokens with its current key and verifies tokens signed by any
+// of its keys, looked up by the kid header. It is read-only once built.
+type KeySet struct {
+	current *Key
+	keys    map[string]*Key
+}
+
+// NewKeySet returns a key set signing with current. The other keys are only
+// used for verification.
+func NewKeySet(current *Key, others ...*Key) (*KeySet, error) {
+	if current == nil || !current.CanSign() {
+		return nil, ErrNoSigningKey
+	}
+
+	ks := &KeySet{current: current, keys: map[string]*Key{current.ID: current}}
+	for _, key := range others {
+		if _, ok := ks.keys[key.ID]; !ok {
+			ks.keys[key.ID] = key
+		}
+	}
+
+	return ks, nil
+}
+
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	key := ks.current
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.signKey)
+}
+
+// Parse verifies tokenString against the key named by its kid header.
+func (ks *KeySet) Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, ks.Keyfunc)
+}
+
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	// Never let the token choose the algorithm, or an RSA public key could
+	// be used as an HMAC secret.
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.verifyKey, nil
+}
+
+// JWKS lists the public keys of the set. HMAC keys are never published.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+
+	// Put the current key first so clients that only look at one pick it.
+	others := make([]*Key, 0, len(ks.keys))
+	for id, key := range ks.keys {
+		if id != ks.current.ID {
+			others = append(others, key)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].ID < others[j].ID })
+
+	ordered := append([]*Key{ks.current}, others...)
+
+	for _, key := range ordered {
+		jwk, err := publicJWK(key.verifyKey)
+		if err != nil {
+			continue
+		}
+		jwk.KeyID = key.ID
+		jwk.Use = "sig"
+		jwk.Algorithm = key.Method.Alg()
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks
+}
@@ -0,0 +1,235 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	secret         = "the current secret, long enough for HS256"
+	previousSecret = "the previous secret, long enough for HS256"
+)
+
+func claims() jwt.StandardClaims {
+	return jwt.StandardClaims{Subject: "42", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+}
+
+// writePEM stores a PEM block in a file of the test's temporary directory.
+func writePEM(t *testing.T, name string, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestThumbprint(t *testing.T) {
+	// The Ed25519 key and thumbprint of RFC 8037 appendix A.
+	x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := NewPublicKey(ed25519.PublicKey(x))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"; key.ID != want {
+		t.Fatalf("thumbprint %s, want %s", key.ID, want)
+	}
+
+	if key.CanSign() {
+		t.Fatal("a public key can sign")
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	if _, err := (Config{Secret: "too short"}).KeySet(); !errors.Is(err, ErrSecretTooShort) {
+		t.Fatalf("a short secret gave %v, want ErrSecretTooShort", err)
+	}
+	if _, err := (Config{}).KeySet(); !errors.Is(err, ErrNoSigningKey) {
+		t.Fatalf("no secret gave %v, want ErrNoSigningKey", err)
+	}
+
+	before, err := Config{Secret: previousSecret}.KeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldToken, err := before.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := Config{Secret: secret, PreviousSecrets: []string{previousSecret}}.KeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newToken, err := after.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tokenString := range []string{oldToken, newToken} {
+		if _, err := after.Parse(tokenString); err != nil {
+			t.Fatalf("the rotated key set rejects %s: %v", tokenString, err)
+		}
+	}
+
+	if keyID(t, newToken) == keyID(t, oldToken) {
+		t.Fatal("the rotated key set still signs with the previous secret")
+	}
+
+	if _, err := before.Parse(newToken); err == nil {
+		t.Fatal("a token of the new secret verifies against the previous key set")
+	}
+
+	if len(after.JWKS().Keys) != 0 {
+		t.Fatalf("HMAC keys were published: %+v", after.JWKS())
+	}
+}
+
+// keyID returns the kid header of a token.
+func keyID(t *testing.T, tokenString string) interface{} {
+	t.Helper()
+
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token.Header["kid"]
+}
+
+func TestAlgorithmConfusion(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := NewPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := NewKeySet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An HS256 token keyed with the published RSA key must not verify.
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	forged.Header["kid"] = key.ID
+
+	tokenString, err := forged.SignedString(x509.MarshalPKCS1PublicKey(&privateKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ks.Parse(tokenString); err == nil {
+		t.Fatal("an HS256 token verified against an RSA key")
+	}
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodRS256, claims())
+	unknown.Header["kid"] = "unknown"
+
+	tokenString, err = unknown.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ks.Parse(tokenString); err == nil {
+		t.Fatal("a token with an unknown kid verified")
+	}
+}
+
+func TestKeyFiles(t *testing.T) {
+	_, edPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(edPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edFile := writePEM(t, "ed25519.pem", "PRIVATE KEY", der)
+
+	rsaPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaFile := writePEM(t, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaPrivateKey))
+	rsaPublicFile := writePEM(t, "rsa.pub", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaPrivateKey.PublicKey))
+
+	if _, err := (Config{Algorithm: RS256, PrivateKeyFile: edFile}).KeySet(); err == nil {
+		t.Fatal("an Ed25519 key file was accepted for RS256")
+	}
+	if _, err := (Config{Algorithm: "none", Secret: secret}).KeySet(); err == nil {
+		t.Fatal("an unsupported algorithm was accepted")
+	}
+
+	before, err := Config{Algorithm: RS256, PrivateKeyFile: rsaFile}.KeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldToken, err := before.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating from RS256 to EdDSA keeps the RSA tokens valid.
+	after, err := Config{Algorithm: EdDSA, PrivateKeyFile: edFile, PreviousKeyFiles: []string{rsaPublicFile}}.KeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := after.Parse(oldToken); err != nil {
+		t.Fatalf("the RS256 token no longer verifies: %v", err)
+	}
+
+	newToken, err := after.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := after.Parse(newToken)
+	if err != nil || parsed.Method.Alg() != EdDSA {
+		t.Fatalf("the rotated key set signed %v: %v", parsed, err)
+	}
+
+	jwks := after.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Algorithm != EdDSA || jwks.Keys[1].Algorithm != RS256 {
+		t.Fatalf("expected the current EdDSA key first, then the RSA key, got %+v", jwks.Keys)
+	}
+
+	publicKeys := []interface{}{edPrivateKey.Public(), &rsaPrivateKey.PublicKey}
+	for i, jwk := range jwks.Keys {
+		publicKey, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(publicKey, publicKeys[i]) {
+			t.Fatalf("key %s does not decode to the key it was built from", jwk.KeyID)
+		}
+	}
+}
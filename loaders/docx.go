@@ -0,0 +1,87 @@
+package loaders
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// DOCXLoader reads the main document part of a Word file, keeping paragraph
+// breaks and tabs.
+type DOCXLoader struct{}
+
+func (DOCXLoader) Load(filePath string) ([]schema.Document, error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening DOCX file: %w", err)
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if file.Name != "word/document.xml" {
+			continue
+		}
+
+		part, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("reading DOCX file: %w", err)
+		}
+		defer part.Close()
+
+		text, err := docxText(part)
+		if err != nil {
+			return nil, fmt.Errorf("parsing DOCX file: %w", err)
+		}
+
+		return singleDocument(text), nil
+	}
+
+	return nil, errors.New("DOCX file has no word/document.xml part")
+}
+
+func docxText(r io.Reader) (string, error) {
+	var sb strings.Builder
+
+	decoder := xml.NewDecoder(r)
+	inText := false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				sb.WriteString("\t")
+			case "br", "cr":
+				sb.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				sb.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				sb.Write(t)
+			}
+		}
+	}
+
+	return strings.TrimSpace(sb.String()), nil
+}
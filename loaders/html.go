@@ -0,0 +1,84 @@
+package loaders
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLLoader strips tags, scripts and styles. Headings are rendered as
+// Markdown style "#" lines and block elements as line breaks.
+type HTMLLoader struct{}
+
+var blankLines = regexp.MustCompile(`\n\s*\n+`)
+
+func (HTMLLoader) Load(filePath string) ([]schema.Document, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening HTML file: %w", err)
+	}
+	defer file.Close()
+
+	root, err := html.Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("parsing HTML file: %w", err)
+	}
+
+	var sb strings.Builder
+	writeHTMLText(&sb, root)
+
+	text := blankLines.ReplaceAllString(sb.String(), "\n\n")
+
+	return singleDocument(strings.TrimSpace(text)), nil
+}
+
+var headingLevels = map[atom.Atom]int{
+	atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6,
+}
+
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Br: true, atom.Li: true, atom.Tr: true,
+	atom.Table: true, atom.Ul: true, atom.Ol: true, atom.Section: true,
+	atom.Article: true, atom.Header: true, atom.Footer: true, atom.Pre: true,
+	atom.Blockquote: true, atom.Dt: true, atom.Dd: true,
+}
+
+func writeHTMLText(sb *strings.Builder, node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		sb.WriteString(node.Data)
+		return
+	case html.ElementNode:
+		switch node.DataAtom {
+		case atom.Script, atom.Style, atom.Noscript, atom.Head, atom.Template:
+			return
+		}
+
+		if level, ok := headingLevels[node.DataAtom]; ok {
+			var heading strings.Builder
+			for child := node.FirstChild; child != nil; child = child.NextSibling {
+				writeHTMLText(&heading, child)
+			}
+
+			sb.WriteString("\n\n" + strings.Repeat("#", level) + " " + strings.Join(strings.Fields(heading.String()), " ") + "\n\n")
+			return
+		}
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		writeHTMLText(sb, child)
+	}
+
+	if node.Type == html.ElementNode {
+		if node.DataAtom == atom.Td || node.DataAtom == atom.Th {
+			sb.WriteString(" ")
+		} else if blockElements[node.DataAtom] {
+			sb.WriteString("\n")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package loaders
+
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Loader extracts the text of a stored file. PDF pages become separate
+// documents carrying a "page" metadata entry; other formats yield one document.
+type Loader interface {
+	Load(filePath string) ([]schema.Document, error)
+}
+
+// Registry finds the loader for an uploaded file by its extension and, failing
+// that, by its detected content type.
+type Registry struct {
+	byExtension   map[string]Loader
+	byContentType map[string]Loader
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		byExtension:   make(map[string]Loader),
+		byContentType: make(map[string]Loader),
+	}
+}
+
+// DefaultRegistry knows every format rag-chat can index.
+func DefaultRegistry() *Registry {
+	registry := NewRegistry()
+
+	registry.Register(PDFLoader{}, []string{"application/pdf"}, []string{".pdf"})
+	registry.Register(DOCXLoader{}, []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"}, []string{".docx"})
+	registry.Register(MarkdownLoader{}, []string{"text/markdown", "text/x-markdown"}, []string{".md", ".markdown"})
+	registry.Register(HTMLLoader{}, []string{"text/html"}, []string{".html", ".htm"})
+	registry.Register(TextLoader{}, []string{"text/plain"}, []string{".txt", ".text"})
+
+	return registry
+}
+
+func (r *Registry) Register(loader Loader, contentTypes []string, extensions []string) {
+	for _, contentType := range contentTypes {
+		r.byContentType[contentType] = loader
+	}
+	for _, extension := range extensions {
+		r.byExtension[strings.ToLower(extension)] = loader
+	}
+}
+
+// Lookup prefers the extension because http.DetectContentType reports DOCX as
+// application/zip and Markdown as text/plain.
+func (r *Registry) Lookup(fileName string, contentType string) (Loader, bool) {
+	if loader, ok := r.byExtension[strings.ToLower(filepath.Ext(fileName))]; ok {
+		return loader, true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	loader, ok := r.byContentType[mediaType]
+
+	return loader, ok
+}
+
+func singleDocument(text string) []schema.Document {
+	return []schema.Document{{
+		PageContent: text,
+		Metadata:    map[string]any{},
+	}}
+}
@@ -0,0 +1,37 @@
+package loaders
+
+import (
+	"fmt"
+
+	"github.com/gen2brain/go-fitz"
+	"github.com/tmc/langchaingo/schema"
+)
+
+type PDFLoader struct{}
+
+func (PDFLoader) Load(filePath string) ([]schema.Document, error) {
+	doc, err := fitz.New(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening PDF file: %w", err)
+	}
+
+	defer doc.Close()
+
+	pagesList := make([]schema.Document, 0, doc.NumPage())
+
+	for idx := range doc.NumPage() {
+		text, err := doc.Text(idx)
+		if err != nil {
+			return nil, fmt.Errorf("reading page %d: %w", idx+1, err)
+		}
+
+		pagesList = append(pagesList, schema.Document{
+			PageContent: text,
+			Metadata: map[string]any{
+				"page": idx + 1,
+			},
+		})
+	}
+
+	return pagesList, nil
+}
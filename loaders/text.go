@@ -0,0 +1,61 @@
+package loaders
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+type TextLoader struct{}
+
+func (TextLoader) Load(filePath string) ([]schema.Document, error) {
+	text, err := readUTF8(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return singleDocument(text), nil
+}
+
+var (
+	markdownImage     = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink      = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	markdownEmphasis  = regexp.MustCompile("(\\*\\*|__|\\*|`)")
+	markdownCodeFence = regexp.MustCompile("(?m)^\\s*(```|~~~).*$")
+)
+
+// MarkdownLoader drops link targets, images and emphasis markers but keeps the
+// "#" headings so the section structure is still visible to the model.
+type MarkdownLoader struct{}
+
+func (MarkdownLoader) Load(filePath string) ([]schema.Document, error) {
+	text, err := readUTF8(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	text = markdownCodeFence.ReplaceAllString(text, "")
+	text = markdownImage.ReplaceAllString(text, "$1")
+	text = markdownLink.ReplaceAllString(text, "$1")
+	text = markdownEmphasis.ReplaceAllString(text, "")
+
+	return singleDocument(strings.TrimSpace(text)), nil
+}
+
+func readUTF8(filePath string) (string, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("reading file: %w", err)
+	}
+
+	if !utf8.Valid(content) {
+		return "", errors.New("file is not valid UTF-8 text")
+	}
+
+	return strings.TrimPrefix(string(content), "\uFEFF"), nil
+}
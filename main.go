@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -10,20 +9,35 @@ import (
 
 	"os"
 	"os/signal"
+	"strconv"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
-	"github.com/tmc/langchaingo/llms/openai"
 
+	"github.com/zarkopopovski/rag-chat/clientinfo"
 	"github.com/zarkopopovski/rag-chat/controllers"
 	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/ingestion"
+	"github.com/zarkopopovski/rag-chat/jwtkeys"
+	"github.com/zarkopopovski/rag-chat/oidc"
+	"github.com/zarkopopovski/rag-chat/passwords"
+	"github.com/zarkopopovski/rag-chat/providers"
+	"github.com/zarkopopovski/rag-chat/retrieval"
+	"github.com/zarkopopovski/rag-chat/tokenizer"
+	"github.com/zarkopopovski/rag-chat/vectorstore"
 )
 
 type Handlers struct {
-	Authentication *controllers.AuthController
-	UserController *controllers.UserController
-	RagController  *controllers.RagController
-	ChatController *controllers.ChatController
+	Authentication   *controllers.AuthController
+	UserController   *controllers.UserController
+	RagController    *controllers.RagController
+	ChatController   *controllers.ChatController
+	AdminController  *controllers.AdminController
+	OrgController    *controllers.OrganizationController
+	APIKeyController *controllers.APIKeyController
+	OIDCController   *controllers.OIDCController
+	TwoFactor        *controllers.TwoFactorController
+	Sessions         *controllers.SessionController
 }
 
 type FileSystem struct {
@@ -56,18 +70,54 @@ func main() {
 	portNumber := os.Getenv("PORT")
 
 	database := os.Getenv("DATABASE")
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbUsername := os.Getenv("DB_USERNAME")
-	dbPassword := os.Getenv("DB_PASSWORD")
 
 	adminUser := os.Getenv("ADMIN_USERNAME")
 	adminPassword := os.Getenv("ADMIN_PASSWORD")
 
+	jwtAlgorithm := os.Getenv("JWT_ALGORITHM")
+	jwtAccessSecret := os.Getenv("JWT_ACCESS_SECRET")
+	jwtAccessPreviousSecrets := splitList(os.Getenv("JWT_ACCESS_PREVIOUS_SECRETS"))
+	jwtPrivateKeyFile := os.Getenv("JWT_PRIVATE_KEY_FILE")
+	jwtPreviousPublicKeyFiles := splitList(os.Getenv("JWT_PREVIOUS_PUBLIC_KEY_FILES"))
+	jwtRefreshSecret := os.Getenv("JWT_REFRESH_SECRET")
+	jwtRefreshPreviousSecrets := splitList(os.Getenv("JWT_REFRESH_PREVIOUS_SECRETS"))
+
+	llmProvider := os.Getenv("LLM_PROVIDER")
 	openaiToken := os.Getenv("OPENAI_TOKEN")
+	openaiBaseURL := os.Getenv("OPENAI_BASE_URL")
+	openaiCompatibleURL := os.Getenv("OPENAI_COMPATIBLE_URL")
+	openaiCompatibleToken := os.Getenv("OPENAI_COMPATIBLE_TOKEN")
+	ollamaURL := os.Getenv("OLLAMA_URL")
 	llmModel := os.Getenv("LLM_MODEL")
 	embeddingModel := os.Getenv("EMBEDDING_MODEL")
 
+	vectorStoreBackend := os.Getenv("VECTOR_STORE")
+	qdrantURL := os.Getenv("QDRANT_URL")
+	qdrantAPIKey := os.Getenv("QDRANT_API_KEY")
+
+	oidcIssuerURL := os.Getenv("OIDC_ISSUER_URL")
+	oidcClientID := os.Getenv("OIDC_CLIENT_ID")
+	oidcClientSecret := os.Getenv("OIDC_CLIENT_SECRET")
+	oidcRedirectURL := os.Getenv("OIDC_REDIRECT_URL")
+	oidcScopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+	oidcGroupsClaim := os.Getenv("OIDC_GROUPS_CLAIM")
+	oidcAdminGroups := splitList(os.Getenv("OIDC_ADMIN_GROUPS"))
+	oidcPostLoginRedirectURL := os.Getenv("OIDC_POST_LOGIN_REDIRECT_URL")
+
+	totpIssuer := os.Getenv("TOTP_ISSUER")
+
+	rerankURL := os.Getenv("RERANK_URL")
+	rerankAPIKey := os.Getenv("RERANK_API_KEY")
+	rerankModel := os.Getenv("RERANK_MODEL")
+
+	geoIPDatabase := os.Getenv("GEOIP_DATABASE")
+	trustProxyHeaders := os.Getenv("TRUST_PROXY_HEADERS") == "true"
+	loginAlerts := os.Getenv("LOGIN_ALERTS") == "true"
+
+	uploadFolder := os.Getenv("UPLOAD_FOLDER")
+	ingestionWorkers, _ := strconv.Atoi(os.Getenv("INGESTION_WORKERS"))
+	ingestionMaxAttempts, _ := strconv.Atoi(os.Getenv("INGESTION_MAX_ATTEMPTS"))
+
 	if _, err := os.Stat("assets"); os.IsNotExist(err) {
 		err := os.Mkdir("assets", 0777)
 		if err != nil {
@@ -88,77 +138,122 @@ func main() {
 		}
 	}
 
-	databaseDSN := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", dbUsername, dbPassword, dbHost, dbPort, database)
+	if err := tokenizer.Load(); err != nil {
+		log.Fatalf("Invalid tokenizer: %v", err)
+	}
 
-	httpRouter := http.NewServeMux()
+	accessKeys, err := jwtkeys.Config{
+		Algorithm:        jwtAlgorithm,
+		Secret:           jwtAccessSecret,
+		PreviousSecrets:  jwtAccessPreviousSecrets,
+		PrivateKeyFile:   jwtPrivateKeyFile,
+		PreviousKeyFiles: jwtPreviousPublicKeyFiles,
+	}.KeySet()
+	if err != nil {
+		log.Fatalf("Invalid JWT access token configuration: %v", err)
+	}
 
-	dbHandler := db.NewDBConnection(databaseDSN)
+	// Refresh tokens are only ever verified by rag-chat itself.
+	refreshKeys, err := jwtkeys.Config{
+		Algorithm:       jwtkeys.HS256,
+		Secret:          jwtRefreshSecret,
+		PreviousSecrets: jwtRefreshPreviousSecrets,
+	}.KeySet()
+	if err != nil {
+		log.Fatalf("Invalid JWT refresh token configuration: %v", err)
+	}
 
-	authController := &controllers.AuthController{
-		DBManager: dbHandler,
+	// Single sign-on stays off unless an issuer is configured.
+	var oidcController *controllers.OIDCController
+	if oidcIssuerURL != "" {
+		oidcProvider, err := oidc.NewProvider(oidc.Config{
+			IssuerURL:    oidcIssuerURL,
+			ClientID:     oidcClientID,
+			ClientSecret: oidcClientSecret,
+			RedirectURL:  oidcRedirectURL,
+			Scopes:       oidcScopes,
+		})
+		if err != nil {
+			log.Fatalf("Invalid OIDC configuration: %v", err)
+		}
+
+		if oidcGroupsClaim == "" {
+			oidcGroupsClaim = "groups"
+		}
+
+		oidcController = &controllers.OIDCController{
+			Provider:             oidcProvider,
+			IssuerURL:            oidcIssuerURL,
+			GroupsClaim:          oidcGroupsClaim,
+			AdminGroups:          oidcAdminGroups,
+			PostLoginRedirectURL: oidcPostLoginRedirectURL,
+		}
 	}
 
-	handlers := &Handlers{
-		Authentication: authController,
-		UserController: &controllers.UserController{
-			DBManager:      dbHandler,
-			AuthController: authController,
-		},
-		RagController: &controllers.RagController{
-			DBManager:      dbHandler,
-			AuthController: authController,
-			OpenAIOptions: []openai.Option{
-				openai.WithToken(openaiToken),
-				openai.WithModel(llmModel),
-				openai.WithEmbeddingModel(embeddingModel),
-			},
-		},
-		ChatController: &controllers.ChatController{
-			DBManager:      dbHandler,
-			AuthController: authController,
-			OpenAIOptions: []openai.Option{
-				openai.WithToken(openaiToken),
-				openai.WithModel(llmModel),
-				openai.WithEmbeddingModel(embeddingModel),
-			},
-		},
+	dbHandler := db.NewDBConnection(database)
+
+	vectorStore, err := vectorstore.New(vectorStoreBackend, dbHandler, qdrantURL, qdrantAPIKey)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	_ = handlers.UserController.RegisterAdminUser(adminUser, adminPassword)
+	providerRegistry := providers.NewRegistry(llmProvider, llmModel, embeddingModel)
 
-	//PUBLIC
-	httpRouter.HandleFunc("POST /api/v1/login", handlers.Authentication.CheckUserCredentials)
-	httpRouter.HandleFunc("POST /api/v1/logout", handlers.Authentication.Logout)
-	httpRouter.HandleFunc("POST /api/v1/register-user", handlers.UserController.RegisterNewUser)
-	httpRouter.HandleFunc("POST /api/v1/reset-password", handlers.UserController.SendTempPassPerMail)
-	httpRouter.HandleFunc("GET /api/v1/confirm-registartion/{confirmationKey}", handlers.UserController.ConfirmRegistration)
+	if openaiToken != "" || openaiBaseURL != "" {
+		providerRegistry.Register(providers.OpenAI, providers.OpenAIProvider{Token: openaiToken, BaseURL: openaiBaseURL})
+	}
 
-	//USER
-	httpRouter.HandleFunc("GET /api/v1/user/refresh-token/{refreshToken}", handlers.Authentication.Refresh)
-	httpRouter.HandleFunc("POST /api/v1/user/change-password", handlers.UserController.ChangePassword)
-	httpRouter.HandleFunc("POST /api/v1/user/user-details", handlers.UserController.UpdateUserDetails)
+	if openaiCompatibleURL != "" {
+		providerRegistry.Register(providers.OpenAICompatible, providers.OpenAIProvider{Token: openaiCompatibleToken, BaseURL: openaiCompatibleURL})
+	}
 
-	//RAG
-	httpRouter.HandleFunc("POST /api/v1/rag/create-vector-collection", handlers.RagController.CreateVectorCollection)
-	httpRouter.HandleFunc("GET /api/v1/rag/list-vector-collections", handlers.RagController.ListVectorCollections)
-	httpRouter.HandleFunc("DELETE /api/v1/rag/delete-vector-collection/{collectionHash}", handlers.RagController.DeleteVectorCollection)
-	httpRouter.HandleFunc("POST /api/v1/rag/upload-pdf-document", handlers.RagController.UploadPDFDocument)
-	httpRouter.HandleFunc("GET /api/v1/rag/list-pdf-documents", handlers.RagController.ListPDFDocuments)
-	httpRouter.HandleFunc("POST /api/v1/rag/prompt-template", handlers.RagController.SetupPromptTemplateForCollection)
-	httpRouter.HandleFunc("GET /api/v1/rag/get-prompt-template/{collectionHash}", handlers.RagController.GetPromptTemplateForCollection)
-	httpRouter.HandleFunc("DELETE /api/v1/rag/delete-prompt-template/{promptTemplateID}", handlers.RagController.DeletePromptTemplateForCollection)
+	if ollamaURL != "" {
+		providerRegistry.Register(providers.Ollama, providers.OllamaProvider{ServerURL: ollamaURL})
+	}
 
-	//CHAT
-	httpRouter.HandleFunc("POST /api/v1/chat/start-chat-session", handlers.ChatController.StartChatSession)
-	httpRouter.HandleFunc("GET /api/v1/chat/list-chat-sessions", handlers.ChatController.ListChatSessions)
-	httpRouter.HandleFunc("POST /api/v1/chat/send-message-to-chat-session", handlers.ChatController.SendMessageToChatSession)
-	httpRouter.HandleFunc("GET /api/v1/chat/get-chat-session-messages/{chatSessionID}", handlers.ChatController.GetChatSessionMessages)
-	httpRouter.HandleFunc("DELETE /api/v1/chat/delete-chat-session/{chatSessionID}", handlers.ChatController.DeleteChatSession)
+	if llmProvider == providers.Fake {
+		providerRegistry.Register(providers.Fake, providers.FakeProvider{})
+	}
 
-	fileServer := http.FileServer(FileSystem{http.Dir("assets/uploads/")})
-	httpRouter.Handle("/static/", http.StripPrefix(strings.TrimRight("/static/", "/"), fileServer))
+	if !providerRegistry.Has(providerRegistry.DefaultProvider) {
+		log.Fatalf("LLM provider %q is not configured", providerRegistry.DefaultProvider)
+	}
+
+	rerankers := &retrieval.Rerankers{Providers: providerRegistry}
+
+	if rerankURL != "" {
+		rerankers.CrossEncoder = retrieval.NewCrossEncoderReranker(rerankURL, rerankAPIKey, rerankModel)
+	}
+
+	ingestionQueue := ingestion.NewQueue(dbHandler, vectorStore, providerRegistry, uploadFolder)
+	ingestionQueue.Workers = ingestionWorkers
+	ingestionQueue.MaxAttempts = ingestionMaxAttempts
+
+	workersContext, stopWorkers := context.WithCancel(context.Background())
+
+	err = ingestionQueue.Start(workersContext)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	clientResolver, err := clientinfo.NewResolver(geoIPDatabase, trustProxyHeaders)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer clientResolver.Close()
+
+	handlers := newHandlers(dbHandler, accessKeys, refreshKeys, vectorStore, providerRegistry, rerankers, ingestionQueue, oidcController)
+
+	_ = handlers.UserController.RegisterAdminUser(adminUser, adminPassword)
+
+	if totpIssuer != "" {
+		handlers.TwoFactor.Issuer = totpIssuer
+	}
+
+	handlers.Authentication.Clients = clientResolver
+	handlers.Authentication.LoginAlerts = loginAlerts
 
-	handler := cors.AllowAll().Handler(httpRouter)
+	handler := newRouter(handlers)
 
 	logger := log.New(os.Stdout, "rag-hat", log.LstdFlags)
 	logger.Println("Start Listening on port:" + portNumber)
@@ -190,4 +285,193 @@ func main() {
 	defer canFunct()
 
 	thisServer.Shutdown(timeOutContext)
+
+	stopWorkers()
+	ingestionQueue.Wait()
+}
+
+// newHandlers wires the controllers together. The rag and chat controllers
+// share the rerankers. oidcController is nil when single sign-on is not
+// configured.
+func newHandlers(dbHandler *db.DBManager, accessKeys *jwtkeys.KeySet, refreshKeys *jwtkeys.KeySet, vectorStore vectorstore.VectorStore, providerRegistry *providers.Registry, rerankers *retrieval.Rerankers, ingestionQueue *ingestion.Queue, oidcController *controllers.OIDCController) *Handlers {
+	authController := &controllers.AuthController{
+		DBManager:   dbHandler,
+		AccessKeys:  accessKeys,
+		RefreshKeys: refreshKeys,
+	}
+
+	userController := &controllers.UserController{
+		DBManager:      dbHandler,
+		AuthController: authController,
+		PasswordPolicy: passwords.DefaultPolicy(),
+	}
+
+	if oidcController != nil {
+		oidcController.DBManager = dbHandler
+		oidcController.AuthController = authController
+	}
+
+	return &Handlers{
+		Authentication: authController,
+		UserController: userController,
+		RagController: &controllers.RagController{
+			DBManager:      dbHandler,
+			AuthController: authController,
+			Providers:      providerRegistry,
+			VectorStore:    vectorStore,
+			IngestionQueue: ingestionQueue,
+			Loaders:        ingestionQueue.Loaders,
+			Rerankers:      rerankers,
+		},
+		ChatController: &controllers.ChatController{
+			DBManager:      dbHandler,
+			AuthController: authController,
+			Providers:      providerRegistry,
+			VectorStore:    vectorStore,
+			Keywords:       ingestionQueue.Keywords,
+			Rerankers:      rerankers,
+		},
+		OrgController: &controllers.OrganizationController{
+			DBManager:      dbHandler,
+			AuthController: authController,
+		},
+		APIKeyController: &controllers.APIKeyController{
+			DBManager:      dbHandler,
+			AuthController: authController,
+		},
+		AdminController: &controllers.AdminController{
+			DBManager:      dbHandler,
+			AuthController: authController,
+			UserController: userController,
+			VectorStore:    vectorStore,
+			IngestionQueue: ingestionQueue,
+		},
+		OIDCController: oidcController,
+		TwoFactor: &controllers.TwoFactorController{
+			DBManager:      dbHandler,
+			AuthController: authController,
+			Issuer:         controllers.DefaultTOTPIssuer,
+		},
+		Sessions: &controllers.SessionController{
+			DBManager:      dbHandler,
+			AuthController: authController,
+		},
+	}
+}
+
+func newRouter(handlers *Handlers) http.Handler {
+	httpRouter := http.NewServeMux()
+
+	auth := handlers.Authentication
+	collectionViewer := auth.RequireCollection(controllers.CollectionViewer)
+	collectionEditor := auth.RequireCollection(controllers.CollectionEditor)
+	collectionOwner := auth.RequireCollection(controllers.CollectionOwner)
+	organizationMember := auth.RequireOrganization(controllers.OrganizationMember)
+	organizationOwner := auth.RequireOrganization(controllers.OrganizationOwner)
+	admin := controllers.RequireRole(controllers.RoleAdmin)
+	readCollections := controllers.RequireScope(controllers.ScopeCollectionsRead)
+	writeCollections := controllers.RequireScope(controllers.ScopeCollectionsWrite)
+	uploadDocuments := controllers.RequireScope(controllers.ScopeDocumentsUpload)
+	readChat := controllers.RequireScope(controllers.ScopeChatRead)
+	writeChat := controllers.RequireScope(controllers.ScopeChatWrite)
+
+	//PUBLIC
+	httpRouter.HandleFunc("POST /api/v1/login", auth.CheckUserCredentials)
+	httpRouter.HandleFunc("POST /api/v1/login/2fa", handlers.TwoFactor.CompleteLogin)
+	httpRouter.HandleFunc("POST /api/v1/logout", auth.Authorize(auth.Logout))
+	httpRouter.HandleFunc("POST /api/v1/register-user", handlers.UserController.RegisterNewUser)
+	httpRouter.HandleFunc("POST /api/v1/reset-password", handlers.UserController.RequestPasswordReset)
+	httpRouter.HandleFunc("POST /api/v1/reset-password/confirm", handlers.UserController.ConfirmPasswordReset)
+	httpRouter.HandleFunc("GET /api/v1/confirm-registartion/{confirmationKey}", handlers.UserController.ConfirmRegistration)
+	httpRouter.HandleFunc("GET /.well-known/jwks.json", auth.JWKS)
+
+	if handlers.OIDCController != nil {
+		httpRouter.HandleFunc("GET /api/v1/oidc/login", handlers.OIDCController.Login)
+		httpRouter.HandleFunc("GET /api/v1/oidc/callback", handlers.OIDCController.Callback)
+	}
+
+	//USER
+	httpRouter.HandleFunc("GET /api/v1/user/refresh-token/{refreshToken}", auth.Refresh)
+	httpRouter.HandleFunc("POST /api/v1/user/change-password", auth.Authorize(handlers.UserController.ChangePassword))
+	httpRouter.HandleFunc("POST /api/v1/user/user-details", auth.Authorize(handlers.UserController.UpdateUserDetails))
+	httpRouter.HandleFunc("GET /api/v1/user/2fa", auth.Authorize(handlers.TwoFactor.GetTwoFactorStatus))
+	httpRouter.HandleFunc("POST /api/v1/user/2fa/enroll", auth.Authorize(handlers.TwoFactor.EnrollTwoFactor))
+	httpRouter.HandleFunc("POST /api/v1/user/2fa/confirm", auth.Authorize(handlers.TwoFactor.ConfirmTwoFactor))
+	httpRouter.HandleFunc("POST /api/v1/user/2fa/disable", auth.Authorize(handlers.TwoFactor.DisableTwoFactor))
+	httpRouter.HandleFunc("POST /api/v1/user/2fa/recovery-codes", auth.Authorize(handlers.TwoFactor.RegenerateRecoveryCodes))
+	httpRouter.HandleFunc("POST /api/v1/user/api-keys", auth.Authorize(handlers.APIKeyController.CreateAPIKey))
+	httpRouter.HandleFunc("GET /api/v1/user/sessions", auth.Authorize(handlers.Sessions.ListSessions))
+	httpRouter.HandleFunc("DELETE /api/v1/user/sessions", auth.Authorize(handlers.Sessions.RevokeOtherSessions))
+	httpRouter.HandleFunc("DELETE /api/v1/user/sessions/{sessionID}", auth.Authorize(handlers.Sessions.RevokeSession))
+
+	httpRouter.HandleFunc("GET /api/v1/user/api-keys", auth.Authorize(handlers.APIKeyController.ListAPIKeys))
+	httpRouter.HandleFunc("DELETE /api/v1/user/api-keys/{apiKeyID}", auth.Authorize(handlers.APIKeyController.RevokeAPIKey))
+
+	//ORGANIZATIONS
+	httpRouter.HandleFunc("POST /api/v1/organizations", auth.Authorize(handlers.OrgController.CreateOrganization))
+	httpRouter.HandleFunc("GET /api/v1/organizations", auth.Authorize(handlers.OrgController.ListOrganizations))
+	httpRouter.HandleFunc("GET /api/v1/organizations/{organizationID}/members", auth.Authorize(handlers.OrgController.ListMembers, organizationMember))
+	httpRouter.HandleFunc("PUT /api/v1/organizations/{organizationID}/members", auth.Authorize(handlers.OrgController.SetMember, organizationOwner))
+	httpRouter.HandleFunc("DELETE /api/v1/organizations/{organizationID}/members/{userID}", auth.Authorize(handlers.OrgController.RemoveMember, organizationMember))
+
+	//RAG
+	httpRouter.HandleFunc("POST /api/v1/rag/create-vector-collection", auth.Authorize(handlers.RagController.CreateVectorCollection, writeCollections))
+	httpRouter.HandleFunc("GET /api/v1/rag/list-vector-collections", auth.Authorize(handlers.RagController.ListVectorCollections, readCollections))
+	httpRouter.HandleFunc("DELETE /api/v1/rag/delete-vector-collection/{collectionHash}", auth.Authorize(handlers.RagController.DeleteVectorCollection, writeCollections, collectionOwner))
+	httpRouter.HandleFunc("GET /api/v1/rag/collections/{collectionHash}/settings", auth.Authorize(handlers.RagController.GetVectorCollectionSettings, readCollections, collectionViewer))
+	httpRouter.HandleFunc("PUT /api/v1/rag/collections/{collectionHash}/settings", auth.Authorize(handlers.RagController.UpdateVectorCollectionSettings, writeCollections, collectionOwner))
+	httpRouter.HandleFunc("POST /api/v1/rag/collections/{collectionHash}/reembed", auth.Authorize(handlers.RagController.ReembedVectorCollection, writeCollections, collectionOwner))
+	httpRouter.HandleFunc("GET /api/v1/rag/collections/{collectionHash}/reembed-status", auth.Authorize(handlers.RagController.GetReembedStatus, readCollections, collectionViewer))
+	httpRouter.HandleFunc("GET /api/v1/rag/collections/{collectionHash}/grants", auth.Authorize(handlers.RagController.ListCollectionGrants, collectionOwner))
+	httpRouter.HandleFunc("PUT /api/v1/rag/collections/{collectionHash}/grants", auth.Authorize(handlers.RagController.GrantCollectionAccess, collectionOwner))
+	httpRouter.HandleFunc("DELETE /api/v1/rag/collections/{collectionHash}/grants/{userID}", auth.Authorize(handlers.RagController.RevokeCollectionAccess, collectionOwner))
+	httpRouter.HandleFunc("POST /api/v1/rag/upload-pdf-document", auth.Authorize(handlers.RagController.UploadPDFDocument, uploadDocuments))
+	httpRouter.HandleFunc("POST /api/v1/rag/upload-document", auth.Authorize(handlers.RagController.UploadDocument, uploadDocuments))
+	httpRouter.HandleFunc("GET /api/v1/rag/list-pdf-documents", auth.Authorize(handlers.RagController.ListPDFDocuments, readCollections))
+	httpRouter.HandleFunc("GET /api/v1/rag/list-documents", auth.Authorize(handlers.RagController.ListPDFDocuments, readCollections))
+	httpRouter.HandleFunc("GET /api/v1/rag/documents/{documentID}/ingestion-status", auth.Authorize(handlers.RagController.GetDocumentIngestionStatus, readCollections, collectionViewer))
+	httpRouter.HandleFunc("DELETE /api/v1/rag/documents/{documentID}", auth.Authorize(handlers.RagController.DeleteDocument, writeCollections, collectionOwner))
+	httpRouter.HandleFunc("POST /api/v1/rag/documents/{documentID}/reindex", auth.Authorize(handlers.RagController.ReindexDocument, uploadDocuments, collectionEditor))
+	httpRouter.HandleFunc("POST /api/v1/rag/prompt-template", auth.Authorize(handlers.RagController.SetupPromptTemplateForCollection, writeCollections))
+	httpRouter.HandleFunc("GET /api/v1/rag/get-prompt-template/{collectionHash}", auth.Authorize(handlers.RagController.GetPromptTemplateForCollection, readCollections, collectionViewer))
+	httpRouter.HandleFunc("DELETE /api/v1/rag/delete-prompt-template/{promptTemplateID}", auth.Authorize(handlers.RagController.DeletePromptTemplateForCollection, writeCollections, collectionOwner))
+
+	//CHAT
+	httpRouter.HandleFunc("POST /api/v1/chat/start-chat-session", auth.Authorize(handlers.ChatController.StartChatSession, writeChat))
+	httpRouter.HandleFunc("GET /api/v1/chat/list-chat-sessions", auth.Authorize(handlers.ChatController.ListChatSessions, readChat))
+	httpRouter.HandleFunc("POST /api/v1/chat/send-message-to-chat-session", auth.Authorize(handlers.ChatController.SendMessageToChatSession, writeChat))
+	httpRouter.HandleFunc("POST /api/v1/chat/stream-message-to-chat-session", auth.Authorize(handlers.ChatController.StreamMessageToChatSession, writeChat))
+	httpRouter.HandleFunc("GET /api/v1/chat/get-chat-session-messages/{chatSessionID}", auth.Authorize(handlers.ChatController.GetChatSessionMessages, readChat))
+	httpRouter.HandleFunc("DELETE /api/v1/chat/delete-chat-session/{chatSessionID}", auth.Authorize(handlers.ChatController.DeleteChatSession, writeChat))
+
+	//ADMIN
+	httpRouter.HandleFunc("GET /api/v1/admin/users", auth.Authorize(handlers.AdminController.ListUsers, admin))
+	httpRouter.HandleFunc("GET /api/v1/admin/users/{userID}", auth.Authorize(handlers.AdminController.GetUser, admin))
+	httpRouter.HandleFunc("PUT /api/v1/admin/users/{userID}/roles", auth.Authorize(handlers.AdminController.UpdateUserRoles, admin))
+	httpRouter.HandleFunc("POST /api/v1/admin/users/{userID}/lock", auth.Authorize(handlers.AdminController.LockUser, admin))
+	httpRouter.HandleFunc("POST /api/v1/admin/users/{userID}/unlock", auth.Authorize(handlers.AdminController.UnlockUser, admin))
+	httpRouter.HandleFunc("POST /api/v1/admin/users/{userID}/force-password-reset", auth.Authorize(handlers.AdminController.ForcePasswordReset, admin))
+	httpRouter.HandleFunc("POST /api/v1/admin/users/{userID}/resend-confirmation", auth.Authorize(handlers.AdminController.ResendConfirmation, admin))
+	httpRouter.HandleFunc("POST /api/v1/admin/users/{userID}/reset-2fa", auth.Authorize(handlers.AdminController.ResetTwoFactor, admin))
+	httpRouter.HandleFunc("DELETE /api/v1/admin/users/{userID}", auth.Authorize(handlers.AdminController.DeleteUser, admin))
+	httpRouter.HandleFunc("GET /api/v1/admin/settings", auth.Authorize(handlers.AdminController.GetSettings, admin))
+	httpRouter.HandleFunc("PUT /api/v1/admin/settings", auth.Authorize(handlers.AdminController.UpdateSettings, admin))
+
+	fileServer := http.FileServer(FileSystem{http.Dir("assets/uploads/")})
+	httpRouter.Handle("/static/", http.StripPrefix(strings.TrimRight("/static/", "/"), fileServer))
+
+	return cors.AllowAll().Handler(httpRouter)
+}
+
+// splitList parses a comma separated environment value, ignoring blanks.
+func splitList(value string) []string {
+	list := make([]string, 0)
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
 }
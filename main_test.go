@@ -0,0 +1,2672 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+
+	"github.com/zarkopopovski/rag-chat/clientinfo"
+	"github.com/zarkopopovski/rag-chat/controllers"
+	"github.com/zarkopopovski/rag-chat/db"
+	"github.com/zarkopopovski/rag-chat/ingestion"
+	"github.com/zarkopopovski/rag-chat/jwtkeys"
+	"github.com/zarkopopovski/rag-chat/oidc"
+	"github.com/zarkopopovski/rag-chat/providers"
+	"github.com/zarkopopovski/rag-chat/retrieval"
+	"github.com/zarkopopovski/rag-chat/totp"
+	"github.com/zarkopopovski/rag-chat/vectorstore"
+)
+
+const testAnswer = "The office opens at nine in the morning."
+
+// testApp runs the whole application against a temporary SQLite database, the
+// SQLite vector store and the fake provider, so no network access is needed.
+type testApp struct {
+	t          *testing.T
+	server     *httptest.Server
+	dbHandler  *db.DBManager
+	providers  *providers.Registry
+	accessKeys *jwtkeys.KeySet
+	handlers   *Handlers
+	queue      *ingestion.Queue
+
+	stopWorkers context.CancelFunc
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	return newTestAppWithOIDC(t, nil)
+}
+
+// newTestAppWithOIDC also enables single sign-on through idp unless it is nil.
+func newTestAppWithOIDC(t *testing.T, idp *mockIdP) *testApp {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	dbHandler := db.NewDBConnection(filepath.Join(dir, "test.db"))
+
+	vectorStore, err := vectorstore.New("sqlite", dbHandler, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providerRegistry := providers.NewRegistry(providers.Fake, "fake-chat", "fake-embedding")
+	providerRegistry.Register(providers.Fake, providers.FakeProvider{Responses: []string{testAnswer}})
+
+	ingestionQueue := ingestion.NewQueue(dbHandler, vectorStore, providerRegistry, dir+string(filepath.Separator))
+	ingestionQueue.Backoff = time.Millisecond
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessKey, err := jwtkeys.NewPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessKeys, err := jwtkeys.NewKeySet(accessKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshKeys, err := jwtkeys.Config{Secret: "refresh secret used only by the tests"}.KeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The callback URL has to be known before the router is built.
+	server := httptest.NewUnstartedServer(nil)
+
+	var oidcController *controllers.OIDCController
+	if idp != nil {
+		oidcProvider, err := oidc.NewProvider(oidc.Config{
+			IssuerURL:    idp.server.URL,
+			ClientID:     mockIdPClientID,
+			ClientSecret: mockIdPClientSecret,
+			RedirectURL:  "http://" + server.Listener.Addr().String() + "/api/v1/oidc/callback",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		oidcController = &controllers.OIDCController{
+			Provider:    oidcProvider,
+			IssuerURL:   idp.server.URL,
+			GroupsClaim: "groups",
+			AdminGroups: []string{"rag-admins"},
+		}
+	}
+
+	rerankers := &retrieval.Rerankers{Providers: providerRegistry}
+
+	handlers := newHandlers(dbHandler, accessKeys, refreshKeys, vectorStore, providerRegistry, rerankers, ingestionQueue, oidcController)
+	handlers.Authentication.Clients = &clientinfo.Resolver{TrustProxyHeaders: true}
+
+	server.Config.Handler = newRouter(handlers)
+	server.Start()
+
+	app := &testApp{t: t, server: server, dbHandler: dbHandler, providers: providerRegistry, accessKeys: accessKeys, handlers: handlers, queue: ingestionQueue}
+	app.startWorkers()
+
+	t.Cleanup(func() {
+		server.Close()
+		app.stopWorkers()
+		ingestionQueue.Wait()
+		dbHandler.DB.Close()
+	})
+
+	return app
+}
+
+// startWorkers starts the ingestion workers, as the application does when it
+// starts up.
+func (app *testApp) startWorkers() {
+	app.t.Helper()
+
+	workersContext, stopWorkers := context.WithCancel(context.Background())
+	if err := app.queue.Start(workersContext); err != nil {
+		app.t.Fatal(err)
+	}
+
+	app.stopWorkers = stopWorkers
+}
+
+// shutDownWorkers stops the ingestion workers, as the application does when
+// it shuts down.
+func (app *testApp) shutDownWorkers() {
+	app.stopWorkers()
+	app.queue.Wait()
+}
+
+func (app *testApp) request(method string, path string, token string, contentType string, body io.Reader) (int, []byte) {
+	app.t.Helper()
+
+	req, err := http.NewRequest(method, app.server.URL+path, body)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := app.server.Client().Do(req)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	return resp.StatusCode, b
+}
+
+// doJSON sends payload as JSON and decodes the response into out, failing the
+// test unless the response status is wantStatus.
+func (app *testApp) doJSON(method string, path string, token string, payload interface{}, wantStatus int, out interface{}) {
+	app.t.Helper()
+
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			app.t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	status, b := app.request(method, path, token, "application/json", body)
+	if status != wantStatus {
+		app.t.Fatalf("%s %s: got status %d, want %d: %s", method, path, status, wantStatus, b)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			app.t.Fatalf("%s %s: decoding %q: %v", method, path, b, err)
+		}
+	}
+}
+
+func (app *testApp) registerAndLogin(email string, password string) string {
+	app.t.Helper()
+
+	app.doJSON("POST", "/api/v1/register-user", "", map[string]string{"email": email, "password": password}, http.StatusOK, nil)
+
+	var out map[string]interface{}
+	app.doJSON("POST", "/api/v1/login", "", map[string]string{"email": email, "password": password}, http.StatusForbidden, &out)
+
+	var confirmationToken string
+	if err := app.dbHandler.DB.Get(&confirmationToken, "SELECT confirmation_token FROM user WHERE email=$1", email); err != nil {
+		app.t.Fatal(err)
+	}
+
+	app.doJSON("GET", "/api/v1/confirm-registartion/"+confirmationToken, "", nil, http.StatusOK, nil)
+
+	accessToken, _ := app.login(email, password)
+
+	return accessToken
+}
+
+func (app *testApp) login(email string, password string) (string, string) {
+	app.t.Helper()
+
+	var login struct {
+		Data struct {
+			Tokens struct {
+				AccessToken  string
+				RefreshToken string
+			} `json:"tokens"`
+		} `json:"data"`
+	}
+	app.doJSON("POST", "/api/v1/login", "", map[string]string{"email": email, "password": password}, http.StatusOK, &login)
+
+	if login.Data.Tokens.AccessToken == "" || login.Data.Tokens.RefreshToken == "" {
+		app.t.Fatal("login returned no tokens")
+	}
+
+	return login.Data.Tokens.AccessToken, login.Data.Tokens.RefreshToken
+}
+
+func (app *testApp) createCollection(token string, name string) string {
+	app.t.Helper()
+
+	return app.createCollectionOn(token, name, providers.Fake, "")
+}
+
+// createCollectionOn creates a collection embedded by model of provider.
+func (app *testApp) createCollectionOn(token string, name string, provider string, model string) string {
+	app.t.Helper()
+
+	app.doJSON("POST", "/api/v1/rag/create-vector-collection", token, map[string]string{"name": name, "embedding_provider": provider, "embedding_model": model}, http.StatusOK, nil)
+
+	var collections struct {
+		Data []struct {
+			Name               string `json:"name"`
+			CollectionHash     string `json:"collection_hash"`
+			EmbeddingProvider  string `json:"embedding_provider"`
+			EmbeddingDimension int    `json:"embedding_dimension"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", token, nil, http.StatusOK, &collections)
+
+	for _, collection := range collections.Data {
+		if collection.Name == name {
+			if collection.EmbeddingProvider != provider || collection.EmbeddingDimension == 0 {
+				app.t.Fatalf("collection %s recorded provider %q and dimension %d", name, collection.EmbeddingProvider, collection.EmbeddingDimension)
+			}
+			return collection.CollectionHash
+		}
+	}
+
+	app.t.Fatalf("collection %s is not listed", name)
+	return ""
+}
+
+// upload sends a document and waits until its ingestion job completes.
+func (app *testApp) upload(token string, collectionHash string, fileName string, content string) int64 {
+	app.t.Helper()
+
+	documentID := app.startUpload(token, collectionHash, fileName, content)
+
+	app.waitForIngestion(token, documentID)
+
+	return documentID
+}
+
+// startUpload sends a document without waiting for its ingestion.
+func (app *testApp) startUpload(token string, collectionHash string, fileName string, content string) int64 {
+	app.t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fw, err := mw.CreateFormFile("file", fileName)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.WriteField("collectionHash", collectionHash)
+	mw.Close()
+
+	status, b := app.request("POST", "/api/v1/rag/upload-document", token, mw.FormDataContentType(), &buf)
+	if status != http.StatusOK {
+		app.t.Fatalf("upload: got status %d: %s", status, b)
+	}
+
+	var uploaded struct {
+		Data struct {
+			DocumentID int64 `json:"document_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(b, &uploaded); err != nil {
+		app.t.Fatal(err)
+	}
+
+	return uploaded.Data.DocumentID
+}
+
+func (app *testApp) waitForIngestion(token string, documentID int64) {
+	app.t.Helper()
+
+	job := app.waitForJob(token, documentID)
+	if job.Status == ingestion.StatusFailed {
+		app.t.Fatalf("ingestion of document %d failed: %s", documentID, job.LastError)
+	}
+}
+
+type ingestionJob struct {
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	MaxAttempts int    `json:"max_attempts"`
+	LastError   string `json:"last_error"`
+}
+
+// waitForJob waits until the latest ingestion job of a document has either
+// completed or failed for good.
+func (app *testApp) waitForJob(token string, documentID int64) ingestionJob {
+	app.t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for time.Now().Before(deadline) {
+		var job struct {
+			Data ingestionJob `json:"data"`
+		}
+		app.doJSON("GET", fmt.Sprintf("/api/v1/rag/documents/%d/ingestion-status", documentID), token, nil, http.StatusOK, &job)
+
+		if job.Data.Status == ingestion.StatusCompleted || job.Data.Status == ingestion.StatusFailed {
+			return job.Data
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	app.t.Fatalf("ingestion of document %d did not finish", documentID)
+	return ingestionJob{}
+}
+
+func (app *testApp) startChatSession(token string, collectionHash string) string {
+	app.t.Helper()
+
+	app.doJSON("POST", "/api/v1/rag/prompt-template", token, map[string]string{"template": "Answer from the context only.", "collection_hash": collectionHash}, http.StatusOK, nil)
+
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", token, map[string]string{"collection_hash": collectionHash}, http.StatusOK, &session)
+
+	if session.SessionID == "" {
+		app.t.Fatal("start-chat-session returned no session_id")
+	}
+
+	return session.SessionID
+}
+
+func (app *testApp) lastChatCall() []llms.MessageContent {
+	app.t.Helper()
+
+	chatModel, err := app.providers.ChatModel("", "")
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	calls := chatModel.(*providers.FakeChatModel).Calls()
+	if len(calls) == 0 {
+		app.t.Fatal("the chat model was never called")
+	}
+
+	return calls[len(calls)-1]
+}
+
+type chatSource struct {
+	DocumentID int64  `json:"document_id"`
+	FileName   string `json:"file_name"`
+	Snippet    string `json:"snippet"`
+}
+
+func TestEndToEndDocumentChat(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("alice@example.com", "correct horse battery")
+	collectionHash := app.createCollection(token, "handbook")
+
+	documentID := app.upload(token, collectionHash, "hours.txt", "Opening hours\n\nThe office opens at nine in the morning and closes at five.")
+	app.upload(token, collectionHash, "parking.md", "# Parking\n\nVisitors park in the garage behind the building.")
+
+	var documents struct {
+		Data []struct {
+			FileName  string `json:"file_name"`
+			IsIndexed bool   `json:"is_indexed"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/rag/list-documents", token, nil, http.StatusOK, &documents)
+	if len(documents.Data) != 2 {
+		t.Fatalf("got %d documents, want 2", len(documents.Data))
+	}
+	for _, document := range documents.Data {
+		if !document.IsIndexed {
+			t.Errorf("document %s is not marked as indexed", document.FileName)
+		}
+	}
+
+	sessionID := app.startChatSession(token, collectionHash)
+
+	var answer struct {
+		Data    string       `json:"data"`
+		Sources []chatSource `json:"sources"`
+	}
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": "When does the office open?"}, http.StatusOK, &answer)
+
+	if answer.Data != testAnswer {
+		t.Errorf("got answer %q, want %q", answer.Data, testAnswer)
+	}
+	if len(answer.Sources) == 0 || answer.Sources[0].DocumentID != documentID {
+		t.Fatalf("the best source should be document %d, got %+v", documentID, answer.Sources)
+	}
+	if !strings.HasSuffix(answer.Sources[0].FileName, "hours.txt") {
+		t.Errorf("got source file %q, want hours.txt", answer.Sources[0].FileName)
+	}
+
+	call := app.lastChatCall()
+	if got := call[0].Role; got != llms.ChatMessageTypeSystem {
+		t.Errorf("the conversation should start with the prompt template, got role %s", got)
+	}
+	if prompt := fmt.Sprint(call[len(call)-1].Parts); !strings.Contains(prompt, "nine in the morning") {
+		t.Errorf("the retrieved context was not passed to the model: %s", prompt)
+	}
+
+	var messages struct {
+		Data []struct {
+			Message     string `json:"message"`
+			MessageRole string `json:"message_role"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/chat/get-chat-session-messages/"+sessionID, token, nil, http.StatusOK, &messages)
+	if n := len(messages.Data); n != 2 || messages.Data[n-1].Message != testAnswer {
+		t.Errorf("unexpected session history: %+v", messages.Data)
+	}
+
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/rag/documents/%d", documentID), token, nil, http.StatusOK, nil)
+
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": "When does the office open?"}, http.StatusOK, &answer)
+	for _, source := range answer.Sources {
+		if source.DocumentID == documentID {
+			t.Errorf("deleted document %d is still retrieved", documentID)
+		}
+	}
+
+	app.doJSON("DELETE", "/api/v1/chat/delete-chat-session/"+sessionID, token, nil, http.StatusOK, nil)
+	app.doJSON("DELETE", "/api/v1/rag/delete-vector-collection/"+collectionHash, token, nil, http.StatusOK, nil)
+
+	var collections struct {
+		Data []interface{} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", token, nil, http.StatusOK, &collections)
+	if len(collections.Data) != 0 {
+		t.Errorf("got %d collections after deleting the only one", len(collections.Data))
+	}
+}
+
+func TestEndToEndStreamingChat(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("bob@example.com", "another long password")
+	collectionHash := app.createCollection(token, "streaming")
+	app.upload(token, collectionHash, "hours.txt", "The office opens at nine in the morning.")
+	sessionID := app.startChatSession(token, collectionHash)
+
+	b, _ := json.Marshal(map[string]string{"session_id": sessionID, "user_message": "When does the office open?"})
+	status, body := app.request("POST", "/api/v1/chat/stream-message-to-chat-session", token, "application/json", bytes.NewReader(b))
+	if status != http.StatusOK {
+		t.Fatalf("got status %d: %s", status, body)
+	}
+
+	var streamed strings.Builder
+	var done map[string]interface{}
+	event := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+
+			switch event {
+			case "token":
+				var chunk map[string]string
+				if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+					t.Fatal(err)
+				}
+				streamed.WriteString(chunk["content"])
+			case "done":
+				if err := json.Unmarshal([]byte(data), &done); err != nil {
+					t.Fatal(err)
+				}
+			case "error":
+				t.Fatalf("stream failed: %s", data)
+			}
+		}
+	}
+
+	if streamed.String() != testAnswer {
+		t.Errorf("got streamed answer %q, want %q", streamed.String(), testAnswer)
+	}
+	if done == nil || done["message_id"] == nil {
+		t.Fatalf("missing done event: %s", body)
+	}
+}
+
+func TestEndToEndCollectionsAreIsolated(t *testing.T) {
+	app := newTestApp(t)
+
+	aliceToken := app.registerAndLogin("alice@example.com", "correct horse battery")
+	bobToken := app.registerAndLogin("bob@example.com", "another long password")
+
+	collectionHash := app.createCollection(aliceToken, "private")
+	documentID := app.upload(aliceToken, collectionHash, "secret.txt", "Only Alice may read this.")
+
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", bobToken, map[string]string{"collection_hash": collectionHash}, http.StatusNotFound, nil)
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/rag/documents/%d", documentID), bobToken, nil, http.StatusNotFound, nil)
+	app.doJSON("DELETE", "/api/v1/rag/delete-vector-collection/"+collectionHash, bobToken, nil, http.StatusNotFound, nil)
+
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", "", nil, http.StatusUnauthorized, nil)
+}
+
+func TestEndToEndPasswordHashing(t *testing.T) {
+	app := newTestApp(t)
+
+	app.doJSON("POST", "/api/v1/register-user", "", map[string]string{"email": "short@example.com", "password": "short"}, http.StatusBadRequest, nil)
+	app.doJSON("POST", "/api/v1/register-user", "", map[string]string{"email": "weak@example.com", "password": "Password123"}, http.StatusBadRequest, nil)
+
+	token := app.registerAndLogin("carol@example.com", "a sufficiently long passphrase")
+	app.doJSON("POST", "/api/v1/user/change-password", token, map[string]string{"password": "qwertyuiop"}, http.StatusBadRequest, nil)
+
+	var stored string
+	if err := app.dbHandler.DB.Get(&stored, "SELECT password FROM user WHERE email=$1", "carol@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "$argon2id$") {
+		t.Fatalf("new passwords should be stored as argon2id, got %q", stored)
+	}
+
+	// SHA-1 of "legacy password", as stored before the switch to argon2id.
+	_, err := app.dbHandler.DB.Exec("INSERT INTO user(email, password, confirmed, last_login, date_created, date_modified, confirmation_token, roles) VALUES($1, $2, true, datetime('now'), datetime('now'), datetime('now'), 'legacy', 'USER')",
+		"dave@example.com", "faeb5f917545ae86dad3e363f0c758b2ff94777c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.doJSON("POST", "/api/v1/login", "", map[string]string{"email": "dave@example.com", "password": "wrong password"}, http.StatusNotFound, nil)
+	app.doJSON("POST", "/api/v1/login", "", map[string]string{"email": "dave@example.com", "password": "legacy password"}, http.StatusOK, nil)
+
+	if err := app.dbHandler.DB.Get(&stored, "SELECT password FROM user WHERE email=$1", "dave@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "$argon2id$") {
+		t.Fatalf("the legacy hash should be upgraded on login, got %q", stored)
+	}
+
+	app.doJSON("POST", "/api/v1/login", "", map[string]string{"email": "dave@example.com", "password": "legacy password"}, http.StatusOK, nil)
+}
+
+func TestEndToEndTokensAndJWKS(t *testing.T) {
+	app := newTestApp(t)
+
+	app.registerAndLogin("erin@example.com", "a sufficiently long passphrase")
+	accessToken, refreshToken := app.login("erin@example.com", "a sufficiently long passphrase")
+
+	var jwks struct {
+		Keys []struct {
+			KeyType   string `json:"kty"`
+			KeyID     string `json:"kid"`
+			Algorithm string `json:"alg"`
+			Curve     string `json:"crv"`
+			X         string `json:"x"`
+		} `json:"keys"`
+	}
+	app.doJSON("GET", "/.well-known/jwks.json", "", nil, http.StatusOK, &jwks)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Algorithm != jwtkeys.EdDSA || jwks.Keys[0].Curve != "Ed25519" {
+		t.Fatalf("unexpected JWKS: %+v", jwks)
+	}
+
+	// Verify the access token the way another service would, from the JWKS alone.
+	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["kid"] != jwks.Keys[0].KeyID {
+			return nil, fmt.Errorf("unexpected kid %v", token.Header["kid"])
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+		return ed25519.PublicKey(x), err
+	})
+	if err != nil || !token.Valid || token.Method.Alg() != jwtkeys.EdDSA {
+		t.Fatalf("the access token does not verify against the JWKS: %v", err)
+	}
+
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", accessToken, nil, http.StatusOK, nil)
+
+	// The refresh token must not work as an access token.
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", refreshToken, nil, http.StatusUnauthorized, nil)
+
+	// Neither may a token signed with a key rag-chat does not know.
+	_, otherPrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := jwtkeys.NewPrivateKey(otherPrivateKey)
+	otherKeys, _ := jwtkeys.NewKeySet(otherKey)
+	forged, err := otherKeys.Sign(token.Claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", forged, nil, http.StatusUnauthorized, nil)
+
+	var refreshed struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	app.doJSON("GET", "/api/v1/user/refresh-token/"+refreshToken, "", nil, http.StatusCreated, &refreshed)
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", refreshed.AccessToken, nil, http.StatusOK, nil)
+
+	app.doJSON("POST", "/api/v1/logout", refreshed.AccessToken, nil, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", refreshed.AccessToken, nil, http.StatusUnauthorized, nil)
+}
+
+func TestEndToEndAdminUserManagement(t *testing.T) {
+	app := newTestApp(t)
+
+	app.registerAndLogin("root@example.com", "a sufficiently long passphrase")
+	userToken := app.registerAndLogin("frank@example.com", "frank's long passphrase")
+
+	app.doJSON("GET", "/api/v1/admin/users", userToken, nil, http.StatusForbidden, nil)
+
+	if _, err := app.dbHandler.DB.Exec("UPDATE user SET roles='USER:ADMIN' WHERE email=$1", "root@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	adminToken, _ := app.login("root@example.com", "a sufficiently long passphrase")
+
+	var users struct {
+		Data struct {
+			Users []struct {
+				ID    int64  `json:"id"`
+				Email string `json:"email"`
+			} `json:"users"`
+			Total int `json:"total"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/admin/users?q=frank", adminToken, nil, http.StatusOK, &users)
+	if users.Data.Total != 1 || len(users.Data.Users) != 1 || users.Data.Users[0].Email != "frank@example.com" {
+		t.Fatalf("unexpected search result: %+v", users.Data)
+	}
+	userPath := fmt.Sprintf("/api/v1/admin/users/%d", users.Data.Users[0].ID)
+
+	collectionHash := app.createCollection(userToken, "frank's notes")
+	app.waitForIngestion(userToken, app.upload(userToken, collectionHash, "notes.txt", "Frank keeps notes here."))
+
+	var details struct {
+		Data struct {
+			Usage struct {
+				Collections int `json:"collections"`
+				Documents   int `json:"documents"`
+			} `json:"usage"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", userPath, adminToken, nil, http.StatusOK, &details)
+	if details.Data.Usage.Collections != 1 || details.Data.Usage.Documents != 1 {
+		t.Fatalf("unexpected usage: %+v", details.Data.Usage)
+	}
+
+	app.doJSON("PUT", userPath+"/roles", adminToken, map[string][]string{"roles": {"SUPERUSER"}}, http.StatusBadRequest, nil)
+	app.doJSON("PUT", userPath+"/roles", adminToken, map[string][]string{"roles": {"ADMIN"}}, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/admin/users", userToken, nil, http.StatusOK, nil)
+	app.doJSON("PUT", userPath+"/roles", adminToken, map[string][]string{"roles": {}}, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/admin/users", userToken, nil, http.StatusForbidden, nil)
+
+	// Locking signs the user out and keeps them from signing in again.
+	app.doJSON("POST", userPath+"/lock", adminToken, nil, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", userToken, nil, http.StatusUnauthorized, nil)
+	app.doJSON("POST", "/api/v1/login", "", map[string]string{"email": "frank@example.com", "password": "frank's long passphrase"}, http.StatusForbidden, nil)
+	app.doJSON("POST", userPath+"/unlock", adminToken, nil, http.StatusOK, nil)
+	userToken, _ = app.login("frank@example.com", "frank's long passphrase")
+
+	app.doJSON("POST", userPath+"/force-password-reset", adminToken, nil, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", userToken, nil, http.StatusUnauthorized, nil)
+	app.doJSON("POST", "/api/v1/login", "", map[string]string{"email": "frank@example.com", "password": "frank's long passphrase"}, http.StatusNotFound, nil)
+
+	app.doJSON("POST", userPath+"/resend-confirmation", adminToken, nil, http.StatusConflict, nil)
+
+	var adminID int64
+	if err := app.dbHandler.DB.Get(&adminID, "SELECT id FROM user WHERE email=$1", "root@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/admin/users/%d", adminID), adminToken, nil, http.StatusConflict, nil)
+
+	app.doJSON("DELETE", userPath, adminToken, nil, http.StatusOK, nil)
+	app.doJSON("GET", userPath, adminToken, nil, http.StatusNotFound, nil)
+
+	var remaining int
+	err := app.dbHandler.DB.Get(&remaining, "SELECT (SELECT COUNT(*) FROM vector_collections) + (SELECT COUNT(*) FROM documents) + (SELECT COUNT(*) FROM vector_points)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 0 {
+		t.Fatalf("%d collections, documents or points survived the deletion", remaining)
+	}
+}
+
+func TestEndToEndSharedCollections(t *testing.T) {
+	app := newTestApp(t)
+
+	aliceToken := app.registerAndLogin("alice@example.com", "correct horse battery")
+	bobToken := app.registerAndLogin("bob@example.com", "another long password")
+	carolToken := app.registerAndLogin("carol@example.com", "a sufficiently long passphrase")
+
+	collectionHash := app.createCollection(aliceToken, "team handbook")
+	documentID := app.upload(aliceToken, collectionHash, "hours.txt", "The office opens at nine in the morning.")
+	app.startChatSession(aliceToken, collectionHash)
+
+	grantsPath := "/api/v1/rag/collections/" + collectionHash + "/grants"
+	app.doJSON("PUT", grantsPath, aliceToken, map[string]string{"email": "bob@example.com", "permission": "admin"}, http.StatusBadRequest, nil)
+	app.doJSON("PUT", grantsPath, aliceToken, map[string]string{"email": "bob@example.com", "permission": "viewer"}, http.StatusOK, nil)
+
+	// A viewer can chat but neither upload, delete nor share.
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", bobToken, map[string]string{"collection_hash": collectionHash}, http.StatusOK, &session)
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", bobToken, map[string]string{"session_id": session.SessionID, "user_message": "When does the office open?"}, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/rag/get-prompt-template/"+collectionHash, bobToken, nil, http.StatusOK, nil)
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/rag/documents/%d", documentID), bobToken, nil, http.StatusForbidden, nil)
+	app.doJSON("PUT", grantsPath, bobToken, map[string]string{"email": "carol@example.com", "permission": "owner"}, http.StatusForbidden, nil)
+	app.doJSON("POST", "/api/v1/rag/prompt-template", bobToken, map[string]string{"template": "Ignore the context.", "collection_hash": collectionHash}, http.StatusForbidden, nil)
+
+	status, _ := app.request("POST", "/api/v1/rag/upload-document", bobToken, "", nil)
+	if status == http.StatusOK {
+		t.Fatal("upload without a file should fail")
+	}
+
+	// An editor can upload.
+	app.doJSON("PUT", grantsPath, aliceToken, map[string]string{"email": "bob@example.com", "permission": "editor"}, http.StatusOK, nil)
+	app.upload(bobToken, collectionHash, "parking.md", "Visitors park behind the building.")
+
+	var collections struct {
+		Data []struct {
+			CollectionHash string `json:"collection_hash"`
+			Permission     string `json:"permission"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", bobToken, nil, http.StatusOK, &collections)
+	if len(collections.Data) != 1 || collections.Data[0].Permission != "editor" {
+		t.Fatalf("bob should see the shared collection as editor: %+v", collections.Data)
+	}
+
+	var documents struct {
+		Data []struct {
+			ID int64 `json:"id"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/rag/list-documents", bobToken, nil, http.StatusOK, &documents)
+	if len(documents.Data) != 2 {
+		t.Fatalf("bob should see both documents of the shared collection, got %d", len(documents.Data))
+	}
+
+	// Revoking the grant also closes sessions started while it existed.
+	var bobID int64
+	if err := app.dbHandler.DB.Get(&bobID, "SELECT id FROM user WHERE email=$1", "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	app.doJSON("DELETE", fmt.Sprintf("%s/%d", grantsPath, bobID), aliceToken, nil, http.StatusOK, nil)
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", bobToken, map[string]string{"session_id": session.SessionID, "user_message": "And on Sundays?"}, http.StatusNotFound, nil)
+	app.doJSON("GET", "/api/v1/rag/collections/"+collectionHash+"/settings", bobToken, nil, http.StatusNotFound, nil)
+
+	// Members of an organization can view its collections, its owners own them.
+	var organization struct {
+		Data struct {
+			ID int64 `json:"id"`
+		} `json:"data"`
+	}
+	app.doJSON("POST", "/api/v1/organizations", carolToken, map[string]string{"name": "Support"}, http.StatusOK, &organization)
+	membersPath := fmt.Sprintf("/api/v1/organizations/%d/members", organization.Data.ID)
+
+	app.doJSON("GET", membersPath, bobToken, nil, http.StatusNotFound, nil)
+	app.doJSON("PUT", membersPath, carolToken, map[string]string{"email": "bob@example.com", "role": "member"}, http.StatusOK, nil)
+	app.doJSON("PUT", membersPath, bobToken, map[string]string{"email": "alice@example.com", "role": "owner"}, http.StatusForbidden, nil)
+
+	var carolID int64
+	if err := app.dbHandler.DB.Get(&carolID, "SELECT id FROM user WHERE email=$1", "carol@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	app.doJSON("DELETE", fmt.Sprintf("%s/%d", membersPath, carolID), carolToken, nil, http.StatusConflict, nil)
+
+	app.doJSON("POST", "/api/v1/rag/create-vector-collection", bobToken, map[string]interface{}{"name": "support answers", "organization_id": organization.Data.ID}, http.StatusOK, nil)
+
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", carolToken, nil, http.StatusOK, &collections)
+	if len(collections.Data) != 1 || collections.Data[0].Permission != "owner" {
+		t.Fatalf("the organization owner should own its collections: %+v", collections.Data)
+	}
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", aliceToken, map[string]string{"collection_hash": collections.Data[0].CollectionHash}, http.StatusNotFound, nil)
+
+	app.doJSON("GET", "/api/v1/rag/collections/"+collections.Data[0].CollectionHash+"/settings", bobToken, nil, http.StatusOK, nil)
+	app.doJSON("DELETE", fmt.Sprintf("%s/%d", membersPath, bobID), bobToken, nil, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/rag/collections/"+collections.Data[0].CollectionHash+"/settings", bobToken, nil, http.StatusNotFound, nil)
+}
+
+func TestEndToEndAPIKeys(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("grace@example.com", "a sufficiently long passphrase")
+	collectionHash := app.createCollection(token, "support")
+	otherHash := app.createCollection(token, "private notes")
+	app.upload(token, collectionHash, "hours.txt", "The office opens at nine in the morning.")
+	app.startChatSession(token, collectionHash)
+
+	app.doJSON("POST", "/api/v1/user/api-keys", token, map[string]interface{}{"name": "bot", "scopes": []string{"chat:delete"}}, http.StatusBadRequest, nil)
+
+	var created struct {
+		Data struct {
+			APIKey struct {
+				ID int64 `json:"id"`
+			} `json:"api_key"`
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	app.doJSON("POST", "/api/v1/user/api-keys", token, map[string]interface{}{"name": "support bot", "scopes": []string{"chat:write"}, "collection_hash": collectionHash, "expires_in_days": 30}, http.StatusOK, &created)
+	key := created.Data.Key
+
+	var stored string
+	if err := app.dbHandler.DB.Get(&stored, "SELECT key_hash FROM api_keys WHERE id=$1", created.Data.APIKey.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, "rck_") || strings.Contains(stored, key) {
+		t.Fatalf("unexpected key %q stored as %q", key, stored)
+	}
+
+	// The key can chat on its collection and nothing else.
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", key, map[string]string{"collection_hash": collectionHash}, http.StatusOK, &session)
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", key, map[string]string{"session_id": session.SessionID, "user_message": "When does the office open?"}, http.StatusOK, nil)
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", key, map[string]string{"collection_hash": otherHash}, http.StatusNotFound, nil)
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", key, nil, http.StatusForbidden, nil)
+	app.doJSON("POST", "/api/v1/user/api-keys", key, map[string]interface{}{"name": "escalated", "scopes": []string{"collections:write"}}, http.StatusForbidden, nil)
+	app.doJSON("POST", "/api/v1/logout", key, nil, http.StatusForbidden, nil)
+
+	var keys struct {
+		Data []struct {
+			KeyPrefix  string     `json:"key_prefix"`
+			LastUsedAt *time.Time `json:"last_used_at"`
+			ExpiresAt  *time.Time `json:"expires_at"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/user/api-keys", token, nil, http.StatusOK, &keys)
+	if len(keys.Data) != 1 || keys.Data[0].LastUsedAt == nil || keys.Data[0].ExpiresAt == nil || !strings.HasPrefix(key, keys.Data[0].KeyPrefix) {
+		t.Fatalf("unexpected key listing: %+v", keys.Data)
+	}
+
+	// A key with read access to every collection lists them all.
+	app.doJSON("POST", "/api/v1/user/api-keys", token, map[string]interface{}{"name": "reporting", "scopes": []string{"collections:read"}}, http.StatusOK, &created)
+	var collections struct {
+		Data []struct {
+			CollectionHash string `json:"collection_hash"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", created.Data.Key, nil, http.StatusOK, &collections)
+	if len(collections.Data) != 2 {
+		t.Fatalf("the reporting key should see both collections, got %d", len(collections.Data))
+	}
+
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/user/api-keys/%d", created.Data.APIKey.ID), token, nil, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", created.Data.Key, nil, http.StatusUnauthorized, nil)
+
+	if _, err := app.dbHandler.DB.Exec("UPDATE api_keys SET expires_at=datetime('now', '-1 minute')"); err != nil {
+		t.Fatal(err)
+	}
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", key, map[string]string{"session_id": session.SessionID, "user_message": "Still there?"}, http.StatusUnauthorized, nil)
+}
+
+const (
+	mockIdPClientID     = "rag-chat"
+	mockIdPClientSecret = "mock idp client secret"
+)
+
+// mockIdP is a minimal OpenID provider. Every authorization request is
+// approved at once for the identity in Claims.
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	Claims jwt.MapClaims
+	// Nonce replaces the nonce sent by rag-chat when it is not empty.
+	Nonce          string
+	authorizations map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key, authorizations: make(map[string]mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /authorize", idp.authorize)
+	mux.HandleFunc("POST /token", idp.token)
+	mux.HandleFunc("GET /jwks", idp.jwks)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+// SignInAs sets the identity approved by the following logins.
+func (idp *mockIdP) SignInAs(claims jwt.MapClaims) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	idp.Claims = claims
+	idp.Nonce = ""
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                idp.server.URL,
+		"authorization_endpoint":                idp.server.URL + "/authorize",
+		"token_endpoint":                        idp.server.URL + "/token",
+		"jwks_uri":                              idp.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if query.Get("client_id") != mockIdPClientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	nonce := query.Get("nonce")
+	if idp.Nonce != "" {
+		nonce = idp.Nonce
+	}
+
+	code := fmt.Sprintf("code-%d", len(idp.authorizations)+1)
+	idp.authorizations[code] = mockAuthorization{challenge: query.Get("code_challenge"), nonce: nonce, claims: idp.Claims}
+
+	callback, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	callback.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != mockIdPClientID || clientSecret != mockIdPClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	idp.mu.Lock()
+	authorization, ok := idp.authorizations[r.PostFormValue("code")]
+	delete(idp.authorizations, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || base64.RawURLEncoding.EncodeToString(sum[:]) != authorization.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   mockIdPClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		"nonce": authorization.nonce,
+	}
+	for name, value := range authorization.claims {
+		claims[name] = value
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = "mock-idp"
+
+	signed, err := idToken.SignedString(idp.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "mock-access-token", "token_type": "Bearer", "expires_in": 300, "id_token": signed})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(jwtkeys.JWKS{Keys: []jwtkeys.JWK{{
+		KeyType:   "RSA",
+		KeyID:     "mock-idp",
+		Use:       "sig",
+		Algorithm: "RS256",
+		N:         base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+// ssoLogin walks through the login redirects like a browser and returns the
+// status, the access token and the body of the callback response.
+func (app *testApp) ssoLogin() (int, string, []byte) {
+	app.t.Helper()
+
+	callback, stateCookie := app.startSSOLogin()
+
+	resp := app.ssoCallback(callback, stateCookie)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	var login struct {
+		Data struct {
+			Tokens struct {
+				AccessToken string
+			} `json:"tokens"`
+		} `json:"data"`
+	}
+	_ = json.Unmarshal(b, &login)
+
+	// Replaying the callback must not sign anybody in again.
+	replay := app.ssoCallback(callback, stateCookie)
+	replay.Body.Close()
+	if replay.StatusCode != http.StatusUnauthorized {
+		app.t.Fatalf("replayed callback: got status %d, want %d", replay.StatusCode, http.StatusUnauthorized)
+	}
+
+	return resp.StatusCode, login.Data.Tokens.AccessToken, b
+}
+
+// startSSOLogin follows the redirects of a login up to the callback and
+// returns the callback URL and the state cookie set for the browser.
+func (app *testApp) startSSOLogin() (string, *http.Cookie) {
+	app.t.Helper()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	var stateCookie *http.Cookie
+
+	location := app.server.URL + "/api/v1/oidc/login"
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(location)
+		if err != nil {
+			app.t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusFound {
+			app.t.Fatalf("GET %s: got status %d, want a redirect", location, resp.StatusCode)
+		}
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == "rag_chat_oidc_state" {
+				stateCookie = cookie
+			}
+		}
+		location = resp.Header.Get("Location")
+	}
+
+	// The test server's callback is plain HTTP, where a Secure cookie would
+	// never come back.
+	if stateCookie == nil || !stateCookie.HttpOnly || stateCookie.Secure || stateCookie.SameSite != http.SameSiteLaxMode {
+		app.t.Fatalf("the login did not set a protected state cookie: %+v", stateCookie)
+	}
+
+	return location, stateCookie
+}
+
+// ssoCallback requests the callback URL, presenting stateCookie unless it is
+// nil.
+func (app *testApp) ssoCallback(callback string, stateCookie *http.Cookie) *http.Response {
+	app.t.Helper()
+
+	req, err := http.NewRequest("GET", callback, nil)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	if stateCookie != nil {
+		req.AddCookie(&http.Cookie{Name: stateCookie.Name, Value: stateCookie.Value})
+	}
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestEndToEndOIDCLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	app := newTestAppWithOIDC(t, idp)
+
+	// A new user is provisioned, and the admin group maps to the ADMIN role.
+	idp.SignInAs(jwt.MapClaims{"sub": "idp-carol", "email": "carol@example.com", "email_verified": true, "groups": []string{"staff", "rag-admins"}})
+
+	status, carolToken, b := app.ssoLogin()
+	if status != http.StatusOK || carolToken == "" {
+		t.Fatalf("SSO login: got status %d: %s", status, b)
+	}
+	app.doJSON("GET", "/api/v1/admin/users", carolToken, nil, http.StatusOK, nil)
+	app.createCollection(carolToken, "Carol's notes")
+
+	// The next login follows the groups again and drops the role.
+	idp.SignInAs(jwt.MapClaims{"sub": "idp-carol", "email": "carol@example.com", "email_verified": true, "groups": []string{"staff"}})
+
+	status, carolToken, b = app.ssoLogin()
+	if status != http.StatusOK {
+		t.Fatalf("second SSO login: got status %d: %s", status, b)
+	}
+	app.doJSON("GET", "/api/v1/admin/users", carolToken, nil, http.StatusForbidden, nil)
+
+	var collections struct {
+		Data []struct {
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", carolToken, nil, http.StatusOK, &collections)
+	if len(collections.Data) != 1 {
+		t.Fatalf("the returning SSO user should see their collection, got %+v", collections.Data)
+	}
+
+	// An existing account is linked by its verified email address and keeps
+	// its password.
+	app.registerAndLogin("dave@example.com", "dave-password-1")
+
+	idp.SignInAs(jwt.MapClaims{"sub": "idp-dave", "email": "dave@example.com", "email_verified": true})
+
+	status, daveToken, b := app.ssoLogin()
+	if status != http.StatusOK || daveToken == "" {
+		t.Fatalf("linking SSO login: got status %d: %s", status, b)
+	}
+	app.login("dave@example.com", "dave-password-1")
+
+	var users int
+	if err := app.dbHandler.DB.Get(&users, "SELECT COUNT(*) FROM user WHERE email='dave@example.com' AND oidc_subject='idp-dave'"); err != nil || users != 1 {
+		t.Fatalf("dave should be linked to his SSO identity, got %d users: %v", users, err)
+	}
+
+	// Another identity claiming the linked address is refused.
+	idp.SignInAs(jwt.MapClaims{"sub": "idp-mallory", "email": "dave@example.com", "email_verified": true})
+
+	if status, _, b := app.ssoLogin(); status != http.StatusConflict {
+		t.Fatalf("SSO login with a linked email: got status %d, want %d: %s", status, http.StatusConflict, b)
+	}
+
+	// Unverified addresses are neither linked nor provisioned.
+	idp.SignInAs(jwt.MapClaims{"sub": "idp-erin", "email": "erin@example.com", "email_verified": false})
+
+	if status, _, b := app.ssoLogin(); status != http.StatusForbidden {
+		t.Fatalf("SSO login with an unverified email: got status %d, want %d: %s", status, http.StatusForbidden, b)
+	}
+
+	// An ID token issued for another login request is rejected.
+	idp.SignInAs(jwt.MapClaims{"sub": "idp-carol", "email": "carol@example.com", "email_verified": true})
+	idp.mu.Lock()
+	idp.Nonce = "nonce-of-another-login"
+	idp.mu.Unlock()
+
+	if status, _, b := app.ssoLogin(); status != http.StatusUnauthorized {
+		t.Fatalf("SSO login with a foreign nonce: got status %d, want %d: %s", status, http.StatusUnauthorized, b)
+	}
+
+	// Locked users cannot sign in through the provider either.
+	if _, err := app.dbHandler.DB.Exec("UPDATE user SET locked=1 WHERE email='carol@example.com'"); err != nil {
+		t.Fatal(err)
+	}
+	idp.SignInAs(jwt.MapClaims{"sub": "idp-carol", "email": "carol@example.com", "email_verified": true})
+
+	if status, _, b := app.ssoLogin(); status != http.StatusForbidden {
+		t.Fatalf("SSO login of a locked user: got status %d, want %d: %s", status, http.StatusForbidden, b)
+	}
+}
+
+// enrollTwoFactor enables two-factor authentication for the user of token and
+// returns the secret and the recovery codes.
+func (app *testApp) enrollTwoFactor(token string) (string, []string) {
+	app.t.Helper()
+
+	var enrolment struct {
+		Data struct {
+			Secret     string `json:"secret"`
+			OTPAuthURI string `json:"otpauth_uri"`
+		} `json:"data"`
+	}
+	app.doJSON("POST", "/api/v1/user/2fa/enroll", token, nil, http.StatusOK, &enrolment)
+	if !strings.HasPrefix(enrolment.Data.OTPAuthURI, "otpauth://totp/Rag%20Chat:") || !strings.Contains(enrolment.Data.OTPAuthURI, "secret="+enrolment.Data.Secret) {
+		app.t.Fatalf("unexpected otpauth URI %q", enrolment.Data.OTPAuthURI)
+	}
+
+	app.doJSON("POST", "/api/v1/user/2fa/confirm", token, map[string]string{"code": "not a code"}, http.StatusBadRequest, nil)
+
+	code, err := totp.Code(enrolment.Data.Secret, totp.Step(time.Now()))
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	var confirmation struct {
+		Data struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		} `json:"data"`
+	}
+	app.doJSON("POST", "/api/v1/user/2fa/confirm", token, map[string]string{"code": code}, http.StatusOK, &confirmation)
+	if len(confirmation.Data.RecoveryCodes) != 10 {
+		app.t.Fatalf("expected 10 recovery codes, got %v", confirmation.Data.RecoveryCodes)
+	}
+
+	return enrolment.Data.Secret, confirmation.Data.RecoveryCodes
+}
+
+// startTwoFactorLogin runs the first login step, which must ask for a second
+// one, and returns the challenge token.
+func (app *testApp) startTwoFactorLogin(email string, password string) string {
+	app.t.Helper()
+
+	var login struct {
+		Data struct {
+			TwoFactorRequired bool   `json:"two_factor_required"`
+			ChallengeToken    string `json:"challenge_token"`
+			Tokens            *struct{}
+		} `json:"data"`
+	}
+	app.doJSON("POST", "/api/v1/login", "", map[string]string{"email": email, "password": password}, http.StatusOK, &login)
+	if !login.Data.TwoFactorRequired || login.Data.ChallengeToken == "" || login.Data.Tokens != nil {
+		app.t.Fatalf("the login should ask for a second factor instead of issuing tokens: %+v", login.Data)
+	}
+
+	return login.Data.ChallengeToken
+}
+
+func TestEndToEndTwoFactorAuthentication(t *testing.T) {
+	app := newTestApp(t)
+
+	graceToken := app.registerAndLogin("grace@example.com", "grace's long passphrase")
+	app.registerAndLogin("heidi@example.com", "heidi's long passphrase")
+
+	secret, recoveryCodes := app.enrollTwoFactor(graceToken)
+	app.doJSON("POST", "/api/v1/user/2fa/enroll", graceToken, nil, http.StatusConflict, nil)
+
+	// The enrolment code cannot be used again, the next one can, once.
+	var lastStep int64
+	if err := app.dbHandler.DB.Get(&lastStep, "SELECT totp_last_step FROM user WHERE email='grace@example.com'"); err != nil {
+		t.Fatal(err)
+	}
+	usedCode, _ := totp.Code(secret, lastStep)
+	nextCode, _ := totp.Code(secret, lastStep+1)
+
+	challenge := app.startTwoFactorLogin("grace@example.com", "grace's long passphrase")
+	app.doJSON("POST", "/api/v1/login/2fa", "", map[string]string{"challenge_token": challenge, "code": usedCode}, http.StatusUnauthorized, nil)
+
+	var login struct {
+		Data struct {
+			Tokens struct {
+				AccessToken string
+			} `json:"tokens"`
+		} `json:"data"`
+	}
+	app.doJSON("POST", "/api/v1/login/2fa", "", map[string]string{"challenge_token": challenge, "code": nextCode}, http.StatusOK, &login)
+	graceToken = login.Data.Tokens.AccessToken
+	app.doJSON("POST", "/api/v1/login/2fa", "", map[string]string{"challenge_token": challenge, "code": nextCode}, http.StatusUnauthorized, nil)
+
+	// Recovery codes work once, however they are typed.
+	challenge = app.startTwoFactorLogin("grace@example.com", "grace's long passphrase")
+	app.doJSON("POST", "/api/v1/login/2fa", "", map[string]string{"challenge_token": challenge, "recovery_code": strings.ToUpper(recoveryCodes[0])}, http.StatusOK, nil)
+
+	challenge = app.startTwoFactorLogin("grace@example.com", "grace's long passphrase")
+	app.doJSON("POST", "/api/v1/login/2fa", "", map[string]string{"challenge_token": challenge, "recovery_code": recoveryCodes[0]}, http.StatusUnauthorized, nil)
+
+	var status struct {
+		Data struct {
+			Enabled           bool `json:"enabled"`
+			RecoveryCodesLeft int  `json:"recovery_codes_left"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/user/2fa", graceToken, nil, http.StatusOK, &status)
+	if !status.Data.Enabled || status.Data.RecoveryCodesLeft != 9 {
+		t.Fatalf("unexpected two-factor status %+v", status.Data)
+	}
+
+	// A challenge only allows a few attempts.
+	challenge = app.startTwoFactorLogin("grace@example.com", "grace's long passphrase")
+	for i := 0; i < 5; i++ {
+		app.doJSON("POST", "/api/v1/login/2fa", "", map[string]string{"challenge_token": challenge, "recovery_code": "wrong-guess"}, http.StatusUnauthorized, nil)
+	}
+	app.doJSON("POST", "/api/v1/login/2fa", "", map[string]string{"challenge_token": challenge, "recovery_code": recoveryCodes[1]}, http.StatusUnauthorized, nil)
+
+	// Administrators can require two-factor authentication for their role,
+	// but only once they use it themselves.
+	if _, err := app.dbHandler.DB.Exec("UPDATE user SET roles='USER:ADMIN'"); err != nil {
+		t.Fatal(err)
+	}
+	heidiToken, _ := app.login("heidi@example.com", "heidi's long passphrase")
+
+	var errorResponse map[string]string
+	app.doJSON("PUT", "/api/v1/admin/settings", heidiToken, map[string]bool{"require_admin_2fa": true}, http.StatusConflict, &errorResponse)
+	if errorResponse["error_code"] != "17" {
+		t.Fatalf("unexpected error %v", errorResponse)
+	}
+
+	var settings struct {
+		Data map[string]bool `json:"data"`
+	}
+	app.doJSON("PUT", "/api/v1/admin/settings", graceToken, map[string]bool{"require_admin_2fa": true}, http.StatusOK, &settings)
+	if !settings.Data["require_admin_2fa"] {
+		t.Fatalf("unexpected settings %v", settings.Data)
+	}
+
+	app.doJSON("GET", "/api/v1/admin/users", graceToken, nil, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/admin/users", heidiToken, nil, http.StatusForbidden, &errorResponse)
+	if errorResponse["error_code"] != "17" {
+		t.Fatalf("unexpected error %v", errorResponse)
+	}
+
+	// Enabling it restores the role; disabling it takes a code.
+	_, heidiRecoveryCodes := app.enrollTwoFactor(heidiToken)
+	app.doJSON("GET", "/api/v1/admin/users", heidiToken, nil, http.StatusOK, nil)
+
+	app.doJSON("POST", "/api/v1/user/2fa/disable", heidiToken, map[string]string{"recovery_code": "wrong-guess"}, http.StatusBadRequest, nil)
+	app.doJSON("POST", "/api/v1/user/2fa/disable", heidiToken, map[string]string{"recovery_code": heidiRecoveryCodes[0]}, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/admin/users", heidiToken, nil, http.StatusForbidden, nil)
+
+	// An administrator can reset the second factor of a user who lost it.
+	var graceID int64
+	if err := app.dbHandler.DB.Get(&graceID, "SELECT id FROM user WHERE email='grace@example.com'"); err != nil {
+		t.Fatal(err)
+	}
+	app.doJSON("POST", fmt.Sprintf("/api/v1/admin/users/%d/reset-2fa", graceID), graceToken, nil, http.StatusOK, nil)
+	app.login("grace@example.com", "grace's long passphrase")
+}
+
+func TestEndToEndPasswordReset(t *testing.T) {
+	app := newTestApp(t)
+
+	oldToken := app.registerAndLogin("ivan@example.com", "ivan's old passphrase")
+
+	// Known and unknown addresses get the same answer, and requesting a
+	// reset leaves the password alone.
+	_, known := app.request("POST", "/api/v1/reset-password", "", "application/json", strings.NewReader(`{"email":"ivan@example.com"}`))
+	_, unknown := app.request("POST", "/api/v1/reset-password", "", "application/json", strings.NewReader(`{"email":"nobody@example.com"}`))
+	if !bytes.Equal(known, unknown) {
+		t.Fatalf("the responses tell accounts apart: %s and %s", known, unknown)
+	}
+	app.login("ivan@example.com", "ivan's old passphrase")
+
+	// The mailed token is only known to the mail, so replace its hash with
+	// the hash of one known to the test.
+	useResetToken := func(token string) {
+		t.Helper()
+
+		sum := sha256.Sum256([]byte(token))
+		result, err := app.dbHandler.DB.Exec("UPDATE password_resets SET token_hash=$1 WHERE user_id=(SELECT id FROM user WHERE email='ivan@example.com')", hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if affected, _ := result.RowsAffected(); affected != 1 {
+			t.Fatalf("expected one pending reset, found %d", affected)
+		}
+	}
+
+	app.doJSON("POST", "/api/v1/reset-password", "", map[string]string{"email": "ivan@example.com"}, http.StatusOK, nil)
+	useResetToken("first-reset-token")
+
+	var errorResponse map[string]string
+	app.doJSON("POST", "/api/v1/reset-password/confirm", "", map[string]string{"token": "first-reset-token", "password": "short"}, http.StatusBadRequest, &errorResponse)
+	if errorResponse["error_code"] != "11" {
+		t.Fatalf("unexpected error %v", errorResponse)
+	}
+	app.doJSON("POST", "/api/v1/reset-password/confirm", "", map[string]string{"token": "guessed-token", "password": "ivan's new passphrase"}, http.StatusBadRequest, &errorResponse)
+	if errorResponse["error_code"] != "19" {
+		t.Fatalf("unexpected error %v", errorResponse)
+	}
+
+	app.doJSON("POST", "/api/v1/reset-password/confirm", "", map[string]string{"token": "first-reset-token", "password": "ivan's new passphrase"}, http.StatusOK, nil)
+	app.doJSON("POST", "/api/v1/reset-password/confirm", "", map[string]string{"token": "first-reset-token", "password": "ivan's other passphrase"}, http.StatusBadRequest, nil)
+
+	app.doJSON("GET", "/api/v1/rag/list-vector-collections", oldToken, nil, http.StatusUnauthorized, nil)
+	app.doJSON("POST", "/api/v1/login", "", map[string]string{"email": "ivan@example.com", "password": "ivan's old passphrase"}, http.StatusNotFound, nil)
+	app.login("ivan@example.com", "ivan's new passphrase")
+
+	// Links expire.
+	app.doJSON("POST", "/api/v1/reset-password", "", map[string]string{"email": "ivan@example.com"}, http.StatusOK, nil)
+	useResetToken("expired-reset-token")
+	if _, err := app.dbHandler.DB.Exec("UPDATE password_resets SET expires_at=datetime('now', '-1 minute')"); err != nil {
+		t.Fatal(err)
+	}
+	app.doJSON("POST", "/api/v1/reset-password/confirm", "", map[string]string{"token": "expired-reset-token", "password": "ivan's other passphrase"}, http.StatusBadRequest, nil)
+}
+
+// loginFrom signs in as if from a browser with userAgent at address.
+func (app *testApp) loginFrom(email string, password string, userAgent string, address string) (string, string) {
+	app.t.Helper()
+
+	req, err := http.NewRequest("POST", app.server.URL+"/api/v1/login", strings.NewReader(fmt.Sprintf(`{"email":%q,"password":%q}`, email, password)))
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Forwarded-For", address+", 10.0.0.1")
+
+	resp, err := app.server.Client().Do(req)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var login struct {
+		Data struct {
+			Tokens struct {
+				AccessToken  string
+				RefreshToken string
+			} `json:"tokens"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil || resp.StatusCode != http.StatusOK {
+		app.t.Fatalf("login from %s failed with status %d: %v", address, resp.StatusCode, err)
+	}
+
+	return login.Data.Tokens.AccessToken, login.Data.Tokens.RefreshToken
+}
+
+func TestEndToEndSessions(t *testing.T) {
+	app := newTestApp(t)
+
+	const (
+		firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+		safari  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1"
+	)
+
+	app.registerAndLogin("judy@example.com", "judy's long passphrase")
+	laptopToken, laptopRefresh := app.loginFrom("judy@example.com", "judy's long passphrase", firefox, "203.0.113.7")
+	phoneToken, _ := app.loginFrom("judy@example.com", "judy's long passphrase", safari, "198.51.100.23")
+
+	type session struct {
+		ID        int64  `json:"id"`
+		IPAddress string `json:"ip_address"`
+		Browser   string `json:"browser"`
+		OS        string `json:"os"`
+		Device    string `json:"device"`
+		Current   bool   `json:"current"`
+	}
+	listSessions := func(token string) []session {
+		t.Helper()
+
+		var list struct {
+			Data []session `json:"data"`
+		}
+		app.doJSON("GET", "/api/v1/user/sessions", token, nil, http.StatusOK, &list)
+
+		return list.Data
+	}
+	findSession := func(sessions []session, address string) session {
+		t.Helper()
+
+		for _, s := range sessions {
+			if s.IPAddress == address {
+				return s
+			}
+		}
+		t.Fatalf("no session from %s in %+v", address, sessions)
+
+		return session{}
+	}
+
+	sessions := listSessions(phoneToken)
+	if len(sessions) != 3 {
+		t.Fatalf("expected the sessions of three logins, got %+v", sessions)
+	}
+	laptop := findSession(sessions, "203.0.113.7")
+	phone := findSession(sessions, "198.51.100.23")
+	if !strings.HasPrefix(laptop.Browser, "Firefox") || !strings.HasPrefix(laptop.OS, "Linux") || laptop.Device != "Desktop" || laptop.Current {
+		t.Fatalf("unexpected laptop session %+v", laptop)
+	}
+	if !strings.HasPrefix(phone.Browser, "Safari") || !strings.HasPrefix(phone.OS, "iOS") || phone.Device != "iPhone" || !phone.Current {
+		t.Fatalf("unexpected phone session %+v", phone)
+	}
+
+	// Refreshing continues the session instead of starting another.
+	var refreshed struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	app.doJSON("GET", "/api/v1/user/refresh-token/"+laptopRefresh, "", nil, http.StatusCreated, &refreshed)
+	sessions = listSessions(refreshed.AccessToken)
+	if len(sessions) != 3 || !findSession(sessions, "203.0.113.7").Current {
+		t.Fatalf("the refresh did not keep the session: %+v", sessions)
+	}
+
+	// Nobody else can end a session.
+	otherToken := app.registerAndLogin("mallory@example.com", "mallory's long passphrase")
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/user/sessions/%d", phone.ID), otherToken, nil, http.StatusNotFound, nil)
+	app.doJSON("GET", "/api/v1/user/sessions", phoneToken, nil, http.StatusOK, nil)
+
+	// Ending one session signs its device out, refresh token included.
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/user/sessions/%d", laptop.ID), phoneToken, nil, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/user/sessions", refreshed.AccessToken, nil, http.StatusUnauthorized, nil)
+	app.doJSON("GET", "/api/v1/user/refresh-token/"+refreshed.RefreshToken, "", nil, http.StatusUnauthorized, nil)
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/user/sessions/%d", laptop.ID), phoneToken, nil, http.StatusNotFound, nil)
+
+	// Ending the others keeps only the caller signed in.
+	laptopToken, _ = app.loginFrom("judy@example.com", "judy's long passphrase", firefox, "203.0.113.7")
+	app.doJSON("DELETE", "/api/v1/user/sessions", phoneToken, nil, http.StatusOK, nil)
+	app.doJSON("GET", "/api/v1/user/sessions", laptopToken, nil, http.StatusUnauthorized, nil)
+	if sessions := listSessions(phoneToken); len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("expected only the current session, got %+v", sessions)
+	}
+
+	app.doJSON("POST", "/api/v1/logout", phoneToken, nil, http.StatusOK, nil)
+	var active int
+	if err := app.dbHandler.DB.Get(&active, "SELECT COUNT(*) FROM sessions WHERE user_id=(SELECT id FROM user WHERE email='judy@example.com') AND ended_at IS NULL"); err != nil || active != 0 {
+		t.Fatalf("expected no active sessions after logging out, got %d: %v", active, err)
+	}
+}
+
+func TestEndToEndHybridSearch(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("kate@example.com", "kate's long passphrase")
+	collectionHash := app.createCollection(token, "manuals")
+	settingsPath := "/api/v1/rag/collections/" + collectionHash + "/settings"
+
+	var settings struct {
+		Data struct {
+			VectorWeight  float64 `json:"vector_weight"`
+			KeywordWeight float64 `json:"keyword_weight"`
+			RRFK          int     `json:"rrf_k"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", settingsPath, token, nil, http.StatusOK, &settings)
+	if settings.Data.VectorWeight != 1 || settings.Data.KeywordWeight != 1 || settings.Data.RRFK != 60 {
+		t.Fatalf("unexpected default fusion settings %+v", settings.Data)
+	}
+
+	var errorResponse map[string]string
+	app.doJSON("PUT", settingsPath, token, map[string]float64{"vector_weight": 0, "keyword_weight": 0}, http.StatusBadRequest, &errorResponse)
+	if errorResponse["error_code"] != "9" {
+		t.Fatalf("unexpected error %v", errorResponse)
+	}
+
+	pumpID := app.upload(token, collectionHash, "pump.txt", "The XJ-9000 pump moves water from the tank.")
+	app.upload(token, collectionHash, "hours.txt", "The office opens at nine in the morning.")
+
+	// Without vector search only chunks holding the code are found.
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"vector_weight": 0, "top_k": 5, "query_rewriting": false}, http.StatusOK, nil)
+
+	sessionID := app.startChatSession(token, collectionHash)
+
+	var answer struct {
+		Sources []chatSource `json:"sources"`
+	}
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": "What is XJ-9000?"}, http.StatusOK, &answer)
+	if len(answer.Sources) != 1 || answer.Sources[0].DocumentID != pumpID {
+		t.Fatalf("keyword search should find only document %d, got %+v", pumpID, answer.Sources)
+	}
+
+	// Fused, the chunk found by both searches comes first.
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"vector_weight": 1, "keyword_weight": 2}, http.StatusOK, nil)
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": "What is XJ-9000?"}, http.StatusOK, &answer)
+	if len(answer.Sources) != 2 || answer.Sources[0].DocumentID != pumpID {
+		t.Fatalf("the fused ranking should start with document %d, got %+v", pumpID, answer.Sources)
+	}
+
+	// Keyword hits that score_threshold never saw need min_keyword_match of
+	// the question's terms, of which the pump manual holds one in three.
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"min_keyword_match": 2}, http.StatusBadRequest, nil)
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"score_threshold": 0.99, "min_keyword_match": 0.5}, http.StatusOK, nil)
+	answer.Sources = nil
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": "What is XJ-9000?"}, http.StatusOK, &answer)
+	if len(answer.Sources) != 0 {
+		t.Fatalf("weak keyword hits should be cut off, got %+v", answer.Sources)
+	}
+
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"min_keyword_match": 0.3}, http.StatusOK, nil)
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": "What is XJ-9000?"}, http.StatusOK, &answer)
+	if len(answer.Sources) != 1 || answer.Sources[0].DocumentID != pumpID {
+		t.Fatalf("the keyword hit matching enough terms should be kept, got %+v", answer.Sources)
+	}
+
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/rag/documents/%d", pumpID), token, nil, http.StatusOK, nil)
+	var chunks int
+	if err := app.dbHandler.DB.Get(&chunks, "SELECT COUNT(*) FROM chunk_texts WHERE document_id=$1", pumpID); err != nil || chunks != 0 {
+		t.Fatalf("the keyword index still holds %d chunks of the deleted document: %v", chunks, err)
+	}
+}
+
+func TestEndToEndReranking(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("leo@example.com", "leo's long passphrase")
+	collectionHash := app.createCollection(token, "facilities")
+	settingsPath := "/api/v1/rag/collections/" + collectionHash + "/settings"
+
+	pumpID := app.upload(token, collectionHash, "pump.txt", "The pump in the basement moves water from the tank.")
+	hoursID := app.upload(token, collectionHash, "hours.txt", "The office opens at nine in the morning.")
+
+	var errorResponse map[string]string
+	app.doJSON("PUT", settingsPath, token, map[string]string{"reranker": "bogus"}, http.StatusBadRequest, &errorResponse)
+	app.doJSON("PUT", settingsPath, token, map[string]string{"reranker": "cross_encoder"}, http.StatusBadRequest, &errorResponse)
+	if errorResponse["error_code"] != "9" {
+		t.Fatalf("an unconfigured cross-encoder should be refused, got %v", errorResponse)
+	}
+
+	// The rerank server prefers whatever mentions the pump, against the
+	// first stage ranking.
+	var failing atomic.Bool
+	rerankServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Model     string   `json:"model"`
+			Query     string   `json:"query"`
+			Documents []string `json:"documents"`
+		}
+		if r.Header.Get("Authorization") != "Bearer rerank-key" || json.NewDecoder(r.Body).Decode(&request) != nil || request.Query == "" || request.Model != "bge-reranker" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if failing.Load() {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+
+		results := make([]map[string]interface{}, len(request.Documents))
+		for i, document := range request.Documents {
+			score := 0.1
+			if strings.Contains(document, "pump") {
+				score = 0.9
+			}
+			results[i] = map[string]interface{}{"index": i, "relevance_score": score}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	}))
+	t.Cleanup(rerankServer.Close)
+
+	app.handlers.ChatController.Rerankers.CrossEncoder = retrieval.NewCrossEncoderReranker(rerankServer.URL, "rerank-key", "bge-reranker")
+
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"top_k": 1, "reranker": "cross_encoder", "rerank_candidates": 5, "query_rewriting": false}, http.StatusOK, nil)
+
+	sessionID := app.startChatSession(token, collectionHash)
+
+	var answer struct {
+		Sources []struct {
+			DocumentID  int64    `json:"document_id"`
+			RerankScore *float64 `json:"rerank_score"`
+		} `json:"sources"`
+	}
+	question := map[string]string{"session_id": sessionID, "user_message": "When does the office open in the morning?"}
+
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, question, http.StatusOK, &answer)
+	if len(answer.Sources) != 1 || answer.Sources[0].DocumentID != pumpID || answer.Sources[0].RerankScore == nil || *answer.Sources[0].RerankScore != 0.9 {
+		t.Fatalf("the reranker should have picked document %d, got %+v", pumpID, answer.Sources)
+	}
+
+	// A failing reranker falls back to the first stage.
+	failing.Store(true)
+	answer.Sources = nil
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, question, http.StatusOK, &answer)
+	if len(answer.Sources) != 1 || answer.Sources[0].DocumentID != hoursID || answer.Sources[0].RerankScore != nil {
+		t.Fatalf("expected the first stage result %d, got %+v", hoursID, answer.Sources)
+	}
+
+	// The LLM judge rates the candidates in the order it was given them.
+	app.providers.Register("judge", providers.FakeProvider{Responses: []string{"Ratings: [0, 10]", testAnswer}})
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"chat_provider": "judge", "chat_model": "judge-model", "reranker": "llm", "rerank_candidates": 2}, http.StatusOK, nil)
+
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, question, http.StatusOK, &answer)
+	if len(answer.Sources) != 1 || answer.Sources[0].RerankScore == nil || *answer.Sources[0].RerankScore != 1 {
+		t.Fatalf("the LLM judge should have picked the second candidate, got %+v", answer.Sources)
+	}
+
+	chatModel, _ := app.providers.ChatModel("judge", "judge-model")
+	judged := chatModel.(*providers.FakeChatModel).Calls()
+	if len(judged) != 2 || !strings.Contains(fmt.Sprint(judged[0]), "Rate how well") {
+		t.Fatalf("expected a judging call before the answer, got %d calls", len(judged))
+	}
+}
+
+func TestEndToEndQueryRewriting(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("mia@example.com", "mia's long passphrase")
+	collectionHash := app.createCollection(token, "equipment")
+	settingsPath := "/api/v1/rag/collections/" + collectionHash + "/settings"
+
+	pumpID := app.upload(token, collectionHash, "pump.txt", "The XJ-9000 pump moves water from the tank.")
+	app.upload(token, collectionHash, "hours.txt", "The office opens at nine in the morning.")
+
+	// Keyword search alone finds nothing for the follow-up as written.
+	app.providers.Register("condenser", providers.FakeProvider{Responses: []string{
+		"The XJ-9000 is a pump.",
+		`Standalone question: "What does the XJ-9000 pump do?"`,
+		"It moves water from the tank.",
+	}})
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"chat_provider": "condenser", "chat_model": "condenser-model", "vector_weight": 0, "top_k": 1}, http.StatusOK, nil)
+
+	sessionID := app.startChatSession(token, collectionHash)
+
+	var answer struct {
+		Sources []chatSource `json:"sources"`
+	}
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": "Tell me about the XJ-9000."}, http.StatusOK, &answer)
+
+	followUp := map[string]string{"session_id": sessionID, "user_message": "What does it do?"}
+
+	answer.Sources = nil
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, followUp, http.StatusOK, &answer)
+	if len(answer.Sources) != 1 || answer.Sources[0].DocumentID != pumpID {
+		t.Fatalf("the rewritten question should find document %d, got %+v", pumpID, answer.Sources)
+	}
+
+	chatModel, _ := app.providers.ChatModel("condenser", "condenser-model")
+	calls := chatModel.(*providers.FakeChatModel).Calls()
+	if len(calls) != 3 || !strings.Contains(fmt.Sprint(calls[1]), "Tell me about the XJ-9000.") {
+		t.Fatalf("expected a rewriting call that reads the history, got %d calls", len(calls))
+	}
+
+	// The model answers the message as the user wrote it.
+	if prompt := fmt.Sprint(calls[2]); !strings.Contains(prompt, "What does it do?") || strings.Contains(prompt, "What does the XJ-9000 pump do?") {
+		t.Errorf("the answer was not asked for the original message: %s", prompt)
+	}
+
+	var messages struct {
+		Data []struct {
+			Message        string `json:"message"`
+			MessageRole    string `json:"message_role"`
+			RewrittenQuery string `json:"rewritten_query"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/chat/get-chat-session-messages/"+sessionID, token, nil, http.StatusOK, &messages)
+	if n := len(messages.Data); n != 4 || messages.Data[0].RewrittenQuery != "" || messages.Data[2].RewrittenQuery != "What does the XJ-9000 pump do?" {
+		t.Fatalf("unexpected session history: %+v", messages.Data)
+	}
+
+	// Without rewriting the follow-up is searched as written.
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"query_rewriting": false}, http.StatusOK, nil)
+
+	answer.Sources = nil
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, followUp, http.StatusOK, &answer)
+	if len(answer.Sources) != 0 {
+		t.Fatalf("the follow-up as written should find nothing, got %+v", answer.Sources)
+	}
+	if calls := chatModel.(*providers.FakeChatModel).Calls(); len(calls) != 4 {
+		t.Fatalf("expected only the answering call, got %d calls in total", len(calls))
+	}
+}
+
+func TestEndToEndContextBudget(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("noah@example.com", "noah's long passphrase")
+	collectionHash := app.createCollection(token, "lockers")
+	settingsPath := "/api/v1/rag/collections/" + collectionHash + "/settings"
+
+	app.upload(token, collectionHash, "lockers.txt", "Lockers are opened with a four digit code.")
+
+	var errorResponse map[string]string
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"context_window": 1024, "max_answer_tokens": 600}, http.StatusBadRequest, &errorResponse)
+	if errorResponse["error_code"] != "9" {
+		t.Fatalf("an answer longer than half the context window should be refused, got %v", errorResponse)
+	}
+
+	app.providers.Register("budget", providers.FakeProvider{Responses: []string{"Noted."}})
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"chat_provider": "budget", "chat_model": "small", "context_window": 1024, "max_answer_tokens": 128, "summarize_after": 0, "query_rewriting": false}, http.StatusOK, nil)
+
+	sessionID := app.startChatSession(token, collectionHash)
+
+	// The oldest turns are dropped once the history outgrows the window.
+	for i := 1; i <= 6; i++ {
+		message := fmt.Sprintf("marker-%d %s", i, strings.Repeat("alpha ", 150))
+		app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": message}, http.StatusOK, nil)
+	}
+
+	chatModel, _ := app.providers.ChatModel("budget", "small")
+	calls := chatModel.(*providers.FakeChatModel).Calls()
+	last := fmt.Sprint(calls[len(calls)-1])
+	if strings.Contains(last, "marker-1 ") || !strings.Contains(last, "marker-5 ") || !strings.Contains(last, "marker-6 ") || !strings.Contains(last, "four digit code") {
+		t.Fatalf("expected the oldest turn to be dropped and the latest ones and the context kept")
+	}
+
+	// A message that cannot fit at all is refused and not stored.
+	tooLong := map[string]string{"session_id": sessionID, "user_message": strings.Repeat("alpha ", 2000)}
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, tooLong, http.StatusBadRequest, &errorResponse)
+	if errorResponse["error_code"] != "9" {
+		t.Fatalf("unexpected error %v", errorResponse)
+	}
+
+	var messages struct {
+		Data []struct {
+			ID          int64  `json:"id"`
+			Message     string `json:"message"`
+			MessageRole string `json:"message_role"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/chat/get-chat-session-messages/"+sessionID, token, nil, http.StatusOK, &messages)
+	if len(messages.Data) != 12 {
+		t.Fatalf("expected 12 messages, got %d", len(messages.Data))
+	}
+
+	// Past summarize_after messages the older turns are summarized.
+	app.providers.Register("summarizer", providers.FakeProvider{Responses: []string{
+		"Answer one.", "Answer two.", "Answer three.", "Answer four.",
+		"The user's locker code is 4711.",
+		"Answer five.",
+	}})
+	app.doJSON("PUT", settingsPath, token, map[string]interface{}{"chat_provider": "summarizer", "summarize_after": 6}, http.StatusOK, nil)
+
+	sessionID = app.startChatSession(token, collectionHash)
+
+	questions := []string{"My locker code is 4711.", "Question two?", "Question three?", "Question four?", "What is my locker code?"}
+	for _, question := range questions {
+		app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": question}, http.StatusOK, nil)
+	}
+
+	chatModel, _ = app.providers.ChatModel("summarizer", "small")
+	calls = chatModel.(*providers.FakeChatModel).Calls()
+	if len(calls) != 6 || !strings.Contains(fmt.Sprint(calls[4]), "My locker code is 4711.") {
+		t.Fatalf("expected a summarizing call before the fifth answer, got %d calls", len(calls))
+	}
+
+	answered := fmt.Sprint(calls[5])
+	if !strings.Contains(answered, "Summary of the earlier conversation: The user's locker code is 4711.") || strings.Contains(answered, "My locker code is 4711.") || !strings.Contains(answered, "Question three?") {
+		t.Fatalf("the answer should see the summary instead of the summarized turns: %s", answered)
+	}
+
+	app.doJSON("GET", "/api/v1/chat/get-chat-session-messages/"+sessionID, token, nil, http.StatusOK, &messages)
+	if len(messages.Data) != 10 {
+		t.Fatalf("the summary should not be listed, got %d messages", len(messages.Data))
+	}
+
+	var summarizedThrough int64
+	if err := app.dbHandler.DB.Get(&summarizedThrough, "SELECT summarized_through FROM session_messages WHERE session_id=$1 AND message_role='summary'", sessionID); err != nil || summarizedThrough != messages.Data[3].ID {
+		t.Fatalf("the summary should cover the first two turns up to message %d, got %d: %v", messages.Data[3].ID, summarizedThrough, err)
+	}
+}
+
+func TestEndToEndMultiCollectionSession(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("olivia@example.com", "olivia's long passphrase")
+
+	manualHash := app.createCollection(token, "manual")
+	notesHash := app.createCollection(token, "release notes")
+	runbookHash := app.createCollection(token, "runbook")
+
+	app.upload(token, manualHash, "manual.txt", "The XJ-9000 pump moves water from the tank.")
+	app.upload(token, notesHash, "notes.txt", "Release 2.1 of the XJ-9000 firmware fixes the pump stall.")
+	app.upload(token, runbookHash, "runbook.txt", "Restart the XJ-9000 pump controller when it stalls.")
+
+	// The session keeps as many chunks as its most generous collection.
+	app.doJSON("PUT", "/api/v1/rag/collections/"+notesHash+"/settings", token, map[string]interface{}{"top_k": 3}, http.StatusOK, nil)
+	app.doJSON("POST", "/api/v1/rag/prompt-template", token, map[string]string{"template": "Answer from the context only.", "collection_hash": manualHash}, http.StatusOK, nil)
+	app.doJSON("POST", "/api/v1/rag/prompt-template", token, map[string]string{"template": "Answer from the release notes only.", "collection_hash": notesHash}, http.StatusOK, nil)
+
+	var errorResponse map[string]string
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", token, map[string]interface{}{"collection_hashes": manualHash}, http.StatusBadRequest, &errorResponse)
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", token, map[string]interface{}{"collection_hashes": []string{}}, http.StatusBadRequest, &errorResponse)
+	if errorResponse["error_code"] != "9" {
+		t.Fatalf("unexpected error %v", errorResponse)
+	}
+
+	otherToken := app.registerAndLogin("peggy@example.com", "peggy's long passphrase")
+	otherHash := app.createCollection(otherToken, "private")
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", token, map[string]interface{}{"collection_hashes": []string{manualHash, otherHash}}, http.StatusNotFound, nil)
+
+	var session struct {
+		SessionID             string `json:"session_id"`
+		PrimaryCollectionHash string `json:"primary_collection_hash"`
+	}
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", token, map[string]interface{}{"collection_hashes": []string{manualHash, notesHash, runbookHash}}, http.StatusOK, &session)
+	if session.PrimaryCollectionHash != manualHash {
+		t.Fatalf("expected the first collection to be the primary one, got %+v", session)
+	}
+
+	var sessions struct {
+		Data []struct {
+			SessionID             string   `json:"session_id"`
+			PrimaryCollectionHash string   `json:"primary_collection_hash"`
+			CollectionHashes      []string `json:"collection_hashes"`
+		} `json:"data"`
+	}
+	app.doJSON("GET", "/api/v1/chat/list-chat-sessions", token, nil, http.StatusOK, &sessions)
+	if len(sessions.Data) != 1 || sessions.Data[0].PrimaryCollectionHash != manualHash || fmt.Sprint(sessions.Data[0].CollectionHashes) != fmt.Sprint([]string{manualHash, notesHash, runbookHash}) {
+		t.Fatalf("unexpected sessions %+v", sessions.Data)
+	}
+
+	type multiSource struct {
+		CollectionHash string  `json:"collection_hash"`
+		CollectionName string  `json:"collection_name"`
+		FileName       string  `json:"file_name"`
+		Score          float32 `json:"score"`
+	}
+	var answer struct {
+		Sources []multiSource `json:"sources"`
+	}
+	question := map[string]string{"session_id": session.SessionID, "user_message": "How do I fix an XJ-9000 pump stall?"}
+
+	// Every collection is searched and the rankings are fused.
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, question, http.StatusOK, &answer)
+	if len(answer.Sources) != 3 {
+		t.Fatalf("expected a source from each collection, got %+v", answer.Sources)
+	}
+
+	names := map[string]string{manualHash: "manual", notesHash: "release notes", runbookHash: "runbook"}
+	files := map[string]string{manualHash: "manual.txt", notesHash: "notes.txt", runbookHash: "runbook.txt"}
+	seen := make(map[string]bool)
+	for i, source := range answer.Sources {
+		if names[source.CollectionHash] != source.CollectionName || !strings.HasSuffix(source.FileName, files[source.CollectionHash]) {
+			t.Fatalf("source %+v does not name its collection", source)
+		}
+		if i > 0 && source.Score > answer.Sources[i-1].Score {
+			t.Fatalf("sources are not ordered by their fusion score: %+v", answer.Sources)
+		}
+		seen[source.CollectionHash] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected sources from three collections, got %+v", answer.Sources)
+	}
+
+	// A deleted collection drops out of the session.
+	app.doJSON("DELETE", "/api/v1/rag/delete-vector-collection/"+runbookHash, token, nil, http.StatusOK, nil)
+	answer.Sources = nil
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, question, http.StatusOK, &answer)
+	if len(answer.Sources) != 2 {
+		t.Fatalf("expected sources from the remaining collections, got %+v", answer.Sources)
+	}
+	for _, source := range answer.Sources {
+		if source.CollectionHash == runbookHash {
+			t.Fatalf("the deleted collection was searched: %+v", answer.Sources)
+		}
+	}
+
+	// Similarity scores of a vector only collection do not crowd out the
+	// far smaller fusion scores of a hybrid one.
+	wikiHash := app.createCollection(token, "wiki")
+	app.upload(token, wikiHash, "stall.txt", "A stalled XJ-9000 pump hums but moves no water.")
+	app.upload(token, wikiHash, "history.txt", "The XJ-9000 pump replaced the XJ-8000 in 2019.")
+	app.doJSON("PUT", "/api/v1/rag/collections/"+wikiHash+"/settings", token, map[string]interface{}{"keyword_weight": 0}, http.StatusOK, nil)
+	app.doJSON("POST", "/api/v1/rag/prompt-template", token, map[string]string{"template": "Answer from the context only.", "collection_hash": wikiHash}, http.StatusOK, nil)
+
+	var mixed struct {
+		SessionID string `json:"session_id"`
+	}
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", token, map[string]interface{}{"collection_hashes": []string{wikiHash, manualHash}}, http.StatusOK, &mixed)
+
+	answer.Sources = nil
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": mixed.SessionID, "user_message": "How do I fix an XJ-9000 pump stall?"}, http.StatusOK, &answer)
+	if len(answer.Sources) != 2 || answer.Sources[0].CollectionHash == answer.Sources[1].CollectionHash {
+		t.Fatalf("expected the best chunk of each collection, got %+v", answer.Sources)
+	}
+
+	// Revoking a grant on a secondary collection drops it from the session
+	// instead of refusing every turn.
+	app.upload(otherToken, otherHash, "warranty.txt", "The XJ-9000 pump warranty covers a stall for two years.")
+	grantsPath := "/api/v1/rag/collections/" + otherHash + "/grants"
+	app.doJSON("PUT", grantsPath, otherToken, map[string]string{"email": "olivia@example.com", "permission": "viewer"}, http.StatusOK, nil)
+
+	var shared struct {
+		SessionID string `json:"session_id"`
+	}
+	app.doJSON("POST", "/api/v1/chat/start-chat-session", token, map[string]interface{}{"collection_hashes": []string{notesHash, otherHash}}, http.StatusOK, &shared)
+
+	sharedQuestion := map[string]string{"session_id": shared.SessionID, "user_message": "How do I fix an XJ-9000 pump stall?"}
+	answer.Sources = nil
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, sharedQuestion, http.StatusOK, &answer)
+	if len(answer.Sources) != 2 {
+		t.Fatalf("expected sources from both collections, got %+v", answer.Sources)
+	}
+
+	var oliviaID int64
+	if err := app.dbHandler.DB.Get(&oliviaID, "SELECT id FROM user WHERE email=$1", "olivia@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	app.doJSON("DELETE", fmt.Sprintf("%s/%d", grantsPath, oliviaID), otherToken, nil, http.StatusOK, nil)
+
+	answer.Sources = nil
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, sharedQuestion, http.StatusOK, &answer)
+	if len(answer.Sources) != 1 || answer.Sources[0].CollectionHash != notesHash {
+		t.Fatalf("expected sources from the collection still shared only, got %+v", answer.Sources)
+	}
+
+	// Deleting the primary collection makes the next one the primary one.
+	app.doJSON("DELETE", "/api/v1/rag/delete-vector-collection/"+manualHash, token, nil, http.StatusOK, nil)
+
+	answer.Sources = nil
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, question, http.StatusOK, &answer)
+	if len(answer.Sources) != 1 || answer.Sources[0].CollectionHash != notesHash {
+		t.Fatalf("expected sources from the remaining collection, got %+v", answer.Sources)
+	}
+
+	sessions.Data = nil
+	app.doJSON("GET", "/api/v1/chat/list-chat-sessions", token, nil, http.StatusOK, &sessions)
+	for _, listed := range sessions.Data {
+		if listed.SessionID == session.SessionID && (listed.PrimaryCollectionHash != notesHash || fmt.Sprint(listed.CollectionHashes) != fmt.Sprint([]string{notesHash})) {
+			t.Fatalf("unexpected session %+v", listed)
+		}
+		if listed.SessionID == mixed.SessionID && listed.PrimaryCollectionHash != wikiHash {
+			t.Fatalf("a session without the deleted collection changed its primary one: %+v", listed)
+		}
+	}
+	if len(sessions.Data) != 3 {
+		t.Fatalf("expected the three sessions to remain, got %+v", sessions.Data)
+	}
+
+	// A session left without collections is deleted with the last one.
+	app.doJSON("DELETE", "/api/v1/rag/delete-vector-collection/"+notesHash, token, nil, http.StatusOK, nil)
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, question, http.StatusNotFound, nil)
+
+	app.doJSON("DELETE", "/api/v1/chat/delete-chat-session/"+mixed.SessionID, token, nil, http.StatusOK, nil)
+	var links int
+	if err := app.dbHandler.DB.Get(&links, "SELECT COUNT(*) FROM chat_session_collections WHERE session_id IN ($1, $2)", session.SessionID, mixed.SessionID); err != nil || links != 0 {
+		t.Fatalf("the session still references %d collections: %v", links, err)
+	}
+}
+
+// smtpSink is an SMTP server that accepts every message and keeps its data.
+type smtpSink struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []string
+}
+
+// newSMTPSink starts an smtpSink and points the mail settings at it for the
+// rest of the test.
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &smtpSink{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	t.Setenv("MAIL_SERVER", host)
+	t.Setenv("SMTP_PORT", port)
+	t.Setenv("MAIL_USERNAME", "")
+	t.Setenv("MAIL_CONTACT", "noreply@example.com")
+
+	return sink
+}
+
+func (sink *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost\r\n")
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch command := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(command, "DATA"):
+			fmt.Fprint(conn, "354 go ahead\r\n")
+
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+
+			sink.mu.Lock()
+			sink.messages = append(sink.messages, data.String())
+			sink.mu.Unlock()
+
+			fmt.Fprint(conn, "250 queued\r\n")
+		case strings.HasPrefix(command, "QUIT"):
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+// containing returns the messages received so far that contain text.
+func (sink *smtpSink) containing(text string) []string {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	matching := make([]string, 0)
+	for _, message := range sink.messages {
+		if strings.Contains(message, text) {
+			matching = append(matching, message)
+		}
+	}
+
+	return matching
+}
+
+// waitFor waits until count messages containing text have arrived.
+func (sink *smtpSink) waitFor(t *testing.T, text string, count int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if matching := sink.containing(text); len(matching) >= count {
+			return matching
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("expected %d mails containing %q, got %d", count, text, len(sink.containing(text)))
+	return nil
+}
+
+func TestEndToEndLoginAlerts(t *testing.T) {
+	sink := newSMTPSink(t)
+	app := newTestApp(t)
+	app.handlers.Authentication.LoginAlerts = true
+
+	const (
+		firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+		safari  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1"
+		alert   = "new location or device"
+	)
+
+	// The first login is not news.
+	app.registerAndLogin("kim@example.com", "kim's long passphrase")
+
+	app.loginFrom("kim@example.com", "kim's long passphrase", firefox, "203.0.113.7")
+	alerts := sink.waitFor(t, alert, 1)
+	if !strings.Contains(alerts[0], "Firefox") || !strings.Contains(alerts[0], "203.0.113.7") {
+		t.Fatalf("the alert does not describe the new login: %s", alerts[0])
+	}
+
+	// A known device is not reported again, another one is.
+	app.loginFrom("kim@example.com", "kim's long passphrase", firefox, "203.0.113.7")
+	app.loginFrom("kim@example.com", "kim's long passphrase", safari, "198.51.100.23")
+	alerts = sink.waitFor(t, alert, 2)
+
+	time.Sleep(200 * time.Millisecond)
+	if alerts = sink.containing(alert); len(alerts) != 2 || !strings.Contains(strings.Join(alerts, ""), "Safari") {
+		t.Fatalf("expected alerts for the two new devices only, got %d", len(alerts))
+	}
+}
+
+func TestEndToEndOIDCLoginCSRF(t *testing.T) {
+	idp := newMockIdP(t)
+	app := newTestAppWithOIDC(t, idp)
+
+	idp.SignInAs(jwt.MapClaims{"sub": "idp-mallory", "email": "mallory@example.com", "email_verified": true})
+
+	// The attacker's callback URL is useless in a browser that did not start
+	// the login, with or without a state cookie of its own.
+	callback, stateCookie := app.startSSOLogin()
+	_, otherCookie := app.startSSOLogin()
+
+	for _, cookie := range []*http.Cookie{nil, otherCookie} {
+		resp := app.ssoCallback(callback, cookie)
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized || strings.Contains(string(b), "access_token") {
+			t.Fatalf("a callback from another browser: got status %d: %s", resp.StatusCode, b)
+		}
+	}
+
+	// The browser that started the login completes it.
+	resp := app.ssoCallback(callback, stateCookie)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("the callback with the state cookie: got status %d", resp.StatusCode)
+	}
+}
+
+// failingEmbedder embeds like the fake provider once the first failures calls
+// to EmbedDocuments have failed; a negative failures fails all of them. With
+// a documentDimension, documents come back with that many dimensions instead.
+type failingEmbedder struct {
+	providers.FakeEmbedder
+
+	failures          atomic.Int32
+	documentDimension int
+}
+
+func newFailingEmbedder(failures int32, documentDimension int) *failingEmbedder {
+	e := &failingEmbedder{FakeEmbedder: providers.FakeEmbedder{Dimension: 64}, documentDimension: documentDimension}
+	e.failures.Store(failures)
+
+	return e
+}
+
+func (e *failingEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	if failures := e.failures.Load(); failures != 0 {
+		if failures > 0 {
+			e.failures.Add(-1)
+		}
+		return nil, errors.New("embedding service unavailable")
+	}
+
+	if e.documentDimension > 0 {
+		return providers.FakeEmbedder{Dimension: e.documentDimension}.EmbedDocuments(ctx, texts)
+	}
+
+	return e.FakeEmbedder.EmbedDocuments(ctx, texts)
+}
+
+// embedderProvider hands out one embedder for every model.
+type embedderProvider struct {
+	embedder embeddings.Embedder
+}
+
+func (p embedderProvider) ChatModel(model string) (llms.Model, error) {
+	return &providers.FakeChatModel{Responses: []string{testAnswer}}, nil
+}
+
+func (p embedderProvider) Embedder(model string) (embeddings.Embedder, error) {
+	return p.embedder, nil
+}
+
+func TestEndToEndIngestionRetries(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("quentin@example.com", "quentin's long passphrase")
+
+	app.providers.Register("flaky", embedderProvider{newFailingEmbedder(2, 0)})
+	app.providers.Register("down", embedderProvider{newFailingEmbedder(-1, 0)})
+	app.providers.Register("resized", embedderProvider{newFailingEmbedder(0, 32)})
+
+	// A transient failure is retried until the job completes.
+	flakyHash := app.createCollectionOn(token, "flaky", "flaky", "flaky-embedding")
+	documentID := app.startUpload(token, flakyHash, "flaky.txt", "The XJ-9000 pump moves water from the tank.")
+
+	job := app.waitForJob(token, documentID)
+	if job.Status != ingestion.StatusCompleted || job.Attempts != 3 || job.LastError != "" {
+		t.Fatalf("expected the job to complete on its third attempt, got %+v", job)
+	}
+
+	var chunks int
+	if err := app.dbHandler.DB.Get(&chunks, "SELECT COUNT(*) FROM vector_points WHERE document_id=$1", documentID); err != nil || chunks == 0 {
+		t.Fatalf("the retried document was not indexed: %d chunks, %v", chunks, err)
+	}
+
+	// A failure that keeps coming back fails the job after its last attempt.
+	downHash := app.createCollectionOn(token, "down", "down", "down-embedding")
+	documentID = app.startUpload(token, downHash, "down.txt", "The XJ-9000 pump moves water from the tank.")
+
+	job = app.waitForJob(token, documentID)
+	if job.Status != ingestion.StatusFailed || job.Attempts != job.MaxAttempts || !strings.Contains(job.LastError, "embedding service unavailable") {
+		t.Fatalf("expected the job to fail after %d attempts, got %+v", job.MaxAttempts, job)
+	}
+
+	// A permanent failure is not retried at all.
+	resizedHash := app.createCollectionOn(token, "resized", "resized", "resized-embedding")
+	documentID = app.startUpload(token, resizedHash, "resized.txt", "The XJ-9000 pump moves water from the tank.")
+
+	job = app.waitForJob(token, documentID)
+	if job.Status != ingestion.StatusFailed || job.Attempts != 1 || !strings.Contains(job.LastError, "dimension") {
+		t.Fatalf("expected the job to fail on its first attempt, got %+v", job)
+	}
+}
+
+func TestEndToEndIngestionResumesAfterRestart(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("rachel@example.com", "rachel's long passphrase")
+	collectionHash := app.createCollection(token, "manual")
+
+	app.shutDownWorkers()
+
+	// One job waits for a worker, the other was cut off by the shutdown.
+	pendingID := app.startUpload(token, collectionHash, "pending.txt", "The XJ-9000 pump moves water from the tank.")
+	interruptedID := app.startUpload(token, collectionHash, "interrupted.txt", "Restart the XJ-9000 pump controller when it stalls.")
+
+	_, err := app.dbHandler.DB.Exec("UPDATE ingestion_jobs SET status=$1, stage=$2, attempts=1 WHERE document_id=$3", ingestion.StatusRunning, ingestion.StageEmbedding, interruptedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	for _, documentID := range []int64{pendingID, interruptedID} {
+		var job struct {
+			Data ingestionJob `json:"data"`
+		}
+		app.doJSON("GET", fmt.Sprintf("/api/v1/rag/documents/%d/ingestion-status", documentID), token, nil, http.StatusOK, &job)
+		if job.Data.Status == ingestion.StatusCompleted {
+			t.Fatalf("document %d was indexed while the workers were stopped", documentID)
+		}
+	}
+
+	app.startWorkers()
+
+	app.waitForIngestion(token, pendingID)
+	app.waitForIngestion(token, interruptedID)
+
+	job := app.waitForJob(token, interruptedID)
+	if job.Attempts != 2 {
+		t.Fatalf("expected the interrupted job to resume with its second attempt, got %+v", job)
+	}
+}
+
+func TestEndToEndReindexDocument(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("sam@example.com", "sam's long passphrase")
+	collectionHash := app.createCollection(token, "manual")
+
+	sentences := make([]string, 0, 12)
+	for i := range 12 {
+		sentences = append(sentences, fmt.Sprintf("Step %d of the XJ-9000 pump service is checking seal number %d.", i+1, i+1))
+	}
+	documentID := app.upload(token, collectionHash, "service.txt", strings.Join(sentences, " "))
+
+	oldChunks := make([]string, 0)
+	if err := app.dbHandler.DB.Select(&oldChunks, "SELECT content FROM vector_points WHERE document_id=$1", documentID); err != nil || len(oldChunks) != 1 {
+		t.Fatalf("expected the document in one chunk, got %d: %v", len(oldChunks), err)
+	}
+
+	app.doJSON("PUT", "/api/v1/rag/collections/"+collectionHash+"/settings", token, map[string]interface{}{"chunk_size": 200, "chunk_overlap": 0}, http.StatusOK, nil)
+	app.doJSON("POST", fmt.Sprintf("/api/v1/rag/documents/%d/reindex", documentID), token, nil, http.StatusOK, nil)
+	app.waitForIngestion(token, documentID)
+
+	chunks := make([]string, 0)
+	if err := app.dbHandler.DB.Select(&chunks, "SELECT content FROM vector_points WHERE document_id=$1", documentID); err != nil || len(chunks) < 3 {
+		t.Fatalf("expected the document in chunks of at most 200 characters, got %d: %v", len(chunks), err)
+	}
+	for _, chunk := range chunks {
+		if chunk == oldChunks[0] {
+			t.Fatal("the vector of the old chunk is left")
+		}
+		if len(chunk) > 200 {
+			t.Fatalf("chunk of %d characters: %q", len(chunk), chunk)
+		}
+	}
+
+	var keywordChunks int
+	if err := app.dbHandler.DB.Get(&keywordChunks, "SELECT COUNT(*) FROM chunk_texts WHERE document_id=$1", documentID); err != nil || keywordChunks != len(chunks) {
+		t.Fatalf("the keyword index holds %d chunks instead of %d: %v", keywordChunks, len(chunks), err)
+	}
+}
+
+func TestEndToEndDeleteVectorCollection(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("tara@example.com", "tara's long passphrase")
+	collectionHash := app.createCollection(token, "manual")
+	keptHash := app.createCollection(token, "kept")
+
+	documentID := app.upload(token, collectionHash, "manual.txt", "The XJ-9000 pump moves water from the tank.")
+	app.upload(token, keptHash, "kept.txt", "Restart the XJ-9000 pump controller when it stalls.")
+	sessionID := app.startChatSession(token, collectionHash)
+	keptSessionID := app.startChatSession(token, keptHash)
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": sessionID, "user_message": "What does the pump move?"}, http.StatusOK, nil)
+
+	var fileName string
+	if err := app.dbHandler.DB.Get(&fileName, "SELECT file_name FROM documents WHERE id=$1", documentID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A document cannot be deleted while a re-embed may copy it.
+	app.shutDownWorkers()
+	app.doJSON("POST", "/api/v1/rag/collections/"+collectionHash+"/reembed", token, map[string]string{"embedding_model": "fake-embedding"}, http.StatusOK, nil)
+
+	var errorResponse map[string]string
+	app.doJSON("DELETE", fmt.Sprintf("/api/v1/rag/documents/%d", documentID), token, nil, http.StatusConflict, &errorResponse)
+	if errorResponse["error_code"] != "7" {
+		t.Fatalf("unexpected error %v", errorResponse)
+	}
+
+	app.doJSON("DELETE", "/api/v1/rag/delete-vector-collection/"+collectionHash, token, nil, http.StatusOK, nil)
+
+	for _, table := range []string{"documents", "ingestion_jobs", "reembed_jobs", "prompt_templates", "chat_sessions", "chat_session_collections", "collection_grants"} {
+		var rows int
+		if err := app.dbHandler.DB.Get(&rows, "SELECT COUNT(*) FROM "+table+" WHERE collection_id NOT IN (SELECT id FROM vector_collections)"); err != nil || rows != 0 {
+			t.Fatalf("%d rows of %s belong to the deleted collection: %v", rows, table, err)
+		}
+	}
+
+	var messages int
+	if err := app.dbHandler.DB.Get(&messages, "SELECT COUNT(*) FROM session_messages WHERE session_id=$1", sessionID); err != nil || messages != 0 {
+		t.Fatalf("%d messages of the session on the deleted collection are left: %v", messages, err)
+	}
+
+	var stores int
+	if err := app.dbHandler.DB.Get(&stores, "SELECT COUNT(*) FROM vector_store_collections WHERE name NOT IN (SELECT store_name FROM vector_collections)"); err != nil || stores != 0 {
+		t.Fatalf("%d store collections of the deleted collection are left: %v", stores, err)
+	}
+
+	if _, err := os.Stat(app.queue.UploadFolder + fileName); !os.IsNotExist(err) {
+		t.Fatalf("the uploaded file was not removed: %v", err)
+	}
+
+	// Nothing of the other collection went with it.
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, map[string]string{"session_id": keptSessionID, "user_message": "What does the pump controller need?"}, http.StatusOK, nil)
+}
+
+type reembedJob struct {
+	Status          string `json:"status"`
+	TargetDimension int    `json:"target_dimension"`
+	ProcessedPoints int    `json:"processed_points"`
+	LastError       string `json:"last_error"`
+}
+
+// waitForReembed waits until the latest re-embed of a collection has
+// completed or failed.
+func (app *testApp) waitForReembed(token string, collectionHash string) reembedJob {
+	app.t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for time.Now().Before(deadline) {
+		var job struct {
+			Data reembedJob `json:"data"`
+		}
+		app.doJSON("GET", "/api/v1/rag/collections/"+collectionHash+"/reembed-status", token, nil, http.StatusOK, &job)
+
+		if job.Data.Status == ingestion.StatusCompleted || job.Data.Status == ingestion.StatusFailed {
+			return job.Data
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	app.t.Fatalf("the re-embed of collection %s did not finish", collectionHash)
+	return reembedJob{}
+}
+
+func TestEndToEndReembedCollection(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("ursula@example.com", "ursula's long passphrase")
+	app.providers.Register("wide", providers.FakeProvider{Dimension: 512, Responses: []string{testAnswer}})
+
+	collectionHash := app.createCollection(token, "manual")
+	app.upload(token, collectionHash, "manual.txt", "The XJ-9000 pump moves water from the tank.")
+	app.upload(token, collectionHash, "runbook.txt", "Restart the XJ-9000 pump controller when it stalls.")
+	sessionID := app.startChatSession(token, collectionHash)
+
+	type collection struct {
+		ID                 int64  `json:"id"`
+		CollectionHash     string `json:"collection_hash"`
+		EmbeddingProvider  string `json:"embedding_provider"`
+		EmbeddingModel     string `json:"embedding_model"`
+		EmbeddingDimension int    `json:"embedding_dimension"`
+	}
+	findCollection := func() collection {
+		var collections struct {
+			Data []collection `json:"data"`
+		}
+		app.doJSON("GET", "/api/v1/rag/list-vector-collections", token, nil, http.StatusOK, &collections)
+		for _, c := range collections.Data {
+			if c.CollectionHash == collectionHash {
+				return c
+			}
+		}
+		t.Fatalf("collection %s is not listed", collectionHash)
+		return collection{}
+	}
+
+	var oldStore string
+	if err := app.dbHandler.DB.Get(&oldStore, "SELECT store_name FROM vector_collections WHERE collection_hash=$1", collectionHash); err != nil {
+		t.Fatal(err)
+	}
+
+	var started struct {
+		Data struct {
+			EmbeddingDimension int `json:"embedding_dimension"`
+		} `json:"data"`
+	}
+	app.doJSON("POST", "/api/v1/rag/collections/"+collectionHash+"/reembed", token, map[string]string{"embedding_provider": "wide"}, http.StatusBadRequest, nil)
+	app.doJSON("POST", "/api/v1/rag/collections/"+collectionHash+"/reembed", token, map[string]string{"embedding_provider": "wide", "embedding_model": "wide-embedding"}, http.StatusOK, &started)
+	if started.Data.EmbeddingDimension != 512 {
+		t.Fatalf("expected the re-embed to target 512 dimensions, got %d", started.Data.EmbeddingDimension)
+	}
+
+	job := app.waitForReembed(token, collectionHash)
+	if job.Status != ingestion.StatusCompleted || job.ProcessedPoints != 2 {
+		t.Fatalf("expected both chunks to be re-embedded, got %+v", job)
+	}
+
+	swapped := findCollection()
+	if swapped.EmbeddingProvider != "wide" || swapped.EmbeddingModel != "wide-embedding" || swapped.EmbeddingDimension != 512 {
+		t.Fatalf("the collection was not swapped to the new model: %+v", swapped)
+	}
+
+	var points, oldPoints int
+	if err := app.dbHandler.DB.Get(&points, "SELECT COUNT(*) FROM vector_points JOIN vector_collections ON vector_collections.store_name=vector_points.collection WHERE vector_collections.id=$1", swapped.ID); err != nil || points != 2 {
+		t.Fatalf("expected the new store to hold both chunks, got %d: %v", points, err)
+	}
+	if err := app.dbHandler.DB.Get(&oldPoints, "SELECT COUNT(*) FROM vector_points WHERE collection=$1", oldStore); err != nil || oldPoints != 0 {
+		t.Fatalf("%d chunks are left in the previous store: %v", oldPoints, err)
+	}
+
+	var answer struct {
+		Sources []chatSource `json:"sources"`
+	}
+	question := map[string]string{"session_id": sessionID, "user_message": "What does the XJ-9000 pump move?"}
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, question, http.StatusOK, &answer)
+	if len(answer.Sources) == 0 {
+		t.Fatal("the re-embedded collection returned no sources")
+	}
+
+	// A question embedded with another dimension than the collection's is
+	// refused instead of compared.
+	if _, err := app.dbHandler.DB.Exec("UPDATE vector_collections SET embedding_provider=$1, embedding_model=$2 WHERE id=$3", providers.Fake, "fake-embedding", swapped.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var errorResponse map[string]string
+	app.doJSON("POST", "/api/v1/chat/send-message-to-chat-session", token, question, http.StatusConflict, &errorResponse)
+	if errorResponse["error_code"] != "10" {
+		t.Fatalf("unexpected error %v", errorResponse)
+	}
+
+	if _, err := app.dbHandler.DB.Exec("UPDATE vector_collections SET embedding_provider=$1, embedding_model=$2 WHERE id=$3", "wide", "wide-embedding", swapped.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A re-embed whose source store is gone fails and leaves the collection
+	// as it was.
+	if _, err := app.dbHandler.DB.Exec("DELETE FROM vector_store_collections WHERE name=(SELECT store_name FROM vector_collections WHERE id=$1)", swapped.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	app.doJSON("POST", "/api/v1/rag/collections/"+collectionHash+"/reembed", token, map[string]string{"embedding_model": "fake-embedding"}, http.StatusOK, nil)
+
+	job = app.waitForReembed(token, collectionHash)
+	if job.Status != ingestion.StatusFailed || job.LastError == "" {
+		t.Fatalf("expected the re-embed to fail, got %+v", job)
+	}
+
+	if failed := findCollection(); failed.EmbeddingProvider != "wide" || failed.EmbeddingDimension != 512 {
+		t.Fatalf("the failed re-embed swapped the collection: %+v", failed)
+	}
+}
+
+func TestEndToEndKeywordSearchMatchesWholeTerms(t *testing.T) {
+	app := newTestApp(t)
+
+	token := app.registerAndLogin("victor@example.com", "victor's long passphrase")
+	collectionHash := app.createCollection(token, "manual")
+
+	app.upload(token, collectionHash, "pumps.txt", "This section lists the pumps of the plant.")
+	app.upload(token, collectionHash, "pump.txt", "The pump is serviced every spring.")
+	app.upload(token, collectionHash, "codes.txt", "Error err-4021 means the pump lost pressure.")
+
+	var collectionID int64
+	if err := app.dbHandler.DB.Get(&collectionID, "SELECT id FROM vector_collections WHERE collection_hash=$1", collectionHash); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both rankings, BM25 with sqlite_fts5 and the term count without it,
+	// match whole terms only.
+	tests := []struct {
+		query string
+		files []string
+	}{
+		{"is pump", []string{"pump.txt", "codes.txt"}},
+		{"pumps", []string{"pumps.txt"}},
+		{"his", nil},
+		{"ERR-4021", []string{"codes.txt"}},
+	}
+
+	for _, test := range tests {
+		docs, err := app.queue.Keywords.Search(context.Background(), collectionID, test.query, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			files = append(files, ingestion.OriginalFileName(fmt.Sprint(doc.Metadata["file_name"])))
+		}
+
+		if fmt.Sprint(files) != fmt.Sprint(test.files) {
+			t.Errorf("%q found %v, want %v", test.query, files, test.files)
+		}
+	}
+}
@@ -0,0 +1 @@
+ALTER TABLE session_messages DROP COLUMN sources;
\ No newline at end of file
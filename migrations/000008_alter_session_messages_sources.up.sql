@@ -0,0 +1 @@
+ALTER TABLE session_messages ADD COLUMN sources TEXT NOT NULL DEFAULT '[]';
\ No newline at end of file
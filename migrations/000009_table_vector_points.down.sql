@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS vector_points;
+DROP TABLE IF EXISTS vector_store_collections;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS vector_store_collections (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(50) UNIQUE NOT NULL,
+    dimension INTEGER NOT NULL,
+    date_created DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS vector_points (
+    id VARCHAR(50) PRIMARY KEY,
+    collection VARCHAR(50) NOT NULL,
+    document_id INTEGER,
+    content TEXT NOT NULL,
+    metadata TEXT NOT NULL,
+    vector BLOB NOT NULL,
+    date_created DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_vector_points_collection ON vector_points(collection, document_id);
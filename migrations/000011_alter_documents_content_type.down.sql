@@ -0,0 +1 @@
+ALTER TABLE documents DROP COLUMN content_type;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE documents ADD COLUMN content_type VARCHAR(120) NOT NULL DEFAULT 'application/pdf';
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE vector_collections DROP COLUMN settings;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE vector_collections ADD COLUMN settings TEXT NOT NULL DEFAULT '{}';
\ No newline at end of file
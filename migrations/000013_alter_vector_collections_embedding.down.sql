@@ -0,0 +1,3 @@
+ALTER TABLE vector_collections DROP COLUMN store_name;
+ALTER TABLE vector_collections DROP COLUMN embedding_dimension;
+ALTER TABLE vector_collections DROP COLUMN embedding_model;
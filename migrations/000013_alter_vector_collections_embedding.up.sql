@@ -0,0 +1,4 @@
+ALTER TABLE vector_collections ADD COLUMN embedding_model VARCHAR(120) NOT NULL DEFAULT '';
+ALTER TABLE vector_collections ADD COLUMN embedding_dimension INTEGER NOT NULL DEFAULT 1536;
+ALTER TABLE vector_collections ADD COLUMN store_name VARCHAR(50) NOT NULL DEFAULT '';
+UPDATE vector_collections SET store_name=collection_hash;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS reembed_jobs;
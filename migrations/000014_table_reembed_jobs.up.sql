@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS reembed_jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    collection_id INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    target_model VARCHAR(120) NOT NULL,
+    target_dimension INTEGER NOT NULL,
+    target_store_name VARCHAR(50) NOT NULL,
+    processed_points INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    date_created  DATETIME NOT NULL,
+    date_modified DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_reembed_jobs_collection ON reembed_jobs(collection_id, status);
@@ -0,0 +1,2 @@
+ALTER TABLE reembed_jobs DROP COLUMN target_provider;
+ALTER TABLE vector_collections DROP COLUMN embedding_provider;
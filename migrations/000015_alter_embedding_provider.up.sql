@@ -0,0 +1,2 @@
+ALTER TABLE vector_collections ADD COLUMN embedding_provider VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE reembed_jobs ADD COLUMN target_provider VARCHAR(50) NOT NULL DEFAULT '';
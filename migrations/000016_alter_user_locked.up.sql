@@ -0,0 +1 @@
+ALTER TABLE user ADD COLUMN locked INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+DROP VIEW IF EXISTS collection_access;
+ALTER TABLE vector_collections DROP COLUMN organization_id;
+DROP TABLE IF EXISTS collection_grants;
+DROP TABLE IF EXISTS organization_members;
+DROP TABLE IF EXISTS organizations;
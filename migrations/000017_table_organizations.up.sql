@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS organizations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL,
+    date_created  DATETIME NOT NULL,
+    date_modified DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS organization_members (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    organization_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    role VARCHAR(20) NOT NULL,
+    date_created  DATETIME NOT NULL,
+    date_modified DATETIME NOT NULL,
+    UNIQUE(organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_organization_members_user ON organization_members(user_id);
+
+CREATE TABLE IF NOT EXISTS collection_grants (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    collection_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    permission VARCHAR(20) NOT NULL,
+    granted_by INTEGER NOT NULL,
+    date_created  DATETIME NOT NULL,
+    date_modified DATETIME NOT NULL,
+    UNIQUE(collection_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_collection_grants_user ON collection_grants(user_id);
+
+ALTER TABLE vector_collections ADD COLUMN organization_id INTEGER NOT NULL DEFAULT 0;
+
+-- Every way a user can reach a collection, with 1 = viewer, 2 = editor and
+-- 3 = owner. The creator owns a personal collection. Owners of an organization
+-- own its collections and other members may view them. Grants add to that;
+-- the creator of an organization collection is granted ownership.
+CREATE VIEW IF NOT EXISTS collection_access AS
+    SELECT id AS collection_id, user_id, 3 AS level FROM vector_collections WHERE organization_id=0
+    UNION ALL
+    SELECT vector_collections.id, organization_members.user_id, CASE organization_members.role WHEN 'owner' THEN 3 ELSE 1 END
+        FROM vector_collections JOIN organization_members ON organization_members.organization_id=vector_collections.organization_id
+    UNION ALL
+    SELECT collection_id, user_id, CASE permission WHEN 'owner' THEN 3 WHEN 'editor' THEN 2 ELSE 1 END FROM collection_grants;
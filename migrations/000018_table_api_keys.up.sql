@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    key_prefix VARCHAR(20) NOT NULL,
+    key_hash VARCHAR(64) UNIQUE NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    collection_id INTEGER NOT NULL DEFAULT 0,
+    expires_at DATETIME,
+    last_used_at DATETIME,
+    revoked INTEGER NOT NULL DEFAULT 0,
+    date_created  DATETIME NOT NULL,
+    date_modified DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_user ON api_keys(user_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS oidc_login_states;
+DROP INDEX IF EXISTS idx_user_oidc_identity;
+ALTER TABLE user DROP COLUMN oidc_subject;
+ALTER TABLE user DROP COLUMN oidc_issuer;
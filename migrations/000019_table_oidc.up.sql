@@ -0,0 +1,11 @@
+ALTER TABLE user ADD COLUMN oidc_issuer VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE user ADD COLUMN oidc_subject VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_oidc_identity ON user(oidc_issuer, oidc_subject) WHERE oidc_subject <> '';
+
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    state VARCHAR(64) PRIMARY KEY,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    date_created  DATETIME NOT NULL
+);
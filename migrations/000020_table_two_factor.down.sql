@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS settings;
+DROP TABLE IF EXISTS login_challenges;
+DROP TABLE IF EXISTS user_recovery_codes;
+ALTER TABLE user DROP COLUMN totp_last_step;
+ALTER TABLE user DROP COLUMN totp_enabled;
+ALTER TABLE user DROP COLUMN totp_secret;
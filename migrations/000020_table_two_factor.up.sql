@@ -0,0 +1,26 @@
+ALTER TABLE user ADD COLUMN totp_secret VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE user ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE user ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    code_hash VARCHAR(64) NOT NULL,
+    used INTEGER NOT NULL DEFAULT 0,
+    date_created  DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_recovery_codes_user ON user_recovery_codes(user_id);
+
+CREATE TABLE IF NOT EXISTS login_challenges (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    date_created  DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS settings (
+    name VARCHAR(64) PRIMARY KEY,
+    value TEXT NOT NULL,
+    date_modified DATETIME NOT NULL
+);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    ip_address VARCHAR(45) NOT NULL,
+    user_agent TEXT NOT NULL,
+    browser VARCHAR(100) NOT NULL,
+    os VARCHAR(100) NOT NULL,
+    device VARCHAR(100) NOT NULL,
+    country VARCHAR(100) NOT NULL,
+    country_code VARCHAR(2) NOT NULL,
+    city VARCHAR(100) NOT NULL,
+    expires_at DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    ended_at DATETIME,
+    date_created  DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+
+ALTER TABLE tokens ADD COLUMN session_id INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS chunk_fts;
+DROP TABLE IF EXISTS chunk_texts;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS chunk_texts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    collection_id INTEGER NOT NULL,
+    document_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    metadata TEXT NOT NULL,
+    date_created DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_chunk_texts_document ON chunk_texts(collection_id, document_id);
+
+INSERT INTO chunk_texts(collection_id, document_id, content, metadata, date_created)
+    SELECT vector_collections.id, vector_points.document_id, vector_points.content, vector_points.metadata, vector_points.date_created
+    FROM vector_points JOIN vector_collections ON vector_collections.store_name=vector_points.collection
+    WHERE vector_points.document_id IS NOT NULL
+    ORDER BY vector_points.rowid;
@@ -0,0 +1 @@
+ALTER TABLE session_messages DROP COLUMN rewritten_query;
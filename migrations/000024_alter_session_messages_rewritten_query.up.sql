@@ -0,0 +1 @@
+ALTER TABLE session_messages ADD COLUMN rewritten_query TEXT NOT NULL DEFAULT '';
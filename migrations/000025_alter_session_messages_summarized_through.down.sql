@@ -0,0 +1 @@
+ALTER TABLE session_messages DROP COLUMN summarized_through;
@@ -0,0 +1 @@
+ALTER TABLE session_messages ADD COLUMN summarized_through INTEGER NOT NULL DEFAULT 0;
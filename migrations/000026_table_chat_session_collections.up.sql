@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS chat_session_collections (
+    session_id VARCHAR(50) NOT NULL,
+    collection_id INTEGER NOT NULL,
+    position INTEGER NOT NULL,
+    PRIMARY KEY (session_id, collection_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_session_collections_collection ON chat_session_collections(collection_id);
+
+INSERT INTO chat_session_collections(session_id, collection_id, position)
+    SELECT session_id, collection_id, 0 FROM chat_sessions;
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// APIKey is a named, scoped credential for machine-to-machine access. Only a
+// hash of the key is stored; the key itself is shown once, on creation.
+type APIKey struct {
+	ID           int64      `json:"id" db:"id"`
+	UserID       int64      `json:"-" db:"user_id"`
+	Name         string     `json:"name" db:"name"`
+	KeyPrefix    string     `json:"key_prefix" db:"key_prefix"`
+	KeyHash      string     `json:"-" db:"key_hash"`
+	Scopes       string     `json:"scopes" db:"scopes"`
+	CollectionID int64      `json:"collection_id" db:"collection_id"`
+	ExpiresAt    *time.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt   *time.Time `json:"last_used_at" db:"last_used_at"`
+	Revoked      bool       `json:"revoked" db:"revoked"`
+	DateCreated  time.Time  `json:"date_created" db:"date_created"`
+	DateModified time.Time  `json:"-" db:"date_modified"`
+}
@@ -12,4 +12,5 @@ type TokenDetails struct {
 	RefreshUuid  string
 	AtExpires    int64
 	RtExpires    int64
+	SessionID    int64
 }
@@ -9,4 +9,13 @@ type ChatSession struct {
 	SessionID    string    `json:"session_id" db:"session_id"`
 	DateCreated  time.Time `json:"date_created" db:"date_created"`
 	DateModified time.Time `json:"date_modified" db:"date_modified"`
+
+	// PrimaryCollectionHash names the collection of CollectionID, the first
+	// one the session searches. Its chat model, settings and budget drive
+	// the turns, as long as it stays shared with the user.
+	PrimaryCollectionHash string `json:"primary_collection_hash" db:"-"`
+
+	// CollectionHashes are the collections the session searches, the one of
+	// CollectionID first.
+	CollectionHashes []string `json:"collection_hashes" db:"-"`
 }
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	SplitterRecursiveCharacter = "recursive_character"
+	SplitterMarkdown           = "markdown"
+	SplitterToken              = "token"
+
+	LengthCharacters = "characters"
+	LengthTokens     = "tokens"
+
+	RerankerNone         = ""
+	RerankerLLM          = "llm"
+	RerankerCrossEncoder = "cross_encoder"
+)
+
+// CollectionSettings controls how documents of a collection are chunked and how
+// chat requests retrieve from it and call the model. Empty ChatProvider and
+// ChatModel use the deployment defaults. It is stored as JSON in
+// vector_collections.settings.
+type CollectionSettings struct {
+	SplitterType    string  `json:"splitter_type"`
+	ChunkSize       int     `json:"chunk_size"`
+	ChunkOverlap    int     `json:"chunk_overlap"`
+	LengthFunction  string  `json:"length_function"`
+	TopK            int     `json:"top_k"`
+	ScoreThreshold  float32 `json:"score_threshold"`
+	MaxAnswerTokens int     `json:"max_answer_tokens"`
+	Temperature     float64 `json:"temperature"`
+	ChatProvider    string  `json:"chat_provider"`
+	ChatModel       string  `json:"chat_model"`
+
+	// VectorWeight and KeywordWeight weigh the ranks of vector and keyword
+	// search when they are fused, RRFK is the rank constant of the fusion.
+	// A KeywordWeight of 0 turns keyword search off.
+	VectorWeight  float64 `json:"vector_weight"`
+	KeywordWeight float64 `json:"keyword_weight"`
+	RRFK          int     `json:"rrf_k"`
+
+	// ScoreThreshold applies to vector similarity, before fusion. Chunks
+	// only keyword search found have no similarity to compare, and are kept
+	// when they contain at least MinKeywordMatch of the question's terms.
+	MinKeywordMatch float64 `json:"min_keyword_match"`
+
+	// Reranker rescores RerankCandidates retrieved chunks before the best
+	// TopK of them are passed to the model. RerankModel overrides the chat
+	// model for the LLM judge and the server's model for the cross-encoder.
+	Reranker         string `json:"reranker"`
+	RerankModel      string `json:"rerank_model"`
+	RerankCandidates int    `json:"rerank_candidates"`
+
+	// QueryRewriting lets the chat model rewrite follow-up messages into
+	// standalone questions before retrieval.
+	QueryRewriting bool `json:"query_rewriting"`
+
+	// ContextWindow is the number of tokens the chat model accepts. Older
+	// turns of a session are dropped to fit it, and once more than
+	// SummarizeAfter messages have not been summarized yet, the older ones
+	// are folded into a rolling summary. A SummarizeAfter of 0 turns
+	// summaries off.
+	ContextWindow  int `json:"context_window"`
+	SummarizeAfter int `json:"summarize_after"`
+}
+
+func DefaultCollectionSettings() CollectionSettings {
+	return CollectionSettings{
+		SplitterType:    SplitterRecursiveCharacter,
+		ChunkSize:       1000,
+		ChunkOverlap:    200,
+		LengthFunction:  LengthCharacters,
+		TopK:            2,
+		ScoreThreshold:  0,
+		MaxAnswerTokens: 512,
+		Temperature:     0,
+		VectorWeight:    1,
+		KeywordWeight:   1,
+		RRFK:            60,
+
+		Reranker:         RerankerNone,
+		RerankCandidates: 20,
+
+		QueryRewriting: true,
+
+		ContextWindow:  8192,
+		SummarizeAfter: 20,
+	}
+}
+
+func (s CollectionSettings) Validate() error {
+	switch s.SplitterType {
+	case SplitterRecursiveCharacter, SplitterMarkdown, SplitterToken:
+	default:
+		return fmt.Errorf("splitter_type must be one of %s, %s, %s", SplitterRecursiveCharacter, SplitterMarkdown, SplitterToken)
+	}
+
+	switch s.LengthFunction {
+	case LengthCharacters, LengthTokens:
+	default:
+		return fmt.Errorf("length_function must be %s or %s", LengthCharacters, LengthTokens)
+	}
+
+	if s.ChunkSize < 50 || s.ChunkSize > 10000 {
+		return errors.New("chunk_size must be between 50 and 10000")
+	}
+
+	if s.ChunkOverlap < 0 || s.ChunkOverlap >= s.ChunkSize {
+		return errors.New("chunk_overlap must be at least 0 and smaller than chunk_size")
+	}
+
+	if s.TopK < 1 || s.TopK > 50 {
+		return errors.New("top_k must be between 1 and 50")
+	}
+
+	if s.ScoreThreshold < 0 || s.ScoreThreshold > 1 {
+		return errors.New("score_threshold must be between 0 and 1")
+	}
+
+	if s.MaxAnswerTokens < 16 || s.MaxAnswerTokens > 16384 {
+		return errors.New("max_answer_tokens must be between 16 and 16384")
+	}
+
+	if s.Temperature < 0 || s.Temperature > 2 {
+		return errors.New("temperature must be between 0 and 2")
+	}
+
+	if s.VectorWeight < 0 || s.VectorWeight > 10 || s.KeywordWeight < 0 || s.KeywordWeight > 10 {
+		return errors.New("vector_weight and keyword_weight must be between 0 and 10")
+	}
+
+	if s.VectorWeight == 0 && s.KeywordWeight == 0 {
+		return errors.New("vector_weight and keyword_weight cannot both be 0")
+	}
+
+	if s.RRFK < 1 || s.RRFK > 1000 {
+		return errors.New("rrf_k must be between 1 and 1000")
+	}
+
+	if s.MinKeywordMatch < 0 || s.MinKeywordMatch > 1 {
+		return errors.New("min_keyword_match must be between 0 and 1")
+	}
+
+	switch s.Reranker {
+	case RerankerNone, RerankerLLM, RerankerCrossEncoder:
+	default:
+		return fmt.Errorf("reranker must be empty, %s or %s", RerankerLLM, RerankerCrossEncoder)
+	}
+
+	if s.RerankCandidates < 1 || s.RerankCandidates > 100 {
+		return errors.New("rerank_candidates must be between 1 and 100")
+	}
+
+	if s.Reranker != RerankerNone && s.RerankCandidates < s.TopK {
+		return errors.New("rerank_candidates must not be smaller than top_k")
+	}
+
+	if s.ContextWindow < 1024 || s.ContextWindow > 2000000 {
+		return errors.New("context_window must be between 1024 and 2000000")
+	}
+
+	if s.MaxAnswerTokens > s.ContextWindow/2 {
+		return errors.New("max_answer_tokens must not be more than half of context_window")
+	}
+
+	if s.SummarizeAfter < 0 || s.SummarizeAfter > 1000 {
+		return errors.New("summarize_after must be between 0 and 1000")
+	}
+
+	return nil
+}
+
+func (s CollectionSettings) Value() (driver.Value, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// Scan starts from the defaults, so settings saved before a field existed
+// pick up its default value.
+func (s *CollectionSettings) Scan(value interface{}) error {
+	*s = DefaultCollectionSettings()
+
+	var data []byte
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return errors.New("unsupported type for CollectionSettings")
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, s)
+}
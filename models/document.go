@@ -7,6 +7,7 @@ type Document struct {
 	UserID       int64     `json:"-" db:"user_id"`
 	CollectionID int64     `json:"collection_id" db:"collection_id"`
 	FileName     string    `json:"file_name" db:"file_name"`
+	ContentType  string    `json:"content_type" db:"content_type"`
 	IsIndexed    bool      `json:"is_indexed" db:"is_indexed"`
 	DateCreated  time.Time `json:"date_created" db:"date_created"`
 	DateModified time.Time `json:"-" db:"date_modified"`
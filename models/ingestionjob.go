@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+type IngestionJob struct {
+	ID            int64     `json:"id" db:"id"`
+	UserID        int64     `json:"-" db:"user_id"`
+	DocumentID    int64     `json:"document_id" db:"document_id"`
+	CollectionID  int64     `json:"collection_id" db:"collection_id"`
+	Status        string    `json:"status" db:"status"`
+	Stage         string    `json:"stage" db:"stage"`
+	Progress      int       `json:"progress" db:"progress"`
+	Attempts      int       `json:"attempts" db:"attempts"`
+	MaxAttempts   int       `json:"max_attempts" db:"max_attempts"`
+	LastError     string    `json:"last_error" db:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at" db:"next_attempt_at"`
+	DateCreated   time.Time `json:"date_created" db:"date_created"`
+	DateModified  time.Time `json:"date_modified" db:"date_modified"`
+}
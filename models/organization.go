@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+type Organization struct {
+	ID           int64     `json:"id" db:"id"`
+	Name         string    `json:"name" db:"name"`
+	Role         string    `json:"role,omitempty" db:"role"`
+	DateCreated  time.Time `json:"date_created" db:"date_created"`
+	DateModified time.Time `json:"date_modified" db:"date_modified"`
+}
+
+type OrganizationMember struct {
+	UserID      int64     `json:"user_id" db:"user_id"`
+	Email       string    `json:"email" db:"email"`
+	Role        string    `json:"role" db:"role"`
+	DateCreated time.Time `json:"date_created" db:"date_created"`
+}
+
+type CollectionGrant struct {
+	UserID      int64     `json:"user_id" db:"user_id"`
+	Email       string    `json:"email" db:"email"`
+	Permission  string    `json:"permission" db:"permission"`
+	GrantedBy   int64     `json:"granted_by" db:"granted_by"`
+	DateCreated time.Time `json:"date_created" db:"date_created"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type ReembedJob struct {
+	ID              int64     `json:"id" db:"id"`
+	UserID          int64     `json:"-" db:"user_id"`
+	CollectionID    int64     `json:"collection_id" db:"collection_id"`
+	Status          string    `json:"status" db:"status"`
+	TargetProvider  string    `json:"target_provider" db:"target_provider"`
+	TargetModel     string    `json:"target_model" db:"target_model"`
+	TargetDimension int       `json:"target_dimension" db:"target_dimension"`
+	TargetStoreName string    `json:"-" db:"target_store_name"`
+	ProcessedPoints int       `json:"processed_points" db:"processed_points"`
+	LastError       string    `json:"last_error" db:"last_error"`
+	DateCreated     time.Time `json:"date_created" db:"date_created"`
+	DateModified    time.Time `json:"date_modified" db:"date_modified"`
+}
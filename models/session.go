@@ -0,0 +1,18 @@
+package models
+
+// Session is one login of a user, kept alive by refreshing its tokens.
+type Session struct {
+	ID          int64  `json:"id" db:"id"`
+	IPAddress   string `json:"ip_address" db:"ip_address"`
+	UserAgent   string `json:"user_agent" db:"user_agent"`
+	Browser     string `json:"browser" db:"browser"`
+	OS          string `json:"os" db:"os"`
+	Device      string `json:"device" db:"device"`
+	Country     string `json:"country" db:"country"`
+	CountryCode string `json:"country_code" db:"country_code"`
+	City        string `json:"city" db:"city"`
+	ExpiresAt   string `json:"expires_at" db:"expires_at"`
+	LastSeenAt  string `json:"last_seen_at" db:"last_seen_at"`
+	DateCreated string `json:"date_created" db:"date_created"`
+	Current     bool   `json:"current" db:"current"`
+}
@@ -3,11 +3,21 @@ package models
 import "time"
 
 type SessionMessage struct {
-	ID           int64     `json:"id" db:"id"`
-	UserID       int64     `json:"user_id" db:"user_id"`
-	SessionID    string    `json:"session_id" db:"session_id"`
-	Message      string    `json:"message" db:"message"`
-	MessageRole  string    `json:"message_role" db:"message_role"`
+	ID          int64   `json:"id" db:"id"`
+	UserID      int64   `json:"user_id" db:"user_id"`
+	SessionID   string  `json:"session_id" db:"session_id"`
+	Message     string  `json:"message" db:"message"`
+	MessageRole string  `json:"message_role" db:"message_role"`
+	Sources     Sources `json:"sources" db:"sources"`
+
+	// RewrittenQuery is the standalone question retrieval searched with
+	// when a follow-up message was rewritten, and empty otherwise.
+	RewrittenQuery string `json:"rewritten_query" db:"rewritten_query"`
+
+	// SummarizedThrough is set on summary messages to the ID of the last
+	// message the summary covers.
+	SummarizedThrough int64 `json:"summarized_through,omitempty" db:"summarized_through"`
+
 	DateCreated  time.Time `json:"date_created" db:"date_created"`
 	DateModified time.Time `json:"date_modified" db:"date_modified"`
 }
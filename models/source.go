@@ -0,0 +1,59 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+type Source struct {
+	CollectionHash string  `json:"collection_hash"`
+	CollectionName string  `json:"collection_name"`
+	DocumentID     int64   `json:"document_id"`
+	FileName       string  `json:"file_name"`
+	Page           int     `json:"page"`
+	Snippet        string  `json:"snippet"`
+	Score          float32 `json:"score"`
+
+	// RerankScore is set when the collection reranks its chunks.
+	RerankScore *float64 `json:"rerank_score,omitempty"`
+}
+
+// Sources is stored as a JSON array in a TEXT column.
+type Sources []Source
+
+func (s Sources) Value() (driver.Value, error) {
+	if s == nil {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (s *Sources) Scan(value interface{}) error {
+	var data []byte
+
+	switch v := value.(type) {
+	case nil:
+		*s = Sources{}
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return errors.New("unsupported type for Sources")
+	}
+
+	if len(data) == 0 {
+		*s = Sources{}
+		return nil
+	}
+
+	return json.Unmarshal(data, s)
+}
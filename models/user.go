@@ -5,10 +5,36 @@ type User struct {
 	Email             string        `json:"email" db:"email"`
 	Password          string        `json:"-" db:"password"`
 	Confirmed         bool          `json:"-" db:"confirmed"`
+	Locked            bool          `json:"-" db:"locked"`
 	LastLogin         string        `json:"last_login" db:"last_login"`
 	DateCreated       string        `json:"-" db:"date_created"`
 	DateModified      string        `json:"-" db:"date_modified"`
 	ConfirmationToken string        `json:"-" db:"confirmation_token"`
 	Tokens            *TokenDetails `json:"tokens"`
 	Roles             string        `json:"roles" db:"roles"`
+	OIDCIssuer        string        `json:"-" db:"oidc_issuer"`
+	OIDCSubject       string        `json:"-" db:"oidc_subject"`
+	TOTPSecret        string        `json:"-" db:"totp_secret"`
+	TOTPEnabled       bool          `json:"-" db:"totp_enabled"`
+	TOTPLastStep      int64         `json:"-" db:"totp_last_step"`
+}
+
+// UserAccount is the administrator's view of a user.
+type UserAccount struct {
+	ID          int64  `json:"id" db:"id"`
+	Email       string `json:"email" db:"email"`
+	Roles       string `json:"roles" db:"roles"`
+	Confirmed   bool   `json:"confirmed" db:"confirmed"`
+	Locked      bool   `json:"locked" db:"locked"`
+	TwoFactor   bool   `json:"two_factor_enabled" db:"totp_enabled"`
+	LastLogin   string `json:"last_login" db:"last_login"`
+	DateCreated string `json:"date_created" db:"date_created"`
+}
+
+// UserUsage counts what a user has stored and done.
+type UserUsage struct {
+	Collections  int `json:"collections" db:"collections"`
+	Documents    int `json:"documents" db:"documents"`
+	ChatSessions int `json:"chat_sessions" db:"chat_sessions"`
+	MessagesSent int `json:"messages_sent" db:"messages_sent"`
 }
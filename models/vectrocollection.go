@@ -3,10 +3,20 @@ package models
 import "time"
 
 type VectorCollection struct {
-	ID             int64     `json:"id" db:"id"`
-	UserID         int64     `json:"user_id" db:"user_id"`
-	Name           string    `json:"name" db:"name"`
-	CollectionHash string    `json:"collection_hash" db:"collection_hash"`
-	DateCreated    time.Time `json:"date_created" db:"date_created"`
-	DateModified   time.Time `json:"date_modified" db:"date_modified"`
+	ID                 int64              `json:"id" db:"id"`
+	UserID             int64              `json:"user_id" db:"user_id"`
+	OrganizationID     int64              `json:"organization_id" db:"organization_id"`
+	Name               string             `json:"name" db:"name"`
+	CollectionHash     string             `json:"collection_hash" db:"collection_hash"`
+	Settings           CollectionSettings `json:"settings" db:"settings"`
+	EmbeddingProvider  string             `json:"embedding_provider" db:"embedding_provider"`
+	EmbeddingModel     string             `json:"embedding_model" db:"embedding_model"`
+	EmbeddingDimension int                `json:"embedding_dimension" db:"embedding_dimension"`
+	StoreName          string             `json:"-" db:"store_name"`
+	DateCreated        time.Time          `json:"date_created" db:"date_created"`
+	DateModified       time.Time          `json:"date_modified" db:"date_modified"`
+
+	// Permission is the caller's access to the collection, filled in by
+	// queries over collection_access.
+	Permission string `json:"permission,omitempty" db:"permission"`
 }
@@ -0,0 +1,377 @@
+// Package oidc signs users in with an external OpenID Connect provider using
+// the authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
+
+	"github.com/zarkopopovski/rag-chat/jwtkeys"
+)
+
+// DefaultScopes are requested when the configuration names none.
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// keyRefreshInterval limits how often an unknown kid makes the provider fetch
+// its key set again, so forged tokens cannot be used to hammer the IdP.
+const keyRefreshInterval = time.Minute
+
+var (
+	ErrInvalidIDToken = errors.New("invalid ID token")
+	ErrNoIDToken      = errors.New("the token response holds no id_token")
+)
+
+// Config describes the relying party registration at the provider.
+type Config struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// HTTPClient is used for discovery, the key set and the code exchange.
+	// A client with a 10 second timeout is used when nil.
+	HTTPClient *http.Client
+}
+
+// Metadata is the part of the provider configuration document rag-chat uses.
+type Metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	SigningAlgorithms     []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// Provider talks to one OpenID provider. Its metadata is discovered on first
+// use so that rag-chat starts even while the provider is unreachable.
+type Provider struct {
+	config Config
+
+	mu          sync.Mutex
+	metadata    *Metadata
+	keys        map[string]jwtkeys.JWK
+	keysFetched time.Time
+}
+
+func NewProvider(config Config) (*Provider, error) {
+	if config.IssuerURL == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("the issuer URL, client ID and redirect URL are required")
+	}
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = DefaultScopes
+	}
+
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &Provider{config: config}, nil
+}
+
+// Discover fetches and caches the provider configuration document.
+func (p *Provider) Discover(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.discover(ctx)
+}
+
+func (p *Provider) discover(ctx context.Context) (*Metadata, error) {
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	metadata := new(Metadata)
+
+	err := p.getJSON(ctx, strings.TrimSuffix(p.config.IssuerURL, "/")+"/.well-known/openid-configuration", metadata)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+
+	// The issuer must match exactly, or the document could speak for
+	// another provider (OpenID Connect Discovery 1.0, section 4.3).
+	if metadata.Issuer != p.config.IssuerURL {
+		return nil, fmt.Errorf("OIDC discovery failed: issuer %q does not match %q", metadata.Issuer, p.config.IssuerURL)
+	}
+
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery failed: the provider metadata is incomplete")
+	}
+
+	p.metadata = metadata
+
+	return metadata, nil
+}
+
+// RedirectURL is where the provider sends the browser back to.
+func (p *Provider) RedirectURL() string {
+	return p.config.RedirectURL
+}
+
+// AuthCodeURL returns the URL of the provider's login page. The verifier is
+// sent as an S256 challenge and must be passed to Exchange later.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	oauthConfig, err := p.oauthConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return oauthConfig.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+// Exchange redeems an authorization code and returns the raw ID token. The
+// token is not verified yet, see VerifyIDToken.
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	oauthConfig, err := p.oauthConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := oauthConfig.Exchange(context.WithValue(ctx, oauth2.HTTPClient, p.config.HTTPClient), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return "", err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return "", ErrNoIDToken
+	}
+
+	return rawIDToken, nil
+}
+
+func (p *Provider) oauthConfig(ctx context.Context) (*oauth2.Config, error) {
+	metadata, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Scopes:       p.config.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  metadata.AuthorizationEndpoint,
+			TokenURL: metadata.TokenEndpoint,
+		},
+	}, nil
+}
+
+// NewVerifier returns a random PKCE code verifier.
+func NewVerifier() string {
+	return oauth2.GenerateVerifier()
+}
+
+// IDToken holds the verified claims rag-chat cares about. Claims keeps all of
+// them for provider specific lookups such as groups.
+type IDToken struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Claims        jwt.MapClaims
+}
+
+// Strings returns a claim that holds a list of strings, or a single string,
+// as a list.
+func (t *IDToken) Strings(claim string) []string {
+	switch value := t.Claims[claim].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+
+	return nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of an
+// ID token (OpenID Connect Core 1.0, section 3.1.3.7).
+func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*IDToken, error) {
+	metadata, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+
+	_, err = jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return p.verificationKey(ctx, token)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("%w: missing exp", ErrInvalidIDToken)
+	}
+
+	if !claims.VerifyIssuer(metadata.Issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidIDToken)
+	}
+
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidIDToken)
+	}
+
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientID {
+		return nil, fmt.Errorf("%w: unexpected authorized party", ErrInvalidIDToken)
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	idToken := &IDToken{Claims: claims}
+	idToken.Subject, _ = claims["sub"].(string)
+	idToken.Email, _ = claims["email"].(string)
+
+	// Some providers send email_verified as a string.
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		idToken.EmailVerified = verified
+	case string:
+		idToken.EmailVerified = verified == "true"
+	}
+
+	if idToken.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidIDToken)
+	}
+
+	return idToken, nil
+}
+
+// verificationKey finds the provider key named by the token's kid header and
+// makes sure it suits the signing method. Symmetric methods and "none" are
+// never accepted.
+func (p *Provider) verificationKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	jwk, err := p.key(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if jwk.Algorithm != "" && jwk.Algorithm != token.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	publicKey, err := jwk.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, ok := publicKey.(*rsa.PublicKey); ok {
+			return publicKey, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := publicKey.(*ecdsa.PublicKey); ok {
+			return publicKey, nil
+		}
+	case *jwt.SigningMethodEd25519:
+		if _, ok := publicKey.(ed25519.PublicKey); ok {
+			return publicKey, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+}
+
+func (p *Provider) key(ctx context.Context, kid string) (jwtkeys.JWK, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	jwk, ok := p.lookupKey(kid)
+	if ok {
+		return jwk, nil
+	}
+
+	// The provider may have rotated its keys since they were fetched.
+	if time.Since(p.keysFetched) < keyRefreshInterval {
+		return jwtkeys.JWK{}, jwtkeys.ErrUnknownKey
+	}
+
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return jwtkeys.JWK{}, err
+	}
+
+	var jwks jwtkeys.JWKS
+
+	err = p.getJSON(ctx, metadata.JWKSURI, &jwks)
+	if err != nil {
+		return jwtkeys.JWK{}, fmt.Errorf("fetching the provider keys failed: %w", err)
+	}
+
+	p.keys = make(map[string]jwtkeys.JWK, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if key.Use == "" || key.Use == "sig" {
+			p.keys[key.KeyID] = key
+		}
+	}
+	p.keysFetched = time.Now()
+
+	jwk, ok = p.lookupKey(kid)
+	if !ok {
+		return jwtkeys.JWK{}, jwtkeys.ErrUnknownKey
+	}
+
+	return jwk, nil
+}
+
+// lookupKey accepts a token without kid only while the provider publishes a
+// single key.
+func (p *Provider) lookupKey(kid string) (jwtkeys.JWK, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, jwk := range p.keys {
+			return jwk, true
+		}
+	}
+
+	jwk, ok := p.keys[kid]
+
+	return jwk, ok
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
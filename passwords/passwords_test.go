@@ -0,0 +1,121 @@
+package passwords
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapParams keep the tests fast; only TestHash pays for DefaultParams.
+var cheapParams = Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHash(t *testing.T) {
+	encoded, err := Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Fatalf("unexpected hash %s", encoded)
+	}
+
+	match, needsRehash, err := Verify("correct horse battery staple", encoded)
+	if !match || needsRehash || err != nil {
+		t.Fatalf("Verify = %v, %v, %v, want a match that needs no rehash", match, needsRehash, err)
+	}
+
+	if other, _ := Hash("correct horse battery staple"); other == encoded {
+		t.Fatal("two hashes of the same password share their salt")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	argon2id, err := HashWithParams("correct horse battery staple", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse battery staple"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha1.Sum([]byte("correct horse battery staple"))
+	legacy := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name        string
+		password    string
+		encoded     string
+		match       bool
+		needsRehash bool
+	}{
+		{"argon2id with other parameters", "correct horse battery staple", argon2id, true, true},
+		{"argon2id, wrong password", "incorrect horse battery staple", argon2id, false, false},
+		{"bcrypt", "correct horse battery staple", string(bcryptHash), true, true},
+		{"bcrypt, wrong password", "incorrect horse battery staple", string(bcryptHash), false, false},
+		{"legacy SHA-1", "correct horse battery staple", legacy, true, true},
+		{"legacy SHA-1 in upper case", "correct horse battery staple", strings.ToUpper(legacy), true, true},
+		{"legacy SHA-1, wrong password", "incorrect horse battery staple", legacy, false, false},
+	}
+
+	for _, test := range tests {
+		match, needsRehash, err := Verify(test.password, test.encoded)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if match != test.match || needsRehash != test.needsRehash {
+			t.Errorf("%s: Verify = %v, %v, want %v, %v", test.name, match, needsRehash, test.match, test.needsRehash)
+		}
+	}
+}
+
+func TestVerifyRejectsUnknownHashes(t *testing.T) {
+	for _, encoded := range []string{"", "plain text password", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA"} {
+		if _, _, err := Verify("password", encoded); !errors.Is(err, ErrUnknownHash) {
+			t.Errorf("Verify(%q) = %v, want ErrUnknownHash", encoded, err)
+		}
+	}
+
+	if _, _, err := Verify("password", "$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5"); err == nil {
+		t.Error("Verify accepted an unsupported argon2 version")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"short", false},
+		{"seven77", false},
+		{"a long enough passphrase", true},
+		{strings.Repeat("ä", 8), true},
+		{strings.Repeat("a", 129), false},
+		{"Password123", false},
+		{"QWERTY123", false},
+	}
+
+	for _, test := range tests {
+		err := policy.Check(test.password)
+		if (err == nil) != test.ok {
+			t.Errorf("Check(%q) = %v, want ok %v", test.password, err, test.ok)
+		}
+	}
+
+	if err := policy.Check("password123"); !errors.Is(err, ErrBreached) {
+		t.Errorf("Check of a breached password = %v, want ErrBreached", err)
+	}
+
+	if err := (Policy{MinLength: 8}).Check("password123"); err != nil {
+		t.Errorf("a policy without the breach check refused a breached password: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package passwords
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var ErrBreached = errors.New("the password appears in a list of breached passwords")
+
+//go:embed breached.txt
+var breachedList string
+
+var (
+	breachedOnce sync.Once
+	breached     map[string]struct{}
+)
+
+// Policy describes which new passwords are acceptable.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// CheckBreached rejects passwords from the bundled breach list.
+	CheckBreached bool
+}
+
+// DefaultPolicy follows NIST SP 800-63B: at least 8 characters, long
+// passphrases allowed, and no passwords known from breaches.
+func DefaultPolicy() Policy {
+	return Policy{
+		MinLength:     8,
+		MaxLength:     128,
+		CheckBreached: true,
+	}
+}
+
+// Check returns a user-facing error describing why password is rejected, or
+// nil if it is acceptable.
+func (p Policy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+
+	if p.MinLength > 0 && length < p.MinLength {
+		return fmt.Errorf("the password must be at least %d characters long", p.MinLength)
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("the password must be at most %d characters long", p.MaxLength)
+	}
+
+	if p.CheckBreached && IsBreached(password) {
+		return ErrBreached
+	}
+
+	return nil
+}
+
+// IsBreached reports whether password is on the bundled breach list.
+func IsBreached(password string) bool {
+	breachedOnce.Do(func() {
+		breached = make(map[string]struct{})
+
+		scanner := bufio.NewScanner(strings.NewReader(breachedList))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			breached[strings.ToLower(line)] = struct{}{}
+		}
+	})
+
+	_, ok := breached[strings.ToLower(password)]
+
+	return ok
+}
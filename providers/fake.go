@@ -0,0 +1,158 @@
+package providers
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const defaultFakeDimension = 256
+
+// FakeProvider works without any network access. Its embeddings are bags of
+// hashed words, so texts sharing words end up close to each other, and its
+// chat model replays scripted responses. It exists for tests and offline
+// development.
+type FakeProvider struct {
+	Dimension int
+	Responses []string
+}
+
+func (p FakeProvider) ChatModel(model string) (llms.Model, error) {
+	return &FakeChatModel{Responses: p.Responses}, nil
+}
+
+func (p FakeProvider) Embedder(model string) (embeddings.Embedder, error) {
+	dimension := p.Dimension
+	if dimension <= 0 {
+		dimension = defaultFakeDimension
+	}
+
+	return FakeEmbedder{Dimension: dimension}, nil
+}
+
+// FakeEmbedder maps every word of a text onto one of Dimension buckets and
+// returns the normalised bucket counts.
+type FakeEmbedder struct {
+	Dimension int
+}
+
+func (e FakeEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = e.embed(text)
+	}
+
+	return vectors, nil
+}
+
+func (e FakeEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	return e.embed(text), nil
+}
+
+func (e FakeEmbedder) embed(text string) []float32 {
+	vector := make([]float32, e.Dimension)
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	for _, word := range words {
+		h := fnv.New32a()
+		h.Write([]byte(word))
+		vector[h.Sum32()%uint32(e.Dimension)]++
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+
+	if norm == 0 {
+		// Keep empty texts comparable instead of returning a zero vector.
+		vector[0] = 1
+		return vector
+	}
+
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+
+	return vector
+}
+
+// FakeChatModel answers with Responses in turn, starting over after the last
+// one, and records every conversation it was given. Without responses it
+// echoes the last message.
+type FakeChatModel struct {
+	Responses []string
+
+	mu    sync.Mutex
+	index int
+	calls [][]llms.MessageContent
+}
+
+func (m *FakeChatModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	opts := llms.CallOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	m.mu.Lock()
+	m.calls = append(m.calls, messages)
+
+	response := ""
+	if len(m.Responses) > 0 {
+		response = m.Responses[m.index%len(m.Responses)]
+		m.index++
+	} else if len(messages) > 0 {
+		response = messageText(messages[len(messages)-1])
+	}
+	m.mu.Unlock()
+
+	if opts.StreamingFunc != nil {
+		for _, word := range strings.SplitAfter(response, " ") {
+			if word == "" {
+				continue
+			}
+
+			if err := opts.StreamingFunc(ctx, []byte(word)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &llms.ContentResponse{
+		Choices: []*llms.ContentChoice{{Content: response, StopReason: "stop"}},
+	}, nil
+}
+
+func (m *FakeChatModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+// Calls returns the conversations the model has been asked to continue.
+func (m *FakeChatModel) Calls() [][]llms.MessageContent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([][]llms.MessageContent(nil), m.calls...)
+}
+
+func messageText(message llms.MessageContent) string {
+	var sb strings.Builder
+
+	for _, part := range message.Parts {
+		if text, ok := part.(llms.TextContent); ok {
+			sb.WriteString(text.Text)
+		}
+	}
+
+	return sb.String()
+}
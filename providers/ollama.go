@@ -0,0 +1,34 @@
+package providers
+
+import (
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/ollama"
+)
+
+type OllamaProvider struct {
+	ServerURL string
+}
+
+func (p OllamaProvider) ChatModel(model string) (llms.Model, error) {
+	return p.client(model)
+}
+
+func (p OllamaProvider) Embedder(model string) (embeddings.Embedder, error) {
+	client, err := p.client(model)
+	if err != nil {
+		return nil, err
+	}
+
+	return embeddings.NewEmbedder(client)
+}
+
+func (p OllamaProvider) client(model string) (*ollama.LLM, error) {
+	options := []ollama.Option{ollama.WithModel(model)}
+
+	if p.ServerURL != "" {
+		options = append(options, ollama.WithServerURL(p.ServerURL))
+	}
+
+	return ollama.New(options...)
+}
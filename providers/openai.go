@@ -0,0 +1,43 @@
+package providers
+
+import (
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// OpenAIProvider talks to the OpenAI API or, with a base URL, to any server
+// implementing it such as vLLM or the llama.cpp server.
+type OpenAIProvider struct {
+	Token   string
+	BaseURL string
+}
+
+func (p OpenAIProvider) ChatModel(model string) (llms.Model, error) {
+	return p.client(openai.WithModel(model))
+}
+
+func (p OpenAIProvider) Embedder(model string) (embeddings.Embedder, error) {
+	client, err := p.client(openai.WithEmbeddingModel(model))
+	if err != nil {
+		return nil, err
+	}
+
+	return embeddings.NewEmbedder(client)
+}
+
+func (p OpenAIProvider) client(options ...openai.Option) (*openai.LLM, error) {
+	token := p.Token
+	if token == "" && p.BaseURL != "" {
+		// Local servers usually ignore the key, but the client insists on one.
+		token = "none"
+	}
+
+	options = append(options, openai.WithToken(token))
+
+	if p.BaseURL != "" {
+		options = append(options, openai.WithBaseURL(p.BaseURL))
+	}
+
+	return openai.New(options...)
+}
@@ -0,0 +1,201 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	OpenAI           = "openai"
+	OpenAICompatible = "openai_compatible"
+	Ollama           = "ollama"
+	Fake             = "fake"
+)
+
+var ErrUnknownProvider = errors.New("unknown LLM provider")
+
+// Provider builds chat and embedding clients for one backend.
+type Provider interface {
+	ChatModel(model string) (llms.Model, error)
+	Embedder(model string) (embeddings.Embedder, error)
+}
+
+// Registry hands out shared clients for the providers configured for this
+// deployment. Empty provider or model names select the deployment defaults.
+type Registry struct {
+	DefaultProvider       string
+	DefaultChatModel      string
+	DefaultEmbeddingModel string
+
+	mu         sync.Mutex
+	providers  map[string]Provider
+	chatModels map[string]llms.Model
+	embedders  map[string]embeddings.Embedder
+	dimensions map[string]int
+}
+
+func NewRegistry(defaultProvider string, defaultChatModel string, defaultEmbeddingModel string) *Registry {
+	if defaultProvider == "" {
+		defaultProvider = OpenAI
+	}
+
+	return &Registry{
+		DefaultProvider:       defaultProvider,
+		DefaultChatModel:      defaultChatModel,
+		DefaultEmbeddingModel: defaultEmbeddingModel,
+		providers:             make(map[string]Provider),
+		chatModels:            make(map[string]llms.Model),
+		embedders:             make(map[string]embeddings.Embedder),
+		dimensions:            make(map[string]int),
+	}
+}
+
+func (r *Registry) Register(name string, provider Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.providers[name] = provider
+}
+
+func (r *Registry) Has(name string) bool {
+	if name == "" {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.providers[name]
+
+	return ok
+}
+
+// Names lists the configured providers.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (r *Registry) ChatModel(provider string, model string) (llms.Model, error) {
+	provider, model, err := r.resolve(provider, model, r.DefaultChatModel)
+	if err != nil {
+		return nil, err
+	}
+
+	key := provider + "|" + model
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if chatModel, ok := r.chatModels[key]; ok {
+		return chatModel, nil
+	}
+
+	chatModel, err := r.providers[provider].ChatModel(model)
+	if err != nil {
+		return nil, err
+	}
+	r.chatModels[key] = chatModel
+
+	return chatModel, nil
+}
+
+func (r *Registry) Embedder(provider string, model string) (embeddings.Embedder, error) {
+	provider, model, err := r.resolve(provider, model, r.DefaultEmbeddingModel)
+	if err != nil {
+		return nil, err
+	}
+
+	key := provider + "|" + model
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if embedder, ok := r.embedders[key]; ok {
+		return embedder, nil
+	}
+
+	embedder, err := r.providers[provider].Embedder(model)
+	if err != nil {
+		return nil, err
+	}
+	r.embedders[key] = embedder
+
+	return embedder, nil
+}
+
+// Dimension embeds a short probe text to learn the vector size of an
+// embedding model. The result is cached for the lifetime of the process.
+func (r *Registry) Dimension(ctx context.Context, provider string, model string) (int, error) {
+	embedder, err := r.Embedder(provider, model)
+	if err != nil {
+		return 0, err
+	}
+
+	provider, model, _ = r.resolve(provider, model, r.DefaultEmbeddingModel)
+	key := provider + "|" + model
+
+	r.mu.Lock()
+	dimension, ok := r.dimensions[key]
+	r.mu.Unlock()
+
+	if ok {
+		return dimension, nil
+	}
+
+	vector, err := embedder.EmbedQuery(ctx, "dimension probe")
+	if err != nil {
+		return 0, err
+	}
+
+	if len(vector) == 0 {
+		return 0, errors.New("embedder returned an empty vector")
+	}
+
+	r.mu.Lock()
+	r.dimensions[key] = len(vector)
+	r.mu.Unlock()
+
+	return len(vector), nil
+}
+
+// ResolveEmbedding returns the concrete provider and model an embedding
+// request for provider and model would use.
+func (r *Registry) ResolveEmbedding(provider string, model string) (string, string, error) {
+	return r.resolve(provider, model, r.DefaultEmbeddingModel)
+}
+
+// resolve fills in the defaults. The default models only belong to the default
+// provider, so overriding the provider requires naming a model too.
+func (r *Registry) resolve(provider string, model string, defaultModel string) (string, string, error) {
+	if provider == "" {
+		provider = r.DefaultProvider
+	}
+
+	if !r.Has(provider) {
+		return "", "", fmt.Errorf("%w: %s", ErrUnknownProvider, provider)
+	}
+
+	if model == "" {
+		if provider != r.DefaultProvider {
+			return "", "", fmt.Errorf("a model is required for provider %s", provider)
+		}
+		model = defaultModel
+	}
+
+	return provider, model, nil
+}
@@ -0,0 +1,75 @@
+package retrieval
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tmc/langchaingo/schema"
+)
+
+// Ranking is a list of results, best first, and the weight of its ranks in a
+// fusion.
+type Ranking struct {
+	Documents []schema.Document
+	Weight    float64
+}
+
+// Fuse merges rankings with weighted reciprocal rank fusion: a chunk scores
+// weight/(k+rank) in every ranking it appears in, and the sums decide the
+// order. Only ranks count, so scores of different kinds, such as cosine
+// similarity and BM25, need no normalization. The Score of the returned
+// documents is their fused score.
+func Fuse(k int, limit int, rankings ...Ranking) []schema.Document {
+	type fused struct {
+		doc   schema.Document
+		score float64
+		first int
+	}
+
+	byKey := make(map[string]*fused)
+	order := make([]*fused, 0)
+
+	for _, ranking := range rankings {
+		if ranking.Weight <= 0 {
+			continue
+		}
+
+		for rank, doc := range ranking.Documents {
+			key := ChunkKey(doc)
+
+			entry, ok := byKey[key]
+			if !ok {
+				entry = &fused{doc: doc, first: len(order)}
+				byKey[key] = entry
+				order = append(order, entry)
+			}
+
+			entry.score += ranking.Weight / float64(k+rank+1)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		if order[i].score != order[j].score {
+			return order[i].score > order[j].score
+		}
+		return order[i].first < order[j].first
+	})
+
+	if limit >= 0 && len(order) > limit {
+		order = order[:limit]
+	}
+
+	docs := make([]schema.Document, len(order))
+	for i, entry := range order {
+		docs[i] = entry.doc
+		docs[i].Score = float32(entry.score)
+	}
+
+	return docs
+}
+
+// ChunkKey identifies a chunk across the vector store and the keyword index,
+// which both keep its text and the id of its document.
+func ChunkKey(doc schema.Document) string {
+	return fmt.Sprint(doc.Metadata["document_id"]) + "\x00" + doc.PageContent
+}
@@ -0,0 +1,354 @@
+// Package retrieval finds the chunks that answer a question. Besides the
+// vector store it keeps a keyword index of every chunk, which finds the exact
+// product codes, error numbers and names embeddings tend to blur, and fuses
+// the rankings of both.
+package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tmc/langchaingo/schema"
+
+	"github.com/zarkopopovski/rag-chat/db"
+)
+
+// maxQueryTerms limits the terms of a keyword query, so a pasted document
+// does not turn into a huge MATCH expression.
+const maxQueryTerms = 32
+
+// KeywordIndex mirrors the text of every chunk into the chunk_texts table and
+// searches it by keyword. Chunks are ranked with BM25 through an FTS5 index
+// when SQLite was built with FTS5 (the sqlite_fts5 build tag), and by the
+// number of query terms they contain as whole terms otherwise.
+type KeywordIndex struct {
+	DBManager *db.DBManager
+
+	setupOnce sync.Once
+	fts       bool
+}
+
+func NewKeywordIndex(dbManager *db.DBManager) *KeywordIndex {
+	return &KeywordIndex{
+		DBManager: dbManager,
+	}
+}
+
+// FTS reports whether searches are ranked with FTS5 and BM25.
+func (index *KeywordIndex) FTS() bool {
+	index.setupOnce.Do(index.setup)
+
+	return index.fts
+}
+
+// setup creates the FTS5 index next to chunk_texts. The index is not part of
+// the migrations because builds without FTS5 could not run them, and it is
+// rebuilt when such a build changed chunk_texts in the meantime.
+func (index *KeywordIndex) setup() {
+	_, err := index.DBManager.DB.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS chunk_fts USING fts5(content, tokenize='unicode61')")
+	if err != nil {
+		log.Printf("Keyword search ranks by matched terms, FTS5 is not available: %v", err)
+		return
+	}
+
+	var stale bool
+
+	queryStr := `SELECT (SELECT COUNT(*) FROM chunk_texts)<>(SELECT COUNT(*) FROM chunk_fts)
+		OR COALESCE((SELECT MAX(id) FROM chunk_texts), 0)<>COALESCE((SELECT MAX(rowid) FROM chunk_fts), 0)`
+
+	if err := index.DBManager.DB.Get(&stale, queryStr); err != nil {
+		log.Printf("Keyword search ranks by matched terms, checking the FTS5 index failed: %v", err)
+		return
+	}
+
+	if stale {
+		err := index.inTx(context.Background(), func(tx *sqlx.Tx) error {
+			if _, err := tx.Exec("DELETE FROM chunk_fts"); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec("INSERT INTO chunk_fts(rowid, content) SELECT id, content FROM chunk_texts")
+
+			return err
+		})
+		if err != nil {
+			log.Printf("Keyword search ranks by matched terms, rebuilding the FTS5 index failed: %v", err)
+			return
+		}
+	}
+
+	index.fts = true
+}
+
+// Replace stores the chunks of a document, replacing the ones stored before.
+func (index *KeywordIndex) Replace(ctx context.Context, collectionID int64, documentID int64, docs []schema.Document) error {
+	fts := index.FTS()
+
+	return index.inTx(ctx, func(tx *sqlx.Tx) error {
+		if err := deleteChunks(ctx, tx, fts, "collection_id=$1 AND document_id=$2", collectionID, documentID); err != nil {
+			return err
+		}
+
+		queryStr := "INSERT INTO chunk_texts(collection_id, document_id, content, metadata, date_created) VALUES($1, $2, $3, $4, datetime('now'))"
+
+		for _, doc := range docs {
+			metadata, err := json.Marshal(doc.Metadata)
+			if err != nil {
+				return err
+			}
+
+			result, err := tx.ExecContext(ctx, queryStr, collectionID, documentID, doc.PageContent, string(metadata))
+			if err != nil {
+				return err
+			}
+
+			if !fts {
+				continue
+			}
+
+			chunkID, err := result.LastInsertId()
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, "INSERT INTO chunk_fts(rowid, content) VALUES($1, $2)", chunkID, doc.PageContent)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (index *KeywordIndex) DeleteDocument(ctx context.Context, collectionID int64, documentID int64) error {
+	fts := index.FTS()
+
+	return index.inTx(ctx, func(tx *sqlx.Tx) error {
+		return deleteChunks(ctx, tx, fts, "collection_id=$1 AND document_id=$2", collectionID, documentID)
+	})
+}
+
+func (index *KeywordIndex) DeleteCollection(ctx context.Context, collectionID int64) error {
+	fts := index.FTS()
+
+	return index.inTx(ctx, func(tx *sqlx.Tx) error {
+		return deleteChunks(ctx, tx, fts, "collection_id=$1", collectionID)
+	})
+}
+
+func deleteChunks(ctx context.Context, tx *sqlx.Tx, fts bool, condition string, args ...interface{}) error {
+	if fts {
+		_, err := tx.ExecContext(ctx, "DELETE FROM chunk_fts WHERE rowid IN (SELECT id FROM chunk_texts WHERE "+condition+")", args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, "DELETE FROM chunk_texts WHERE "+condition, args...)
+
+	return err
+}
+
+// Search returns up to limit chunks of a collection that contain terms of
+// query, best first. Their Score is the BM25 score, or the number of matched
+// terms without FTS5; higher is better either way.
+func (index *KeywordIndex) Search(ctx context.Context, collectionID int64, query string, limit int) ([]schema.Document, error) {
+	terms := Terms(query)
+	if len(terms) == 0 || limit <= 0 {
+		return []schema.Document{}, nil
+	}
+
+	if !index.FTS() {
+		return index.searchTerms(ctx, collectionID, terms, limit)
+	}
+
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+
+	// bm25() is lower for better matches.
+	queryStr := `SELECT chunk_texts.content, chunk_texts.metadata, -bm25(chunk_fts) AS score
+		FROM chunk_fts JOIN chunk_texts ON chunk_texts.id=chunk_fts.rowid
+		WHERE chunk_fts MATCH ? AND chunk_texts.collection_id=?
+		ORDER BY score DESC, chunk_texts.id LIMIT ?`
+
+	rows, err := index.DBManager.DB.QueryxContext(ctx, queryStr, strings.Join(quoted, " OR "), collectionID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("keyword search: %w", err)
+	}
+	defer rows.Close()
+
+	docs := make([]schema.Document, 0)
+
+	for rows.Next() {
+		var content, metadata string
+		var score float64
+
+		if err := rows.Scan(&content, &metadata, &score); err != nil {
+			return nil, err
+		}
+
+		doc, err := chunkDocument(content, metadata, score)
+		if err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, doc)
+	}
+
+	return docs, rows.Err()
+}
+
+// searchTerms ranks chunks by the number of terms they contain without FTS5.
+// The database finds chunks containing a term anywhere, "pumps" for "pump"
+// too, so the terms are matched again as whole terms, as FTS5 and Coverage
+// match them.
+func (index *KeywordIndex) searchTerms(ctx context.Context, collectionID int64, terms []string, limit int) ([]schema.Document, error) {
+	matches := make([]string, len(terms))
+	args := []interface{}{collectionID}
+
+	for i, term := range terms {
+		matches[i] = "instr(content, ?)>0"
+		args = append(args, term)
+	}
+
+	queryStr := "SELECT content, metadata FROM chunk_texts WHERE collection_id=? AND (" + strings.Join(matches, " OR ") + ") ORDER BY id"
+
+	rows, err := index.DBManager.DB.QueryxContext(ctx, queryStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("keyword search: %w", err)
+	}
+	defer rows.Close()
+
+	docs := make([]schema.Document, 0)
+
+	for rows.Next() {
+		var content, metadata string
+
+		if err := rows.Scan(&content, &metadata); err != nil {
+			return nil, err
+		}
+
+		matched := countTerms(terms, content)
+		if matched == 0 {
+			continue
+		}
+
+		doc, err := chunkDocument(content, metadata, float64(matched))
+		if err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, doc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Stable, so chunks matching as many terms keep their order.
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].Score > docs[j].Score
+	})
+
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+
+	return docs, nil
+}
+
+func chunkDocument(content string, metadata string, score float64) (schema.Document, error) {
+	doc := schema.Document{
+		PageContent: content,
+		Score:       float32(score),
+	}
+
+	err := json.Unmarshal([]byte(metadata), &doc.Metadata)
+
+	return doc, err
+}
+
+// Terms splits text into the lower case terms keyword search looks for.
+// Hyphens, dots and underscores inside a term are kept, so that codes such as
+// "err-4021" or "v2.1" stay whole.
+func Terms(text string) []string {
+	return splitTerms(text, maxQueryTerms)
+}
+
+// Coverage returns the share of the terms of query that text contains.
+func Coverage(query string, text string) float64 {
+	terms := Terms(query)
+	if len(terms) == 0 {
+		return 0
+	}
+
+	return float64(countTerms(terms, text)) / float64(len(terms))
+}
+
+// countTerms returns how many of terms text contains as whole terms.
+func countTerms(terms []string, text string) int {
+	contained := make(map[string]bool)
+	for _, term := range splitTerms(text, 0) {
+		contained[term] = true
+	}
+
+	matched := 0
+	for _, term := range terms {
+		if contained[term] {
+			matched++
+		}
+	}
+
+	return matched
+}
+
+// splitTerms returns the distinct terms of text, at most limit of them unless
+// limit is 0.
+func splitTerms(text string, limit int) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '.' && r != '_'
+	})
+
+	terms := make([]string, 0, len(fields))
+	seen := make(map[string]bool, len(fields))
+
+	for _, field := range fields {
+		term := strings.Trim(field, "-._")
+		if term == "" || seen[term] {
+			continue
+		}
+
+		seen[term] = true
+		terms = append(terms, term)
+
+		if len(terms) == limit {
+			break
+		}
+	}
+
+	return terms
+}
+
+func (index *KeywordIndex) inTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := index.DBManager.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,292 @@
+package retrieval
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/schema"
+
+	"github.com/zarkopopovski/rag-chat/models"
+	"github.com/zarkopopovski/rag-chat/providers"
+)
+
+// ErrRerankerNotConfigured is returned for a cross-encoder reranker while no
+// rerank server is configured.
+var ErrRerankerNotConfigured = errors.New("the cross-encoder reranker is not configured")
+
+// Reranker scores candidate chunks against a question in a second stage,
+// more thoroughly than the first stage could afford for every chunk.
+type Reranker interface {
+	// Rerank returns a score for each document, in their order. Higher
+	// scores are more relevant.
+	Rerank(ctx context.Context, query string, docs []schema.Document) ([]float64, error)
+}
+
+// Rerankers builds the reranker a collection's settings ask for.
+type Rerankers struct {
+	Providers *providers.Registry
+
+	// CrossEncoder is nil unless a rerank server is configured.
+	CrossEncoder *CrossEncoderReranker
+}
+
+// Reranker returns the reranker of settings, or nil when it has none.
+func (r *Rerankers) Reranker(settings models.CollectionSettings) (Reranker, error) {
+	switch settings.Reranker {
+	case models.RerankerNone:
+		return nil, nil
+	case models.RerankerLLM:
+		model := settings.ChatModel
+		if settings.RerankModel != "" {
+			model = settings.RerankModel
+		}
+
+		llm, err := r.Providers.ChatModel(settings.ChatProvider, model)
+		if err != nil {
+			return nil, err
+		}
+
+		return &LLMReranker{Model: llm}, nil
+	case models.RerankerCrossEncoder:
+		if r.CrossEncoder == nil {
+			return nil, ErrRerankerNotConfigured
+		}
+
+		if settings.RerankModel == "" {
+			return r.CrossEncoder, nil
+		}
+
+		crossEncoder := *r.CrossEncoder
+		crossEncoder.Model = settings.RerankModel
+
+		return &crossEncoder, nil
+	default:
+		return nil, fmt.Errorf("unknown reranker %q", settings.Reranker)
+	}
+}
+
+// Rerank orders docs by the scores of reranker and keeps the best limit of
+// them. The scores are returned along with the documents.
+func Rerank(ctx context.Context, reranker Reranker, query string, docs []schema.Document, limit int) ([]schema.Document, []float64, error) {
+	scores, err := reranker.Rerank(ctx, query, docs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(scores) != len(docs) {
+		return nil, nil, fmt.Errorf("the reranker returned %d scores for %d documents", len(scores), len(docs))
+	}
+
+	order := make([]int, len(docs))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+
+	if limit >= 0 && len(order) > limit {
+		order = order[:limit]
+	}
+
+	reranked := make([]schema.Document, len(order))
+	rerankScores := make([]float64, len(order))
+
+	for i, index := range order {
+		reranked[i] = docs[index]
+		rerankScores[i] = scores[index]
+	}
+
+	return reranked, rerankScores, nil
+}
+
+// maxJudgedPassageLength limits how much of each chunk the LLM judge reads.
+const maxJudgedPassageLength = 1500
+
+// LLMReranker asks a chat model to judge how well every chunk answers the
+// question, all chunks in one call. Scores are between 0 and 1.
+type LLMReranker struct {
+	Model llms.Model
+}
+
+func (reranker *LLMReranker) Rerank(ctx context.Context, query string, docs []schema.Document) ([]float64, error) {
+	if len(docs) == 0 {
+		return []float64{}, nil
+	}
+
+	var prompt strings.Builder
+
+	prompt.WriteString("Rate how well each passage helps to answer the question, from 0 (not at all) to 10 (answers it completely).\n")
+	prompt.WriteString("Reply with a JSON array holding one number per passage, in the order of the passages, and nothing else.\n\n")
+	prompt.WriteString("Question: " + query + "\n")
+
+	for i, doc := range docs {
+		passage := []rune(doc.PageContent)
+		if len(passage) > maxJudgedPassageLength {
+			passage = passage[:maxJudgedPassageLength]
+		}
+
+		prompt.WriteString("\nPassage " + strconv.Itoa(i+1) + ":\n" + string(passage) + "\n")
+	}
+
+	answer, err := llms.GenerateFromSinglePrompt(ctx, reranker.Model, prompt.String(), llms.WithTemperature(0))
+	if err != nil {
+		return nil, err
+	}
+
+	// Models like to wrap the array in prose or a code block.
+	start, end := strings.Index(answer, "["), strings.LastIndex(answer, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("the LLM judge did not answer with a JSON array: %q", answer)
+	}
+
+	var ratings []float64
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &ratings); err != nil {
+		return nil, fmt.Errorf("the LLM judge did not answer with a JSON array: %w", err)
+	}
+
+	if len(ratings) != len(docs) {
+		return nil, fmt.Errorf("the LLM judge rated %d of %d passages", len(ratings), len(docs))
+	}
+
+	scores := make([]float64, len(ratings))
+	for i, rating := range ratings {
+		scores[i] = min(max(rating, 0), 10) / 10
+	}
+
+	return scores, nil
+}
+
+// CrossEncoderReranker scores chunks with a cross-encoder served over HTTP.
+// It speaks the rerank API of Cohere and Jina, which Infinity, vLLM and the
+// llama.cpp server implement too, as well as the one of Hugging Face's Text
+// Embeddings Inference.
+type CrossEncoderReranker struct {
+	URL    string
+	APIKey string
+	Model  string
+
+	// HTTPClient is used for the requests. A client with a 30 second
+	// timeout is used when nil.
+	HTTPClient *http.Client
+}
+
+func NewCrossEncoderReranker(url string, apiKey string, model string) *CrossEncoderReranker {
+	return &CrossEncoderReranker{
+		URL:    url,
+		APIKey: apiKey,
+		Model:  model,
+	}
+}
+
+type rerankResult struct {
+	Index          int      `json:"index"`
+	RelevanceScore *float64 `json:"relevance_score"`
+	Score          *float64 `json:"score"`
+}
+
+func (reranker *CrossEncoderReranker) Rerank(ctx context.Context, query string, docs []schema.Document) ([]float64, error) {
+	if len(docs) == 0 {
+		return []float64{}, nil
+	}
+
+	texts := make([]string, len(docs))
+	for i, doc := range docs {
+		texts[i] = doc.PageContent
+	}
+
+	// "documents" is read by the Cohere style servers, "texts" by TEI.
+	payload := map[string]interface{}{
+		"query":     query,
+		"documents": texts,
+		"texts":     texts,
+		"top_n":     len(texts),
+	}
+	if reranker.Model != "" {
+		payload["model"] = reranker.Model
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reranker.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if reranker.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+reranker.APIKey)
+	}
+
+	client := reranker.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rerank request failed with %s: %s", resp.Status, b)
+	}
+
+	// TEI answers with a bare list, the others wrap it in "results".
+	var results []rerankResult
+	if err := json.Unmarshal(b, &results); err != nil {
+		var wrapped struct {
+			Results []rerankResult `json:"results"`
+		}
+		if err := json.Unmarshal(b, &wrapped); err != nil {
+			return nil, fmt.Errorf("unexpected rerank response: %w", err)
+		}
+		results = wrapped.Results
+	}
+
+	scores := make([]float64, len(docs))
+	scored := make([]bool, len(docs))
+
+	for _, result := range results {
+		if result.Index < 0 || result.Index >= len(docs) {
+			return nil, fmt.Errorf("the rerank response holds an unknown index %d", result.Index)
+		}
+
+		switch {
+		case result.RelevanceScore != nil:
+			scores[result.Index] = *result.RelevanceScore
+		case result.Score != nil:
+			scores[result.Index] = *result.Score
+		default:
+			return nil, fmt.Errorf("the rerank response holds no score for index %d", result.Index)
+		}
+		scored[result.Index] = true
+	}
+
+	for i := range scored {
+		if !scored[i] {
+			return nil, fmt.Errorf("the rerank response holds no score for index %d", i)
+		}
+	}
+
+	return scores, nil
+}
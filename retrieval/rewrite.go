@@ -0,0 +1,77 @@
+package retrieval
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+
+	"github.com/zarkopopovski/rag-chat/models"
+)
+
+const (
+	// maxCondensedTurns is how many of the latest messages the rewrite sees.
+	maxCondensedTurns = 6
+
+	// maxCondensedMessageLength limits how much of each message it reads.
+	maxCondensedMessageLength = 1000
+)
+
+// CondenseQuestion rewrites a follow-up question into one that can be
+// searched for without the conversation, so that "what about the second
+// one?" names what the second one is. history holds the earlier messages of
+// the session, oldest first; only the human and ai messages are read.
+func CondenseQuestion(ctx context.Context, llm llms.Model, history []models.SessionMessage, question string) (string, error) {
+	turns := make([]models.SessionMessage, 0, len(history))
+	for _, message := range history {
+		if message.MessageRole == "human" || message.MessageRole == "ai" {
+			turns = append(turns, message)
+		}
+	}
+
+	if len(turns) == 0 {
+		return question, nil
+	}
+
+	if len(turns) > maxCondensedTurns {
+		turns = turns[len(turns)-maxCondensedTurns:]
+	}
+
+	var prompt strings.Builder
+
+	prompt.WriteString("Given the conversation and the follow-up question below, rewrite the follow-up question into a standalone question that can be understood without the conversation.\n")
+	prompt.WriteString("Keep names, numbers and codes exactly as they were written. If the question already stands on its own, repeat it unchanged.\n")
+	prompt.WriteString("Reply with the standalone question only.\n\nConversation:\n")
+
+	for _, turn := range turns {
+		speaker := "User"
+		if turn.MessageRole == "ai" {
+			speaker = "Assistant"
+		}
+
+		message := []rune(turn.Message)
+		if len(message) > maxCondensedMessageLength {
+			message = message[:maxCondensedMessageLength]
+		}
+
+		prompt.WriteString(speaker + ": " + string(message) + "\n")
+	}
+
+	prompt.WriteString("\nFollow-up question: " + question + "\nStandalone question:")
+
+	answer, err := llms.GenerateFromSinglePrompt(ctx, llm, prompt.String(), llms.WithTemperature(0))
+	if err != nil {
+		return "", err
+	}
+
+	rewritten := strings.TrimSpace(answer)
+	rewritten = strings.TrimSpace(strings.TrimPrefix(rewritten, "Standalone question:"))
+	rewritten = strings.Trim(rewritten, "\"'`")
+
+	if rewritten == "" {
+		return "", errors.New("the model did not rewrite the question")
+	}
+
+	return rewritten, nil
+}
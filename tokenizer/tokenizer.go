@@ -0,0 +1,47 @@
+package tokenizer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Encoding used by the OpenAI chat and embedding models rag-chat talks to.
+const Encoding = "cl100k_base"
+
+var (
+	loadOnce sync.Once
+	encoder  *tiktoken.Tiktoken
+	loadErr  error
+)
+
+func init() {
+	// The BPE ranks are compiled in, so neither Count nor the token text
+	// splitter ever download them.
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// Load prepares the encoding. It only fails when the bundled ranks are
+// unusable; main calls it at startup so such a build refuses to run.
+func Load() error {
+	loadOnce.Do(func() {
+		encoder, loadErr = tiktoken.GetEncoding(Encoding)
+		if loadErr != nil {
+			loadErr = fmt.Errorf("loading encoding %s: %w", Encoding, loadErr)
+		}
+	})
+
+	return loadErr
+}
+
+// Count returns the number of tokens in text. It panics when the encoding
+// cannot be loaded, which Load reports at startup.
+func Count(text string) int {
+	if err := Load(); err != nil {
+		panic(err)
+	}
+
+	return len(encoder.Encode(text, nil, nil))
+}
@@ -0,0 +1,24 @@
+package tokenizer
+
+import "testing"
+
+func TestCount(t *testing.T) {
+	if err := Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text   string
+		tokens int
+	}{
+		{"", 0},
+		{"hello world", 2},
+		{"tiktoken is great!", 6},
+	}
+
+	for _, test := range tests {
+		if tokens := Count(test.text); tokens != test.tokens {
+			t.Errorf("Count(%q) = %d, want %d", test.text, tokens, test.tokens)
+		}
+	}
+}
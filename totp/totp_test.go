@@ -0,0 +1,114 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the test vectors in RFC 6238 appendix B.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// Appendix B lists 8 digit codes; 6 digit codes are their last 6 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", test.unix, err)
+		}
+
+		if code != test.code {
+			t.Errorf("Code at %d = %s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestCodeRejectsInvalidSecrets(t *testing.T) {
+	for _, secret := range []string{"", "not base32!"} {
+		if _, err := Code(secret, 1); err == nil {
+			t.Errorf("Code accepted the secret %q", secret)
+		}
+	}
+
+	lower, err := Code(strings.ToLower(rfcSecret), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upper, _ := Code(rfcSecret, 1); lower != upper {
+		t.Errorf("a lower case secret gave %s instead of %s", lower, upper)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	codeAt := func(step int64) string {
+		code, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name string
+		code string
+		step int64
+		ok   bool
+	}{
+		{"current", codeAt(current), current, true},
+		{"previous period", codeAt(current - 1), current - 1, true},
+		{"next period", codeAt(current + 1), current + 1, true},
+		{"with spaces", " " + codeAt(current)[:3] + " " + codeAt(current)[3:] + " ", current, true},
+		{"too old", codeAt(current - 2), 0, false},
+		{"too early", codeAt(current + 2), 0, false},
+		{"too short", codeAt(current)[:5], 0, false},
+		{"wrong", "000000", 0, false},
+	}
+
+	for _, test := range tests {
+		step, ok := Validate(rfcSecret, test.code, now)
+		if ok != test.ok || step != test.step {
+			t.Errorf("%s: Validate(%q) = %d, %v, want %d, %v", test.name, test.code, step, ok, test.step, test.ok)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) != secretLength {
+		t.Fatalf("GenerateSecret returned %q, %d bytes: %v", secret, len(key), err)
+	}
+
+	if other, _ := GenerateSecret(); other == secret {
+		t.Fatal("GenerateSecret returned the same secret twice")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Rag Chat", "ann@example.com", "JBSWY3DPEHPK3PXP")
+
+	want := "otpauth://totp/Rag%20Chat:ann@example.com?algorithm=SHA1&digits=6&issuer=Rag+Chat&period=30&secret=JBSWY3DPEHPK3PXP"
+	if uri != want {
+		t.Fatalf("URI = %s, want %s", uri, want)
+	}
+}
@@ -0,0 +1,239 @@
+package vectorstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/vectorstores/qdrant"
+	"github.com/twinj/uuid"
+)
+
+type QdrantStore struct {
+	baseURL url.URL
+	apiKey  string
+}
+
+func NewQdrantStore(qdrantURL string, apiKey string) (*QdrantStore, error) {
+	urlAPI, err := url.Parse(qdrantURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if urlAPI.Host == "" {
+		return nil, fmt.Errorf("invalid qdrant url %q", qdrantURL)
+	}
+
+	return &QdrantStore{
+		baseURL: *urlAPI,
+		apiKey:  apiKey,
+	}, nil
+}
+
+func (s *QdrantStore) CreateCollection(ctx context.Context, collection string, dimension int) error {
+	collectionConfig := map[string]interface{}{
+		"vectors": map[string]interface{}{
+			"size":     dimension,
+			"distance": "Cosine",
+		},
+	}
+
+	return s.do(ctx, "creating collection", http.MethodPut, collectionConfig, nil, "collections", collection)
+}
+
+func (s *QdrantStore) DeleteCollection(ctx context.Context, collection string) error {
+	return s.do(ctx, "deleting collection", http.MethodDelete, nil, nil, "collections", collection)
+}
+
+func (s *QdrantStore) AddDocuments(ctx context.Context, collection string, docs []schema.Document, vectors [][]float32) ([]string, error) {
+	if len(vectors) != len(docs) {
+		return nil, fmt.Errorf("number of vectors (%d) does not match number of documents (%d)", len(vectors), len(docs))
+	}
+
+	if len(docs) == 0 {
+		return []string{}, nil
+	}
+
+	ids := make([]string, len(docs))
+	payloads := make([]map[string]interface{}, len(docs))
+
+	for i, doc := range docs {
+		ids[i] = uuid.NewV4().String()
+
+		payload := make(map[string]interface{}, len(doc.Metadata)+1)
+		for key, value := range doc.Metadata {
+			payload[key] = value
+		}
+		payload[contentKey] = doc.PageContent
+
+		payloads[i] = payload
+	}
+
+	body := map[string]interface{}{
+		"batch": map[string]interface{}{
+			"ids":      ids,
+			"vectors":  vectors,
+			"payloads": payloads,
+		},
+	}
+
+	if err := s.do(ctx, "upserting vectors", http.MethodPut, body, nil, "collections", collection, "points"); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (s *QdrantStore) DeleteByDocument(ctx context.Context, collection string, documentID int64) error {
+	body := map[string]interface{}{
+		"filter": qdrantFilter(Filter{"document_id": documentID}),
+	}
+
+	return s.do(ctx, "deleting vectors", http.MethodPost, body, nil, "collections", collection, "points", "delete")
+}
+
+func (s *QdrantStore) SimilaritySearch(ctx context.Context, collection string, vector []float32, numDocuments int, options ...Option) ([]schema.Document, error) {
+	opts, err := getOptions(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]interface{}{
+		"vector":       vector,
+		"limit":        numDocuments,
+		"with_payload": true,
+		"with_vector":  false,
+	}
+
+	if opts.ScoreThreshold != 0 {
+		body["score_threshold"] = opts.ScoreThreshold
+	}
+
+	if len(opts.Filter) > 0 {
+		body["filter"] = qdrantFilter(opts.Filter)
+	}
+
+	var response struct {
+		Result []struct {
+			Score   float32                `json:"score"`
+			Payload map[string]interface{} `json:"payload"`
+		} `json:"result"`
+	}
+
+	if err := s.do(ctx, "querying collection", http.MethodPost, body, &response, "collections", collection, "points", "search"); err != nil {
+		return nil, err
+	}
+
+	docs := make([]schema.Document, 0, len(response.Result))
+	for _, match := range response.Result {
+		pageContent, ok := match.Payload[contentKey].(string)
+		if !ok {
+			return nil, fmt.Errorf("payload does not contain content key '%s'", contentKey)
+		}
+		delete(match.Payload, contentKey)
+
+		docs = append(docs, schema.Document{
+			PageContent: pageContent,
+			Metadata:    match.Payload,
+			Score:       match.Score,
+		})
+	}
+
+	return docs, nil
+}
+
+func (s *QdrantStore) Scroll(ctx context.Context, collection string, batchSize int, fn func(docs []schema.Document) error) error {
+	var offset interface{}
+
+	for {
+		body := map[string]interface{}{
+			"limit":        batchSize,
+			"with_payload": true,
+			"with_vector":  false,
+		}
+
+		if offset != nil {
+			body["offset"] = offset
+		}
+
+		var response struct {
+			Result struct {
+				Points []struct {
+					Payload map[string]interface{} `json:"payload"`
+				} `json:"points"`
+				NextPageOffset interface{} `json:"next_page_offset"`
+			} `json:"result"`
+		}
+
+		if err := s.do(ctx, "scrolling collection", http.MethodPost, body, &response, "collections", collection, "points", "scroll"); err != nil {
+			return err
+		}
+
+		docs := make([]schema.Document, 0, len(response.Result.Points))
+		for _, point := range response.Result.Points {
+			pageContent, _ := point.Payload[contentKey].(string)
+			delete(point.Payload, contentKey)
+
+			docs = append(docs, schema.Document{
+				PageContent: pageContent,
+				Metadata:    point.Payload,
+			})
+		}
+
+		if len(docs) > 0 {
+			if err := fn(docs); err != nil {
+				return err
+			}
+		}
+
+		if response.Result.NextPageOffset == nil {
+			return nil
+		}
+
+		offset = response.Result.NextPageOffset
+	}
+}
+
+func (s *QdrantStore) do(ctx context.Context, task string, method string, payload interface{}, response interface{}, path ...string) error {
+	urlRequest := s.baseURL.JoinPath(path...)
+
+	body, status, err := qdrant.DoRequest(ctx, *urlRequest, s.apiKey, method, payload)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if status == http.StatusNotFound {
+		return ErrCollectionNotFound
+	}
+
+	if status != http.StatusOK {
+		buf := new(bytes.Buffer)
+		_, _ = io.Copy(buf, body)
+
+		return fmt.Errorf("%s: %s", task, buf.String())
+	}
+
+	if response != nil {
+		return json.NewDecoder(body).Decode(response)
+	}
+
+	return nil
+}
+
+func qdrantFilter(filter Filter) map[string]interface{} {
+	conditions := make([]map[string]interface{}, 0, len(filter))
+	for key, value := range filter {
+		conditions = append(conditions, map[string]interface{}{
+			"key":   key,
+			"match": map[string]interface{}{"value": value},
+		})
+	}
+
+	return map[string]interface{}{"must": conditions}
+}
@@ -0,0 +1,305 @@
+package vectorstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/tmc/langchaingo/schema"
+	"github.com/twinj/uuid"
+
+	"github.com/zarkopopovski/rag-chat/db"
+)
+
+// SQLiteStore keeps vectors in the application database and searches them by
+// brute force cosine similarity, which is plenty for collections of a few
+// hundred thousand chunks and needs no external service.
+type SQLiteStore struct {
+	DBManager *db.DBManager
+}
+
+func NewSQLiteStore(dbManager *db.DBManager) *SQLiteStore {
+	return &SQLiteStore{
+		DBManager: dbManager,
+	}
+}
+
+func (s *SQLiteStore) CreateCollection(ctx context.Context, collection string, dimension int) error {
+	if dimension <= 0 {
+		return fmt.Errorf("invalid vector dimension %d", dimension)
+	}
+
+	queryStr := "INSERT INTO vector_store_collections(name, dimension, date_created) VALUES($1, $2, datetime('now'))"
+
+	_, err := s.DBManager.DB.ExecContext(ctx, queryStr, collection, dimension)
+
+	return err
+}
+
+func (s *SQLiteStore) DeleteCollection(ctx context.Context, collection string) error {
+	tx, err := s.DBManager.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM vector_points WHERE collection=$1", collection); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM vector_store_collections WHERE name=$1", collection)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrCollectionNotFound
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) AddDocuments(ctx context.Context, collection string, docs []schema.Document, vectors [][]float32) ([]string, error) {
+	if len(vectors) != len(docs) {
+		return nil, fmt.Errorf("number of vectors (%d) does not match number of documents (%d)", len(vectors), len(docs))
+	}
+
+	dimension, err := s.collectionDimension(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.DBManager.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	queryStr := "INSERT INTO vector_points(id, collection, document_id, content, metadata, vector, date_created) VALUES($1, $2, $3, $4, $5, $6, datetime('now'))"
+
+	ids := make([]string, len(docs))
+
+	for i, doc := range docs {
+		if len(vectors[i]) != dimension {
+			return nil, fmt.Errorf("vector dimension %d does not match collection dimension %d", len(vectors[i]), dimension)
+		}
+
+		metadata, err := json.Marshal(doc.Metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		var documentID sql.NullInt64
+		switch value := doc.Metadata["document_id"].(type) {
+		case int64:
+			documentID = sql.NullInt64{Int64: value, Valid: true}
+		case int:
+			documentID = sql.NullInt64{Int64: int64(value), Valid: true}
+		case float64:
+			documentID = sql.NullInt64{Int64: int64(value), Valid: true}
+		}
+
+		ids[i] = uuid.NewV4().String()
+
+		_, err = tx.ExecContext(ctx, queryStr, ids[i], collection, documentID, doc.PageContent, string(metadata), encodeVector(vectors[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (s *SQLiteStore) DeleteByDocument(ctx context.Context, collection string, documentID int64) error {
+	queryStr := "DELETE FROM vector_points WHERE collection=$1 AND document_id=$2"
+
+	_, err := s.DBManager.DB.ExecContext(ctx, queryStr, collection, documentID)
+
+	return err
+}
+
+func (s *SQLiteStore) SimilaritySearch(ctx context.Context, collection string, vector []float32, numDocuments int, options ...Option) ([]schema.Document, error) {
+	opts, err := getOptions(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	dimension, err := s.collectionDimension(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(vector) != dimension {
+		return nil, fmt.Errorf("query vector dimension %d does not match collection dimension %d", len(vector), dimension)
+	}
+
+	queryStr := "SELECT content, metadata, vector FROM vector_points WHERE collection=?"
+	args := []interface{}{collection}
+
+	keys := make([]string, 0, len(opts.Filter))
+	for key := range opts.Filter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		queryStr += " AND json_extract(metadata, '$." + key + "')=?"
+		args = append(args, opts.Filter[key])
+	}
+
+	rows, err := s.DBManager.DB.QueryxContext(ctx, queryStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := make([]schema.Document, 0)
+
+	for rows.Next() {
+		var content, metadata string
+		var blob []byte
+
+		if err := rows.Scan(&content, &metadata, &blob); err != nil {
+			return nil, err
+		}
+
+		score := cosineSimilarity(vector, decodeVector(blob))
+		if score < opts.ScoreThreshold {
+			continue
+		}
+
+		doc := schema.Document{
+			PageContent: content,
+			Score:       score,
+		}
+
+		if err := json.Unmarshal([]byte(metadata), &doc.Metadata); err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, doc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].Score > docs[j].Score
+	})
+
+	if numDocuments >= 0 && len(docs) > numDocuments {
+		docs = docs[:numDocuments]
+	}
+
+	return docs, nil
+}
+
+func (s *SQLiteStore) Scroll(ctx context.Context, collection string, batchSize int, fn func(docs []schema.Document) error) error {
+	if _, err := s.collectionDimension(ctx, collection); err != nil {
+		return err
+	}
+
+	queryStr := "SELECT rowid, content, metadata FROM vector_points WHERE collection=$1 AND rowid>$2 ORDER BY rowid LIMIT $3"
+
+	var lastRowID int64
+
+	for {
+		rows, err := s.DBManager.DB.QueryxContext(ctx, queryStr, collection, lastRowID, batchSize)
+		if err != nil {
+			return err
+		}
+
+		docs := make([]schema.Document, 0, batchSize)
+
+		for rows.Next() {
+			var content, metadata string
+
+			if err := rows.Scan(&lastRowID, &content, &metadata); err != nil {
+				rows.Close()
+				return err
+			}
+
+			doc := schema.Document{PageContent: content}
+			if err := json.Unmarshal([]byte(metadata), &doc.Metadata); err != nil {
+				rows.Close()
+				return err
+			}
+
+			docs = append(docs, doc)
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		if len(docs) == 0 {
+			return nil
+		}
+
+		if err := fn(docs); err != nil {
+			return err
+		}
+
+		if len(docs) < batchSize {
+			return nil
+		}
+	}
+}
+
+func (s *SQLiteStore) collectionDimension(ctx context.Context, collection string) (int, error) {
+	var dimension int
+
+	err := s.DBManager.DB.QueryRowxContext(ctx, "SELECT dimension FROM vector_store_collections WHERE name=$1", collection).Scan(&dimension)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrCollectionNotFound
+	}
+
+	return dimension, err
+}
+
+func encodeVector(vector []float32) []byte {
+	buf := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(value))
+	}
+	return buf
+}
+
+func decodeVector(buf []byte) []float32 {
+	vector := make([]float32, len(buf)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:]))
+	}
+	return vector
+}
+
+func cosineSimilarity(a []float32, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return float32(dot / (math.Sqrt(normA) * math.Sqrt(normB)))
+}
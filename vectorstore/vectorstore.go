@@ -0,0 +1,91 @@
+package vectorstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/tmc/langchaingo/schema"
+
+	"github.com/zarkopopovski/rag-chat/db"
+)
+
+const (
+	BackendQdrant = "qdrant"
+	BackendSQLite = "sqlite"
+)
+
+// contentKey is the payload key holding the chunk text, the same key
+// langchaingo's qdrant store uses so existing collections stay readable.
+const contentKey = "content"
+
+var ErrCollectionNotFound = errors.New("vector collection not found")
+
+var filterKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Filter matches points whose payload value under each key equals the given value.
+type Filter map[string]any
+
+// VectorStore keeps embedded chunks grouped in named collections. Vectors are
+// computed by the caller, so a store is independent of the embedding provider.
+type VectorStore interface {
+	CreateCollection(ctx context.Context, collection string, dimension int) error
+	DeleteCollection(ctx context.Context, collection string) error
+	AddDocuments(ctx context.Context, collection string, docs []schema.Document, vectors [][]float32) ([]string, error)
+	DeleteByDocument(ctx context.Context, collection string, documentID int64) error
+	SimilaritySearch(ctx context.Context, collection string, vector []float32, numDocuments int, options ...Option) ([]schema.Document, error)
+	// Scroll calls fn with every stored chunk, batchSize at a time.
+	Scroll(ctx context.Context, collection string, batchSize int, fn func(docs []schema.Document) error) error
+}
+
+type Options struct {
+	ScoreThreshold float32
+	Filter         Filter
+}
+
+type Option func(*Options)
+
+func WithScoreThreshold(scoreThreshold float32) Option {
+	return func(o *Options) {
+		o.ScoreThreshold = scoreThreshold
+	}
+}
+
+func WithFilter(filter Filter) Option {
+	return func(o *Options) {
+		o.Filter = filter
+	}
+}
+
+func getOptions(options ...Option) (Options, error) {
+	opts := Options{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	if opts.ScoreThreshold < 0 || opts.ScoreThreshold > 1 {
+		return opts, errors.New("score threshold must be between 0 and 1")
+	}
+
+	for key := range opts.Filter {
+		if !filterKeyPattern.MatchString(key) {
+			return opts, fmt.Errorf("invalid filter key %q", key)
+		}
+	}
+
+	return opts, nil
+}
+
+// New returns the store for the configured backend. An empty backend falls back
+// to Qdrant, which was the only option before the embedded store existed.
+func New(backend string, dbManager *db.DBManager, qdrantURL string, qdrantAPIKey string) (VectorStore, error) {
+	switch backend {
+	case "", BackendQdrant:
+		return NewQdrantStore(qdrantURL, qdrantAPIKey)
+	case BackendSQLite:
+		return NewSQLiteStore(dbManager), nil
+	default:
+		return nil, fmt.Errorf("unknown vector store backend %q", backend)
+	}
+}